@@ -0,0 +1,528 @@
+// Package client is a Go client for the ZapStore HTTP API. A Client is safe for
+// concurrent use and keeps a pool of connections to the server, so create one per
+// server and share it.
+//
+//	c, err := client.New("http://localhost:8080", client.WithToken(os.Getenv("ZAPSTORE_TOKEN")))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	if err := c.Set(ctx, "app/greeting", "hello"); err != nil {
+//		return err
+//	}
+//	value, err := c.Get(ctx, "app/greeting")
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"zap-store/internal/bulk"
+)
+
+const (
+	DefaultTimeout      = 10 * time.Second
+	DefaultRetries      = 3
+	DefaultMinBackoff   = 50 * time.Millisecond
+	DefaultMaxBackoff   = 2 * time.Second
+	DefaultMaxIdleConns = 64 // Idle connections kept open to the server
+)
+
+// maxBatchKeys is the most keys the server takes in one /mget or /mset request.
+const maxBatchKeys = 1000
+
+// Client talks to one ZapStore server, or to a zapstore-router in front of several.
+type Client struct {
+	baseURL      string
+	http         *http.Client
+	ownTransport bool // http was built by New, so Close may close its connections
+	token        string
+	tlsConfig    *tls.Config
+	maxIdleConns int
+	timeout      time.Duration
+	retries      int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken sends token as a bearer token with every request.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTLSConfig sets the TLS configuration used for https:// servers, for instance to
+// trust a private CA or present a client certificate.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) { c.tlsConfig = cfg }
+}
+
+// WithMaxIdleConns sets how many idle connections to the server are kept for reuse.
+// Set it to about the number of goroutines using the client at once.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) { c.maxIdleConns = n }
+}
+
+// WithHTTPClient sends requests through hc instead of a client built by New. The TLS
+// and connection pool options are then ignored.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithTimeout bounds every attempt of a request, DefaultTimeout by default. Zero
+// leaves attempts bounded by their context only. Watches wait for changes on top of it.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries sets how many times a request failing in a way that may be transient is
+// retried, DefaultRetries by default. Zero disables retries.
+func WithRetries(n int) Option {
+	return func(c *Client) { c.retries = n }
+}
+
+// WithBackoff sets the delay before the first retry, doubled for every further one
+// up to max. Delays are jittered so that clients do not retry in lockstep.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// New creates a client for the server at addr, "http://host:port", "https://host:port"
+// or "host:port". Without a scheme, https is used if a TLS configuration is given.
+func New(addr string, opts ...Option) (*Client, error) {
+	c := &Client{
+		maxIdleConns: DefaultMaxIdleConns,
+		timeout:      DefaultTimeout,
+		retries:      DefaultRetries,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if !strings.Contains(addr, "://") {
+		scheme := "http://"
+		if c.tlsConfig != nil {
+			scheme = "https://"
+		}
+		addr = scheme + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server address %q: want http://host:port or https://host:port", addr)
+	}
+	c.baseURL = strings.TrimSuffix(u.String(), "/")
+
+	if c.retries < 0 {
+		c.retries = 0
+	}
+	if c.minBackoff <= 0 {
+		c.minBackoff = DefaultMinBackoff
+	}
+	c.maxBackoff = max(c.maxBackoff, c.minBackoff)
+
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = c.maxIdleConns
+		transport.MaxIdleConnsPerHost = c.maxIdleConns
+		if c.tlsConfig != nil {
+			transport.TLSClientConfig = c.tlsConfig
+		}
+		c.http = &http.Client{Transport: transport}
+		c.ownTransport = true
+	}
+	return c, nil
+}
+
+// Close closes the idle connections of the client. Requests made afterwards open new ones.
+func (c *Client) Close() {
+	if c.ownTransport {
+		c.http.CloseIdleConnections()
+	}
+}
+
+// KeyValue is a key and its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Result is the outcome of reading one key of a batch.
+type Result struct {
+	Key   string
+	Value string
+	Found bool
+}
+
+// Get returns the value of key, or an error matching ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := c.GetVersioned(ctx, key)
+	return value, err
+}
+
+// GetVersioned returns the value of key and its version, which changes with every
+// write and can be passed to SetIf and DeleteIf.
+func (c *Client) GetVersioned(ctx context.Context, key string) (string, uint64, error) {
+	path, err := keyPath(key)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := c.do(ctx, request{op: "get", method: http.MethodGet, path: path, idempotent: true})
+	if err != nil {
+		return "", 0, err
+	}
+	version, err := parseETag(resp.header.Get("ETag"))
+	if err != nil {
+		return "", 0, err
+	}
+	return string(resp.body), version, nil
+}
+
+// Set stores value under key.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{op: "set", method: http.MethodPut, path: path, body: []byte(value), idempotent: true})
+	return err
+}
+
+// SetIf stores value under key only if the key is still at version, or does not
+// exist when version is 0, and returns the new version. Otherwise it fails with an
+// error matching ErrPreconditionFailed. It is not retried after errors that leave it
+// unknown whether the write happened.
+func (c *Client) SetIf(ctx context.Context, key, value string, version uint64) (uint64, error) {
+	path, err := keyPath(key)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(ctx, request{op: "set", method: http.MethodPut, path: path, header: versionHeader(version), body: []byte(value)})
+	if err != nil {
+		return 0, err
+	}
+	return parseETag(resp.header.Get("ETag"))
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{op: "delete", method: http.MethodDelete, path: path, idempotent: true})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeleteIf removes key only if it is still at version, failing with an error matching
+// ErrPreconditionFailed otherwise, or ErrNotFound if the key is missing.
+func (c *Client) DeleteIf(ctx context.Context, key string, version uint64) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{op: "delete", method: http.MethodDelete, path: path, header: versionHeader(version)})
+	return err
+}
+
+// MGet reads many keys at once and returns their results in the order of keys.
+// Large batches are split into several requests.
+func (c *Client) MGet(ctx context.Context, keys []string) ([]Result, error) {
+	results := make([]Result, 0, len(keys))
+	for start := 0; start < len(keys); start += maxBatchKeys {
+		body, err := json.Marshal(keys[start:min(start+maxBatchKeys, len(keys))])
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(ctx, request{op: "mget", method: http.MethodPost, path: "/mget", body: body, json: true, idempotent: true})
+		if err != nil {
+			return nil, err
+		}
+		var batch []struct {
+			Key   string  `json:"key"`
+			Value *string `json:"value"`
+			Found bool    `json:"found"`
+		}
+		if err := json.Unmarshal(resp.body, &batch); err != nil {
+			return nil, fmt.Errorf("invalid mget response: %w", err)
+		}
+		for _, r := range batch {
+			result := Result{Key: r.Key, Found: r.Found}
+			if r.Value != nil {
+				result.Value = *r.Value
+			}
+			results = append(results, result)
+		}
+	}
+	if len(results) != len(keys) {
+		return nil, fmt.Errorf("invalid mget response: %d results for %d keys", len(results), len(keys))
+	}
+	return results, nil
+}
+
+// MSet stores all pairs, 1000 per request, which the server writes under one lock if
+// its engine supports batches. Larger batches are split into several requests and are
+// not atomic: if one fails, the pairs of the requests before it stay stored.
+func (c *Client) MSet(ctx context.Context, pairs []KeyValue) error {
+	for start := 0; start < len(pairs); start += maxBatchKeys {
+		body, err := json.Marshal(pairs[start:min(start+maxBatchKeys, len(pairs))])
+		if err != nil {
+			return err
+		}
+		if _, err := c.do(ctx, request{op: "mset", method: http.MethodPost, path: "/mset", body: body, json: true, idempotent: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan calls fn with every key starting with prefix and its value, in key order,
+// stopping at the first error fn returns. The pairs are streamed, so the timeout only
+// bounds the wait for the server to start answering, and a failure part way is not
+// retried since fn has seen some of the pairs.
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	path := "/v1/keys"
+	if prefix != "" {
+		path += "?" + url.Values{"prefix": {prefix}}.Encode()
+	}
+	resp, err := c.open(ctx, request{op: "scan", method: http.MethodGet, path: path, idempotent: true})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reader := bulk.NewReader(resp.Body, bulk.NDJSON)
+	for {
+		pair, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("scan of prefix '%s' failed: %w", prefix, err)
+		}
+		if err := fn(pair.Key, pair.Value); err != nil {
+			return err
+		}
+	}
+}
+
+// request is one API call, rebuilt for every attempt.
+type request struct {
+	op      string // Operation name used in errors
+	method  string
+	path    string // Escaped path, with the query
+	header  http.Header
+	body    []byte
+	json    bool // The body is JSON rather than a raw value
+	timeout time.Duration
+
+	// idempotent requests have the same effect however many times they are applied,
+	// so they are retried even when an attempt may have reached the server.
+	idempotent bool
+}
+
+// response is a successful answer, read in full.
+type response struct {
+	header http.Header
+	body   []byte
+}
+
+// do sends req, retrying failures that may be transient, and reads the answer. Answers
+// with a status of 400 and above are returned as an *Error.
+func (c *Client) do(ctx context.Context, req request) (*response, error) {
+	var resp *response
+	err := c.retry(ctx, req.idempotent, func() error {
+		ctx := ctx
+		if timeout := c.attemptTimeout(req); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		httpResp, err := c.roundTrip(ctx, req)
+		if err != nil {
+			return err
+		}
+		defer httpResp.Body.Close()
+		body, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return fmt.Errorf("%s: failed to read the response: %w", req.op, err)
+		}
+		if httpResp.StatusCode >= 400 {
+			return newError(req.op, httpResp.StatusCode, body)
+		}
+		resp = &response{header: httpResp.Header, body: body}
+		return nil
+	})
+	return resp, err
+}
+
+// open is do for streamed answers: it returns once the server starts answering, and
+// the timeout only applies until then. The caller closes the body.
+func (c *Client) open(ctx context.Context, req request) (*http.Response, error) {
+	var resp *http.Response
+	err := c.retry(ctx, req.idempotent, func() error {
+		ctx, cancel := context.WithCancel(ctx)
+		var timer *time.Timer
+		if timeout := c.attemptTimeout(req); timeout > 0 {
+			timer = time.AfterFunc(timeout, cancel)
+		}
+		httpResp, err := c.roundTrip(ctx, req)
+		if timer != nil && !timer.Stop() && err == nil {
+			httpResp.Body.Close()
+			err = fmt.Errorf("%s: %w", req.op, context.DeadlineExceeded)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		if httpResp.StatusCode >= 400 {
+			body, _ := io.ReadAll(httpResp.Body)
+			httpResp.Body.Close()
+			cancel()
+			return newError(req.op, httpResp.StatusCode, body)
+		}
+		httpResp.Body = &cancelBody{ReadCloser: httpResp.Body, cancel: cancel}
+		resp = httpResp
+		return nil
+	})
+	return resp, err
+}
+
+// cancelBody releases the context of a streamed answer when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (c *Client) attemptTimeout(req request) time.Duration {
+	if c.timeout <= 0 {
+		return 0
+	}
+	return c.timeout + req.timeout
+}
+
+// roundTrip sends one attempt of req.
+func (c *Client) roundTrip(ctx context.Context, req request) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, bytes.NewReader(req.body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if req.body != nil {
+		contentType := "application/octet-stream"
+		if req.json {
+			contentType = "application/json"
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", req.op, err)
+	}
+	return resp, nil
+}
+
+// retry calls attempt until it succeeds, fails in a way that retrying cannot fix, or
+// the retries run out, sleeping with exponential backoff in between.
+func (c *Client) retry(ctx context.Context, idempotent bool, attempt func() error) error {
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= c.retries || ctx.Err() != nil || !retryable(err, idempotent) {
+			return err
+		}
+		timer := time.NewTimer(c.backoff(i))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed attempt may succeed if repeated. Requests that
+// are not idempotent are only retried when the server said it did not apply them.
+func retryable(err error, idempotent bool) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return idempotent // The server may or may not have received the request
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// backoff returns the delay before retry i, between half and all of the doubled delay.
+func (c *Client) backoff(i int) time.Duration {
+	delay := c.maxBackoff
+	if i < 30 {
+		delay = min(c.minBackoff<<i, c.maxBackoff)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// keyPath returns the escaped resource path of key.
+func keyPath(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("key cannot be empty")
+	}
+	return "/v1/keys/" + url.PathEscape(key), nil
+}
+
+// versionHeader is the precondition of a conditional write on version, 0 meaning that
+// the key must not exist.
+func versionHeader(version uint64) http.Header {
+	if version == 0 {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {`"` + strconv.FormatUint(version, 16) + `"`}}
+}
+
+// parseETag reads the version out of the entity tag the server sends with keys.
+func parseETag(etag string) (uint64, error) {
+	if etag == "" {
+		return 0, nil // Engines without versions send none
+	}
+	version, err := strconv.ParseUint(strings.Trim(etag, `"`), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ETag %q", etag)
+	}
+	return version, nil
+}
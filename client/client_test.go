@@ -0,0 +1,316 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zap-store/internal/server"
+	"zap-store/internal/storage/inmem"
+	"zap-store/internal/zapstore"
+)
+
+// newTestClient starts an in-memory server and returns a client for it.
+func newTestClient(t *testing.T, opts ...Option) (*Client, *zapstore.ZapStore) {
+	t.Helper()
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	ts := httptest.NewServer(server.New(kv, server.WithLogger(slog.New(slog.DiscardHandler))))
+	t.Cleanup(ts.Close)
+	c, err := New(ts.URL, opts...)
+	if err != nil {
+		t.Fatalf("New(%q) error = %v", ts.URL, err)
+	}
+	t.Cleanup(c.Close)
+	return c, kv
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "localhost:8080", want: "http://localhost:8080"},
+		{addr: "http://localhost:8080/", want: "http://localhost:8080"},
+		{addr: "https://db.example.com", want: "https://db.example.com"},
+		{addr: "http://proxy/zapstore", want: "http://proxy/zapstore"},
+		{addr: "ftp://localhost", wantErr: true},
+		{addr: "http://", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := New(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.baseURL != tt.want {
+			t.Errorf("New(%q) base URL = %q, want %q", tt.addr, c.baseURL, tt.want)
+		}
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	c, kv := newTestClient(t)
+	ctx := context.Background()
+
+	// Keys are escaped, whatever they contain
+	keys := []string{"plain", "app/nested/key", "a//b", "../up", "with space", "100%", "q?x=1&y", "#frag", "ünï", "trailing/"}
+	for _, key := range keys {
+		if err := c.Set(ctx, key, "value of "+key); err != nil {
+			t.Fatalf("Set(%q) error = %v", key, err)
+		}
+		if got, err := kv.Get(key); err != nil || got != "value of "+key {
+			t.Errorf("server holds %q, %v under %q, want %q", got, err, key, "value of "+key)
+		}
+		if got, err := c.Get(ctx, key); err != nil || got != "value of "+key {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, "value of "+key)
+		}
+	}
+
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := c.Set(ctx, "", "x"); err == nil {
+		t.Errorf("Set() of an empty key error = nil, want an error")
+	}
+	if err := c.Delete(ctx, "plain"); err != nil {
+		t.Errorf("Delete(plain) error = %v", err)
+	}
+	if err := c.Delete(ctx, "plain"); err != nil {
+		t.Errorf("Delete() of a missing key error = %v, want nil", err)
+	}
+
+	// Conditional writes
+	version, err := c.SetIf(ctx, "cas", "1", 0)
+	if err != nil {
+		t.Fatalf("SetIf() creating a key error = %v", err)
+	}
+	if _, err := c.SetIf(ctx, "cas", "x", 0); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("SetIf() creating an existing key error = %v, want ErrPreconditionFailed", err)
+	}
+	next, err := c.SetIf(ctx, "cas", "2", version)
+	if err != nil || next == version {
+		t.Fatalf("SetIf() at the current version = %d, %v, want a new version", next, err)
+	}
+	if value, got, err := c.GetVersioned(ctx, "cas"); err != nil || value != "2" || got != next {
+		t.Errorf("GetVersioned(cas) = %q, %d, %v, want %q, %d", value, got, err, "2", next)
+	}
+	if err := c.DeleteIf(ctx, "cas", version); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("DeleteIf() at an old version error = %v, want ErrPreconditionFailed", err)
+	}
+	if err := c.DeleteIf(ctx, "cas", next); err != nil {
+		t.Errorf("DeleteIf() at the current version error = %v", err)
+	}
+}
+
+func TestClientBatches(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	pairs := []KeyValue{{Key: "b", Value: "2"}, {Key: "a", Value: "1"}, {Key: "b/c", Value: ""}}
+	if err := c.MSet(ctx, pairs); err != nil {
+		t.Fatalf("MSet() error = %v", err)
+	}
+	results, err := c.MGet(ctx, []string{"a", "missing", "b/c", "a"})
+	want := []Result{{Key: "a", Value: "1", Found: true}, {Key: "missing"}, {Key: "b/c", Found: true}, {Key: "a", Value: "1", Found: true}}
+	if err != nil || fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Errorf("MGet() = %v, %v, want %v", results, err, want)
+	}
+
+	// Batches larger than the server takes at once are split
+	keys := make([]string, 2500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	keys[2400] = "a"
+	results, err = c.MGet(ctx, keys)
+	if err != nil || len(results) != len(keys) || !results[2400].Found || results[2399].Found {
+		t.Errorf("MGet() of %d keys = %d results, %v, want them all with only \"a\" found", len(keys), len(results), err)
+	}
+	many := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		many[i] = KeyValue{Key: key, Value: fmt.Sprint(i)}
+	}
+	if err := c.MSet(ctx, many); err != nil {
+		t.Fatalf("MSet() of %d pairs error = %v", len(many), err)
+	}
+	results, err = c.MGet(ctx, keys)
+	if err != nil || len(results) != len(keys) || results[0].Value != "0" || results[2499].Value != "2499" {
+		t.Errorf("MGet() after MSet() of %d pairs = %d results, %v, want them all stored", len(many), len(results), err)
+	}
+
+	var scanned []string
+	err = c.Scan(ctx, "b", func(key, value string) error {
+		scanned = append(scanned, key+"="+value)
+		return nil
+	})
+	if want := "b=2,b/c="; err != nil || strings.Join(scanned, ",") != want {
+		t.Errorf("Scan(b) = %v, %v, want %s", scanned, err, want)
+	}
+	stop := errors.New("stop")
+	if err := c.Scan(ctx, "", func(key, value string) error { return stop }); err != stop {
+		t.Errorf("Scan() error = %v, want the error of fn", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	c, kv := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kv.Set("app/before", "ignored")
+	w, err := c.Watch(ctx, "app/")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	kv.Set("other", "ignored")
+	kv.Set("app/x", "1")
+	kv.Delete("app/x")
+
+	var events []Event
+	for len(events) < 2 {
+		batch, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		events = append(events, batch...)
+	}
+	if len(events) != 2 || events[0].Type != EventSet || events[0].Key != "app/x" || events[0].Value != "1" || events[1].Type != EventDelete {
+		t.Errorf("Next() = %+v, want a set then a delete of app/x", events)
+	}
+
+	// A watcher resumed from a sequence sees what it missed
+	resumed := c.WatchFrom("app/", events[0].Seq)
+	if got, err := resumed.Next(ctx); err != nil || len(got) != 1 || got[0] != events[1] {
+		t.Errorf("Next() after WatchFrom(%d) = %+v, %v, want %+v", events[0].Seq, got, err, events[1:])
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{status: http.StatusNotFound, want: ErrNotFound},
+		{status: http.StatusPreconditionFailed, want: ErrPreconditionFailed},
+		{status: http.StatusBadRequest, want: ErrBadRequest},
+		{status: http.StatusUnauthorized, want: ErrUnauthorized},
+		{status: http.StatusForbidden, want: ErrForbidden},
+		{status: http.StatusRequestEntityTooLarge, want: ErrTooLarge},
+		{status: http.StatusServiceUnavailable, body: "storage is read-only", want: ErrUnavailable},
+		{status: http.StatusNotImplemented, want: ErrUnsupported},
+		{status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, tt.body, tt.status)
+		}))
+		c, _ := New(ts.URL, WithRetries(0))
+		err := c.Set(context.Background(), "key", "value")
+		ts.Close()
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Message != tt.body || apiErr.Op != "set" {
+			t.Errorf("Set() answered %d error = %#v, want an *Error with the status and body", tt.status, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("Set() answered %d error = %v, want %v", tt.status, err, tt.want)
+		}
+	}
+
+	// A watcher that fell behind moves to the latest change
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+		io.WriteString(w, `{"error":"sequence unavailable","seq":42}`)
+	}))
+	defer ts.Close()
+	c, _ := New(ts.URL)
+	w := c.WatchFrom("", 1)
+	if _, err := w.Next(context.Background()); !errors.Is(err, ErrEventsLost) || w.Seq() != 42 {
+		t.Errorf("Next() on 410 = %v with Seq() %d, want ErrEventsLost and 42", err, w.Seq())
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int // Attempts answered with status before the server recovers
+		status       int
+		conditional  bool
+		wantAttempts int32
+		wantErr      error
+	}{
+		{name: "recovers", failures: 2, status: http.StatusServiceUnavailable, wantAttempts: 3},
+		{name: "gives_up", failures: 10, status: http.StatusServiceUnavailable, wantAttempts: 4, wantErr: ErrUnavailable},
+		{name: "bad_gateway", failures: 1, status: http.StatusBadGateway, wantAttempts: 2},
+		{name: "not_transient", failures: 1, status: http.StatusForbidden, wantAttempts: 1, wantErr: ErrForbidden},
+		{name: "conditional_unavailable", failures: 1, status: http.StatusServiceUnavailable, conditional: true, wantAttempts: 2},
+		{name: "conditional_bad_gateway", failures: 1, status: http.StatusBadGateway, conditional: true, wantAttempts: 1},
+		{name: "timeout", failures: 1, status: 0, wantAttempts: 2},
+		{name: "conditional_timeout", failures: 1, status: 0, conditional: true, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) <= int32(tt.failures) {
+					if tt.status == 0 {
+						io.Copy(io.Discard, r.Body) // Lets the server notice the client going away
+						<-r.Context().Done()        // Hang until the client gives up
+						return
+					}
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Header().Set("ETag", `"a"`)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer ts.Close()
+			c, _ := New(ts.URL, WithBackoff(time.Millisecond, 5*time.Millisecond), WithTimeout(100*time.Millisecond))
+
+			var err error
+			if tt.conditional {
+				_, err = c.SetIf(context.Background(), "key", "value", 1)
+			} else {
+				err = c.Set(context.Background(), "key", "value")
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && tt.wantAttempts > int32(tt.failures) && err != nil {
+				t.Errorf("error = %v, want nil", err)
+			}
+		})
+	}
+
+	// Cancelling the context stops the retries. The server cancels it during the third
+	// attempt, so the error is either that attempt's or the cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 3 {
+			cancel()
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c, _ := New(ts.URL, WithRetries(1000), WithBackoff(time.Millisecond, time.Millisecond))
+	if err := c.Set(ctx, "key", "value"); !errors.Is(err, ErrUnavailable) && !errors.Is(err, context.Canceled) {
+		t.Errorf("Set() with a cancelled context error = %v, want ErrUnavailable or context.Canceled", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("%d attempts, want 3, the last one during which the context was cancelled", got)
+	}
+}
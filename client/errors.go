@@ -0,0 +1,64 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors matched, with errors.Is, by the *Error of a failed request.
+var (
+	ErrNotFound           = errors.New("key not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrBadRequest         = errors.New("bad request")
+	ErrUnauthorized       = errors.New("missing or invalid token")
+	ErrForbidden          = errors.New("token not allowed")
+	ErrTooLarge           = errors.New("request too large")
+	ErrEventsLost         = errors.New("watched events no longer available")
+	ErrUnavailable        = errors.New("server unavailable") // Read-only, not ready or overloaded
+	ErrUnsupported        = errors.New("not supported by the server's storage engine")
+)
+
+// Error is an error answer of the server.
+type Error struct {
+	Op         string // The client method, such as "get" or "mset"
+	StatusCode int
+	Message    string // The body of the answer
+}
+
+func newError(op string, status int, body []byte) *Error {
+	return &Error{Op: op, StatusCode: status, Message: strings.TrimSpace(string(body))}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: server answered %d %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s: server answered %d: %s", e.Op, e.StatusCode, e.Message)
+}
+
+// Unwrap returns the error matching the status of the answer, if there is one.
+func (e *Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case http.StatusBadRequest:
+		return ErrBadRequest
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case http.StatusGone:
+		return ErrEventsLost
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return ErrUnavailable
+	case http.StatusNotImplemented:
+		return ErrUnsupported
+	}
+	return nil
+}
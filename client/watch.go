@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// watchPollTimeout is how long one long-poll waits for changes.
+const watchPollTimeout = 30 * time.Second
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventSet    EventType = "set"
+	EventDelete EventType = "delete"
+)
+
+// Event is one change to a watched key. Seq increases with every change on the server.
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Type    EventType `json:"type"`
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"`   // The new value of set events
+	Version uint64    `json:"version,omitempty"` // The record version, if the engine tracks them
+}
+
+// Watcher reports the changes to the keys under a prefix, in order, by long-polling
+// /v1/watch. It is not safe for concurrent use.
+type Watcher struct {
+	c      *Client
+	prefix string
+	seq    uint64
+}
+
+// Watch starts watching the keys under prefix: Next reports the changes made after
+// Watch returns.
+func (c *Client) Watch(ctx context.Context, prefix string) (*Watcher, error) {
+	w := &Watcher{c: c, prefix: prefix}
+	query := url.Values{"prefix": {prefix}, "timeout": {"0s"}}
+	resp, err := w.poll(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	w.seq = resp.Seq
+	return w, nil
+}
+
+// WatchFrom resumes watching the keys under prefix after the change numbered seq,
+// such as the Seq of a Watcher that stopped.
+func (c *Client) WatchFrom(prefix string, seq uint64) *Watcher {
+	return &Watcher{c: c, prefix: prefix, seq: seq}
+}
+
+// Seq returns the sequence of the last change the watcher went past, to resume from
+// with WatchFrom.
+func (w *Watcher) Seq() uint64 {
+	return w.seq
+}
+
+// Next waits for the next changes and returns them. If the server no longer has the
+// changes after Seq, because the watcher fell too far behind or the server restarted,
+// it fails with an error matching ErrEventsLost and moves Seq to the server's latest
+// change: re-read the keys under the prefix, then call Next again to go on from there.
+func (w *Watcher) Next(ctx context.Context) ([]Event, error) {
+	for {
+		query := url.Values{
+			"prefix":  {w.prefix},
+			"after":   {strconv.FormatUint(w.seq, 10)},
+			"timeout": {watchPollTimeout.String()},
+		}
+		resp, err := w.poll(ctx, query)
+		if err != nil {
+			var apiErr *Error
+			if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusGone {
+				var gone struct {
+					Seq uint64 `json:"seq"`
+				}
+				if json.Unmarshal([]byte(apiErr.Message), &gone) == nil {
+					w.seq = gone.Seq
+				}
+			}
+			return nil, err
+		}
+		w.seq = resp.Seq
+		if len(resp.Events) > 0 {
+			return resp.Events, nil
+		}
+	}
+}
+
+type watchResponse struct {
+	Events []Event `json:"events"`
+	Seq    uint64  `json:"seq"`
+}
+
+func (w *Watcher) poll(ctx context.Context, query url.Values) (*watchResponse, error) {
+	resp, err := w.c.do(ctx, request{
+		op:         "watch",
+		method:     http.MethodGet,
+		path:       "/v1/watch?" + query.Encode(),
+		timeout:    watchPollTimeout,
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var watched watchResponse
+	if err := json.Unmarshal(resp.body, &watched); err != nil {
+		return nil, fmt.Errorf("invalid watch response: %w", err)
+	}
+	return &watched, nil
+}
@@ -0,0 +1,299 @@
+// Command zapstore-admin inspects and fixes a bitcask data directory that no server
+// has open: it dumps the records of the log files, verifies their CRCs, reports live
+// and dead bytes, merges the files and truncates corrupted tails.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"zap-store/internal/storage/bitcask"
+)
+
+var dataDirFlag = flag.String("dataDir", "data", "Bitcask data directory to work on")
+
+// errFound marks a command that ran but found corrupt log files.
+var errFound = errors.New("corrupt log files found")
+
+// command is a subcommand, run as "zapstore-admin [flags] <name> [flags]".
+type command struct {
+	usage string
+	run   func(dataDir string, args []string) error
+}
+
+var commands = map[string]command{
+	"dump":   {usage: "dump [-file id] [-values]   print every record with its offset", run: runDump},
+	"verify": {usage: "verify                       check every record and its CRC", run: runVerify},
+	"stats":  {usage: "stats [-json]                keys and live and dead bytes per file", run: runStats},
+	"merge":  {usage: "merge                        rewrite the live records into fresh files", run: runMerge},
+	"repair": {usage: "repair [-dry-run]            truncate log files at their first corrupt record", run: runRepair},
+}
+
+// locked runs fn holding the lock of dataDir, so that no server opens it meanwhile.
+func locked(dataDir string, fn func() error) error {
+	if _, err := os.Stat(dataDir); err != nil {
+		return err
+	}
+	unlock, err := bitcask.LockDir(dataDir)
+	if errors.Is(err, bitcask.ErrLocked) {
+		return fmt.Errorf("%w; stop the server first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// runDump prints the records of every log file, or of one, in order.
+func runDump(dataDir string, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	fileFlag := fs.Int64("file", 0, "Only dump this log file id")
+	valuesFlag := fs.Bool("values", false, "Print the values too")
+	fs.Parse(args)
+
+	return locked(dataDir, func() error {
+		ids, err := bitcask.LogFileIDs(dataDir)
+		if err != nil {
+			return err
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "FILE\tOFFSET\tSIZE\tTIMESTAMP\tOP\tKEY\tVALUE")
+		var corrupt bool
+		for _, id := range ids {
+			if *fileFlag != 0 && id != *fileFlag {
+				continue
+			}
+			_, err := bitcask.ReadLog(dataDir, id, func(r bitcask.Record) error {
+				op, value := "set", fmt.Sprintf("(%d bytes)", len(r.Value))
+				if r.Deleted {
+					op, value = "del", ""
+				} else if *valuesFlag {
+					value = strconv.Quote(r.Value)
+				}
+				timestamp := time.Unix(0, r.Timestamp).UTC().Format(time.RFC3339Nano)
+				fmt.Fprintf(out, "%d\t%d\t%d\t%s\t%s\t%s\t%s\n", id, r.Offset, r.Size, timestamp, op, strconv.Quote(r.Key), value)
+				return nil
+			})
+			if errors.Is(err, bitcask.ErrCorrupt) {
+				out.Flush()
+				fmt.Fprintln(os.Stderr, err)
+				corrupt = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if corrupt {
+			return errFound
+		}
+		return nil
+	})
+}
+
+// runVerify reads every record of every log file and reports the files that do not
+// read to their end.
+func runVerify(dataDir string, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+
+	return locked(dataDir, func() error {
+		ids, err := bitcask.LogFileIDs(dataDir)
+		if err != nil {
+			return err
+		}
+		var corrupt int
+		for _, id := range ids {
+			records := 0
+			end, err := bitcask.ReadLog(dataDir, id, func(bitcask.Record) error {
+				records++
+				return nil
+			})
+			switch {
+			case errors.Is(err, bitcask.ErrCorrupt):
+				corrupt++
+				fmt.Printf("%d: CORRUPT after %d records (%d bytes): %v\n", id, records, end, err)
+			case err != nil:
+				return err
+			default:
+				fmt.Printf("%d: ok, %d records, %d bytes\n", id, records, end)
+			}
+		}
+		fmt.Printf("%d log files, %d corrupt\n", len(ids), corrupt)
+		if corrupt > 0 {
+			return errFound
+		}
+		return nil
+	})
+}
+
+// runStats prints the keys of the directory and the live and dead bytes of its files.
+func runStats(dataDir string, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	jsonFlag := fs.Bool("json", false, "Print the statistics as JSON")
+	fs.Parse(args)
+
+	return locked(dataDir, func() error {
+		stats, err := bitcask.ReadStats(dataDir, slog.Default())
+		if err != nil {
+			return err
+		}
+		if *jsonFlag {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(stats)
+		}
+
+		fmt.Printf("keys: %d\nkeyDir bytes: %d (approximate memory of a server opening it)\n\n", stats.Keys, stats.KeyDirBytes)
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(out, "FILE\tBYTES\tLIVE\tDEAD\tDEAD %\t")
+		for _, seg := range stats.Segments {
+			fmt.Fprintf(out, "%d\t%d\t%d\t%d\t%s\t\n", seg.FileID, seg.Bytes, seg.Bytes-seg.DeadBytes, seg.DeadBytes, percent(seg.DeadBytes, seg.Bytes))
+		}
+		data, dead := stats.DataBytes(), stats.DeadBytes()
+		fmt.Fprintf(out, "total\t%d\t%d\t%d\t%s\t\n", data, data-dead, dead, percent(dead, data))
+		return out.Flush()
+	})
+}
+
+func percent(part, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", float64(part)*100/float64(total))
+}
+
+// runMerge opens the directory as the server would and merges it.
+func runMerge(dataDir string, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Parse(args)
+
+	if _, err := os.Stat(dataDir); err != nil {
+		return err
+	}
+	engine, err := bitcask.NewBitCaskStorageEngine(dataDir)
+	if errors.Is(err, bitcask.ErrLocked) {
+		return fmt.Errorf("%w; stop the server first", err)
+	}
+	if err != nil {
+		return err
+	}
+	before := engine.Stats()
+	if err := engine.Merge(); err != nil {
+		engine.Close()
+		return err
+	}
+	after := engine.Stats()
+	if err := engine.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("merged %d keys: %d files, %d bytes -> %d files, %d bytes\n",
+		after.Keys, len(before.Segments), before.DataBytes(), len(after.Segments), after.DataBytes())
+	return nil
+}
+
+// runRepair truncates every log file at its first corrupt record, so that the rest of
+// the directory opens cleanly. Whatever follows that record is lost.
+func runRepair(dataDir string, args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be truncated")
+	fs.Parse(args)
+
+	return locked(dataDir, func() error {
+		ids, err := bitcask.LogFileIDs(dataDir)
+		if err != nil {
+			return err
+		}
+		repaired := 0
+		for _, id := range ids {
+			end, corruption := bitcask.ReadLog(dataDir, id, func(bitcask.Record) error { return nil })
+			if !errors.Is(corruption, bitcask.ErrCorrupt) {
+				if corruption != nil {
+					return corruption
+				}
+				continue
+			}
+
+			path := bitcask.LogFilePath(dataDir, id)
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			verb := "truncating"
+			if *dryRun {
+				verb = "would truncate"
+			}
+			fmt.Printf("%d: %s at offset %d, dropping %d bytes (%v)\n", id, verb, end, info.Size()-end, corruption)
+			repaired++
+			if *dryRun {
+				continue
+			}
+			if err := truncate(path, end); err != nil {
+				return err
+			}
+		}
+		if *dryRun {
+			fmt.Printf("%d log files need repair\n", repaired)
+		} else {
+			fmt.Printf("%d log files repaired\n", repaired)
+		}
+		return nil
+	})
+}
+
+// truncate cuts the file at path to size and syncs it.
+func truncate(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [-dataDir dir] <command> [flags]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Works on a data directory no server has open. Commands:")
+		for _, name := range []string{"dump", "verify", "stats", "merge", "repair"} {
+			fmt.Fprintf(out, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(*dataDirFlag, flag.Args()[1:]); err != nil {
+		if !errors.Is(err, errFound) {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		os.Exit(1)
+	}
+}
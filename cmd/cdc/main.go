@@ -0,0 +1,88 @@
+// Command zapstore-cdc follows the log files of a bitcask data directory and writes
+// every change to a file, or stdout, as newline delimited JSON. It takes no lock, so
+// it can run next to the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"zap-store/internal/cdc"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/bitcask"
+)
+
+var (
+	dataDirFlag = flag.String("dataDir", "", "Bitcask data directory to follow")
+	outFlag     = flag.String("out", "", "File to append changes to, resuming after its last change (default stdout)")
+	fromFlag    = flag.String("from", "", "Where to start: start, end or <fileId>:<offset> (default: after the last change in -out, else start)")
+	pollFlag    = flag.Duration("poll", 100*time.Millisecond, "How often to check for new records once caught up")
+)
+
+// parsePosition reads -from. An empty value keeps the fallback position.
+func parsePosition(s string, fallback storage.LogPosition) (storage.LogPosition, error) {
+	switch s {
+	case "":
+		return fallback, nil
+	case "start":
+		return storage.LogPosition{}, nil
+	case "end":
+		return bitcask.LogEnd(*dataDirFlag)
+	}
+
+	fileId, offset, ok := strings.Cut(s, ":")
+	var pos storage.LogPosition
+	var err error
+	if pos.FileID, err = strconv.ParseInt(fileId, 10, 64); err != nil || !ok {
+		return pos, fmt.Errorf("invalid position %q (want start, end or <fileId>:<offset>)", s)
+	}
+	if pos.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+		return pos, fmt.Errorf("invalid position %q (want start, end or <fileId>:<offset>)", s)
+	}
+	return pos, nil
+}
+
+func main() {
+	flag.Parse()
+	if *dataDirFlag == "" {
+		log.Fatal("-dataDir is required")
+	}
+
+	var sink cdc.Sink = cdc.NewStreamSink(os.Stdout, nil, false)
+	var resume storage.LogPosition
+	if *outFlag != "" {
+		fileSink, err := cdc.OpenFileSink(*outFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fileSink.Close()
+		sink, resume = fileSink, fileSink.Position()
+	}
+
+	from, err := parsePosition(*fromFlag, resume)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tailer := bitcask.NewTailer(*dataDirFlag, from, *pollFlag)
+	defer tailer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = cdc.Copy(ctx, sink, tailer, time.Second)
+	if flushErr := sink.Flush(); err == nil || errors.Is(err, context.Canceled) {
+		err = flushErr
+	}
+	if err != nil {
+		log.Printf("stopped at %d:%d: %v", tailer.Position().FileID, tailer.Position().Offset, err)
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errIncomplete is returned by splitArgs for a line that goes on with the next one:
+// an unterminated quote, or a backslash at the end.
+var errIncomplete = errors.New("unterminated quote")
+
+// splitArgs splits a command line into arguments the way a shell does. Single quotes
+// keep everything up to the next single quote as it is. Double quotes understand the
+// escapes \n, \t, \r, \\, \", \xHH and \uHHHH. Outside quotes a backslash takes the
+// next character literally. A backslash before a line break joins the two lines.
+func splitArgs(line string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool // Set once the current argument has started, even if empty
+		quote   rune // The quote the rest of the argument is in, or 0
+		escaped bool // The previous character was a backslash
+	)
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		c := line[i : i+size] // As written, so that bytes of invalid UTF-8 pass unchanged
+		i += size
+
+		switch {
+		case escaped:
+			escaped = false
+			switch {
+			case r == '\n':
+			case quote == '"':
+				n, err := unescape(&arg, c, line[i:])
+				if err != nil {
+					return nil, err
+				}
+				i += n
+			default:
+				arg.WriteString(c)
+			}
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteString(c)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteString(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errIncomplete
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// unescape writes the character escaped by \c inside double quotes, reading the digits
+// of \x and \u from rest, and returns how many bytes of rest it used.
+func unescape(arg *strings.Builder, c string, rest string) (int, error) {
+	r, _ := utf8.DecodeRuneInString(c)
+	digits := 0
+	switch r {
+	case 'n':
+		arg.WriteByte('\n')
+	case 't':
+		arg.WriteByte('\t')
+	case 'r':
+		arg.WriteByte('\r')
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case '\\', '"':
+		arg.WriteString(c)
+	default:
+		// Like a shell, keep the backslash of escapes it does not know
+		arg.WriteByte('\\')
+		arg.WriteString(c)
+	}
+	if digits == 0 {
+		return 0, nil
+	}
+
+	if len(rest) < digits {
+		return 0, fmt.Errorf("invalid escape \\%c: want %d hex digits", r, digits)
+	}
+	n, err := strconv.ParseUint(rest[:digits], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid escape \\%c%s: want %d hex digits", r, rest[:digits], digits)
+	}
+	if r == 'x' {
+		arg.WriteByte(byte(n))
+	} else {
+		arg.WriteRune(rune(n))
+	}
+	return digits, nil
+}
+
+// quoteArg returns arg written so that splitArgs reads it back as one argument.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\r'\"\\#") && utf8.ValidString(arg) {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); {
+		r, size := utf8.DecodeRuneInString(arg[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, arg[i])
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// joinArgs is the reverse of splitArgs.
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
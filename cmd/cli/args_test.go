@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{line: "", want: nil},
+		{line: "get foo", want: []string{"get", "foo"}},
+		{line: " \t set  a\tb \r\n", want: []string{"set", "a", "b"}},
+		{line: `''`, want: []string{""}},
+		{line: `set "" x`, want: []string{"set", "", "x"}},
+		{line: `'a b' c`, want: []string{"a b", "c"}},
+		{line: `'a\n"b'`, want: []string{`a\n"b`}},
+		{line: `"it's"`, want: []string{"it's"}},
+		{line: `foo"bar"'baz'`, want: []string{"foobarbaz"}},
+		{line: `"a\nb\tc\rd\\e\"f"`, want: []string{"a\nb\tc\rd\\e\"f"}},
+		{line: `"\x41\x00\xffé"`, want: []string{"A\x00\xffé"}},
+		{line: `"a\qb"`, want: []string{`a\qb`}},
+		{line: `a\ b\"c\'d`, want: []string{`a b"c'd`}},
+		{line: "a\\\nb c", want: []string{"ab", "c"}},
+		{line: "\"a\\\nb\"", want: []string{"ab"}},
+		{line: "é ünï", want: []string{"é", "ünï"}},
+		{line: "\xff\xfe '\x80' \"\xc3\"", want: []string{"\xff\xfe", "\x80", "\xc3"}},
+	}
+
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q, nil", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	tests := []struct {
+		line       string
+		incomplete bool
+	}{
+		{line: `'abc`, incomplete: true},
+		{line: `"abc`, incomplete: true},
+		{line: `"abc\"`, incomplete: true},
+		{line: `abc\`, incomplete: true},
+		{line: "set k \"multi\nline", incomplete: true},
+		{line: `"\x4"`},
+		{line: `"\xzz"`},
+		{line: `"\u12"`},
+		{line: `"\uzzzz"`},
+	}
+
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err == nil {
+			t.Errorf("splitArgs(%q) = %q, nil, want error", tt.line, got)
+		} else if errors.Is(err, errIncomplete) != tt.incomplete {
+			t.Errorf("splitArgs(%q) error = %v, want errIncomplete: %v", tt.line, err, tt.incomplete)
+		}
+	}
+}
+
+func TestJoinArgsRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"get", "foo"},
+		{""},
+		{"set", "", "x"},
+		{"a b", "c\td", "e\nf\rg"},
+		{`it's`, `say "hi"`, `back\slash`, `#comment`},
+		{"\x00\x01\x7f", "\xff\xfe", "bad\xc3", "é", "日本語"},
+		{`\x41`, `é`, `'`, `"`, `\`},
+	}
+
+	for _, args := range tests {
+		line := joinArgs(args)
+		got, err := splitArgs(line)
+		if err != nil || !slices.Equal(got, args) {
+			t.Errorf("splitArgs(joinArgs(%q)) = splitArgs(%q) = %q, %v, want %q, nil", args, line, got, err, args)
+		}
+	}
+}
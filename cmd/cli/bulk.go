@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"zap-store/internal/bulk"
+)
+
+// runImport uploads pairs from a file, or stdin, to /admin/import without buffering them.
+func runImport(s *session, args []string) error {
+	fs := newFlagSet("import")
+	formatFlag := fs.String("format", "ndjson", "Input format: ndjson or binary")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	format, err := bulk.ParseFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+
+	in := s.stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	} else if in == nil {
+		return fmt.Errorf("%w: stdin holds the commands, give a file to import", errUsage)
+	}
+
+	resp, err := s.http.Post(s.baseURL+"/admin/import", format.ContentType(), in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import failed: %s: %s", resp.Status, body)
+	}
+	_, err = s.stdout.Write(body)
+	return err
+}
+
+// runExport downloads the pairs under a prefix from /admin/export into a file, or stdout.
+// The file is only left behind if the whole export arrived.
+func runExport(s *session, args []string) error {
+	fs := newFlagSet("export")
+	formatFlag := fs.String("format", "ndjson", "Output format: ndjson or binary")
+	prefixFlag := fs.String("prefix", "", "Only export keys starting with this prefix")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	format, err := bulk.ParseFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"format": {string(format)}}
+	if *prefixFlag != "" {
+		query.Set("prefix", *prefixFlag)
+	}
+	resp, err := s.http.Get(s.baseURL + "/admin/export?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("export failed: %s: %s", resp.Status, body)
+	}
+
+	name := fs.Arg(0)
+	if name == "" || name == "-" {
+		_, err := io.Copy(s.stdout, resp.Body)
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(name)
+		return fmt.Errorf("export interrupted: %w", err)
+	}
+	return f.Close()
+}
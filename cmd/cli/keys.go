@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"zap-store/client"
+)
+
+// Output formats of the commands.
+const (
+	formatRaw   = "raw"   // Values as they are, one per line
+	formatJSON  = "json"  // One JSON object per line
+	formatTable = "table" // Aligned columns with a header
+)
+
+func parseFormat(s string) (string, error) {
+	switch s {
+	case formatRaw, formatJSON, formatTable:
+		return s, nil
+	}
+	return "", fmt.Errorf("%w: unknown output format %q, want raw, json or table", errUsage, s)
+}
+
+// newFlagSet returns the flag set of a command, whose errors are usage errors.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// parseFlags parses the flags of a command.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return fmt.Errorf("%w: %s: %v", errUsage, fs.Name(), err)
+	}
+	return nil
+}
+
+// cell returns s for a table, quoted if it would break the layout.
+func cell(s string) string {
+	if strings.ContainsAny(s, "\t\n\r") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// getResult is a key read by get, printed in the same shape as the server's /mget answer.
+type getResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// runGet prints the values of keys. Missing keys print as empty lines in the raw
+// format, when there are several keys, and make the command fail once the others
+// are printed.
+func runGet(s *session, args []string) error {
+	fs := newFlagSet("get")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	keys := fs.Args()
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: get key...", errUsage)
+	}
+
+	results, err := s.kv.MGet(context.Background(), keys)
+	if err != nil {
+		return err
+	}
+	s.remember(keys...)
+
+	out := bufio.NewWriter(s.stdout)
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if s.format == formatTable {
+		fmt.Fprintln(table, "KEY\tVALUE")
+	}
+	var missing []string
+	enc := json.NewEncoder(out)
+	for i, r := range results {
+		if !r.Found {
+			missing = append(missing, keys[i])
+		}
+		switch {
+		case s.format == formatJSON:
+			enc.Encode(getResult{Key: keys[i], Value: r.Value, Found: r.Found})
+		case s.format == formatTable:
+			value := cell(r.Value)
+			if !r.Found {
+				value = "(not found)"
+			}
+			fmt.Fprintf(table, "%s\t%s\n", cell(keys[i]), value)
+		case r.Found || len(keys) > 1:
+			fmt.Fprintln(out, r.Value)
+		}
+	}
+	table.Flush()
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", client.ErrNotFound, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// runSet stores a value given as an argument, read from a file, or read from stdin
+// when there is neither.
+func runSet(s *session, args []string) error {
+	fs := newFlagSet("set")
+	fileFlag := fs.String("file", "", "Read the value from this file, or from stdin with -")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var value string
+	switch {
+	case fs.NArg() == 2 && *fileFlag == "":
+		value = fs.Arg(1)
+	case fs.NArg() == 1:
+		data, err := s.readValue(*fileFlag)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	default:
+		return fmt.Errorf("%w: set [-file path|-] key [value]", errUsage)
+	}
+	if err := s.kv.Set(context.Background(), fs.Arg(0), value); err != nil {
+		return err
+	}
+	s.remember(fs.Arg(0))
+	return nil
+}
+
+// readValue reads a value from the file name, or from stdin if name is empty or "-".
+func (s *session) readValue(name string) ([]byte, error) {
+	if name != "" && name != "-" {
+		return os.ReadFile(name)
+	}
+	if s.stdin == nil {
+		return nil, fmt.Errorf("%w: stdin holds the commands, give the value or a file", errUsage)
+	}
+	return io.ReadAll(s.stdin)
+}
+
+// runDel deletes keys. Deleting a missing key is not an error.
+func runDel(s *session, args []string) error {
+	fs := newFlagSet("del")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("%w: del key...", errUsage)
+	}
+	for _, key := range fs.Args() {
+		if err := s.kv.Delete(context.Background(), key); err != nil {
+			return err
+		}
+	}
+	s.remember(fs.Args()...)
+	return nil
+}
+
+// runScan prints the keys under a prefix, with their values unless -keys is given.
+func runScan(s *session, args []string) error {
+	fs := newFlagSet("scan")
+	keysOnly := fs.Bool("keys", false, "Print the keys only")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("%w: scan [-keys] [prefix]", errUsage)
+	}
+
+	out := bufio.NewWriter(s.stdout)
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	enc := json.NewEncoder(out)
+	switch {
+	case s.format != formatTable:
+	case *keysOnly:
+		fmt.Fprintln(table, "KEY")
+	default:
+		fmt.Fprintln(table, "KEY\tVALUE")
+	}
+	err := s.kv.Scan(context.Background(), fs.Arg(0), func(key, value string) error {
+		s.remember(key)
+		switch {
+		case s.format == formatJSON && *keysOnly:
+			return enc.Encode(map[string]string{"key": key})
+		case s.format == formatJSON:
+			return enc.Encode(client.KeyValue{Key: key, Value: value})
+		case s.format == formatTable && *keysOnly:
+			fmt.Fprintln(table, cell(key))
+		case s.format == formatTable:
+			fmt.Fprintf(table, "%s\t%s\n", cell(key), cell(value))
+		case *keysOnly:
+			fmt.Fprintln(out, key)
+		default:
+			fmt.Fprintf(out, "%s\t%s\n", key, value)
+		}
+		return nil
+	})
+	table.Flush()
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// runStats prints the statistics of the server from /admin/stats.
+func runStats(s *session, args []string) error {
+	fs := newFlagSet("stats")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: stats", errUsage)
+	}
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/admin/stats", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stats failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if s.format != formatTable {
+		_, err := s.stdout.Write(body)
+		return err
+	}
+	var stats map[string]any
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return fmt.Errorf("invalid stats: %w", err)
+	}
+	table := tabwriter.NewWriter(s.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "STAT\tVALUE")
+	printStats(table, "", stats)
+	return table.Flush()
+}
+
+// printStats writes one row per statistic, naming nested ones after their parents.
+func printStats(w io.Writer, prefix string, stats map[string]any) {
+	for _, name := range slices.Sorted(maps.Keys(stats)) {
+		switch v := stats[name].(type) {
+		case map[string]any:
+			printStats(w, prefix+name+".", v)
+		case string:
+			fmt.Fprintf(w, "%s%s\t%s\n", prefix, name, cell(v))
+		default:
+			data, _ := json.Marshal(v)
+			fmt.Fprintf(w, "%s%s\t%s\n", prefix, name, data)
+		}
+	}
+}
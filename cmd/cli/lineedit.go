@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C drops the line being typed.
+var errInterrupted = errors.New("interrupted")
+
+// Keys the line editor acts on.
+const (
+	keyCtrlA     = 0x01
+	keyCtrlB     = 0x02
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlE     = 0x05
+	keyCtrlF     = 0x06
+	keyCtrlK     = 0x0b
+	keyCtrlL     = 0x0c
+	keyCtrlN     = 0x0e
+	keyCtrlP     = 0x10
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyTab       = '\t'
+	keyEscape    = 0x1b
+	keyBackspace = 0x7f
+)
+
+// lineEditor reads lines from a terminal with editing, history and completion. If
+// the terminal cannot be put in raw mode it reads plain lines instead.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	fd  int
+
+	history []string
+	// complete returns the words that may replace the word ending at pos in line
+	complete func(line string, pos int) (start int, words []string)
+}
+
+// editState is a line being edited.
+type editState struct {
+	prompt string
+	line   []rune
+	pos    int
+}
+
+// addHistory adds a line to the history, unless it repeats the last one.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// readLine shows prompt and returns the line typed, without the line break. It
+// returns io.EOF at the end of input or on Ctrl-D on an empty line.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	defer restore()
+
+	s := &editState{prompt: prompt}
+	historyPos, saved := len(e.history), ""
+	e.refresh(s)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(s.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.deleteAt(s.pos)
+		case keyBackspace, '\b':
+			if s.pos > 0 {
+				s.pos--
+				s.deleteAt(s.pos)
+			}
+		case keyCtrlA:
+			s.pos = 0
+		case keyCtrlE:
+			s.pos = len(s.line)
+		case keyCtrlB:
+			s.pos = max(s.pos-1, 0)
+		case keyCtrlF:
+			s.pos = min(s.pos+1, len(s.line))
+		case keyCtrlK:
+			s.line = s.line[:s.pos]
+		case keyCtrlU:
+			s.line = slices.Delete(s.line, 0, s.pos)
+			s.pos = 0
+		case keyCtrlW:
+			start := s.pos
+			for start > 0 && s.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && s.line[start-1] != ' ' {
+				start--
+			}
+			s.line = slices.Delete(s.line, start, s.pos)
+			s.pos = start
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case keyCtrlP, keyCtrlN:
+			historyPos, saved = e.moveHistory(s, historyPos, saved, r == keyCtrlP)
+		case keyTab:
+			e.completeWord(s)
+		case keyEscape:
+			switch e.readEscape() {
+			case "[A", "OA":
+				historyPos, saved = e.moveHistory(s, historyPos, saved, true)
+			case "[B", "OB":
+				historyPos, saved = e.moveHistory(s, historyPos, saved, false)
+			case "[C", "OC":
+				s.pos = min(s.pos+1, len(s.line))
+			case "[D", "OD":
+				s.pos = max(s.pos-1, 0)
+			case "[H", "OH", "[1~", "[7~":
+				s.pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				s.pos = len(s.line)
+			case "[3~":
+				s.deleteAt(s.pos)
+			}
+		default:
+			if r >= ' ' {
+				s.line = slices.Insert(s.line, s.pos, r)
+				s.pos++
+			}
+		}
+		e.refresh(s)
+	}
+}
+
+// readEscape reads the rest of an escape sequence, such as "[A" for the up arrow.
+func (e *lineEditor) readEscape() string {
+	first, _, err := e.in.ReadRune()
+	if err != nil || (first != '[' && first != 'O') {
+		return ""
+	}
+	seq := []rune{first}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		// Parameters are digits and separators, the final character ends the sequence
+		if r >= 0x40 && r <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+// moveHistory replaces the line with the previous or next history entry. The line
+// being typed is kept in saved while browsing.
+func (e *lineEditor) moveHistory(s *editState, pos int, saved string, back bool) (int, string) {
+	switch {
+	case back && pos > 0:
+		if pos == len(e.history) {
+			saved = string(s.line)
+		}
+		pos--
+		s.line = []rune(e.history[pos])
+	case !back && pos < len(e.history):
+		pos++
+		if pos == len(e.history) {
+			s.line = []rune(saved)
+		} else {
+			s.line = []rune(e.history[pos])
+		}
+	default:
+		return pos, saved
+	}
+	s.pos = len(s.line)
+	return pos, saved
+}
+
+// completeWord completes the word before the cursor as far as all the candidates
+// agree, and lists them if that does not get any further.
+func (e *lineEditor) completeWord(s *editState) {
+	if e.complete == nil {
+		return
+	}
+	line := string(s.line[:s.pos])
+	start, words := e.complete(line, len(line))
+	if len(words) == 0 {
+		return
+	}
+
+	typed := line[start:]
+	common := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	for !utf8.ValidString(common) {
+		common = common[:len(common)-1]
+	}
+	if len(words) == 1 {
+		common += " "
+	}
+	if len(common) > len(typed) {
+		insert := []rune(common[len(typed):])
+		s.line = slices.Insert(s.line, s.pos, insert...)
+		s.pos += len(insert)
+		return
+	}
+
+	fmt.Fprint(e.out, "\r\n")
+	for _, w := range words {
+		fmt.Fprintf(e.out, "%s  ", w)
+	}
+	fmt.Fprint(e.out, "\r\n")
+}
+
+// refresh redraws the line and puts the cursor back in place.
+func (e *lineEditor) refresh(s *editState) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", s.prompt, string(s.line))
+	if back := len(s.line) - s.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (s *editState) deleteAt(pos int) {
+	if pos < len(s.line) {
+		s.line = slices.Delete(s.line, pos, pos+1)
+	}
+}
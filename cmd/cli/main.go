@@ -2,103 +2,264 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
+	"zap-store/client"
+	"zap-store/internal/tlsutil"
 )
 
-func main() {
-	reader := bufio.NewReader(os.Stdin)
+var (
+	addrFlag    = flag.String("addr", "localhost:8080", "Server address, optionally prefixed with http:// or https://")
+	caCertFlag  = flag.String("cacert", "", "CA certificate to trust when connecting over TLS")
+	certFlag    = flag.String("cert", "", "Client certificate to present for mutual TLS")
+	keyFlag     = flag.String("key", "", "Private key of the client certificate")
+	tokenFlag   = flag.String("token", os.Getenv("ZAPSTORE_TOKEN"), "Bearer token sent with every request (default $ZAPSTORE_TOKEN)")
+	timeoutFlag = flag.Duration("timeout", client.DefaultTimeout, "Timeout of each request, 0 for none; import and export are not limited")
+	formatFlag  = flag.String("format", formatRaw, "Output format: raw, json or table")
+	scriptFlag  = flag.String("script", "", "Run the commands in this file, one per line, or read them from stdin with -")
+	historyFlag = flag.String("history", defaultHistoryFile(), "File keeping the history of the interactive shell, empty for none")
+)
 
-	fmt.Println("Welcome to ZapStore CLI!")
-	fmt.Println("Type 'exit' to quit.")
-	for {
-		fmt.Print("zapstore=> ")
+// Exit codes of the non-interactive commands.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
 
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			fmt.Println("error reading input:", err)
-			continue
-		}
-		input = strings.TrimSpace(input)
+// errUsage marks errors in the way a command was called.
+var errUsage = errors.New("usage")
 
-		if input == "exit" {
-			break
-		}
+// session is what commands run with.
+type session struct {
+	baseURL string
+	http    *http.Client
+	kv      *client.Client
+	timeout time.Duration
+	format  string
+	stdin   io.Reader // Nil when stdin is where the commands come from
+	stdout  io.Writer
+	recent  *recentKeys // Keys to complete in the interactive shell, nil elsewhere
+}
 
-		args := strings.Fields(input)
-		if len(args) < 2 {
-			fmt.Println("invalid command")
-			continue
+// command is a non-interactive subcommand, run as "zapstore-cli <name> [flags] [args]".
+type command struct {
+	usage string
+	run   func(s *session, args []string) error
+	ack   bool // Prints nothing on success, so the shell confirms it with OK
+}
+
+var commands = map[string]command{
+	"get":    {usage: "get key...", run: runGet},
+	"set":    {usage: "set [-file path|-] key [value]", run: runSet, ack: true},
+	"del":    {usage: "del key...", run: runDel, ack: true},
+	"scan":   {usage: "scan [-keys] [prefix]", run: runScan},
+	"stats":  {usage: "stats", run: runStats},
+	"import": {usage: "import [-format ndjson|binary] [file|-]", run: runImport},
+	"export": {usage: "export [-format ndjson|binary] [-prefix p] [file|-]", run: runExport},
+}
+
+// aliases are other names of commands, kept from the first versions of the shell.
+var aliases = map[string]string{"delete": "del"}
+
+// lookup finds a command by name, ignoring case.
+func lookup(name string) (command, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	cmd, ok := commands[name]
+	return cmd, ok
+}
+
+// tokenTransport adds a bearer token to every request.
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
+// newSession connects a session to the server given by the flags. TLS is used when
+// the address says https:// or any TLS flag is given.
+func newSession() (*session, error) {
+	format, err := parseFormat(*formatFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := *addrFlag
+	useTLS := strings.HasPrefix(addr, "https://") || *caCertFlag != "" || *certFlag != "" || *keyFlag != ""
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+
+	scheme := "http://"
+	var transport http.RoundTripper = http.DefaultTransport
+	opts := []client.Option{client.WithTimeout(*timeoutFlag)}
+	if useTLS {
+		tlsConfig, err := tlsutil.ClientConfig(*caCertFlag, *certFlag, *keyFlag)
+		if err != nil {
+			return nil, err
 		}
+		scheme = "https://"
+		transport = &http.Transport{TLSClientConfig: tlsConfig}
+		opts = append(opts, client.WithTLSConfig(tlsConfig))
+	}
+	if *tokenFlag != "" {
+		transport = &tokenTransport{token: *tokenFlag, next: transport}
+		opts = append(opts, client.WithToken(*tokenFlag))
+	}
 
-		command := strings.ToUpper(args[0])
-		key := args[1]
+	kv, err := client.New(scheme+addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		baseURL: scheme + addr,
+		http:    &http.Client{Transport: transport},
+		kv:      kv,
+		timeout: *timeoutFlag,
+		format:  format,
+		stdin:   os.Stdin,
+		stdout:  os.Stdout,
+	}, nil
+}
 
-		switch command {
-		case "GET":
-			resp, err := http.Get(fmt.Sprintf("http://localhost:8080/get?key=%s", key))
-			if err != nil {
-				fmt.Println("error:", err)
-				continue
-			}
-			defer resp.Body.Close()
+// exitCode returns the exit code for the outcome of a command.
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, client.ErrNotFound):
+		return exitNotFound
+	default:
+		return exitError
+	}
+}
 
-			body, _ := io.ReadAll(resp.Body)
-			fmt.Println(string(body))
+// run runs the command named by the first of args.
+func (s *session) run(args []string) (command, error) {
+	cmd, ok := lookup(args[0])
+	if !ok {
+		return command{}, fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+	return cmd, cmd.run(s, args[1:])
+}
 
-		case "SET":
-			if len(args) < 3 {
-				fmt.Println("usage: SET key value")
+// runScript runs the commands read from r, one per line, stopping at the first that
+// fails. Empty lines and lines starting with # are skipped. Quoted arguments may go
+// on over several lines.
+func (s *session) runScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var command string
+	first := 0 // The line the command started on
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if command == "" {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
 				continue
 			}
-			value := args[2]
-			payload := map[string]string{
-				"key":   key,
-				"value": value,
-			}
-			data, _ := json.Marshal(payload)
+			first = n
+		} else {
+			line = command + "\n" + line
+		}
 
-			resp, err := http.Post("http://localhost:8080/set", "application/json", bytes.NewReader(data))
-			if err != nil {
-				fmt.Println("error:", err)
-				continue
-			}
-			defer resp.Body.Close()
+		args, err := splitArgs(line)
+		if errors.Is(err, errIncomplete) {
+			command = line
+			continue
+		}
+		command = ""
+		if err != nil {
+			return fmt.Errorf("line %d: %w: %v", first, errUsage, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := s.run(args); err != nil {
+			return fmt.Errorf("line %d: %w", first, err)
+		}
+	}
+	if command != "" {
+		return fmt.Errorf("line %d: %w: %v", first, errUsage, errIncomplete)
+	}
+	return scanner.Err()
+}
 
-			if resp.StatusCode == http.StatusOK {
-				fmt.Println("OK")
-			} else {
-				body, _ := io.ReadAll(resp.Body)
-				fmt.Println("error:", string(body))
-			}
+// isTerminal reports whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-		case "DELETE":
-			req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://localhost:8080/delete?key=%s", key), nil)
-			if err != nil {
-				fmt.Println("error:", err)
-				continue
-			}
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				fmt.Println("error:", err)
-				continue
-			}
-			defer resp.Body.Close()
+func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Without a command, commands are read from -script, or from stdin if it is not a")
+		fmt.Fprintln(out, "terminal, and an interactive shell is started otherwise. Commands:")
+		for _, name := range slices.Sorted(maps.Keys(commands)) {
+			fmt.Fprintf(out, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(out, "\nExit codes: %d success, %d failure, %d bad usage, %d key not found.\n", exitOK, exitError, exitUsage, exitNotFound)
+		fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-			if resp.StatusCode == http.StatusOK {
-				fmt.Println("OK")
-			} else {
-				body, _ := io.ReadAll(resp.Body)
-				fmt.Println("error:", string(body))
-			}
+	s, err := newSession()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exitCode(err))
+	}
 
-		default:
-			fmt.Println("unknown command:", command)
+	var script io.Reader
+	switch {
+	case flag.NArg() > 0:
+		cmd, ok := lookup(flag.Arg(0))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		err = cmd.run(s, flag.Args()[1:])
+	case *scriptFlag != "" && *scriptFlag != "-":
+		f, err := os.Open(*scriptFlag)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer f.Close()
+		script = f
+	case *scriptFlag == "-" || !isTerminal(os.Stdin):
+		script, s.stdin = os.Stdin, nil
+	default:
+		s.stdin = nil
+		s.shell()
+		return
+	}
+	if script != nil {
+		err = s.runScript(script)
+	}
+
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, "error:", err)
 	}
+	os.Exit(exitCode(err))
 }
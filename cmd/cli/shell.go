@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	historySize = 1000 // Lines of history kept
+	recentSize  = 1000 // Recently used keys offered for completion
+)
+
+// builtins are the shell's own commands.
+var builtins = []string{"exit", "help", "quit"}
+
+// defaultHistoryFile returns ~/.zapstore_history, or nothing if there is no home.
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".zapstore_history")
+}
+
+// recentKeys is the keys used last, most recent last, without repeats.
+type recentKeys struct {
+	keys []string
+}
+
+func (r *recentKeys) add(key string) {
+	if i := slices.Index(r.keys, key); i >= 0 {
+		r.keys = slices.Delete(r.keys, i, i+1)
+	} else if len(r.keys) == recentSize {
+		r.keys = r.keys[1:]
+	}
+	r.keys = append(r.keys, key)
+}
+
+// remember notes keys the user worked with, for completion in the shell.
+func (s *session) remember(keys ...string) {
+	if s.recent == nil {
+		return
+	}
+	for _, key := range keys {
+		s.recent.add(key)
+	}
+}
+
+// complete offers the commands for the first word of a line and recently used keys
+// for the others.
+func (s *session) complete(line string, pos int) (int, []string) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	prefix := line[start:pos]
+	if strings.ContainsAny(prefix, `'"\`) {
+		return start, nil
+	}
+
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		candidates = append(slices.Collect(maps.Keys(commands)), builtins...)
+	} else {
+		for i := len(s.recent.keys) - 1; i >= 0; i-- {
+			candidates = append(candidates, quoteArg(s.recent.keys[i]))
+		}
+	}
+
+	var words []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) && !slices.Contains(words, c) {
+			words = append(words, c)
+		}
+	}
+	slices.Sort(words)
+	return start, words
+}
+
+// loadHistory reads the history file, keeping its last historySize lines, and returns
+// the file open for appending new ones, or nil if there is no history file.
+func loadHistory(name string) ([]string, *os.File, error) {
+	if name == "" {
+		return nil, nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if lines[0] == "" {
+		lines = nil
+	}
+	if len(lines) > historySize {
+		lines = lines[len(lines)-historySize:]
+		// Keep the file from growing forever
+		if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, f, nil
+}
+
+// shell reads commands from the terminal and runs them until "exit" or the end of
+// input. Lines can be edited, Up and Down go through the history and Tab completes
+// commands and keys. An unterminated quote goes on to the next line, for values of
+// several lines. Every command reports how long it took.
+func (s *session) shell() {
+	s.recent = &recentKeys{}
+	editor := &lineEditor{
+		in:       bufio.NewReader(os.Stdin),
+		out:      os.Stdout,
+		fd:       int(os.Stdin.Fd()),
+		complete: s.complete,
+	}
+	history, historyFile, err := loadHistory(*historyFlag)
+	if err != nil {
+		fmt.Println("warning: history not kept:", err)
+	}
+	editor.history = history
+	if historyFile != nil {
+		defer historyFile.Close()
+	}
+
+	fmt.Println("Welcome to ZapStore CLI!")
+	fmt.Println("Type 'help' for the commands and 'exit' to quit.")
+	for {
+		args, entry, err := readCommand(editor)
+		switch {
+		case errors.Is(err, errInterrupted):
+			continue
+		case err == io.EOF:
+			return
+		case err != nil:
+			fmt.Println("error:", err)
+			continue
+		case len(args) == 0:
+			continue
+		}
+		editor.addHistory(entry)
+		if historyFile != nil {
+			fmt.Fprintln(historyFile, entry)
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "exit", "quit":
+			return
+		case "help":
+			fmt.Println("Commands:")
+			for _, name := range slices.Sorted(maps.Keys(commands)) {
+				fmt.Printf("  %s\n", commands[name].usage)
+			}
+			fmt.Println("  exit")
+			continue
+		}
+
+		start := time.Now()
+		cmd, err := s.run(args)
+		elapsed := time.Since(start).Round(time.Microsecond)
+		switch {
+		case err != nil:
+			fmt.Printf("error: %v (%s)\n", err, elapsed)
+		case cmd.ack:
+			fmt.Printf("OK (%s)\n", elapsed)
+		default:
+			fmt.Printf("(%s)\n", elapsed)
+		}
+	}
+}
+
+// readCommand reads a command, going on over further lines while a quote is open, and
+// returns its arguments and the entry to keep in the history for it, on one line.
+func readCommand(editor *lineEditor) ([]string, string, error) {
+	line, err := editor.readLine("zapstore=> ")
+	if err != nil {
+		return nil, "", err
+	}
+	lines := 1
+	for {
+		args, err := splitArgs(line)
+		if !errors.Is(err, errIncomplete) {
+			if lines > 1 && err == nil {
+				line = joinArgs(args)
+			}
+			return args, strings.TrimSpace(line), err
+		}
+
+		next, err := editor.readLine("        -> ")
+		if err == io.EOF {
+			return nil, "", errIncomplete
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		line += "\n" + next
+		lines++
+	}
+}
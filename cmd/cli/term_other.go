@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// makeRaw is not supported here, so the shell reads whole lines without editing.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,77 @@
+// Command zapstore-router spreads keys over several zapstore-server nodes by
+// consistent hashing, forwarding every request to the node owning its key. Nodes are
+// added and removed at runtime through its /admin/shards endpoints, which move the
+// affected keys in the background.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"zap-store/internal/sharding"
+	"zap-store/internal/tlsutil"
+)
+
+var (
+	addrFlag   = flag.String("addr", ":8090", "Address to listen on")
+	nodesFlag  = flag.String("nodes", "", "Comma separated base URLs of the zapstore-server nodes")
+	vnodesFlag = flag.Int("vnodes", sharding.DefaultVirtualNodes, "Points per node on the hash ring; the same on every router")
+	stateFlag  = flag.String("state", "", "File keeping the ring across restarts (default: ring from -nodes only)")
+	caFlag     = flag.String("caFile", "", "CA certificate to verify https nodes with")
+)
+
+func main() {
+	flag.Parse()
+	var nodes []string
+	for _, node := range strings.Split(*nodesFlag, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	// The token moves keys between nodes, so it stays out of the process list
+	opts := []sharding.Option{
+		sharding.WithToken(os.Getenv("ZAPSTORE_ROUTER_TOKEN")),
+		sharding.WithVirtualNodes(*vnodesFlag),
+		sharding.WithStateFile(*stateFlag),
+	}
+	if *caFlag != "" {
+		tlsConfig, err := tlsutil.ClientConfig(*caFlag, "", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, sharding.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	router, err := sharding.NewRouter(nodes, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s := router.Status(); s.PreviousNodes != nil {
+		slog.Warn("a rebalance did not finish, POST /admin/shards/rebalance to resume it", "nodes", s.Nodes, "previous", s.PreviousNodes)
+	}
+
+	srv := &http.Server{Addr: *addrFlag, Handler: router, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("zapstore-router listening", "addr", *addrFlag, "nodes", router.Status().Nodes)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
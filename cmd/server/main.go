@@ -1,150 +1,537 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/config"
+	"zap-store/internal/logging"
+	"zap-store/internal/metrics"
+	"zap-store/internal/raft"
+	"zap-store/internal/replication"
+	"zap-store/internal/server"
 	"zap-store/internal/storage"
 	"zap-store/internal/storage/bitcask"
+	"zap-store/internal/storage/btree"
 	"zap-store/internal/storage/inmem"
+	"zap-store/internal/storage/lsm"
+	"zap-store/internal/tlsutil"
+	"zap-store/internal/watch"
 	"zap-store/internal/zapstore"
 )
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
+var (
+	configFlag  = flag.String("config", "", "Path to a JSON, TOML (.toml) or YAML (.yaml, .yml) configuration file")
+	addrFlag    = flag.String("addr", "", "Address to listen on (overrides server.addr)")
+	engineFlag  = flag.String("engine", "", "Storage engine to use, inmem, bitcask, lsm or btree (overrides engine.name)")
+	dataDirFlag = flag.String("dataDir", "", "Directory for BitCask data files (overrides engine.dataDir)")
+	followFlag  = flag.String("follow", "", "Run as a read-only replica of the leader at this URL (overrides replication.leader)")
+)
+
+// loadConfig reads the config file and environment, applies explicitly set flags on top
+// and validates the result.
+func loadConfig() (config.Config, error) {
+	cfg, err := config.Load(*configFlag)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addrFlag
+		case "engine":
+			cfg.Engine.Name = *engineFlag
+		case "dataDir":
+			cfg.Engine.DataDir = *dataDirFlag
+		case "follow":
+			cfg.Replication.Leader = *followFlag
+		}
 	})
+
+	if err := cfg.Validate(); err != nil {
+		return config.Config{}, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
 }
 
-func setHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+func bitcaskOptions(c config.BitcaskConfig) ([]bitcask.Option, error) {
+	policy, err := bitcask.ParseSyncPolicy(c.Sync)
+	if err != nil {
+		return nil, err
+	}
+	return []bitcask.Option{
+		bitcask.WithMaxFileSize(c.MaxFileSize),
+		bitcask.WithSyncPolicy(policy, time.Duration(c.SyncInterval)),
+		bitcask.WithMergeInterval(time.Duration(c.MergeInterval)),
+	}, nil
+}
+
+func lsmOptions(c config.LSMConfig) ([]lsm.Option, error) {
+	style, err := lsm.ParseCompactionStyle(c.Compaction)
+	if err != nil {
+		return nil, err
+	}
+	opts := []lsm.Option{lsm.WithMemtableSize(c.MemtableSize), lsm.WithCompaction(style)}
+	if c.SyncWrites {
+		opts = append(opts, lsm.WithSyncWrites())
+	}
+	return opts, nil
+}
+
+// maintenanceHooks records bitcask merge and fsync timings in reg, and logs those
+// slower than the threshold held in slow.
+func maintenanceHooks(reg *metrics.Registry, slow *atomic.Int64) bitcask.Hooks {
+	merges := reg.NewHistogramVec("zapstore_merge_duration_seconds",
+		"Duration of bitcask merges, by result.", []float64{.01, .1, 1, 10, 60, 300}, "result")
+	syncs := reg.NewHistogramVec("zapstore_fsync_duration_seconds",
+		"Duration of fsyncs of the active log, by result.", metrics.DefaultBuckets, "result")
+	observe := func(op string, h *metrics.HistogramVec) func(time.Duration, error) {
+		return func(took time.Duration, err error) {
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			h.WithLabelValues(result).Observe(took.Seconds())
+			if threshold := time.Duration(slow.Load()); threshold > 0 && took > threshold {
+				slog.Warn("slow engine operation", "op", op, "duration", took, "threshold", threshold, "error", err)
+			}
 		}
+	}
+	return bitcask.Hooks{Merge: observe("merge", merges), Sync: observe("fsync", syncs)}
+}
+
+func openEngine(cfg config.EngineConfig, reg *metrics.Registry, slow *atomic.Int64) (storage.StorageEngine, error) {
+	switch cfg.Name {
+	case "inmem":
+		return inmem.NewInMemStorageEngine(), nil
+	case "bitcask":
+		slog.Info("using bitcask storage engine", "data_dir", cfg.DataDir)
 
-		var req struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
+		opts, err := bitcaskOptions(cfg.Bitcask)
+		if err != nil {
+			return nil, err
+		}
+		// Load in the background so probes can answer while the KeyDir is rebuilt
+		opts = append(opts, bitcask.WithHooks(maintenanceHooks(reg, slow)), bitcask.WithBackgroundLoad())
+		engine, err := bitcask.NewBitCaskStorageEngine(cfg.DataDir, opts...)
+		if err != nil {
+			return nil, err
 		}
+		go func() {
+			start := time.Now()
+			if err := engine.WaitLoaded(); err != nil {
+				slog.Error("loading data directory failed", "error", err)
+				return
+			}
+			slog.Info("loaded data directory", "duration", time.Since(start))
+		}()
+		return engine, nil
+	case "lsm":
+		slog.Info("using lsm storage engine", "data_dir", cfg.DataDir, "compaction", cfg.LSM.Compaction)
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		opts, err := lsmOptions(cfg.LSM)
+		if err != nil {
+			return nil, err
 		}
+		return lsm.NewLSMStorageEngine(cfg.DataDir, opts...)
+	case "btree":
+		slog.Info("using btree storage engine", "data_dir", cfg.DataDir, "page_size", cfg.BTree.PageSize)
 
-		if err := kvs.Set(req.Key, req.Value); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		opts := []btree.Option{btree.WithPageSize(cfg.BTree.PageSize), btree.WithCacheSize(cfg.BTree.CacheSize)}
+		if cfg.BTree.NoSync {
+			opts = append(opts, btree.WithNoSync())
 		}
+		return btree.NewBTreeStorageEngine(cfg.DataDir, opts...)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", cfg.Name)
+	}
+}
 
-		w.WriteHeader(http.StatusOK)
+// newLogger builds the process logger from cfg. Output goes to stderr and, when a log
+// file is configured, to that file with size based rotation. The returned closer
+// closes the file.
+func newLogger(cfg config.LogConfig, level *slog.LevelVar) (*slog.Logger, io.Closer, error) {
+	parsed, err := logging.ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	level.Set(parsed)
 
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if cfg.File != "" {
+		file, err := logging.OpenRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, closer = io.MultiWriter(file, os.Stderr), file
+	}
+
+	handler, err := logging.NewHandler(out, cfg.Format, level)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
 	}
+	return slog.New(handler), closer, nil
 }
 
-func getHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// fatal logs err and exits. It is only used before anything needs releasing.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func newTLSReloader(cfg config.TLSConfig) (*tlsutil.Reloader, error) {
+	clientAuth, err := tlsutil.ParseClientAuth(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return tlsutil.NewReloader(tlsutil.ServerOptions{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		ClientAuth:   clientAuth,
+	})
+}
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "missing key parameter", http.StatusBadRequest)
-			return
+// newFollower makes kvs a replica of the leader in cfg.Replication. Followers on disk
+// keep their position next to the data, so a restart resumes streaming.
+func newFollower(cfg config.Config, kvs *zapstore.ZapStore, logger *slog.Logger) (*replication.Follower, error) {
+	r := cfg.Replication
+	opts := []replication.Option{replication.WithToken(r.Token), replication.WithLogger(logger)}
+	if r.CAFile != "" || r.CertFile != "" {
+		tlsConfig, err := tlsutil.ClientConfig(r.CAFile, r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, err
 		}
-		value, err := kvs.Get(key)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, replication.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	if cfg.Engine.Name != "inmem" {
+		opts = append(opts, replication.WithStateFile(filepath.Join(cfg.Engine.DataDir, "replication.json")))
+	}
+	return replication.NewFollower(kvs, r.Leader, opts...)
+}
+
+// startRaft makes kvs a member of the Raft group in cfg.Raft, keeping the log and votes
+// in raft.dataDir, by default a "raft" directory next to the engine's data. The
+// returned stop function stops the node and releases its storage.
+func startRaft(cfg config.Config, kvs *zapstore.ZapStore, logger *slog.Logger) (*raft.Node, func(), error) {
+	r := cfg.Raft
+	dir := r.DataDir
+	if dir == "" {
+		dir = filepath.Join(cfg.Engine.DataDir, "raft")
+	}
+	raftStorage, err := raft.OpenFileStorage(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := []raft.HTTPOption{raft.WithToken(r.Token), raft.WithLogger(logger)}
+	if r.CAFile != "" || r.CertFile != "" {
+		tlsConfig, err := tlsutil.ClientConfig(r.CAFile, r.CertFile, r.KeyFile)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+			raftStorage.Close()
+			return nil, nil, err
 		}
-		w.Write([]byte(value))
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, raft.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	transport := raft.NewHTTPTransport(opts...)
+
+	node, err := kvs.StartRaft(raft.Config{
+		ID:        r.ID,
+		Members:   r.Members,
+		Storage:   raftStorage,
+		Transport: transport,
+		Logger:    logger,
+	})
+	if err != nil {
+		transport.Close()
+		raftStorage.Close()
+		return nil, nil, err
+	}
+	if strings.EqualFold(r.ReadConsistency, "linearizable") {
+		kvs.SetReadConsistency(zapstore.ReadLinearizable)
 	}
+	stop := func() {
+		node.Stop()
+		transport.Close()
+		raftStorage.Close()
+	}
+	return node, stop, nil
+}
+
+// reloadable holds the parts of a running server that SIGHUP can reconfigure.
+type reloadable struct {
+	engine        storage.StorageEngine
+	tlsReloader   *tlsutil.Reloader   // nil without TLS
+	authenticator *auth.Authenticator // nil without authentication
+	server        *server.Server
+	logLevel      *slog.LevelVar
+	slowOps       *atomic.Int64 // Slow engine operation threshold, a time.Duration
 }
 
-func deleteHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+// reload re-reads the configuration and applies the settings that can change at runtime.
+// Everything is parsed and checked before any of it is applied, so a rejected file
+// leaves the running configuration as it was. Anything else that changed is reported
+// as needing a restart.
+func (rt *reloadable) reload(current config.Config) (config.Config, error) {
+	next, err := loadConfig()
+	if err != nil {
+		return current, err
+	}
+
+	level, err := logging.ParseLevel(next.Log.Level)
+	if err != nil {
+		return current, err
+	}
+	policy, err := bitcask.ParseSyncPolicy(next.Engine.Bitcask.Sync)
+	if err != nil {
+		return current, err
+	}
+	for _, token := range next.Auth.Tokens {
+		if err := token.Validate(); err != nil {
+			return current, err
 		}
+	}
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "missing key parameter", http.StatusBadRequest)
-			return
+	// Certificates are re-read even when the paths are unchanged, to pick up rotated files
+	applyTLS := func() {}
+	if rt.tlsReloader != nil && next.Server.TLS == current.Server.TLS {
+		if applyTLS, err = rt.tlsReloader.Prepare(); err != nil {
+			return current, err
 		}
-		err := kvs.Delete(key)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	}
+
+	// The engine checks its schedule as a whole and is the last step that can fail
+	if bc, ok := rt.engine.(*bitcask.BitCaskStorageEngine); ok {
+		b := next.Engine.Bitcask
+		if err := bc.SetSchedule(policy, time.Duration(b.SyncInterval), time.Duration(b.MergeInterval)); err != nil {
+			return current, err
 		}
-		w.WriteHeader(http.StatusOK)
 	}
-}
 
-func StartServer(kv *zapstore.ZapStore) {
-	mux := http.NewServeMux()
-	mux.Handle("/set", loggingMiddleware(setHandler(kv)))
-	mux.Handle("/get", loggingMiddleware(getHandler(kv)))
-	mux.Handle("/delete", loggingMiddleware(deleteHandler(kv)))
+	applyTLS()
+	if rt.authenticator != nil {
+		// Cannot fail, the tokens were validated above
+		rt.authenticator.SetStaticTokens(next.Auth.Tokens)
+	}
+	rt.logLevel.Set(level)
+	rt.server.SetSlowThreshold(time.Duration(next.Log.SlowThreshold))
+	rt.slowOps.Store(int64(next.Log.SlowThreshold))
 
-	fmt.Println("Server started at :8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
-		log.Fatal(err)
+	if next.Auth.Enabled != current.Auth.Enabled || next.Auth.Keyspace != current.Auth.Keyspace {
+		slog.Warn("authentication mode changed; restart to apply it")
+	}
+	if next.Server != current.Server {
+		slog.Warn("server settings changed; restart to apply them")
+	}
+	if next.Log.File != current.Log.File || next.Log.Format != current.Log.Format ||
+		next.Log.MaxSize != current.Log.MaxSize || next.Log.MaxBackups != current.Log.MaxBackups {
+		slog.Warn("log file or format changed; restart to apply them")
+	}
+	if next.Replication != current.Replication {
+		slog.Warn("replication settings changed; restart to apply them")
+	}
+	if !reflect.DeepEqual(next.Raft, current.Raft) {
+		slog.Warn("raft settings changed; restart to apply them")
+	}
+	if next.Engine.Name != current.Engine.Name || next.Engine.DataDir != current.Engine.DataDir ||
+		next.Engine.Bitcask.MaxFileSize != current.Engine.Bitcask.MaxFileSize || next.Engine.LSM != current.Engine.LSM ||
+		next.Engine.BTree != current.Engine.BTree {
+		slog.Warn("engine selection, data directory, file size, lsm or btree settings changed; restart to apply them")
 	}
+	return next, nil
 }
 
 func main() {
+	flag.Parse()
 
-	logFileName := "logFile.log"
-	logFile, err := os.OpenFile(logFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("failed to open log file: %s", err)
+		fatal("failed to load configuration", err)
 	}
-	defer logFile.Close()
 
-	// log.SetOutput(io.MultiWriter(logFile, os.Stderr))
-	log.SetOutput(os.Stderr)
-	// log.SetFlags(log.LstdFlags | log.Llongfile)
-	log.SetFlags(log.Ltime | log.Ldate | log.LUTC | log.Lmicroseconds)
+	logLevel := new(slog.LevelVar)
+	logger, logCloser, err := newLogger(cfg.Log, logLevel)
+	if err != nil {
+		fatal("failed to set up logging", err)
+	}
+	slog.SetDefault(logger)
 
-	var engineFlag = flag.String("engine", "inmem", "Storage engine to use (inmem or bitcask)")
-	var dataDirFlag = flag.String("dataDir", "", "Directory for BitCask data files")
-	flag.Parse()
+	// run has released the engine and everything else by the time it returns
+	err = run(cfg, logger, logLevel)
+	if err != nil {
+		slog.Error("server failed", "error", err)
+	}
+	logCloser.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+}
 
-	log.Printf("Starting with storage engine: %s\n", *engineFlag)
+// run serves until a signal or a fatal error stops the server, then shuts down in order:
+// the listener, replication or Raft, and finally the storage engine.
+func run(cfg config.Config, logger *slog.Logger, logLevel *slog.LevelVar) error {
+	slog.Info("starting", "engine", cfg.Engine.Name)
 
-	var storageEngine storage.StorageEngine
+	slowOps := new(atomic.Int64)
+	slowOps.Store(int64(cfg.Log.SlowThreshold))
+	registry := metrics.NewRegistry()
+	storageEngine, err := openEngine(cfg.Engine, registry, slowOps)
+	if err != nil {
+		return fmt.Errorf("failed to open storage engine: %w", err)
+	}
+	defer storageEngine.Close()
 
-	switch *engineFlag {
-	case "inmem":
-		storageEngine = inmem.NewInMemStorageEngine()
-	case "bitcask":
-		if *dataDirFlag == "" {
-			log.Fatal("Please specify a data directory for BitCask using the -dataDir flag")
+	kvs := zapstore.NewZapStore(storageEngine, zapstore.WithWatchRetention(watch.Retention{
+		Events: cfg.Watch.RetainEvents,
+		Bytes:  int(cfg.Watch.RetainBytes),
+		Idle:   time.Duration(cfg.Watch.RetainIdle),
+	}))
+
+	serverOpts := []server.Option{
+		server.WithMetrics(registry),
+		server.WithLogger(logger),
+		server.WithSlowThreshold(time.Duration(cfg.Log.SlowThreshold)),
+	}
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled {
+		var tokenStore *zapstore.ZapStore
+		if cfg.Auth.Keyspace {
+			tokenStore = kvs
+		}
+		if authenticator, err = auth.NewAuthenticator(cfg.Auth.Tokens, tokenStore); err != nil {
+			return fmt.Errorf("failed to set up authentication: %w", err)
 		}
+		serverOpts = append(serverOpts, server.WithAuthenticator(authenticator))
+	}
 
-		log.Printf("Using BitCask storage engine with data directory: %s\n", *dataDirFlag)
+	// Followers apply the leader's writes until shutdown, then save their position
+	// before the engine closes
+	var follower *replication.Follower
+	if cfg.Replication.Leader != "" {
+		if follower, err = newFollower(cfg, kvs, logger); err != nil {
+			return fmt.Errorf("failed to set up replication: %w", err)
+		}
+		serverOpts = append(serverOpts, server.WithFollower(follower))
+		slog.Info("following leader", "leader", cfg.Replication.Leader)
+	}
+	replicaCtx, stopReplica := context.WithCancel(context.Background())
+	replicaDone := make(chan struct{})
+	if follower != nil {
+		go func() {
+			defer close(replicaDone)
+			follower.Run(replicaCtx)
+		}()
+	} else {
+		close(replicaDone)
+	}
+	defer func() {
+		stopReplica()
+		<-replicaDone
+	}()
 
-		var err error
-		storageEngine, err = bitcask.NewBitCaskStorageEngine(*dataDirFlag)
-		if err != nil {
-			log.Fatal(err)
+	// Raft members stop before the engine closes, with the writes they applied. A node
+	// that stops itself on a storage failure shuts the server down.
+	var node *raft.Node
+	var raftDone <-chan struct{}
+	if cfg.Raft.Enabled() {
+		var stopRaft func()
+		if node, stopRaft, err = startRaft(cfg, kvs, logger); err != nil {
+			return fmt.Errorf("failed to start raft: %w", err)
 		}
-		defer storageEngine.Close()
-	default:
-		log.Fatal("usage: specify at least one storage engine: inmem or bitcask")
+		raftDone = node.Done()
+		defer stopRaft()
+		serverOpts = append(serverOpts, server.WithRaft(node))
+		slog.Info("joined raft group", "id", cfg.Raft.ID, "members", cfg.Raft.Members)
+	}
+
+	srv := server.New(kvs, serverOpts...)
+	httpServer := &http.Server{
+		Addr:     cfg.Server.Addr,
+		Handler:  srv,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	httpServer.RegisterOnShutdown(srv.CloseWatches)
+
+	var tlsReloader *tlsutil.Reloader
+	if cfg.Server.TLS.Enabled() {
+		if tlsReloader, err = newTLSReloader(cfg.Server.TLS); err != nil {
+			return fmt.Errorf("failed to load TLS certificates: %w", err)
+		}
+		httpServer.TLSConfig = tlsReloader.TLSConfig()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server started", "addr", cfg.Server.Addr, "tls", tlsReloader != nil)
+		if tlsReloader != nil {
+			// Certificates come from the reloader's TLSConfig
+			serveErr <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- httpServer.ListenAndServe()
+		}
+	}()
+
+	rt := &reloadable{
+		engine:        storageEngine,
+		tlsReloader:   tlsReloader,
+		authenticator: authenticator,
+		server:        srv,
+		logLevel:      logLevel,
+		slowOps:       slowOps,
 	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	kvs := zapstore.NewZapStore(storageEngine)
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Error("shutdown failed", "error", err)
+		}
+	}
 
-	StartServer(kvs)
+	for {
+		select {
+		case err := <-serveErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("server stopped: %w", err)
+			}
+			return nil
+		case <-raftDone:
+			shutdown()
+			return fmt.Errorf("raft stopped: %w", node.Err())
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				slog.Info("reloading configuration")
+				if cfg, err = rt.reload(cfg); err != nil {
+					slog.Error("reload failed, keeping previous configuration", "error", err)
+				}
+				continue
+			}
 
+			slog.Info("shutting down", "signal", sig.String())
+			shutdown()
+			return nil
+		}
+	}
 }
@@ -2,6 +2,7 @@ module zap-store
 
 go 1.24.0
 
-require github.com/gofrs/flock v0.12.1
-
-require golang.org/x/sys v0.22.0 // indirect
+require (
+	github.com/gofrs/flock v0.12.1
+	golang.org/x/sys v0.22.0
+)
@@ -0,0 +1,272 @@
+// Package auth implements token authentication and per-prefix access control for
+// ZapStore front-ends. Tokens come from the server configuration or from a reserved
+// keyspace inside the store itself.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+var (
+	// ErrUnauthenticated means no token, or an unknown token, was presented.
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrForbidden means the token is valid but lacks the permission for the key.
+	ErrForbidden = errors.New("permission denied")
+	// ErrInvalidTokenID means a token id is not a hex encoded SHA-256 digest.
+	ErrInvalidTokenID = errors.New("invalid token id")
+)
+
+// Permission is a level of access. Each level includes the ones below it.
+type Permission int
+
+const (
+	None Permission = iota
+	Read
+	Write
+	Admin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case None:
+		return "none"
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Permission(%d)", int(p))
+	}
+}
+
+// ParsePermission converts "none", "read", "write" or "admin" into a Permission.
+func ParsePermission(s string) (Permission, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "none":
+		return None, nil
+	case "read":
+		return Read, nil
+	case "write":
+		return Write, nil
+	case "admin":
+		return Admin, nil
+	default:
+		return None, fmt.Errorf("unknown permission %q (want none, read, write or admin)", s)
+	}
+}
+
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePermission(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Rule grants a permission on every key starting with Prefix. An empty prefix matches all keys.
+type Rule struct {
+	Prefix     string     `json:"prefix"`
+	Permission Permission `json:"permission"`
+}
+
+// ReservedPrefix is the keyspace ZapStore keeps for its own data. Keys under it always
+// need Admin permission, whatever rule matches them.
+const ReservedPrefix = "__zapstore/"
+
+// Principal is an authenticated caller and the rules that apply to it.
+type Principal struct {
+	Name  string `json:"name"`
+	Rules []Rule `json:"rules"`
+}
+
+// Permission returns the access the principal has to key. The rule with the longest
+// matching prefix wins, so a narrower rule can restrict a broader one.
+func (p *Principal) Permission(key string) Permission {
+	best, bestLen := None, -1
+	for _, rule := range p.Rules {
+		if strings.HasPrefix(key, rule.Prefix) && len(rule.Prefix) > bestLen {
+			best, bestLen = rule.Permission, len(rule.Prefix)
+		}
+	}
+	return best
+}
+
+// Authorize reports whether the principal may perform an operation needing perm on key.
+func (p *Principal) Authorize(perm Permission, key string) error {
+	if strings.HasPrefix(key, ReservedPrefix) && perm < Admin {
+		perm = Admin
+	}
+	if p.Permission(key) < perm {
+		return fmt.Errorf("%w: %s needs %s access to %q", ErrForbidden, p.Name, perm, key)
+	}
+	return nil
+}
+
+// HashToken returns the hex SHA-256 digest tokens are stored and compared as.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StaticToken is a token defined in the server configuration. Either the token itself
+// or its SHA-256 hex digest can be given, so configs need not hold the secret.
+type StaticToken struct {
+	Name        string `json:"name"`
+	Token       string `json:"token,omitempty"`
+	TokenSHA256 string `json:"tokenSHA256,omitempty"`
+	Rules       []Rule `json:"rules"`
+}
+
+func (t StaticToken) hash() string {
+	if t.TokenSHA256 != "" {
+		return strings.ToLower(t.TokenSHA256)
+	}
+	return HashToken(t.Token)
+}
+
+// Validate checks that the token is usable.
+func (t StaticToken) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("token name must not be empty")
+	}
+	if (t.Token == "") == (t.TokenSHA256 == "") {
+		return fmt.Errorf("token %q: exactly one of token and tokenSHA256 must be set", t.Name)
+	}
+	if t.TokenSHA256 != "" {
+		if b, err := hex.DecodeString(t.TokenSHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("token %q: tokenSHA256 must be a hex encoded SHA-256 digest", t.Name)
+		}
+	}
+	return nil
+}
+
+// tokenKeyPrefix is where CreateToken stores principals, keyed by token hash.
+const tokenKeyPrefix = ReservedPrefix + "auth/tokens/"
+
+// Authenticator resolves bearer tokens into principals. Static tokens are checked
+// first, then, if a store is attached, tokens kept in the reserved keyspace.
+type Authenticator struct {
+	mu     sync.RWMutex
+	static map[string]*Principal // Keyed by token hash
+	kv     *zapstore.ZapStore    // Optional keyspace token store
+}
+
+// NewAuthenticator creates an Authenticator from static tokens. kv may be nil to
+// disable keyspace tokens.
+func NewAuthenticator(tokens []StaticToken, kv *zapstore.ZapStore) (*Authenticator, error) {
+	a := &Authenticator{kv: kv}
+	if err := a.SetStaticTokens(tokens); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetStaticTokens replaces the configured tokens, e.g. after a configuration reload.
+func (a *Authenticator) SetStaticTokens(tokens []StaticToken) error {
+	static := make(map[string]*Principal, len(tokens))
+	for _, t := range tokens {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		static[t.hash()] = &Principal{Name: t.Name, Rules: t.Rules}
+	}
+
+	a.mu.Lock()
+	a.static = static
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns the principal owning token, or ErrUnauthenticated. Any other
+// error means the token could not be checked, e.g. because the keyspace is unavailable.
+func (a *Authenticator) Authenticate(token string) (*Principal, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	hash := HashToken(token)
+
+	a.mu.RLock()
+	for storedHash, principal := range a.static {
+		// Constant time comparison so response timing doesn't leak matching prefixes
+		if subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) == 1 {
+			a.mu.RUnlock()
+			return principal, nil
+		}
+	}
+	a.mu.RUnlock()
+
+	if a.kv == nil {
+		return nil, ErrUnauthenticated
+	}
+	data, err := a.kv.Get(tokenKeyPrefix + hash)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up token: %w", err)
+	}
+	var principal Principal
+	if err := json.Unmarshal([]byte(data), &principal); err != nil {
+		return nil, fmt.Errorf("corrupt token record: %w", err)
+	}
+	return &principal, nil
+}
+
+// CreateToken generates a new random token for principal and stores it in the reserved
+// keyspace. It returns the token and its id, the hash under which it is stored.
+func (a *Authenticator) CreateToken(principal Principal) (token string, id string, err error) {
+	if a.kv == nil {
+		return "", "", fmt.Errorf("keyspace tokens are disabled")
+	}
+	if principal.Name == "" {
+		return "", "", fmt.Errorf("token name must not be empty")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = hex.EncodeToString(secret)
+	id = HashToken(token)
+
+	data, err := json.Marshal(principal)
+	if err != nil {
+		return "", "", err
+	}
+	if err := a.kv.Set(tokenKeyPrefix+id, string(data)); err != nil {
+		return "", "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, id, nil
+}
+
+// RevokeToken removes a keyspace token by id.
+func (a *Authenticator) RevokeToken(id string) error {
+	if a.kv == nil {
+		return fmt.Errorf("keyspace tokens are disabled")
+	}
+	if b, err := hex.DecodeString(id); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%w %q", ErrInvalidTokenID, id)
+	}
+	return a.kv.Delete(tokenKeyPrefix + id)
+}
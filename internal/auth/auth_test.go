@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/inmem"
+	"zap-store/internal/zapstore"
+)
+
+func TestPrincipalAuthorize(t *testing.T) {
+	p := &Principal{
+		Name: "app",
+		Rules: []Rule{
+			{Prefix: "", Permission: Read},
+			{Prefix: "app/", Permission: Write},
+			{Prefix: "app/secrets/", Permission: None},
+			{Prefix: "ops/", Permission: Admin},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		perm    Permission
+		key     string
+		allowed bool
+	}{
+		{name: "read_anywhere", perm: Read, key: "other", allowed: true},
+		{name: "write_outside_prefix", perm: Write, key: "other", allowed: false},
+		{name: "write_in_prefix", perm: Write, key: "app/user1", allowed: true},
+		{name: "longest_prefix_restricts", perm: Read, key: "app/secrets/db", allowed: false},
+		{name: "admin_includes_write", perm: Write, key: "ops/flag", allowed: true},
+		{name: "reserved_needs_admin", perm: Read, key: ReservedPrefix + "auth/tokens/x", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Authorize(tt.perm, tt.key)
+			if tt.allowed && err != nil {
+				t.Errorf("Authorize(%s, %q) error = %v, want allowed", tt.perm, tt.key, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrForbidden) {
+				t.Errorf("Authorize(%s, %q) error = %v, want ErrForbidden", tt.perm, tt.key, err)
+			}
+		})
+	}
+
+	root := &Principal{Name: "root", Rules: []Rule{{Prefix: "", Permission: Admin}}}
+	if err := root.Authorize(Read, ReservedPrefix+"auth/tokens/x"); err != nil {
+		t.Errorf("Admin principal denied the reserved keyspace: %v", err)
+	}
+}
+
+func TestStaticTokens(t *testing.T) {
+	a, err := NewAuthenticator([]StaticToken{
+		{Name: "plain", Token: "s3cret", Rules: []Rule{{Prefix: "", Permission: Read}}},
+		{Name: "hashed", TokenSHA256: HashToken("hunter2"), Rules: []Rule{{Prefix: "", Permission: Write}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+
+	tests := []struct {
+		token    string
+		wantName string
+		wantErr  error
+	}{
+		{token: "s3cret", wantName: "plain"},
+		{token: "hunter2", wantName: "hashed"},
+		{token: "wrong", wantErr: ErrUnauthenticated},
+		{token: "", wantErr: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		p, err := a.Authenticate(tt.token)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Authenticate(%q) error = %v, want %v", tt.token, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.Name != tt.wantName {
+			t.Errorf("Authenticate(%q) = %q, want %q", tt.token, p.Name, tt.wantName)
+		}
+	}
+
+	// Reload replaces the previous tokens
+	if err := a.SetStaticTokens([]StaticToken{{Name: "new", Token: "fresh"}}); err != nil {
+		t.Fatalf("SetStaticTokens failed: %v", err)
+	}
+	if _, err := a.Authenticate("s3cret"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Old token still valid after reload: %v", err)
+	}
+
+	invalid := []StaticToken{
+		{Name: "", Token: "x"},
+		{Name: "both", Token: "x", TokenSHA256: HashToken("x")},
+		{Name: "neither"},
+		{Name: "badhash", TokenSHA256: "abc"},
+	}
+	for _, tok := range invalid {
+		if err := tok.Validate(); err == nil {
+			t.Errorf("StaticToken %+v validated, want error", tok)
+		}
+	}
+}
+
+func TestKeyspaceTokens(t *testing.T) {
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	a, err := NewAuthenticator(nil, kv)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+
+	token, id, err := a.CreateToken(Principal{Name: "svc", Rules: []Rule{{Prefix: "svc/", Permission: Write}}})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	// Only the hash of the token is stored
+	stored, err := kv.Get(tokenKeyPrefix + id)
+	if err != nil {
+		t.Fatalf("Token record not stored under its hash: %v", err)
+	}
+	var record Principal
+	if err := json.Unmarshal([]byte(stored), &record); err != nil || record.Name != "svc" {
+		t.Errorf("Stored record = %q (%v), want principal svc", stored, err)
+	}
+
+	p, err := a.Authenticate(token)
+	if err != nil {
+		t.Fatalf("Authenticate(created token) failed: %v", err)
+	}
+	if err := p.Authorize(Write, "svc/x"); err != nil {
+		t.Errorf("Created token cannot write its prefix: %v", err)
+	}
+
+	if err := a.RevokeToken(id); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if _, err := a.Authenticate(token); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate after revoke error = %v, want ErrUnauthenticated", err)
+	}
+	if err := a.RevokeToken("../not-an-id"); err == nil {
+		t.Errorf("RevokeToken accepted an invalid id")
+	}
+}
+
+// failingEngine fails every read with err.
+type failingEngine struct {
+	storage.StorageEngine
+	err error
+}
+
+func (e failingEngine) Get(key string) (string, error) { return "", e.err }
+
+func TestAuthenticateStorageError(t *testing.T) {
+	a, err := NewAuthenticator(nil, zapstore.NewZapStore(failingEngine{inmem.NewInMemStorageEngine(), storage.ErrNotReady}))
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+	_, err = a.Authenticate("some-token")
+	if errors.Is(err, ErrUnauthenticated) || !errors.Is(err, storage.ErrNotReady) {
+		t.Errorf("Authenticate with failing keyspace error = %v, want wrapped ErrNotReady", err)
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(`[{"prefix":"a/","permission":"write"}]`), &rules); err != nil {
+		t.Fatalf("Unmarshal rules failed: %v", err)
+	}
+	if rules[0].Permission != Write {
+		t.Errorf("Permission = %v, want write", rules[0].Permission)
+	}
+	if err := json.Unmarshal([]byte(`[{"prefix":"a/","permission":"root"}]`), &rules); err == nil {
+		t.Errorf("Unmarshal accepted unknown permission")
+	}
+}
@@ -0,0 +1,172 @@
+// Package bulk encodes streams of key/value pairs for import and export, either as
+// newline delimited JSON or in a compact length-prefixed binary form.
+package bulk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"zap-store/internal/storage"
+)
+
+// Format is a wire format for a stream of pairs.
+type Format string
+
+const (
+	// NDJSON is one {"key": ..., "value": ...} object per line.
+	NDJSON Format = "ndjson"
+	// Binary is a sequence of records, each a uvarint key length, the key, a uvarint
+	// value length and the value.
+	Binary Format = "binary"
+)
+
+// maxFieldSize bounds a single key or value in the binary format, so a corrupt length
+// cannot make the reader allocate without limit.
+const maxFieldSize = 64 << 20
+
+// ParseFormat converts "ndjson" or "binary" into a Format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case NDJSON, Binary:
+		return f, nil
+	case "":
+		return NDJSON, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (want ndjson or binary)", s)
+	}
+}
+
+// ContentType is the media type used for the format over HTTP.
+func (f Format) ContentType() string {
+	if f == Binary {
+		return "application/octet-stream"
+	}
+	return "application/x-ndjson"
+}
+
+// FormatForContentType picks the format matching a Content-Type header, NDJSON by default.
+func FormatForContentType(contentType string) Format {
+	if strings.HasPrefix(contentType, Binary.ContentType()) {
+		return Binary
+	}
+	return NDJSON
+}
+
+// Reader decodes pairs from a stream.
+type Reader struct {
+	format Format
+	r      *bufio.Reader
+	line   int // Records read so far, for error messages
+}
+
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{format: format, r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Next returns the next pair, or io.EOF once the stream is exhausted.
+func (br *Reader) Next() (storage.KeyValue, error) {
+	br.line++
+	if br.format == Binary {
+		return br.nextBinary()
+	}
+	return br.nextJSON()
+}
+
+func (br *Reader) nextJSON() (storage.KeyValue, error) {
+	for {
+		line, err := br.r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) == 0 {
+			if err != nil {
+				return storage.KeyValue{}, err // io.EOF after the last record
+			}
+			continue // Blank lines are allowed
+		}
+		if err != nil && err != io.EOF {
+			return storage.KeyValue{}, err
+		}
+
+		var record struct {
+			Key   *string `json:"key"`
+			Value *string `json:"value"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return storage.KeyValue{}, fmt.Errorf("record %d: %w", br.line, err)
+		}
+		if record.Key == nil || record.Value == nil {
+			return storage.KeyValue{}, fmt.Errorf("record %d: key and value are required", br.line)
+		}
+		return storage.KeyValue{Key: *record.Key, Value: *record.Value}, nil
+	}
+}
+
+func (br *Reader) nextBinary() (storage.KeyValue, error) {
+	key, err := br.readField()
+	if err != nil {
+		return storage.KeyValue{}, err // io.EOF between records ends the stream cleanly
+	}
+	value, err := br.readField()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return storage.KeyValue{}, fmt.Errorf("record %d: %w", br.line, err)
+	}
+	return storage.KeyValue{Key: key, Value: value}, nil
+}
+
+func (br *Reader) readField() (string, error) {
+	size, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		return "", err
+	}
+	if size > maxFieldSize {
+		return "", fmt.Errorf("record %d: field of %d bytes exceeds the %d byte limit", br.line, size, maxFieldSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br.r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", fmt.Errorf("record %d: %w", br.line, err)
+	}
+	return string(buf), nil
+}
+
+// Writer encodes pairs onto a stream. Call Flush once done.
+type Writer struct {
+	format Format
+	w      *bufio.Writer
+	enc    *json.Encoder
+}
+
+func NewWriter(w io.Writer, format Format) *Writer {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	return &Writer{format: format, w: bw, enc: enc}
+}
+
+func (bw *Writer) Write(pair storage.KeyValue) error {
+	if bw.format == Binary {
+		var size [binary.MaxVarintLen64]byte
+		for _, field := range []string{pair.Key, pair.Value} {
+			if _, err := bw.w.Write(size[:binary.PutUvarint(size[:], uint64(len(field)))]); err != nil {
+				return err
+			}
+			if _, err := bw.w.WriteString(field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return bw.enc.Encode(pair) // Encode terminates each record with a newline
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (bw *Writer) Flush() error {
+	return bw.w.Flush()
+}
@@ -0,0 +1,114 @@
+package bulk
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"zap-store/internal/storage"
+)
+
+func readAll(t *testing.T, r *Reader) ([]storage.KeyValue, error) {
+	t.Helper()
+	var pairs []storage.KeyValue
+	for {
+		pair, err := r.Next()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return pairs, err
+		}
+		pairs = append(pairs, pair)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	pairs := []storage.KeyValue{
+		{Key: "a", Value: "1"},
+		{Key: "empty", Value: ""},
+		{Key: "multi\nline", Value: "tab\tand <html> & \"quotes\""},
+		{Key: "你好", Value: string([]byte{0, 1, 2, 255})},
+	}
+
+	for _, format := range []Format{NDJSON, Binary} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, format)
+			for _, pair := range pairs {
+				if err := w.Write(pair); err != nil {
+					t.Fatalf("Write(%+v) failed: %v", pair, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+
+			got, err := readAll(t, NewReader(&buf, format))
+			if err != nil {
+				t.Fatalf("Reading back failed: %v", err)
+			}
+			if len(got) != len(pairs) {
+				t.Fatalf("Read %d pairs, want %d", len(got), len(pairs))
+			}
+			for i := range pairs {
+				// Invalid UTF-8 is replaced in JSON, so only compare it in binary form
+				if format == NDJSON && i == 3 {
+					continue
+				}
+				if got[i] != pairs[i] {
+					t.Errorf("Pair %d = %+v, want %+v", i, got[i], pairs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     Format
+		input      string
+		wantPairs  int
+		wantErrMsg string
+	}{
+		{name: "ndjson_blank_lines", format: NDJSON, input: "\n{\"key\":\"a\",\"value\":\"1\"}\n\n{\"key\":\"b\",\"value\":\"2\"}", wantPairs: 2},
+		{name: "ndjson_missing_value", format: NDJSON, input: `{"key":"a"}`, wantErrMsg: "record 1: key and value are required"},
+		{name: "ndjson_bad_json", format: NDJSON, input: "{\"key\":\"a\",\"value\":\"1\"}\nnot json\n", wantPairs: 1, wantErrMsg: "record 2"},
+		{name: "binary_truncated", format: Binary, input: "\x01a\x05ab", wantErrMsg: io.ErrUnexpectedEOF.Error()},
+		{name: "binary_huge_field", format: Binary, input: "\xff\xff\xff\xff\x0f", wantErrMsg: "exceeds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, err := readAll(t, NewReader(strings.NewReader(tt.input), tt.format))
+			if len(pairs) != tt.wantPairs {
+				t.Errorf("Read %d pairs, want %d", len(pairs), tt.wantPairs)
+			}
+			if tt.wantErrMsg == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("Error = %v, want error containing %q", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("BINARY"); err != nil || f != Binary {
+		t.Errorf("ParseFormat(%q) = %q, %v, want %q, nil", "BINARY", f, err, Binary)
+	}
+	if f, err := ParseFormat(""); err != nil || f != NDJSON {
+		t.Errorf("ParseFormat(%q) = %q, %v, want %q, nil", "", f, err, NDJSON)
+	}
+	if _, err := ParseFormat("csv"); err == nil {
+		t.Errorf("ParseFormat(%q) succeeded, want error", "csv")
+	}
+	if got := FormatForContentType("application/octet-stream"); got != Binary {
+		t.Errorf("FormatForContentType(octet-stream) = %q, want %q", got, Binary)
+	}
+}
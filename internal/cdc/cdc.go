@@ -0,0 +1,196 @@
+// Package cdc moves changes read from a storage engine's change log into sinks: a
+// local file that remembers where to resume from, or any stream such as an HTTP
+// response. Changes are written as newline delimited JSON, one storage.Change per line.
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"zap-store/internal/storage"
+)
+
+// Sink receives changes. Writes may be buffered until Flush.
+type Sink interface {
+	Write(change storage.Change) error
+	Flush() error
+}
+
+// Copy writes every change src returns to dst until ctx ends or either fails. dst is
+// flushed whenever Copy has caught up with the log, and every idle interval while it
+// waits for more, so sinks can keep connections alive.
+func Copy(ctx context.Context, dst Sink, src storage.ChangeReader, idle time.Duration) error {
+	// A cancelled context makes Next return what is already there without waiting
+	now, cancel := context.WithCancel(ctx)
+	cancel()
+
+	for {
+		change, err := src.Next(now)
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			if err := dst.Flush(); err != nil {
+				return err
+			}
+			waitCtx, cancel := context.WithTimeout(ctx, idle)
+			change, err = src.Next(waitCtx)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.Write(change); err != nil {
+			return err
+		}
+	}
+}
+
+// StreamSink writes changes to a stream such as an HTTP response or stdout.
+type StreamSink struct {
+	w         *bufio.Writer
+	enc       *json.Encoder
+	flush     func() error // Pushes flushed bytes on to the client, may be nil
+	keepalive bool
+	written   bool // Whether anything was written since the last Flush
+}
+
+// NewStreamSink returns a sink writing to w. After each Flush it calls flush, if not
+// nil. With keepalive, a Flush with nothing to send writes an empty line instead, so
+// idle connections are not dropped by proxies; readers should skip empty lines.
+func NewStreamSink(w io.Writer, flush func() error, keepalive bool) *StreamSink {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	return &StreamSink{w: bw, enc: enc, flush: flush, keepalive: keepalive}
+}
+
+func (s *StreamSink) Write(change storage.Change) error {
+	s.written = true
+	return s.enc.Encode(change)
+}
+
+func (s *StreamSink) Flush() error {
+	if !s.written && s.keepalive {
+		if err := s.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	s.written = false
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.flush != nil {
+		return s.flush()
+	}
+	return nil
+}
+
+// FileSink appends changes to a file and fsyncs them on Flush. Every line records the
+// position after its change, so a restarted consumer resumes from the last line.
+type FileSink struct {
+	file    *os.File
+	stream  *StreamSink
+	pos     storage.LogPosition
+	pending bool
+}
+
+// OpenFileSink opens or creates the file at path for appending. A partial last line,
+// left by a crash in the middle of a write, is cut off.
+func OpenFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change file: %w", err)
+	}
+	pos, end, err := lastPosition(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to recover change file %s: %w", path, err)
+	}
+	return &FileSink{file: file, stream: NewStreamSink(file, nil, false), pos: pos}, nil
+}
+
+// lastPosition returns the Next position of the last complete line of f, or the zero
+// position if there is none, and the offset where that line ends.
+func lastPosition(f *os.File) (storage.LogPosition, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return storage.LogPosition{}, 0, err
+	}
+
+	// Read backwards until the buffer holds the last complete line
+	const chunkSize = 64 << 10
+	var buf []byte
+	start := info.Size()
+	for start > 0 {
+		size := min(chunkSize, start)
+		start -= size
+		chunk := make([]byte, size)
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return storage.LogPosition{}, 0, err
+		}
+		buf = append(chunk, buf...)
+
+		end := bytes.LastIndexByte(buf, '\n')
+		if end < 0 {
+			continue
+		}
+		lineStart := bytes.LastIndexByte(buf[:end], '\n') + 1
+		if lineStart == 0 && start > 0 {
+			continue // The line may begin in an earlier chunk
+		}
+		var change storage.Change
+		if err := json.Unmarshal(buf[lineStart:end], &change); err != nil {
+			return storage.LogPosition{}, 0, fmt.Errorf("last line: %w", err)
+		}
+		return change.Next, start + int64(end) + 1, nil
+	}
+	return storage.LogPosition{}, 0, nil
+}
+
+// Position returns where to resume tailing from: after the last change written.
+func (s *FileSink) Position() storage.LogPosition {
+	return s.pos
+}
+
+func (s *FileSink) Write(change storage.Change) error {
+	if err := s.stream.Write(change); err != nil {
+		return err
+	}
+	s.pos = change.Next
+	s.pending = true
+	return nil
+}
+
+// Flush writes buffered changes to the file and fsyncs it.
+func (s *FileSink) Flush() error {
+	if !s.pending {
+		return nil
+	}
+	if err := s.stream.Flush(); err != nil {
+		return err
+	}
+	s.pending = false
+	return s.file.Sync()
+}
+
+// Close flushes and closes the file.
+func (s *FileSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
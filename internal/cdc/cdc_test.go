@@ -0,0 +1,99 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zap-store/internal/storage"
+)
+
+// sliceReader returns a fixed list of changes, then waits like a caught up tailer.
+type sliceReader struct {
+	changes []storage.Change
+}
+
+func (r *sliceReader) Next(ctx context.Context) (storage.Change, error) {
+	if len(r.changes) > 0 {
+		change := r.changes[0]
+		r.changes = r.changes[1:]
+		return change, nil
+	}
+	<-ctx.Done()
+	return storage.Change{}, ctx.Err()
+}
+
+func (r *sliceReader) Close() error { return nil }
+
+func changeAt(key string, offset int64) storage.Change {
+	return storage.Change{
+		Type:  storage.ChangeSet,
+		Key:   key,
+		Value: "v",
+		At:    storage.LogPosition{FileID: 1, Offset: offset},
+		Next:  storage.LogPosition{FileID: 1, Offset: offset + 10},
+	}
+}
+
+func TestFileSinkResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.ndjson")
+	sink, err := OpenFileSink(path)
+	if err != nil {
+		t.Fatalf("OpenFileSink failed: %v", err)
+	}
+	if pos := sink.Position(); pos != (storage.LogPosition{}) {
+		t.Errorf("Position() of a new file = %+v, want the zero position", pos)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	src := &sliceReader{changes: []storage.Change{changeAt("a", 0), changeAt("b", 10)}}
+	if err := Copy(ctx, sink, src, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Copy() = %v, want context.DeadlineExceeded", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Simulate a crash half way through writing a third line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"type":"set","key":"c"`)
+	f.Close()
+
+	sink, err = OpenFileSink(path)
+	if err != nil {
+		t.Fatalf("Reopening the sink failed: %v", err)
+	}
+	if want := (storage.LogPosition{FileID: 1, Offset: 20}); sink.Position() != want {
+		t.Errorf("Position() after reopening = %+v, want %+v", sink.Position(), want)
+	}
+	sink.Write(changeAt("c", 20))
+	sink.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], `{"type":"set","key":"c","value"`) {
+		t.Errorf("File holds %q, want three complete lines", data)
+	}
+}
+
+func TestStreamSinkKeepalive(t *testing.T) {
+	var buf bytes.Buffer
+	flushes := 0
+	sink := NewStreamSink(&buf, func() error { flushes++; return nil }, true)
+
+	sink.Write(changeAt("a", 0))
+	sink.Flush()
+	sink.Flush() // Nothing new: an empty line keeps the connection busy
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 3 || lines[1] != "" || !strings.Contains(lines[0], `"key":"a"`) {
+		t.Errorf("Stream = %q, want a change and then an empty line", buf.String())
+	}
+	if flushes != 2 {
+		t.Errorf("flush called %d times, want 2", flushes)
+	}
+}
@@ -0,0 +1,539 @@
+// Package config loads the zapstore-server configuration from a JSON, TOML or YAML file and
+// ZAPSTORE_* environment variables, and validates it before the server starts.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/logging"
+)
+
+// Duration is a time.Duration that reads and writes as a Go duration string ("30s", "5m").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	Server      ServerConfig      `json:"server"`
+	Engine      EngineConfig      `json:"engine"`
+	Auth        AuthConfig        `json:"auth"`
+	Log         LogConfig         `json:"log"`
+	Replication ReplicationConfig `json:"replication"`
+	Watch       WatchConfig       `json:"watch"`
+	Raft        RaftConfig        `json:"raft"`
+}
+
+type ServerConfig struct {
+	Addr string    `json:"addr"` // Listen address, e.g. ":8080"
+	TLS  TLSConfig `json:"tls"`
+}
+
+type LogConfig struct {
+	File          string   `json:"file"`          // Log file path, empty to log to stderr only
+	Format        string   `json:"format"`        // "text" or "json"
+	Level         string   `json:"level"`         // "debug", "info", "warn" or "error"
+	MaxSize       int64    `json:"maxSize"`       // Bytes before the log file rotates, 0 disables rotation
+	MaxBackups    int      `json:"maxBackups"`    // Rotated files to keep
+	SlowThreshold Duration `json:"slowThreshold"` // Requests and engine operations slower than this are logged, 0 disables
+}
+
+type TLSConfig struct {
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"` // CA bundle used to verify client certificates
+	ClientAuth   string `json:"clientAuth"`   // "none", "request" or "require"
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type AuthConfig struct {
+	Enabled  bool               `json:"enabled"`  // Require a bearer token on every request
+	Keyspace bool               `json:"keyspace"` // Also accept tokens stored in the reserved keyspace
+	Tokens   []auth.StaticToken `json:"tokens"`
+}
+
+// ReplicationConfig makes the server a read-only follower of another zapstore-server.
+type ReplicationConfig struct {
+	Leader   string `json:"leader"`   // Base URL of the leader, empty for a standalone server
+	Token    string `json:"token"`    // Bearer token with admin rights on the leader
+	CAFile   string `json:"caFile"`   // CA bundle to trust for an https leader, on top of the system roots
+	CertFile string `json:"certFile"` // Client certificate for leaders requiring mTLS
+	KeyFile  string `json:"keyFile"`
+}
+
+// RaftConfig makes the server a member of a Raft group. Members are named by the base
+// URL the others reach them at, and exchange messages over HTTP.
+type RaftConfig struct {
+	ID              string   `json:"id"`              // This member's base URL, e.g. "https://10.0.0.1:8443"; empty disables Raft
+	Members         []string `json:"members"`         // Base URLs of the members of a new group, id included; empty to join an existing group
+	DataDir         string   `json:"dataDir"`         // Where the log and votes are kept, by default the "raft" directory of engine.dataDir
+	ReadConsistency string   `json:"readConsistency"` // "stale" or "linearizable"
+	Token           string   `json:"token"`           // Bearer token sent to the other members, with admin rights there
+	CAFile          string   `json:"caFile"`          // CA bundle to trust for https members, on top of the system roots
+	CertFile        string   `json:"certFile"`        // Client certificate for members requiring mTLS
+	KeyFile         string   `json:"keyFile"`
+}
+
+// Enabled reports whether the server should join a Raft group.
+func (c RaftConfig) Enabled() bool {
+	return c.ID != ""
+}
+
+// WatchConfig bounds the changes kept in memory for watchers to resume from. They are
+// kept only while a watch is open, and for RetainIdle after the last one ends.
+type WatchConfig struct {
+	RetainEvents int      `json:"retainEvents"` // Most changes kept
+	RetainBytes  int64    `json:"retainBytes"`  // Most bytes of keys and values kept
+	RetainIdle   Duration `json:"retainIdle"`   // How long changes are kept once no watch is open
+}
+
+type EngineConfig struct {
+	Name    string        `json:"name"`    // "inmem", "bitcask", "lsm" or "btree"
+	DataDir string        `json:"dataDir"` // Required for bitcask, lsm and btree
+	Bitcask BitcaskConfig `json:"bitcask"`
+	LSM     LSMConfig     `json:"lsm"`
+	BTree   BTreeConfig   `json:"btree"`
+}
+
+type BitcaskConfig struct {
+	MaxFileSize   int64    `json:"maxFileSize"`   // Bytes before the active log rotates, 0 disables rotation
+	Sync          string   `json:"sync"`          // "never", "always" or "interval"
+	SyncInterval  Duration `json:"syncInterval"`  // Used with sync "interval"
+	MergeInterval Duration `json:"mergeInterval"` // 0 disables scheduled merges
+}
+
+type LSMConfig struct {
+	MemtableSize int64  `json:"memtableSize"` // Bytes of writes held in memory before they are flushed to a table
+	Compaction   string `json:"compaction"`   // "leveled" or "tiered"
+	SyncWrites   bool   `json:"syncWrites"`   // Fsync the write-ahead log after every write
+}
+
+type BTreeConfig struct {
+	PageSize  int  `json:"pageSize"`  // Bytes per page of a new file; an existing file keeps its own
+	CacheSize int  `json:"cacheSize"` // Pages kept in the buffer pool
+	NoSync    bool `json:"noSync"`    // Skip the fsyncs of every commit
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr: ":8080",
+		},
+		Log: LogConfig{
+			Format:        "text",
+			Level:         "info",
+			MaxSize:       100 << 20,
+			MaxBackups:    3,
+			SlowThreshold: Duration(500 * time.Millisecond),
+		},
+		Engine: EngineConfig{
+			Name: "inmem",
+			Bitcask: BitcaskConfig{
+				MaxFileSize:  64 << 20,
+				Sync:         "never",
+				SyncInterval: Duration(time.Second),
+			},
+			LSM: LSMConfig{
+				MemtableSize: 4 << 20,
+				Compaction:   "leveled",
+			},
+			BTree: BTreeConfig{
+				PageSize:  4096,
+				CacheSize: 2048,
+			},
+		},
+		Watch: WatchConfig{
+			RetainEvents: 10000,
+			RetainBytes:  64 << 20,
+			RetainIdle:   Duration(time.Minute),
+		},
+	}
+}
+
+// Load builds a configuration from the defaults, the file at path (skipped when
+// path is empty) and the ZAPSTORE_* environment, in that order of precedence. The
+// result is not validated; call Validate once any flag overrides have been applied.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads a TOML file if path ends in .toml, a YAML one if it ends in .yaml or
+// .yml, and JSON otherwise. TOML and YAML are decoded into the same JSON fields, so all
+// formats name and check settings alike. Only the subsets of TOML and YAML described
+// at parseTOML and parseYAML are read; anything else fails, naming its line.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var parse func([]byte) (map[string]any, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		parse = parseTOML
+	case ".yaml", ".yml":
+		parse = parseYAML
+	}
+	if parse != nil {
+		doc, err := parse(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envVar maps a ZAPSTORE_* environment variable onto a configuration field.
+type envVar struct {
+	name string
+	set  func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = Duration(d)
+		return nil
+	}
+}
+
+func setInt64(field func(c *Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// setList splits a comma-separated value, dropping empty items.
+func setList(field func(c *Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+var envVars = []envVar{
+	{"ZAPSTORE_ADDR", setString(func(c *Config) *string { return &c.Server.Addr })},
+	{"ZAPSTORE_TLS_CERT_FILE", setString(func(c *Config) *string { return &c.Server.TLS.CertFile })},
+	{"ZAPSTORE_TLS_KEY_FILE", setString(func(c *Config) *string { return &c.Server.TLS.KeyFile })},
+	{"ZAPSTORE_TLS_CLIENT_CA_FILE", setString(func(c *Config) *string { return &c.Server.TLS.ClientCAFile })},
+	{"ZAPSTORE_TLS_CLIENT_AUTH", setString(func(c *Config) *string { return &c.Server.TLS.ClientAuth })},
+	{"ZAPSTORE_ENGINE", setString(func(c *Config) *string { return &c.Engine.Name })},
+	{"ZAPSTORE_DATA_DIR", setString(func(c *Config) *string { return &c.Engine.DataDir })},
+	{"ZAPSTORE_BITCASK_MAX_FILE_SIZE", setInt64(func(c *Config) *int64 { return &c.Engine.Bitcask.MaxFileSize })},
+	{"ZAPSTORE_BITCASK_SYNC", setString(func(c *Config) *string { return &c.Engine.Bitcask.Sync })},
+	{"ZAPSTORE_BITCASK_SYNC_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Engine.Bitcask.SyncInterval })},
+	{"ZAPSTORE_BITCASK_MERGE_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Engine.Bitcask.MergeInterval })},
+	{"ZAPSTORE_LSM_MEMTABLE_SIZE", setInt64(func(c *Config) *int64 { return &c.Engine.LSM.MemtableSize })},
+	{"ZAPSTORE_LSM_COMPACTION", setString(func(c *Config) *string { return &c.Engine.LSM.Compaction })},
+	{"ZAPSTORE_LSM_SYNC_WRITES", setBool(func(c *Config) *bool { return &c.Engine.LSM.SyncWrites })},
+	{"ZAPSTORE_BTREE_PAGE_SIZE", setInt(func(c *Config) *int { return &c.Engine.BTree.PageSize })},
+	{"ZAPSTORE_BTREE_CACHE_SIZE", setInt(func(c *Config) *int { return &c.Engine.BTree.CacheSize })},
+	{"ZAPSTORE_BTREE_NO_SYNC", setBool(func(c *Config) *bool { return &c.Engine.BTree.NoSync })},
+	{"ZAPSTORE_AUTH_ENABLED", setBool(func(c *Config) *bool { return &c.Auth.Enabled })},
+	{"ZAPSTORE_AUTH_KEYSPACE", setBool(func(c *Config) *bool { return &c.Auth.Keyspace })},
+	{"ZAPSTORE_LOG_FILE", setString(func(c *Config) *string { return &c.Log.File })},
+	{"ZAPSTORE_LOG_FORMAT", setString(func(c *Config) *string { return &c.Log.Format })},
+	{"ZAPSTORE_LOG_LEVEL", setString(func(c *Config) *string { return &c.Log.Level })},
+	{"ZAPSTORE_LOG_MAX_SIZE", setInt64(func(c *Config) *int64 { return &c.Log.MaxSize })},
+	{"ZAPSTORE_LOG_MAX_BACKUPS", setInt(func(c *Config) *int { return &c.Log.MaxBackups })},
+	{"ZAPSTORE_LOG_SLOW_THRESHOLD", setDuration(func(c *Config) *Duration { return &c.Log.SlowThreshold })},
+	{"ZAPSTORE_REPLICATION_LEADER", setString(func(c *Config) *string { return &c.Replication.Leader })},
+	{"ZAPSTORE_REPLICATION_TOKEN", setString(func(c *Config) *string { return &c.Replication.Token })},
+	{"ZAPSTORE_REPLICATION_CA_FILE", setString(func(c *Config) *string { return &c.Replication.CAFile })},
+	{"ZAPSTORE_REPLICATION_CERT_FILE", setString(func(c *Config) *string { return &c.Replication.CertFile })},
+	{"ZAPSTORE_REPLICATION_KEY_FILE", setString(func(c *Config) *string { return &c.Replication.KeyFile })},
+	{"ZAPSTORE_RAFT_ID", setString(func(c *Config) *string { return &c.Raft.ID })},
+	{"ZAPSTORE_RAFT_MEMBERS", setList(func(c *Config) *[]string { return &c.Raft.Members })},
+	{"ZAPSTORE_RAFT_DATA_DIR", setString(func(c *Config) *string { return &c.Raft.DataDir })},
+	{"ZAPSTORE_RAFT_READ_CONSISTENCY", setString(func(c *Config) *string { return &c.Raft.ReadConsistency })},
+	{"ZAPSTORE_RAFT_TOKEN", setString(func(c *Config) *string { return &c.Raft.Token })},
+	{"ZAPSTORE_RAFT_CA_FILE", setString(func(c *Config) *string { return &c.Raft.CAFile })},
+	{"ZAPSTORE_RAFT_CERT_FILE", setString(func(c *Config) *string { return &c.Raft.CertFile })},
+	{"ZAPSTORE_RAFT_KEY_FILE", setString(func(c *Config) *string { return &c.Raft.KeyFile })},
+	{"ZAPSTORE_WATCH_RETAIN_EVENTS", setInt(func(c *Config) *int { return &c.Watch.RetainEvents })},
+	{"ZAPSTORE_WATCH_RETAIN_BYTES", setInt64(func(c *Config) *int64 { return &c.Watch.RetainBytes })},
+	{"ZAPSTORE_WATCH_RETAIN_IDLE", setDuration(func(c *Config) *Duration { return &c.Watch.RetainIdle })},
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, v := range envVars {
+		value, ok := lookup(v.name)
+		if !ok {
+			continue
+		}
+		if err := v.set(c, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the configuration and reports every problem found, one per line.
+func (c Config) Validate() error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Server.Addr == "" {
+		addErr("server.addr: must not be empty")
+	}
+	if c.Server.TLS.Enabled() {
+		if c.Server.TLS.CertFile == "" || c.Server.TLS.KeyFile == "" {
+			addErr("server.tls: certFile and keyFile must be set together")
+		}
+		switch strings.ToLower(c.Server.TLS.ClientAuth) {
+		case "", "none", "request":
+		case "require":
+			if c.Server.TLS.ClientCAFile == "" {
+				addErr("server.tls.clientCAFile: required when clientAuth is require")
+			}
+		default:
+			addErr("server.tls.clientAuth: unknown mode %q (want none, request or require)", c.Server.TLS.ClientAuth)
+		}
+		for _, file := range []string{c.Server.TLS.CertFile, c.Server.TLS.KeyFile, c.Server.TLS.ClientCAFile} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				addErr("server.tls: %v", err)
+			}
+		}
+	}
+
+	switch c.Engine.Name {
+	case "inmem":
+	case "bitcask", "lsm", "btree":
+		if c.Engine.DataDir == "" {
+			addErr("engine.dataDir: required when engine.name is %s", c.Engine.Name)
+		}
+	default:
+		addErr("engine.name: unknown storage engine %q (want inmem, bitcask, lsm or btree)", c.Engine.Name)
+	}
+
+	b := c.Engine.Bitcask
+	if b.MaxFileSize < 0 {
+		addErr("engine.bitcask.maxFileSize: must not be negative (got %d)", b.MaxFileSize)
+	}
+	switch strings.ToLower(b.Sync) {
+	case "", "never", "always":
+	case "interval":
+		if b.SyncInterval <= 0 {
+			addErr("engine.bitcask.syncInterval: must be positive when sync is interval")
+		}
+	default:
+		addErr("engine.bitcask.sync: unknown policy %q (want never, always or interval)", b.Sync)
+	}
+	if b.MergeInterval < 0 {
+		addErr("engine.bitcask.mergeInterval: must not be negative")
+	}
+
+	l := c.Engine.LSM
+	if l.MemtableSize <= 0 {
+		addErr("engine.lsm.memtableSize: must be positive (got %d)", l.MemtableSize)
+	}
+	switch strings.ToLower(l.Compaction) {
+	case "", "leveled", "tiered":
+	default:
+		addErr("engine.lsm.compaction: unknown style %q (want leveled or tiered)", l.Compaction)
+	}
+
+	bt := c.Engine.BTree
+	if bt.PageSize < 512 || bt.PageSize > 64<<10 || bt.PageSize&(bt.PageSize-1) != 0 {
+		addErr("engine.btree.pageSize: must be a power of two from 512 to 65536 (got %d)", bt.PageSize)
+	}
+	if bt.CacheSize <= 0 {
+		addErr("engine.btree.cacheSize: must be positive (got %d)", bt.CacheSize)
+	}
+
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		addErr("log.format: unknown format %q (want text or json)", c.Log.Format)
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		addErr("log.level: %v", err)
+	}
+	if c.Log.MaxSize < 0 {
+		addErr("log.maxSize: must not be negative (got %d)", c.Log.MaxSize)
+	}
+	if c.Log.MaxBackups < 0 {
+		addErr("log.maxBackups: must not be negative (got %d)", c.Log.MaxBackups)
+	}
+	if c.Log.SlowThreshold < 0 {
+		addErr("log.slowThreshold: must not be negative")
+	}
+
+	if r := c.Replication; r.Leader != "" {
+		if u, err := url.Parse(r.Leader); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addErr("replication.leader: %q is not an http:// or https:// URL", r.Leader)
+		}
+		if (r.CertFile == "") != (r.KeyFile == "") {
+			addErr("replication: certFile and keyFile must be set together")
+		}
+		for _, file := range []string{r.CAFile, r.CertFile, r.KeyFile} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				addErr("replication: %v", err)
+			}
+		}
+	}
+
+	if r := c.Raft; r.Enabled() {
+		validURL := func(s string) bool {
+			u, err := url.Parse(s)
+			return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		}
+		if !validURL(r.ID) {
+			addErr("raft.id: %q is not an http:// or https:// URL", r.ID)
+		}
+		for _, member := range r.Members {
+			if !validURL(member) {
+				addErr("raft.members: %q is not an http:// or https:// URL", member)
+			}
+		}
+		if len(r.Members) > 0 && !slices.Contains(r.Members, r.ID) {
+			addErr("raft.members: must include raft.id %q", r.ID)
+		}
+		if r.DataDir == "" && c.Engine.DataDir == "" {
+			addErr("raft.dataDir: required when engine.dataDir is not set")
+		}
+		switch strings.ToLower(r.ReadConsistency) {
+		case "", "stale", "linearizable":
+		default:
+			addErr("raft.readConsistency: unknown consistency %q (want stale or linearizable)", r.ReadConsistency)
+		}
+		if (r.CertFile == "") != (r.KeyFile == "") {
+			addErr("raft: certFile and keyFile must be set together")
+		}
+		for _, file := range []string{r.CAFile, r.CertFile, r.KeyFile} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				addErr("raft: %v", err)
+			}
+		}
+		if c.Replication.Leader != "" {
+			addErr("raft: a Raft member cannot also follow replication.leader")
+		}
+	}
+
+	if c.Watch.RetainEvents <= 0 {
+		addErr("watch.retainEvents: must be positive (got %d)", c.Watch.RetainEvents)
+	}
+	if c.Watch.RetainBytes < 0 {
+		addErr("watch.retainBytes: must not be negative (got %d)", c.Watch.RetainBytes)
+	}
+	if c.Watch.RetainIdle < 0 {
+		addErr("watch.retainIdle: must not be negative")
+	}
+
+	if c.Auth.Enabled && len(c.Auth.Tokens) == 0 {
+		addErr("auth.tokens: at least one token is required when auth is enabled")
+	}
+	names := make(map[string]bool)
+	for i, token := range c.Auth.Tokens {
+		if err := token.Validate(); err != nil {
+			addErr("auth.tokens[%d]: %v", i, err)
+		}
+		if names[token.Name] {
+			addErr("auth.tokens[%d]: duplicate token name %q", i, token.Name)
+		}
+		names[token.Name] = true
+	}
+
+	return errors.Join(errs...)
+}
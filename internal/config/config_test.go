@@ -0,0 +1,490 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"zap-store/internal/auth"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zapstore.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"server": {"addr": ":9090"},
+		"auth": {"enabled": true, "tokens": [{"name": "ci", "token": "t0k3n", "rules": [{"prefix": "ci/", "permission": "write"}]}]},
+		"engine": {
+			"name": "bitcask",
+			"dataDir": "/tmp/zap",
+			"bitcask": {"sync": "interval", "syncInterval": "250ms", "mergeInterval": "1h"}
+		}
+	}`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load(%q) error = %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	if cfg.Server.Addr != ":9090" {
+		t.Errorf("Server.Addr = %q, want %q", cfg.Server.Addr, ":9090")
+	}
+	if cfg.Engine.Name != "bitcask" || cfg.Engine.DataDir != "/tmp/zap" {
+		t.Errorf("Engine = %+v, want bitcask at /tmp/zap", cfg.Engine)
+	}
+	if got := time.Duration(cfg.Engine.Bitcask.SyncInterval); got != 250*time.Millisecond {
+		t.Errorf("SyncInterval = %v, want 250ms", got)
+	}
+	if got := time.Duration(cfg.Engine.Bitcask.MergeInterval); got != time.Hour {
+		t.Errorf("MergeInterval = %v, want 1h", got)
+	}
+	if len(cfg.Auth.Tokens) != 1 || cfg.Auth.Tokens[0].Rules[0].Permission != auth.Write {
+		t.Errorf("Auth.Tokens = %+v, want one token with write on ci/", cfg.Auth.Tokens)
+	}
+	// Fields missing from the file keep their defaults
+	if cfg.Engine.Bitcask.MaxFileSize != Default().Engine.Bitcask.MaxFileSize {
+		t.Errorf("MaxFileSize = %d, want default %d", cfg.Engine.Bitcask.MaxFileSize, Default().Engine.Bitcask.MaxFileSize)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		contents   string
+		wantErrMsg string
+	}{
+		{name: "unknown_field", contents: `{"server": {"port": 8080}}`, wantErrMsg: "unknown field"},
+		{name: "bad_duration", contents: `{"engine": {"bitcask": {"mergeInterval": "soon"}}}`, wantErrMsg: "invalid duration"},
+		{name: "not_json", contents: `addr = ":8080"`, wantErrMsg: "failed to parse config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("Load() error = %v, want error containing %q", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func writeTOMLFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zapstore.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// TestLoadFileTOML loads the same settings from JSON and TOML and compares the results.
+func TestLoadFileTOML(t *testing.T) {
+	want, err := Load(writeConfigFile(t, `{
+		"server": {"addr": ":9090", "tls": {"certFile": "a \"b\".crt", "keyFile": "c:\\d.key"}},
+		"engine": {
+			"name": "bitcask",
+			"dataDir": "/tmp/zap",
+			"bitcask": {"maxFileSize": 1000000, "sync": "interval", "syncInterval": "250ms", "mergeInterval": "1h"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Load(JSON) error = %v", err)
+	}
+
+	got, err := Load(writeTOMLFile(t, `
+# zapstore-server
+[server]
+addr = ":9090" # trailing comment
+tls = { certFile = "a \"b\".crt", 'keyFile' = 'c:\d.key' }
+
+[engine]
+name = "bitcask"
+"dataDir" = "/tmp/zap"
+bitcask.maxFileSize = 1_000_000
+
+[engine.bitcask]
+sync = "interval"
+syncInterval = "250ms"
+mergeInterval = "1h"
+`))
+	if err != nil {
+		t.Fatalf("Load(TOML) error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load(TOML) = %+v, want the JSON config %+v", got, want)
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	got, err := parseTOML([]byte(`
+n = 0x10
+f = -1.5e3
+[[tokens]]
+name = "ci"
+rules = [
+  { prefix = "ci/", permission = "write" },
+  { prefix = "", permission = "read" }, # trailing comma
+]
+[tokens.meta]
+owner = "ops"
+
+[[tokens]]
+name = "ops"
+rules = []
+[tokens.meta]
+owner = "sre"
+`))
+	if err != nil {
+		t.Fatalf("parseTOML() error = %v", err)
+	}
+	want := map[string]any{
+		"n": int64(16),
+		"f": -1500.0,
+		"tokens": []any{
+			map[string]any{
+				"name": "ci",
+				"rules": []any{
+					map[string]any{"prefix": "ci/", "permission": "write"},
+					map[string]any{"prefix": "", "permission": "read"},
+				},
+				"meta": map[string]any{"owner": "ops"},
+			},
+			map[string]any{"name": "ops", "rules": []any{}, "meta": map[string]any{"owner": "sre"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTOML() = %#v, want %#v", got, want)
+	}
+}
+
+func TestLoadFileTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		contents   string
+		wantErrMsg string
+	}{
+		{name: "unknown_field", contents: "[server]\nport = 8080", wantErrMsg: "unknown field"},
+		{name: "wrong_type", contents: "[server]\naddr = 8080", wantErrMsg: "cannot unmarshal number"},
+		{name: "bad_duration", contents: "[engine.bitcask]\nmergeInterval = \"soon\"", wantErrMsg: "invalid duration"},
+		{name: "duplicate_key", contents: "[server]\naddr = \":1\"\naddr = \":2\"", wantErrMsg: "line 3: key addr defined twice"},
+		{name: "duplicate_table", contents: "[server]\n[engine]\n[server]", wantErrMsg: "line 3: table [server] defined twice"},
+		{name: "value_as_table", contents: "[server]\naddr = \":1\"\n[server.addr]", wantErrMsg: "line 3: key server.addr is a value, not a table"},
+		{name: "missing_value", contents: "[server]\naddr =\n", wantErrMsg: "line 2: missing value"},
+		{name: "unterminated_string", contents: "[server]\naddr = \":1\n", wantErrMsg: "line 2: unterminated string"},
+		{name: "multiline_string", contents: "[server]\naddr = \"\"\"\n:1\"\"\"", wantErrMsg: "line 2: multi-line strings are not supported"},
+		{name: "bad_escape", contents: `a = "\q"`, wantErrMsg: `line 1: invalid escape \q`},
+		{name: "date", contents: "\na = 1979-05-27", wantErrMsg: "line 2: invalid value \"1979-05-27\" (dates are not supported)"},
+		{name: "leading_zero", contents: "a = 012", wantErrMsg: "line 1: invalid number \"012\""},
+		{name: "two_values", contents: "a = 1 2", wantErrMsg: "line 1: unexpected '2' after value"},
+		{name: "unclosed_array", contents: "a = [1, 2", wantErrMsg: "line 1: expected ',' or ']'"},
+		{name: "unclosed_header", contents: "[server", wantErrMsg: "line 1: expected ']'"},
+		{name: "no_key", contents: "= 1", wantErrMsg: "line 1: expected a key"},
+		{name: "invalid_utf8", contents: "a = 1\nb = \"\xff\"", wantErrMsg: "line 2: TOML must be valid UTF-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeTOMLFile(t, tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("Load() error = %v, want error containing %q", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func writeYAMLFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// TestLoadFileYAML loads the same settings from JSON and YAML and compares the results.
+func TestLoadFileYAML(t *testing.T) {
+	want, err := Load(writeConfigFile(t, `{
+		"server": {"addr": ":9090", "tls": {"certFile": "a \"b\".crt", "keyFile": "c:\\d.key #1"}},
+		"engine": {
+			"name": "bitcask",
+			"dataDir": "/tmp/zap",
+			"bitcask": {"maxFileSize": 1000000, "sync": "interval", "syncInterval": "250ms", "mergeInterval": "1h"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Load(JSON) error = %v", err)
+	}
+
+	for _, name := range []string{"zapstore.yaml", "zapstore.YML"} {
+		got, err := Load(writeYAMLFile(t, name, `
+# zapstore-server
+---
+server:
+  addr: ":9090" # trailing comment
+  tls: {certFile: 'a "b".crt', keyFile: "c:\\d.key #1"}
+
+engine:
+  name: bitcask
+  "dataDir": /tmp/zap
+  bitcask:
+    maxFileSize: 1000000
+    sync: interval
+    syncInterval: 250ms
+    mergeInterval: 1h
+...
+`))
+		if err != nil {
+			t.Fatalf("Load(%s) error = %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Load(%s) = %+v, want the JSON config %+v", name, got, want)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	got, err := parseYAML([]byte(`
+n: 0x10
+f: -1.5e3
+b: True
+none:
+members: [http://a:1, "http://b:2",]
+tokens:
+- name: ci
+  rules:
+    - {prefix: ci/, permission: write}
+    - prefix: ""
+      permission: read
+- name: 'ops #1'
+  rules: []
+nested:
+  -
+    - a
+    - b
+`))
+	if err != nil {
+		t.Fatalf("parseYAML() error = %v", err)
+	}
+	want := map[string]any{
+		"n":       int64(16),
+		"f":       -1500.0,
+		"b":       true,
+		"none":    nil,
+		"members": []any{"http://a:1", "http://b:2"},
+		"tokens": []any{
+			map[string]any{
+				"name": "ci",
+				"rules": []any{
+					map[string]any{"prefix": "ci/", "permission": "write"},
+					map[string]any{"prefix": "", "permission": "read"},
+				},
+			},
+			map[string]any{"name": "ops #1", "rules": []any{}},
+		},
+		"nested": []any{[]any{"a", "b"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseYAML() = %#v, want %#v", got, want)
+	}
+}
+
+func TestLoadFileYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		contents   string
+		wantErrMsg string
+	}{
+		{name: "unknown_field", contents: "server:\n  port: 8080", wantErrMsg: "unknown field"},
+		{name: "wrong_type", contents: "server:\n  addr: 8080", wantErrMsg: "cannot unmarshal number"},
+		{name: "bad_duration", contents: "engine:\n  bitcask:\n    mergeInterval: soon", wantErrMsg: "invalid duration"},
+		{name: "duplicate_key", contents: "server:\n  addr: \":1\"\n  addr: \":2\"", wantErrMsg: "line 3: key addr defined twice"},
+		{name: "bad_indentation", contents: "server:\n  addr: \":1\"\n    tls: {}", wantErrMsg: "line 3: unexpected indentation"},
+		{name: "tab", contents: "server:\n\taddr: \":1\"", wantErrMsg: "line 2: tabs are not allowed"},
+		{name: "no_key", contents: "server:\n  addr", wantErrMsg: "line 2: expected \"key: value\""},
+		{name: "item_in_mapping", contents: "server:\n  addr: \":1\"\n  - x", wantErrMsg: "line 3: unexpected sequence item"},
+		{name: "unterminated_string", contents: "server:\n  addr: \":1\n", wantErrMsg: "line 2: unterminated string"},
+		{name: "bad_escape", contents: `a: "\q"`, wantErrMsg: `line 1: invalid escape \q`},
+		{name: "after_string", contents: `a: "x" y`, wantErrMsg: "line 1: unexpected \"y\" after value"},
+		{name: "unclosed_sequence", contents: "a: [1, 2", wantErrMsg: "line 1: expected ',' or ']'"},
+		{name: "unclosed_mapping", contents: "a: {b: 1", wantErrMsg: "line 1: expected ',' or '}'"},
+		{name: "anchor", contents: "a: &x 1", wantErrMsg: "line 1: anchors and aliases are not supported"},
+		{name: "tag", contents: "a: !!str 1", wantErrMsg: "line 1: tags are not supported"},
+		{name: "block_scalar", contents: "a: |\n  text", wantErrMsg: "line 1: block scalars are not supported"},
+		{name: "two_documents", contents: "a: 1\n---\nb: 2", wantErrMsg: "line 2: multiple documents"},
+		{name: "directive", contents: "%YAML 1.2\na: 1", wantErrMsg: "line 1: directives are not supported"},
+		{name: "not_a_mapping", contents: "# list\n- a\n- b", wantErrMsg: "line 2: YAML document must be a mapping"},
+		{name: "infinity", contents: "a: .inf", wantErrMsg: "line 1: invalid number \".inf\""},
+		{name: "invalid_utf8", contents: "a: 1\nb: \xff", wantErrMsg: "line 2: YAML must be valid UTF-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeYAMLFile(t, "zapstore.yaml", tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("Load() error = %v, want error containing %q", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"ZAPSTORE_ADDR":                   "127.0.0.1:7000",
+		"ZAPSTORE_ENGINE":                 "bitcask",
+		"ZAPSTORE_DATA_DIR":               "data",
+		"ZAPSTORE_BITCASK_MAX_FILE_SIZE":  "1024",
+		"ZAPSTORE_BITCASK_MERGE_INTERVAL": "30m",
+		"ZAPSTORE_LOG_LEVEL":              "debug",
+		"ZAPSTORE_LOG_MAX_BACKUPS":        "7",
+		"ZAPSTORE_REPLICATION_LEADER":     "http://leader:8080",
+		"ZAPSTORE_REPLICATION_TOKEN":      "s3cr3t",
+		"ZAPSTORE_WATCH_RETAIN_EVENTS":    "500",
+		"ZAPSTORE_RAFT_ID":                "http://a:8080",
+		"ZAPSTORE_RAFT_MEMBERS":           "http://a:8080, http://b:8080,",
+		"ZAPSTORE_WATCH_RETAIN_IDLE":      "0s",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg := Default()
+	if err := cfg.applyEnv(lookup); err != nil {
+		t.Fatalf("applyEnv() error = %v", err)
+	}
+	if cfg.Server.Addr != "127.0.0.1:7000" {
+		t.Errorf("Server.Addr = %q, want %q", cfg.Server.Addr, "127.0.0.1:7000")
+	}
+	if cfg.Engine.Name != "bitcask" || cfg.Engine.DataDir != "data" {
+		t.Errorf("Engine = %+v, want bitcask at data", cfg.Engine)
+	}
+	if cfg.Engine.Bitcask.MaxFileSize != 1024 {
+		t.Errorf("MaxFileSize = %d, want 1024", cfg.Engine.Bitcask.MaxFileSize)
+	}
+	if got := time.Duration(cfg.Engine.Bitcask.MergeInterval); got != 30*time.Minute {
+		t.Errorf("MergeInterval = %v, want 30m", got)
+	}
+
+	if cfg.Log.Level != "debug" || cfg.Log.MaxBackups != 7 {
+		t.Errorf("Log = %+v, want level debug and 7 backups", cfg.Log)
+	}
+
+	if cfg.Replication.Leader != "http://leader:8080" || cfg.Replication.Token != "s3cr3t" {
+		t.Errorf("Replication = %+v, want leader http://leader:8080 with token s3cr3t", cfg.Replication)
+	}
+
+	if want := []string{"http://a:8080", "http://b:8080"}; cfg.Raft.ID != "http://a:8080" || !slices.Equal(cfg.Raft.Members, want) {
+		t.Errorf("Raft = %+v, want id http://a:8080 and members %v", cfg.Raft, want)
+	}
+
+	if cfg.Watch.RetainEvents != 500 || cfg.Watch.RetainIdle != 0 {
+		t.Errorf("Watch = %+v, want 500 events kept without idle retention", cfg.Watch)
+	}
+
+	env["ZAPSTORE_BITCASK_MAX_FILE_SIZE"] = "big"
+	if err := cfg.applyEnv(lookup); err == nil || !strings.Contains(err.Error(), "ZAPSTORE_BITCASK_MAX_FILE_SIZE") {
+		t.Errorf("applyEnv() error = %v, want error naming ZAPSTORE_BITCASK_MAX_FILE_SIZE", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(c *Config)
+		wantErrMsg string
+	}{
+		{name: "defaults", modify: func(c *Config) {}},
+		{name: "unknown_engine", modify: func(c *Config) { c.Engine.Name = "rocks" }, wantErrMsg: "engine.name"},
+		{name: "bitcask_without_dir", modify: func(c *Config) { c.Engine.Name = "bitcask" }, wantErrMsg: "engine.dataDir"},
+		{name: "lsm_without_dir", modify: func(c *Config) { c.Engine.Name = "lsm" }, wantErrMsg: "engine.dataDir"},
+		{name: "btree_without_dir", modify: func(c *Config) { c.Engine.Name = "btree" }, wantErrMsg: "engine.dataDir"},
+		{name: "bad_page_size", modify: func(c *Config) { c.Engine.BTree.PageSize = 1000 }, wantErrMsg: "engine.btree.pageSize"},
+		{name: "bad_compaction", modify: func(c *Config) { c.Engine.LSM.Compaction = "universal" }, wantErrMsg: "engine.lsm.compaction"},
+		{name: "empty_addr", modify: func(c *Config) { c.Server.Addr = "" }, wantErrMsg: "server.addr"},
+		{name: "bad_sync", modify: func(c *Config) { c.Engine.Bitcask.Sync = "sometimes" }, wantErrMsg: "engine.bitcask.sync"},
+		{name: "interval_without_period", modify: func(c *Config) {
+			c.Engine.Bitcask.Sync = "interval"
+			c.Engine.Bitcask.SyncInterval = 0
+		}, wantErrMsg: "engine.bitcask.syncInterval"},
+		{name: "tls_missing_key", modify: func(c *Config) { c.Server.TLS.CertFile = "cert.pem" }, wantErrMsg: "server.tls"},
+		{name: "mtls_without_ca", modify: func(c *Config) {
+			c.Server.TLS.CertFile, c.Server.TLS.KeyFile = "cert.pem", "key.pem"
+			c.Server.TLS.ClientAuth = "require"
+		}, wantErrMsg: "server.tls.clientCAFile"},
+		{name: "bad_client_auth", modify: func(c *Config) {
+			c.Server.TLS.CertFile, c.Server.TLS.KeyFile = "cert.pem", "key.pem"
+			c.Server.TLS.ClientAuth = "sometimes"
+		}, wantErrMsg: "server.tls.clientAuth"},
+		{name: "auth_without_tokens", modify: func(c *Config) { c.Auth.Enabled = true }, wantErrMsg: "auth.tokens"},
+		{name: "auth_bad_token", modify: func(c *Config) {
+			c.Auth.Enabled = true
+			c.Auth.Tokens = []auth.StaticToken{{Name: "ci"}}
+		}, wantErrMsg: "auth.tokens[0]"},
+		{name: "auth_duplicate_names", modify: func(c *Config) {
+			c.Auth.Enabled = true
+			c.Auth.Tokens = []auth.StaticToken{{Name: "ci", Token: "a"}, {Name: "ci", Token: "b"}}
+		}, wantErrMsg: "duplicate token name"},
+		{name: "bad_log_level", modify: func(c *Config) { c.Log.Level = "loud" }, wantErrMsg: "log.level"},
+		{name: "bad_log_format", modify: func(c *Config) { c.Log.Format = "xml" }, wantErrMsg: "log.format"},
+		{name: "negative_log_backups", modify: func(c *Config) { c.Log.MaxBackups = -1 }, wantErrMsg: "log.maxBackups"},
+		{name: "raft", modify: func(c *Config) {
+			c.Engine.Name, c.Engine.DataDir = "bitcask", "data"
+			c.Raft.ID, c.Raft.Members = "http://a:8080", []string{"http://a:8080", "http://b:8080"}
+		}},
+		{name: "raft_id_not_url", modify: func(c *Config) {
+			c.Raft.ID, c.Raft.DataDir = "a:8080", "raft"
+		}, wantErrMsg: "raft.id"},
+		{name: "raft_members_without_id", modify: func(c *Config) {
+			c.Raft.ID, c.Raft.DataDir = "http://a:8080", "raft"
+			c.Raft.Members = []string{"http://b:8080", "http://c:8080"}
+		}, wantErrMsg: "must include raft.id"},
+		{name: "raft_without_data_dir", modify: func(c *Config) { c.Raft.ID = "http://a:8080" }, wantErrMsg: "raft.dataDir"},
+		{name: "raft_and_replication", modify: func(c *Config) {
+			c.Raft.ID, c.Raft.DataDir = "http://a:8080", "raft"
+			c.Replication.Leader = "http://leader:8080"
+		}, wantErrMsg: "cannot also follow"},
+		{name: "raft_bad_consistency", modify: func(c *Config) {
+			c.Raft.ID, c.Raft.DataDir = "http://a:8080", "raft"
+			c.Raft.ReadConsistency = "eventual"
+		}, wantErrMsg: "raft.readConsistency"},
+		{name: "watch_no_events", modify: func(c *Config) { c.Watch.RetainEvents = 0 }, wantErrMsg: "watch.retainEvents"},
+		{name: "watch_negative_idle", modify: func(c *Config) { c.Watch.RetainIdle = -1 }, wantErrMsg: "watch.retainIdle"},
+		{name: "follower", modify: func(c *Config) { c.Replication.Leader = "https://leader:8443" }},
+		{name: "leader_not_url", modify: func(c *Config) { c.Replication.Leader = "leader:8080" }, wantErrMsg: "replication.leader"},
+		{name: "replication_cert_without_key", modify: func(c *Config) {
+			c.Replication.Leader = "https://leader:8443"
+			c.Replication.CertFile = "client.pem"
+		}, wantErrMsg: "certFile and keyFile"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+
+			if tt.wantErrMsg == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("Validate() error = %v, want error containing %q", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML decodes a TOML document into nested maps, ready to be re-encoded as JSON
+// and decoded like a JSON config file. It covers what a config file needs: tables,
+// arrays of tables, dotted and quoted keys, basic and literal strings, integers,
+// floats, booleans, arrays and inline tables. Multi-line strings and dates are
+// rejected.
+func parseTOML(data []byte) (map[string]any, error) {
+	if line, ok := invalidUTF8Line(data); ok {
+		return nil, fmt.Errorf("line %d: TOML must be valid UTF-8", line)
+	}
+	p := &tomlParser{src: string(data), line: 1, root: make(map[string]any), defined: make(map[string]bool)}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return p.root, nil
+}
+
+type tomlParser struct {
+	src     string
+	pos     int
+	line    int
+	root    map[string]any
+	current map[string]any  // Table the key/value pairs go into
+	defined map[string]bool // Tables opened by a [header], which may not be opened again
+}
+
+func (p *tomlParser) parse() error {
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos += 2
+			err = p.arrayTableHeader()
+		case p.src[p.pos] == '[':
+			p.pos++
+			err = p.tableHeader()
+		default:
+			err = p.keyValue(p.current)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// skipBlank skips spaces, tabs and comments, and newlines too if newlines is set.
+func (p *tomlParser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skipBlank(false)
+	if p.eof() {
+		return nil
+	}
+	if p.src[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q after value", p.src[p.pos])
+	}
+	return nil
+}
+
+func (p *tomlParser) expect(c byte) error {
+	p.skipBlank(false)
+	if p.peek() != c {
+		if p.eof() {
+			return fmt.Errorf("expected %q, found end of file", c)
+		}
+		return fmt.Errorf("expected %q, found %q", c, p.src[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+// keyPath reads a dotted key such as a.b."c.d".
+func (p *tomlParser) keyPath() ([]string, error) {
+	var path []string
+	for {
+		p.skipBlank(false)
+		var key string
+		var err error
+		switch c := p.peek(); {
+		case c == '"':
+			key, err = p.basicString()
+		case c == '\'':
+			key, err = p.literalString()
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.src[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, errors.New("expected a key")
+			}
+			key = p.src[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, key)
+		p.skipBlank(false)
+		if p.peek() != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// table descends from t through path, creating the tables that do not exist yet. A
+// path through an array of tables continues in its last table.
+func table(t map[string]any, path []string) (map[string]any, error) {
+	for i, key := range path {
+		switch next := t[key].(type) {
+		case nil:
+			created := make(map[string]any)
+			t[key] = created
+			t = created
+		case map[string]any:
+			t = next
+		case []any:
+			last, ok := next[len(next)-1].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("key %s is an array, not a table", strings.Join(path[:i+1], "."))
+			}
+			t = last
+		default:
+			return nil, fmt.Errorf("key %s is a value, not a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	return t, nil
+}
+
+func (p *tomlParser) tableHeader() error {
+	path, err := p.keyPath()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(']'); err != nil {
+		return err
+	}
+	name := strings.Join(path, "\x00")
+	if p.defined[name] {
+		return fmt.Errorf("table [%s] defined twice", strings.Join(path, "."))
+	}
+	p.defined[name] = true
+	p.current, err = table(p.root, path)
+	return err
+}
+
+func (p *tomlParser) arrayTableHeader() error {
+	path, err := p.keyPath()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(']'); err != nil {
+		return err
+	}
+	if err := p.expect(']'); err != nil {
+		return err
+	}
+	parent, err := table(p.root, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	key := path[len(path)-1]
+	element := make(map[string]any)
+	switch existing := parent[key].(type) {
+	case nil:
+		parent[key] = []any{element}
+	case []any:
+		parent[key] = append(existing, element)
+	default:
+		return fmt.Errorf("key %s is not an array of tables", strings.Join(path, "."))
+	}
+	// Tables under the previous element may be opened again under this one
+	prefix := strings.Join(path, "\x00") + "\x00"
+	for name := range p.defined {
+		if strings.HasPrefix(name, prefix) {
+			delete(p.defined, name)
+		}
+	}
+	p.current = element
+	return nil
+}
+
+func (p *tomlParser) keyValue(t map[string]any) error {
+	path, err := p.keyPath()
+	if err != nil {
+		return err
+	}
+	if err := p.expect('='); err != nil {
+		return err
+	}
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	parent, err := table(t, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	key := path[len(path)-1]
+	if _, exists := parent[key]; exists {
+		return fmt.Errorf("key %s defined twice", strings.Join(path, "."))
+	}
+	parent[key] = value
+	return nil
+}
+
+func (p *tomlParser) value() (any, error) {
+	p.skipBlank(false)
+	switch c := p.peek(); {
+	case c == '"':
+		return p.basicString()
+	case c == '\'':
+		return p.literalString()
+	case c == '[':
+		p.pos++
+		return p.array()
+	case c == '{':
+		p.pos++
+		return p.inlineTable()
+	case p.eof() || c == '\n':
+		return nil, errors.New("missing value")
+	}
+
+	start := p.pos
+	for !p.eof() && strings.IndexByte(" \t\r\n#,]}", p.src[p.pos]) < 0 {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	digits := strings.TrimLeft(token, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return nil, fmt.Errorf("invalid number %q: leading zeros are not allowed", token)
+	}
+	if n, err := strconv.ParseInt(token, 0, 64); err == nil {
+		return n, nil
+	}
+	if !strings.HasPrefix(digits, "0x") && strings.ContainsAny(digits, ".eE") {
+		if f, err := strconv.ParseFloat(token, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q (dates are not supported)", token)
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.src[p.pos] == '\n' {
+			return "", errors.New("unterminated string")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return errors.New("unterminated string")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return fmt.Errorf("invalid escape \\%c", c)
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid escape \\%c%s", c, p.src[p.pos:p.pos+size])
+		}
+		p.pos += size
+		b.WriteRune(rune(code))
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], "'''") {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	p.pos++
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", errors.New("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// array reads the values of an array up to its closing bracket. Values may be spread
+// over several lines, with comments, and followed by a trailing comma.
+func (p *tomlParser) array() ([]any, error) {
+	values := []any{}
+	for {
+		p.skipBlank(true)
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipBlank(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, errors.New("expected ',' or ']' in array")
+		}
+	}
+}
+
+// inlineTable reads the pairs of an inline table, which must fit on one line.
+func (p *tomlParser) inlineTable() (map[string]any, error) {
+	t := make(map[string]any)
+	p.skipBlank(false)
+	if p.peek() == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, errors.New("expected ',' or '}' in inline table")
+		}
+	}
+}
+
+// invalidUTF8Line returns the line of the first byte of data that is not valid UTF-8.
+func invalidUTF8Line(data []byte) (int, bool) {
+	line := 1
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return line, true
+		}
+		if r == '\n' {
+			line++
+		}
+		data = data[size:]
+	}
+	return 0, false
+}
@@ -0,0 +1,491 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseYAML decodes a YAML document into nested maps, ready to be re-encoded as JSON
+// and decoded like a JSON config file. It covers what a config file needs: block
+// mappings and sequences, flow mappings and sequences on one line, plain, single and
+// double quoted scalars, and comments. Plain scalars resolve as in the YAML 1.2 core
+// schema. Anchors, aliases, tags, block scalars, multi-line scalars and multiple
+// documents are rejected.
+func parseYAML(data []byte) (map[string]any, error) {
+	if line, ok := invalidUTF8Line(data); ok {
+		return nil, fmt.Errorf("line %d: YAML must be valid UTF-8", line)
+	}
+	p := &yamlParser{}
+	if err := p.split(string(data)); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	if len(p.lines) == 0 {
+		return make(map[string]any), nil
+	}
+	doc, err := p.block(p.lines[0].indent)
+	if err == nil && p.i < len(p.lines) {
+		p.line = p.lines[p.i].num
+		err = errors.New("unexpected indentation")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	root, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("line %d: YAML document must be a mapping", p.lines[0].num)
+	}
+	return root, nil
+}
+
+// yamlLine is a line with content, its comment removed.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int // Next line to read
+	line  int // Number of the line being read, for errors
+}
+
+// split breaks src into the lines that have content.
+func (p *yamlParser) split(src string) error {
+	started := false
+	for i, raw := range strings.Split(src, "\n") {
+		p.line = i + 1
+		raw = strings.TrimSuffix(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return errors.New("tabs are not allowed in indentation")
+		}
+		if indent == 0 {
+			switch {
+			case text == "---" || strings.HasPrefix(text, "--- "):
+				if started {
+					return errors.New("multiple documents are not supported")
+				}
+				started = true
+				if text = strings.TrimLeft(text[3:], " "); text == "" {
+					continue
+				}
+				return errors.New("content after '---' is not supported")
+			case text == "...":
+				return nil
+			case strings.HasPrefix(text, "%"):
+				return errors.New("directives are not supported")
+			}
+		}
+		started = true
+		p.lines = append(p.lines, yamlLine{num: p.line, indent: indent, text: text})
+	}
+	return nil
+}
+
+// stripYAMLComment cuts a line at the '#' starting a comment, one that opens the line
+// or follows a space outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:-", s[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block reads the mapping or sequence whose lines start at indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLSequenceItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	m := make(map[string]any)
+	for p.i < len(p.lines) {
+		line := p.lines[p.i]
+		p.line = line.num
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, errors.New("unexpected indentation")
+		}
+		if isYAMLSequenceItem(line.text) {
+			return nil, errors.New("unexpected sequence item in a mapping")
+		}
+		key, rest, err := splitYAMLKey(line.text)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("key %s defined twice", key)
+		}
+		p.i++
+		var value any
+		if rest == "" {
+			// A sequence may be indented as much as its key
+			value, err = p.nested(indent, true)
+		} else {
+			value, err = parseYAMLValue(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	s := []any{}
+	for p.i < len(p.lines) {
+		line := p.lines[p.i]
+		p.line = line.num
+		if line.indent < indent || (line.indent == indent && !isYAMLSequenceItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, errors.New("unexpected indentation")
+		}
+		rest := strings.TrimLeft(line.text[1:], " ")
+		var value any
+		var err error
+		switch {
+		case rest == "":
+			p.i++
+			value, err = p.nested(indent, false)
+		case isYAMLSequenceItem(rest) || isYAMLKey(rest):
+			// The item is a block of its own, starting on this line: read the rest of
+			// the line as its first line, indented past the dash
+			offset := indent + len(line.text) - len(rest)
+			p.lines[p.i] = yamlLine{num: line.num, indent: offset, text: rest}
+			value, err = p.block(offset)
+		default:
+			p.i++
+			value, err = parseYAMLValue(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, value)
+	}
+	return s, nil
+}
+
+// nested reads the block under a key or sequence item that has nothing after it on its
+// line. Without one the value is null.
+func (p *yamlParser) nested(indent int, sameIndentSequence bool) (any, error) {
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.i]
+	switch {
+	case next.indent > indent:
+		return p.block(next.indent)
+	case next.indent == indent && sameIndentSequence && isYAMLSequenceItem(next.text):
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+// isYAMLKey reports whether text starts with a mapping key.
+func isYAMLKey(text string) bool {
+	if strings.IndexByte("[{", text[0]) >= 0 {
+		return false
+	}
+	_, _, err := splitYAMLKey(text)
+	return err == nil
+}
+
+// splitYAMLKey splits "key: value" into the key and what follows it.
+func splitYAMLKey(text string) (key, rest string, err error) {
+	if text[0] == '"' || text[0] == '\'' {
+		f := &yamlFlow{src: text}
+		if key, err = f.quoted(); err != nil {
+			return "", "", err
+		}
+		f.skipSpaces()
+		rest = text[f.pos:]
+		if !strings.HasPrefix(rest, ":") || (len(rest) > 1 && rest[1] != ' ') {
+			return "", "", fmt.Errorf("expected ':' after key %q", key)
+		}
+		return key, strings.TrimLeft(rest[1:], " "), nil
+	}
+
+	end := strings.Index(text, ": ")
+	switch {
+	case end >= 0:
+		rest = strings.TrimLeft(text[end+2:], " ")
+	case strings.HasSuffix(text, ":"):
+		end = len(text) - 1
+	default:
+		return "", "", fmt.Errorf("expected \"key: value\", found %q", text)
+	}
+	key = strings.TrimRight(text[:end], " ")
+	if key == "" || strings.IndexByte("?[{&*!|>%@`", key[0]) >= 0 {
+		return "", "", fmt.Errorf("expected a key, found %q", key)
+	}
+	return key, rest, nil
+}
+
+// parseYAMLValue reads the value following a key or sequence item on its line.
+func parseYAMLValue(text string) (any, error) {
+	f := &yamlFlow{src: text}
+	value, err := f.value(false)
+	if err != nil {
+		return nil, err
+	}
+	f.skipSpaces()
+	if !f.eof() {
+		return nil, fmt.Errorf("unexpected %q after value", f.src[f.pos:])
+	}
+	return value, nil
+}
+
+// yamlFlow reads the values within a line: scalars and flow collections.
+type yamlFlow struct {
+	src string
+	pos int
+}
+
+func (f *yamlFlow) eof() bool {
+	return f.pos >= len(f.src)
+}
+
+func (f *yamlFlow) peek() byte {
+	if f.eof() {
+		return 0
+	}
+	return f.src[f.pos]
+}
+
+func (f *yamlFlow) skipSpaces() {
+	for !f.eof() && (f.src[f.pos] == ' ' || f.src[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+// value reads a value. Plain scalars end at the end of the line, or in a flow
+// collection at the next ',', ']' or '}'.
+func (f *yamlFlow) value(inFlow bool) (any, error) {
+	f.skipSpaces()
+	switch c := f.peek(); c {
+	case '"', '\'':
+		return f.quoted()
+	case '[':
+		f.pos++
+		return f.sequence()
+	case '{':
+		f.pos++
+		return f.mapping()
+	case '&', '*':
+		return nil, errors.New("anchors and aliases are not supported")
+	case '!':
+		return nil, errors.New("tags are not supported")
+	case '|', '>':
+		return nil, errors.New("block scalars are not supported")
+	case '@', '`', '%', '?':
+		return nil, fmt.Errorf("unexpected %q", c)
+	}
+
+	start := f.pos
+	if inFlow {
+		for !f.eof() && strings.IndexByte(",]}", f.src[f.pos]) < 0 {
+			f.pos++
+		}
+	} else {
+		f.pos = len(f.src)
+	}
+	return resolveYAMLScalar(strings.TrimRight(f.src[start:f.pos], " \t"))
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlHex   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	yamlOctal = regexp.MustCompile(`^0o[0-7]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// resolveYAMLScalar gives a plain scalar its type under the YAML 1.2 core schema.
+func resolveYAMLScalar(s string) (any, error) {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	var n int64
+	var err error
+	switch {
+	case yamlInt.MatchString(s):
+		n, err = strconv.ParseInt(s, 10, 64)
+	case yamlHex.MatchString(s):
+		n, err = strconv.ParseInt(s[2:], 16, 64)
+	case yamlOctal.MatchString(s):
+		n, err = strconv.ParseInt(s[2:], 8, 64)
+	case yamlFloat.MatchString(s):
+		return strconv.ParseFloat(s, 64)
+	case strings.EqualFold(strings.TrimLeft(s, "+-"), ".inf") || strings.EqualFold(s, ".nan"):
+		return nil, fmt.Errorf("invalid number %q: infinity and NaN are not supported", s)
+	default:
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+func (f *yamlFlow) quoted() (string, error) {
+	quote := f.src[f.pos]
+	f.pos++
+	var b strings.Builder
+	for {
+		if f.eof() {
+			return "", errors.New("unterminated string (multi-line strings are not supported)")
+		}
+		c := f.src[f.pos]
+		f.pos++
+		switch {
+		case c == quote && quote == '\'' && f.peek() == '\'':
+			f.pos++
+			b.WriteByte('\'')
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			if err := f.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (f *yamlFlow) escape(b *strings.Builder) error {
+	if f.eof() {
+		return errors.New("unterminated string")
+	}
+	c := f.src[f.pos]
+	f.pos++
+	if r, ok := map[byte]byte{'0': 0, 'a': '\a', 'b': '\b', 't': '\t', 'n': '\n', 'v': '\v',
+		'f': '\f', 'r': '\r', 'e': 0x1b, ' ': ' ', '"': '"', '/': '/', '\\': '\\'}[c]; ok {
+		b.WriteByte(r)
+		return nil
+	}
+	size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+	if size == 0 || f.pos+size > len(f.src) {
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	code, err := strconv.ParseUint(f.src[f.pos:f.pos+size], 16, 32)
+	if err != nil || code > math.MaxInt32 || !utf8.ValidRune(rune(code)) {
+		return fmt.Errorf("invalid escape \\%c%s", c, f.src[f.pos:f.pos+size])
+	}
+	f.pos += size
+	b.WriteRune(rune(code))
+	return nil
+}
+
+// sequence reads a flow sequence up to its closing bracket, which must be on the same
+// line. A trailing comma is allowed.
+func (f *yamlFlow) sequence() ([]any, error) {
+	values := []any{}
+	for {
+		f.skipSpaces()
+		if f.peek() == ']' {
+			f.pos++
+			return values, nil
+		}
+		value, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		f.skipSpaces()
+		switch f.peek() {
+		case ',':
+			f.pos++
+		case ']':
+		default:
+			return nil, errors.New("expected ',' or ']' in flow sequence (flow sequences must fit on one line)")
+		}
+	}
+}
+
+// mapping reads a flow mapping up to its closing brace, which must be on the same line.
+func (f *yamlFlow) mapping() (map[string]any, error) {
+	m := make(map[string]any)
+	for {
+		f.skipSpaces()
+		if f.peek() == '}' {
+			f.pos++
+			return m, nil
+		}
+		var key string
+		if c := f.peek(); c == '"' || c == '\'' {
+			var err error
+			if key, err = f.quoted(); err != nil {
+				return nil, err
+			}
+		} else {
+			start := f.pos
+			for !f.eof() && strings.IndexByte(":,]}", f.src[f.pos]) < 0 {
+				f.pos++
+			}
+			key = strings.TrimRight(f.src[start:f.pos], " \t")
+		}
+		f.skipSpaces()
+		if key == "" || f.peek() != ':' {
+			return nil, errors.New("expected \"key: value\" in flow mapping")
+		}
+		f.pos++
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("key %s defined twice", key)
+		}
+		value, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+		f.skipSpaces()
+		switch f.peek() {
+		case ',':
+			f.pos++
+		case '}':
+		default:
+			return nil, errors.New("expected ',' or '}' in flow mapping (flow mappings must fit on one line)")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{input: "", want: slog.LevelInfo},
+		{input: "debug", want: slog.LevelDebug},
+		{input: "WARN", want: slog.LevelWarn},
+		{input: "error", want: slog.LevelError},
+		{input: "loud", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	handler, err := NewHandler(&buf, "json", level)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	logger := slog.New(handler)
+
+	logger.Debug("hidden")
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown", "key", "value")
+
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, `"msg":"shown","key":"value"`) {
+		t.Errorf("Unexpected log output: %q", out)
+	}
+
+	if _, err := NewHandler(&buf, "xml", level); err == nil {
+		t.Errorf("NewHandler with format xml succeeded, want error")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zapstore.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer f.Close()
+
+	// Each write fills the file, so every following write rotates it
+	for _, line := range []string{"first---\n", "second--\n", "third---\n", "fourth--\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write(%q) failed: %v", line, err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth--\n",
+		path + ".1": "third---\n",
+		path + ".2": "second--\n",
+	}
+	for file, contents := range want {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("Reading %s failed: %v", file, err)
+			continue
+		}
+		if string(data) != contents {
+			t.Errorf("%s contains %q, want %q", filepath.Base(file), data, contents)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Backup beyond maxBackups exists (stat error %v)", err)
+	}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var sb strings.Builder
+	if err := r.WriteText(&sb); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	return sb.String()
+}
+
+func assertContains(t *testing.T, output string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("output missing line %q:\n%s", line, output)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests served.", "op", "code")
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				requests.WithLabelValues("get", "200").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	requests.WithLabelValues("set", "500").Add(2)
+	requests.WithLabelValues("odd", `a"b\`).Inc()
+
+	assertContains(t, render(t, r),
+		"# HELP requests_total Requests served.",
+		"# TYPE requests_total counter",
+		`requests_total{op="get",code="200"} 1000`,
+		`requests_total{op="set",code="500"} 2`,
+		`requests_total{op="odd",code="a\"b\\"} 1`,
+	)
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+	for _, v := range []float64{0.05, 0.5, 2} {
+		latency.WithLabelValues("get").Observe(v)
+	}
+
+	assertContains(t, render(t, r),
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{op="get",le="0.1"} 1`,
+		`latency_seconds_bucket{op="get",le="1"} 2`,
+		`latency_seconds_bucket{op="get",le="+Inf"} 3`,
+		`latency_seconds_sum{op="get"} 2.55`,
+		`latency_seconds_count{op="get"} 3`,
+	)
+}
+
+func TestGaugeFuncs(t *testing.T) {
+	r := NewRegistry()
+	keys := 3.0
+	r.NewGaugeFunc("keys", "Number of keys.", func() float64 { return keys })
+	r.NewGaugeVecFunc("segment_bytes", "Segment sizes.", []string{"segment"}, func(emit func(float64, ...string)) {
+		emit(100, "1")
+		emit(250, "2")
+	})
+
+	keys = 7
+	assertContains(t, render(t, r),
+		"# TYPE keys gauge",
+		"keys 7",
+		`segment_bytes{segment="1"} 100`,
+		`segment_bytes{segment="2"} 250`,
+	)
+}
+
+func TestHandlerAndDuplicateRegistration(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("hits_total", "Hits.").WithLabelValues().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	assertContains(t, string(body), "hits_total 1")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a metric twice did not panic")
+		}
+	}()
+	r.NewGaugeFunc("hits_total", "Again.", func() float64 { return 0 })
+}
@@ -0,0 +1,343 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+)
+
+// A FileStorage directory holds
+//
+//	state     the hard state, as JSON
+//	snapshot  the latest snapshot, as JSON
+//	log       the entries following the snapshot
+//
+// State and snapshot are replaced whole, by renaming a synced temporary file over
+// them. The log is appended to and synced on every Append; its records are framed as
+//
+//	crc32(4) | payload length(4) | index(8) | term(8) | type(1) | data
+//
+// with the CRC and length covering everything after the header.
+
+const (
+	stateFileName    = "state"
+	snapshotFileName = "snapshot"
+	logFileName      = "log"
+	lockFileName     = "raft.lock"
+
+	logHeaderSize = 8
+	logEntryFixed = 17 // index, term and type
+)
+
+// ErrLocked is returned when opening a directory another process has open.
+var ErrLocked = errors.New("raft directory is locked by another process")
+
+// FileStorage keeps a node's state in a directory, so that it survives restarts. It
+// is safe for concurrent use, but only one FileStorage may have a directory open.
+type FileStorage struct {
+	mu            sync.Mutex
+	dir           string
+	fLock         *flock.Flock
+	log           *os.File
+	snapshotIndex uint64
+	offsets       []int64 // Log offset of each entry after the snapshot, then of the end
+}
+
+// OpenFileStorage opens, or creates, the storage in dir. A record cut short at the end
+// of the log is the write a crash interrupted, and is dropped.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory %s: %w", dir, err)
+	}
+	lockPath := filepath.Join(dir, lockFileName)
+	fLock := flock.New(lockPath)
+	locked, err := fLock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check or acquire file lock %s: %w", lockPath, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: %s (lock file: %s)", ErrLocked, dir, lockPath)
+	}
+
+	s := &FileStorage{dir: dir, fLock: fLock}
+	if err := s.open(); err != nil {
+		if s.log != nil {
+			s.log.Close()
+		}
+		fLock.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open reads the snapshot index and the log offsets, and opens the log for appending.
+// Entries the snapshot covers, left by a crash while it was stored, are dropped.
+func (s *FileStorage) open() error {
+	var snapshot Snapshot
+	if err := s.readJSON(snapshotFileName, &snapshot); err != nil {
+		return err
+	}
+	s.snapshotIndex = snapshot.Index
+
+	entries, offsets, err := readLog(s.path(logFileName))
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && entries[0].Index <= s.snapshotIndex {
+		return s.rewriteLog(entries)
+	}
+	if len(entries) > 0 && entries[0].Index != s.snapshotIndex+1 {
+		return fmt.Errorf("raft log %s starts at index %d, after the snapshot at %d", s.path(logFileName), entries[0].Index, s.snapshotIndex)
+	}
+
+	if s.log, err = os.OpenFile(s.path(logFileName), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return fmt.Errorf("failed to open raft log: %w", err)
+	}
+	if err := s.log.Truncate(offsets[len(offsets)-1]); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	s.offsets = offsets
+	return nil
+}
+
+func (s *FileStorage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// Close closes the log and releases the directory.
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.log.Close()
+	if unlockErr := s.fLock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+func (s *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state HardState
+	var snapshot Snapshot
+	if err := s.readJSON(stateFileName, &state); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	if err := s.readJSON(snapshotFileName, &snapshot); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	entries, _, err := readLog(s.path(logFileName))
+	if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	return state, snapshot, entries, nil
+}
+
+func (s *FileStorage) SetHardState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeJSON(stateFileName, state)
+}
+
+func (s *FileStorage) Append(from uint64, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := s.snapshotIndex + 1
+	count := uint64(len(s.offsets) - 1)
+	if from < first || from > first+count {
+		return fmt.Errorf("cannot append at index %d to a log holding %d to %d", from, first, first+count-1)
+	}
+	kept := from - first + 1
+	end := s.offsets[kept-1]
+	if from < first+count {
+		if err := s.log.Truncate(end); err != nil {
+			return fmt.Errorf("failed to truncate raft log: %w", err)
+		}
+		s.offsets = s.offsets[:kept]
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		buf = appendLogRecord(buf, e)
+	}
+	_, err := s.log.WriteAt(buf, end)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		// Leave no part of the entries for the next append or a restart to find
+		s.log.Truncate(end)
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+	offset := end
+	for _, e := range entries {
+		offset += int64(logHeaderSize + logEntryFixed + len(e.Data))
+		s.offsets = append(s.offsets, offset)
+	}
+	return nil
+}
+
+func (s *FileStorage) SetSnapshot(snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeJSON(snapshotFileName, snapshot); err != nil {
+		return err
+	}
+	entries, _, err := readLog(s.path(logFileName))
+	if err != nil {
+		return err
+	}
+	s.snapshotIndex = snapshot.Index
+	return s.rewriteLog(entries)
+}
+
+// rewriteLog replaces the log with the entries following the snapshot, and reopens it.
+func (s *FileStorage) rewriteLog(entries []Entry) error {
+	var buf []byte
+	offsets := []int64{0}
+	for _, e := range entries {
+		if e.Index <= s.snapshotIndex {
+			continue
+		}
+		buf = appendLogRecord(buf, e)
+		offsets = append(offsets, int64(len(buf)))
+	}
+	if err := s.writeFile(logFileName, buf); err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(s.path(logFileName), os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open raft log: %w", err)
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, s.offsets = log, offsets
+	return nil
+}
+
+// appendLogRecord appends the record of e to buf.
+func appendLogRecord(buf []byte, e Entry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, logHeaderSize)...)
+	buf = binary.BigEndian.AppendUint64(buf, e.Index)
+	buf = binary.BigEndian.AppendUint64(buf, e.Term)
+	buf = append(buf, byte(e.Type))
+	buf = append(buf, e.Data...)
+	payload := buf[start+logHeaderSize:]
+	binary.BigEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+// readLog returns the entries of the log at path with their offsets, followed by the
+// offset where the valid records end. A missing log is empty.
+func readLog(path string) ([]Entry, []int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, []int64{0}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read raft log: %w", err)
+	}
+
+	var entries []Entry
+	offsets := []int64{0}
+	for offset := 0; len(data)-offset >= logHeaderSize; {
+		crc := binary.BigEndian.Uint32(data[offset:])
+		size := int(binary.BigEndian.Uint32(data[offset+4:]))
+		payload := data[offset+logHeaderSize:]
+		if size < logEntryFixed || len(payload) < size || crc32.ChecksumIEEE(payload[:size]) != crc {
+			break // Cut short by a crash
+		}
+		payload = payload[:size]
+		e := Entry{
+			Index: binary.BigEndian.Uint64(payload),
+			Term:  binary.BigEndian.Uint64(payload[8:]),
+			Type:  EntryType(payload[16]),
+		}
+		if len(payload) > logEntryFixed {
+			e.Data = payload[logEntryFixed:]
+		}
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 {
+			return nil, nil, fmt.Errorf("raft log %s has entry %d after %d", path, e.Index, entries[len(entries)-1].Index)
+		}
+		entries = append(entries, e)
+		offset += logHeaderSize + size
+		offsets = append(offsets, int64(offset))
+	}
+	return entries, offsets, nil
+}
+
+// readJSON decodes the file name into v, leaving v alone if the file does not exist.
+func (s *FileStorage) readJSON(name string, v any) error {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read raft %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode raft %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *FileStorage) writeJSON(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(name, data)
+}
+
+// writeFile replaces the file name with data, syncing the file and the directory so
+// that the new contents survive a crash.
+func (s *FileStorage) writeFile(name string, data []byte) error {
+	path := s.path(name)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write raft %s: %w", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write raft %s: %w", name, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync raft %s: %w", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write raft %s: %w", name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write raft %s: %w", name, err)
+	}
+	return syncDir(s.dir)
+}
+
+// syncDir syncs the entries of a directory, making renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
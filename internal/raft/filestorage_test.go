@@ -0,0 +1,171 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testEntries(from, to, term uint64) []Entry {
+	var es []Entry
+	for i := from; i <= to; i++ {
+		es = append(es, Entry{Index: i, Term: term, Data: []byte{byte(i)}})
+	}
+	return es
+}
+
+func openFileStorage(t *testing.T, dir string) *FileStorage {
+	t.Helper()
+	s, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStorage() error = %v", err)
+	}
+	return s
+}
+
+func checkLoad(t *testing.T, s Storage, wantState HardState, wantSnapshot Snapshot, wantEntries []Entry) {
+	t.Helper()
+	state, snapshot, got, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if state != wantState {
+		t.Errorf("Load() hard state = %+v, want %+v", state, wantState)
+	}
+	if !reflect.DeepEqual(snapshot, wantSnapshot) {
+		t.Errorf("Load() snapshot = %+v, want %+v", snapshot, wantSnapshot)
+	}
+	if !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("Load() entries = %+v, want %+v", got, wantEntries)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStorage(t, dir)
+	checkLoad(t, s, HardState{}, Snapshot{}, nil)
+
+	if _, err := OpenFileStorage(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("OpenFileStorage() of an open directory error = %v, want %v", err, ErrLocked)
+	}
+
+	state := HardState{Term: 3, Vote: "n2"}
+	if err := s.SetHardState(state); err != nil {
+		t.Fatalf("SetHardState() error = %v", err)
+	}
+	if err := s.Append(1, testEntries(1, 5, 1)); err != nil {
+		t.Fatalf("Append(1) error = %v", err)
+	}
+	// A new leader overwrites the tail
+	if err := s.Append(4, testEntries(4, 6, 2)); err != nil {
+		t.Fatalf("Append(4) error = %v", err)
+	}
+	if err := s.Append(9, testEntries(9, 9, 2)); err == nil {
+		t.Errorf("Append(9) leaving a gap error = nil, want an error")
+	}
+	want := append(testEntries(1, 3, 1), testEntries(4, 6, 2)...)
+	checkLoad(t, s, state, Snapshot{}, want)
+
+	snapshot := Snapshot{Index: 4, Term: 2, Members: []string{"n1", "n2"}}
+	if err := s.SetSnapshot(snapshot); err != nil {
+		t.Fatalf("SetSnapshot() error = %v", err)
+	}
+	if err := s.Append(7, testEntries(7, 7, 3)); err != nil {
+		t.Fatalf("Append(7) error = %v", err)
+	}
+	want = append(testEntries(5, 6, 2), testEntries(7, 7, 3)...)
+	checkLoad(t, s, state, snapshot, want)
+
+	// Everything survives a restart, and a torn write at the end of the log is dropped
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write(appendLogRecord(nil, Entry{Index: 8, Term: 3, Data: []byte("torn")})[:20])
+	log.Close()
+
+	s = openFileStorage(t, dir)
+	defer s.Close()
+	checkLoad(t, s, state, snapshot, want)
+	if err := s.Append(8, testEntries(8, 8, 3)); err != nil {
+		t.Fatalf("Append(8) after the restart error = %v", err)
+	}
+	checkLoad(t, s, state, snapshot, append(want, testEntries(8, 8, 3)...))
+
+	// A snapshot past the end of the log empties it
+	snapshot = Snapshot{Index: 20, Term: 4, Members: []string{"n1"}}
+	if err := s.SetSnapshot(snapshot); err != nil {
+		t.Fatalf("SetSnapshot() error = %v", err)
+	}
+	if err := s.Append(21, testEntries(21, 21, 4)); err != nil {
+		t.Fatalf("Append(21) error = %v", err)
+	}
+	checkLoad(t, s, state, snapshot, testEntries(21, 21, 4))
+}
+
+func TestFileStorageNodeRestart(t *testing.T) {
+	dir := t.TempDir()
+	start := func(members []string, machine *kvMachine) (*Node, *FileStorage) {
+		t.Helper()
+		storage := openFileStorage(t, dir)
+		n, err := Start(Config{
+			ID:              "n1",
+			Members:         members,
+			Storage:         storage,
+			Transport:       NewMemoryNetwork().Transport("n1"),
+			StateMachine:    machine,
+			TickInterval:    5 * time.Millisecond,
+			SnapshotEntries: 5,
+			Logger:          slog.New(slog.DiscardHandler),
+		})
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		waitFor(t, "n1 to lead", func() bool { return n.Status().Role == Leader })
+		return n, storage
+	}
+
+	machine := newKVMachine()
+	machine.persistent.Store(true)
+	n, storage := start([]string{"n1"}, machine)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, command := range []string{"a=1", "b=2", "a=3", "c=4", "d=5", "e=6", "a=7"} {
+		if _, err := n.Propose(ctx, []byte(command)); err != nil {
+			t.Fatalf("Propose(%q) error = %v", command, err)
+		}
+	}
+	term := n.Status().Term
+	n.Stop()
+	storage.Close()
+
+	// The restarted node keeps its term, and replays the log after the snapshot onto
+	// what the state machine synced at compaction
+	restarted := newKVMachine()
+	restarted.persistent.Store(true)
+	machine.mu.Lock()
+	maps.Copy(restarted.data, machine.synced)
+	machine.mu.Unlock()
+	if len(restarted.data) == 0 {
+		t.Fatal("state machine was not synced at compaction")
+	}
+	n, storage = start(nil, restarted)
+	defer storage.Close()
+	defer n.Stop()
+	if s := n.Status(); s.Term <= term || s.SnapshotIndex == 0 {
+		t.Errorf("after restart term = %d, snapshot index = %d, want a term above %d and a snapshot", s.Term, s.SnapshotIndex, term)
+	}
+	want := map[string]string{"a": "7", "b": "2", "c": "4", "d": "5", "e": "6"}
+	waitFor(t, "the state machine to be rebuilt", func() bool {
+		return reflect.DeepEqual(restarted.snapshot(), want)
+	})
+}
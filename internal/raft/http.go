@@ -0,0 +1,237 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessagesPath is the endpoint of a member taking the messages of the others, as a
+// JSON array posted by HTTPTransport.
+const MessagesPath = "/admin/raft/messages"
+
+// SnapshotPath is the endpoint of a member taking snapshots from the leader. The body
+// is the snapshot data, and SnapshotHeader holds the MsgSnap as JSON.
+const (
+	SnapshotPath   = "/admin/raft/snapshot"
+	SnapshotHeader = "X-Zapstore-Raft-Message"
+)
+
+const (
+	httpQueueSize     = 1024            // Messages waiting for a peer before new ones are dropped
+	httpBatchMessages = 64              // Messages posted at once
+	httpSendTimeout   = 5 * time.Second // Time a post may take before its messages are given up
+)
+
+// HTTPTransport sends messages to other members over HTTP. Member ids are their base
+// URLs, such as "https://10.0.0.2:8443", and messages are posted to MessagesPath
+// there. Every peer has a queue, drained in batches by a goroutine of its own, so
+// that Send never blocks; messages finding a full queue or a failed post are dropped,
+// which Raft tolerates. Snapshots are streamed to SnapshotPath, without a time limit.
+type HTTPTransport struct {
+	client *http.Client
+	token  string
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	peers  map[string]chan Message
+	closed bool
+	ctx    context.Context // Cancelled by Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// HTTPOption configures an HTTPTransport.
+type HTTPOption func(*HTTPTransport)
+
+// WithToken sends a bearer token with every post, which needs admin rights on the
+// other members.
+func WithToken(token string) HTTPOption {
+	return func(t *HTTPTransport) { t.token = token }
+}
+
+// WithHTTPClient sets the client posting messages, e.g. to trust the members' CA.
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(t *HTTPTransport) { t.client = client }
+}
+
+// WithLogger sets the logger for failed posts. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) HTTPOption {
+	return func(t *HTTPTransport) { t.logger = logger }
+}
+
+func NewHTTPTransport(opts ...HTTPOption) *HTTPTransport {
+	t := &HTTPTransport{
+		client: http.DefaultClient,
+		logger: slog.Default(),
+		peers:  make(map[string]chan Message),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+func (t *HTTPTransport) Send(msg Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	queue, ok := t.peers[msg.To]
+	if !ok {
+		queue = make(chan Message, httpQueueSize)
+		t.peers[msg.To] = queue
+		t.wg.Add(1)
+		go t.run(msg.To, queue)
+	}
+	select {
+	case queue <- msg:
+	default:
+	}
+}
+
+// Close stops sending. Messages still queued are dropped.
+func (t *HTTPTransport) Close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.cancel()
+	t.wg.Wait()
+}
+
+// run posts the messages queued for peer until the transport is closed.
+func (t *HTTPTransport) run(peer string, queue chan Message) {
+	defer t.wg.Done()
+	url := strings.TrimSuffix(peer, "/") + MessagesPath
+	failing := false
+	for {
+		var batch []Message
+		select {
+		case msg := <-queue:
+			batch = append(batch, msg)
+		case <-t.ctx.Done():
+			return
+		}
+	drain:
+		for len(batch) < httpBatchMessages {
+			select {
+			case msg := <-queue:
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+
+		// Only the first failure of a row is worth a warning: an unreachable member
+		// fails every heartbeat
+		err := t.post(url, batch)
+		if err != nil && !failing {
+			t.logger.Warn("failed to send raft messages", "peer", peer, "error", err)
+		}
+		failing = err != nil
+	}
+}
+
+func (t *HTTPTransport) post(url string, batch []Message) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, httpSendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", url, resp.Status, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+func (t *HTTPTransport) SendSnapshot(ctx context.Context, msg Message, data io.WriterTo) error {
+	header, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(t.ctx, cancel)()
+
+	// The data is written as the request is sent; a failed request stops the writer
+	pr, pw := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_, err := data.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer func() {
+		pr.Close()
+		<-written
+	}()
+
+	url := strings.TrimSuffix(msg.To, "/") + SnapshotPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(SnapshotHeader, string(header))
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", url, resp.Status, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+// DecodeSnapshotMessage reads the MsgSnap in the SnapshotHeader of a snapshot posted to
+// SnapshotPath, for the member's InstallSnapshot.
+func DecodeSnapshotMessage(header string) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal([]byte(header), &msg); err != nil {
+		return Message{}, fmt.Errorf("invalid raft snapshot message: %w", err)
+	}
+	if msg.Type != MsgSnap || msg.Snapshot == nil {
+		return Message{}, errors.New("invalid raft snapshot message: not a snapshot")
+	}
+	return msg, nil
+}
+
+// DecodeMessages reads the messages posted to MessagesPath, for the member's Step.
+func DecodeMessages(r io.Reader) ([]Message, error) {
+	var msgs []Message
+	if err := json.NewDecoder(r).Decode(&msgs); err != nil {
+		return nil, fmt.Errorf("invalid raft messages: %w", err)
+	}
+	return msgs, nil
+}
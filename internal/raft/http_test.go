@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	const token = "s3cr3t"
+	var mu sync.Mutex
+	nodes := make(map[string]*Node)
+	var ids []string
+	for range 3 {
+		var id string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			node := nodes[id]
+			mu.Unlock()
+			if r.URL.Path == SnapshotPath {
+				msg, err := DecodeSnapshotMessage(r.Header.Get(SnapshotHeader))
+				if err == nil && node != nil {
+					err = node.InstallSnapshot(r.Context(), msg, r.Body)
+				}
+				if err != nil || node == nil {
+					http.Error(w, "snapshot not installed", http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if r.URL.Path != MessagesPath {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			msgs, err := DecodeMessages(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, msg := range msgs {
+				if node != nil {
+					node.Step(msg)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(srv.Close)
+		id = srv.URL
+		ids = append(ids, id)
+	}
+
+	machines := make(map[string]*kvMachine)
+	start := func(id string) {
+		transport := NewHTTPTransport(WithToken(token), WithLogger(slog.New(slog.DiscardHandler)))
+		machines[id] = newKVMachine()
+		n, err := Start(Config{
+			ID:              id,
+			Members:         ids,
+			Storage:         NewMemoryStorage(),
+			Transport:       transport,
+			StateMachine:    machines[id],
+			TickInterval:    5 * time.Millisecond,
+			SnapshotEntries: 3,
+			Logger:          slog.New(slog.DiscardHandler),
+		})
+		if err != nil {
+			t.Fatalf("Start(%s) error = %v", id, err)
+		}
+		t.Cleanup(func() {
+			n.Stop()
+			transport.Close()
+		})
+		mu.Lock()
+		nodes[id] = n
+		mu.Unlock()
+	}
+	propose := func(command string) {
+		t.Helper()
+		waitFor(t, "a command to commit", func() bool {
+			mu.Lock()
+			running := slices.Collect(maps.Values(nodes))
+			mu.Unlock()
+			for _, n := range running {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				_, err := n.Propose(ctx, []byte(command))
+				cancel()
+				if err == nil {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	// Two members commit enough for the log to be compacted, so the third one gets
+	// a snapshot streamed to it when it starts
+	start(ids[0])
+	start(ids[1])
+	want := make(map[string]string)
+	for i := range 8 {
+		key := fmt.Sprintf("k%d", i)
+		propose(key + "=v")
+		want[key] = "v"
+	}
+	start(ids[2])
+	propose("k=v")
+	want["k"] = "v"
+	for _, id := range ids {
+		waitFor(t, id+" to apply the commands", func() bool {
+			return maps.Equal(machines[id].snapshot(), want)
+		})
+	}
+	if machines[ids[2]].restores.Load() == 0 {
+		t.Errorf("late member restored no snapshot, want one")
+	}
+}
@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+)
+
+// MemoryNetwork connects nodes running in one process, such as the members of a test
+// cluster. Nodes can be cut off to simulate partitions, and messages dropped at random.
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	nodes    map[string]*Node
+	isolated map[string]bool
+	dropRate float64
+	drop     func(Message) bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*Node), isolated: make(map[string]bool)}
+}
+
+// Transport returns the transport for the node with the given id.
+func (net *MemoryNetwork) Transport(id string) Transport {
+	return memoryTransport{net: net, from: id}
+}
+
+// Attach delivers the messages sent to node.ID() to node, replacing any node attached
+// with that id before.
+func (net *MemoryNetwork) Attach(node *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[node.ID()] = node
+}
+
+// Detach stops delivering messages to id.
+func (net *MemoryNetwork) Detach(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.nodes, id)
+}
+
+// Isolate drops every message sent to or by id until Heal.
+func (net *MemoryNetwork) Isolate(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.isolated[id] = true
+}
+
+// Heal reconnects every isolated node.
+func (net *MemoryNetwork) Heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	clear(net.isolated)
+}
+
+// SetDropRate drops the given share of messages, between 0 and 1.
+func (net *MemoryNetwork) SetDropRate(rate float64) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.dropRate = rate
+}
+
+// SetDrop drops every message for which drop returns true, until it is set to nil.
+func (net *MemoryNetwork) SetDrop(drop func(Message) bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.drop = drop
+}
+
+type memoryTransport struct {
+	net  *MemoryNetwork
+	from string
+}
+
+func (t memoryTransport) Send(msg Message) {
+	if node := t.deliver(msg); node != nil {
+		node.Step(msg)
+	}
+}
+
+func (t memoryTransport) SendSnapshot(ctx context.Context, msg Message, data io.WriterTo) error {
+	node := t.deliver(msg)
+	if node == nil {
+		return errors.New("snapshot dropped by the network")
+	}
+	var buf bytes.Buffer
+	if _, err := data.WriteTo(&buf); err != nil {
+		return err
+	}
+	return node.InstallSnapshot(ctx, msg, &buf)
+}
+
+// deliver returns the node msg reaches, nil if it is dropped.
+func (t memoryTransport) deliver(msg Message) *Node {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	dropped := t.net.isolated[t.from] || t.net.isolated[msg.To] || rand.Float64() < t.net.dropRate ||
+		(t.net.drop != nil && t.net.drop(msg))
+	if dropped {
+		return nil
+	}
+	return t.net.nodes[msg.To]
+}
@@ -0,0 +1,1346 @@
+// Package raft implements the Raft consensus algorithm: leader election, log
+// replication, single-server membership changes, log compaction and linearizable reads
+// through read-index.
+//
+// Compaction only marks the point of the log the state machine holds: a persistent
+// state machine is synced first and replays the log from there after a restart. A
+// member that needs the compacted entries, or restarts with a state machine kept in
+// memory, gets a snapshot the leader's state machine writes on demand, streamed on a
+// goroutine of its own so that heartbeats go on meanwhile.
+//
+// A Node runs one member of a group. It owns all its state on a single goroutine,
+// which handles timer ticks, messages from other members and requests from callers in
+// turn, and applies committed entries to the StateMachine in log order. Messages
+// travel over a Transport, which may lose, duplicate or reorder them.
+//
+// FileStorage and HTTPTransport keep the state on disk and carry the messages between
+// servers; MemoryStorage and MemoryNetwork do so within one process, for tests.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader           = errors.New("not the raft leader")
+	ErrNoLeader            = errors.New("no raft leader known")
+	ErrStopped             = errors.New("raft node stopped")
+	ErrProposalDropped     = errors.New("proposal was dropped by a leader change")
+	ErrConfigChangePending = errors.New("another membership change is in progress")
+)
+
+const (
+	DefaultTickInterval    = 50 * time.Millisecond
+	DefaultElectionTicks   = 10
+	DefaultHeartbeatTicks  = 1
+	DefaultSnapshotEntries = 1000
+
+	maxAppendEntries = 256  // Entries sent in one append message
+	recvBuffer       = 1024 // Messages waiting for the node before new ones are dropped
+)
+
+// Role is the part a node currently plays in its group.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+type EntryType uint8
+
+const (
+	// EntryCommand carries a state machine command, or nothing for the entry a new
+	// leader appends to commit the entries of earlier terms.
+	EntryCommand EntryType = iota
+	// EntryConfig carries the JSON encoded members of the group. A configuration takes
+	// effect as soon as it is in the log, committed or not.
+	EntryConfig
+)
+
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Snapshot replaces the log up to and including Index. The state it stands for is in the
+// state machine, or streamed along with a MsgSnap.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []string // Configuration as of Index
+}
+
+type MessageType uint8
+
+const (
+	MsgVote MessageType = iota + 1
+	MsgVoteResp
+	MsgApp
+	MsgAppResp
+	MsgSnap
+	MsgReadIndex
+	MsgReadIndexResp
+	// MsgSnapRequest asks the leader for a snapshot, from a node whose state machine
+	// lost what its log was compacted into.
+	MsgSnapRequest
+)
+
+// Message is sent between the nodes of a group. Which fields are set depends on Type.
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	Term uint64
+
+	// MsgVote: the candidate's last entry. MsgApp: the entry preceding Entries.
+	LogIndex uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+	Snapshot *Snapshot
+
+	// MsgAppResp: the last index matching the leader's log or, when rejecting, the
+	// follower's last index. MsgReadIndexResp: the index to read at.
+	Index  uint64
+	Reject bool
+	// MsgApp and MsgAppResp: the leader's latest read-index round, confirmed by the
+	// response. MsgReadIndex and MsgReadIndexResp: the request id on the asking node.
+	Seq uint64
+}
+
+// Transport sends messages to other nodes, delivering them by calling their Step.
+// Send must not block; a message may be dropped.
+type Transport interface {
+	Send(msg Message)
+	// SendSnapshot delivers a MsgSnap along with the snapshot data writes, by calling
+	// the receiver's InstallSnapshot, and returns once it did. It is called on a
+	// goroutine of its own and may take as long as the data does, until ctx ends.
+	SendSnapshot(ctx context.Context, msg Message, data io.WriterTo) error
+}
+
+// SnapshotData is the state of a state machine at one point, written out on demand.
+type SnapshotData interface {
+	io.WriterTo
+	Close() error
+}
+
+// StateMachine is replicated by the group. Its methods are only ever called from the
+// node's goroutine, except for writing out the SnapshotData it returns.
+type StateMachine interface {
+	// Apply applies a committed command. Its result is returned to the proposer.
+	Apply(index uint64, data []byte) any
+	// Persistent reports whether the state survives a restart once synced.
+	Persistent() bool
+	// Sync makes the state after the last applied command durable. It is called before
+	// the log is compacted up to that command.
+	Sync() error
+	// Snapshot captures the state after the last applied command, for a member that
+	// needs it. It must return quickly: the data is written on another goroutine, while
+	// later commands are applied. It may include their effects as long as applying
+	// them again after Restore ends in the same state.
+	Snapshot() (SnapshotData, error)
+	// Restore replaces the state with a snapshot taken after the command at index.
+	Restore(index uint64, r io.Reader) error
+}
+
+type Config struct {
+	ID string
+	// Members of a new group, including ID. Ignored if Storage holds state already;
+	// empty for a node that is going to be added to an existing group.
+	Members      []string
+	Storage      Storage
+	Transport    Transport
+	StateMachine StateMachine
+
+	TickInterval time.Duration
+	// ElectionTicks is the minimum number of ticks without hearing from a leader before
+	// a follower starts an election; the actual timeout is randomized up to twice that.
+	ElectionTicks  int
+	HeartbeatTicks int
+	// SnapshotEntries is the number of applied entries after which the log is compacted.
+	// Negative disables compaction.
+	SnapshotEntries int
+	Logger          *slog.Logger
+}
+
+// Status describes a node at one point in time.
+type Status struct {
+	ID            string
+	Role          Role
+	Term          uint64
+	Leader        string
+	Members       []string
+	Commit        uint64
+	Applied       uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+}
+
+type proposalResult struct {
+	value any
+	err   error
+}
+
+type proposal struct {
+	typ    EntryType
+	data   []byte
+	change *memberChange
+	result chan proposalResult
+}
+
+type memberChange struct {
+	id     string
+	remove bool
+}
+
+// waiter waits for the entry at some index to be applied. If the entry there by then
+// has another term, the proposal was overwritten.
+type waiter struct {
+	term   uint64
+	result chan proposalResult
+}
+
+// readRequest waits for a quorum to confirm the leader is still the leader.
+type readRequest struct {
+	seq   uint64     // Read-index round
+	index uint64     // Commit index when the request arrived
+	from  string     // Asking node
+	id    uint64     // Request id on the asking node
+	done  chan error // Set for requests of this node
+}
+
+// snapshotRequest is a snapshot arriving through InstallSnapshot.
+type snapshotRequest struct {
+	msg  Message
+	r    io.Reader
+	done chan error
+}
+
+// snapshotSent reports the end of a snapshot sent to a node.
+type snapshotSent struct {
+	to  string
+	err error
+}
+
+// readWait waits for the state machine to catch up with a read index.
+type readWait struct {
+	index uint64
+	done  chan error
+}
+
+type Node struct {
+	id           string
+	cfg          Config
+	logger       *slog.Logger
+	storage      Storage
+	transport    Transport
+	stateMachine StateMachine
+
+	// Owned by the run loop
+	failure         error // Why the node stopped itself; read by others once done is closed
+	role            Role
+	term            uint64
+	vote            string
+	leader          string
+	snapshot        Snapshot
+	log             []Entry // Entries after snapshot.Index
+	members         []string
+	commit          uint64
+	applied         uint64 // 0 while behind
+	behind          bool   // The state machine lacks the entries compacted from the log
+	electionElapsed int
+	electionTimeout int
+	heartbeatTicks  int
+	votes           map[string]bool
+	waiters         map[uint64]waiter
+	readWaits       []readWait
+	remoteReads     map[uint64]chan error // Forwarded to the leader, by request id
+	lastReadID      uint64
+
+	// Leader state
+	next          map[string]uint64 // Next entry to send to each node
+	match         map[string]uint64 // Last entry known to be replicated on each node
+	acks          map[string]uint64 // Latest read-index round confirmed by each node
+	active        map[string]bool   // Nodes heard from since the last quorum check
+	sending       map[string]bool   // Nodes a snapshot is on its way to
+	readSeq       uint64
+	reads         []readRequest
+	deferredReads []readRequest // Waiting for an entry of this term to commit
+
+	recvc   chan Message
+	propc   chan proposal
+	readc   chan chan error
+	statusc chan chan Status
+	snapc   chan snapshotRequest
+	sentc   chan snapshotSent
+	stopc   chan struct{}
+	done    chan struct{}
+
+	// Snapshots being sent, stopped along with the node
+	sendCtx    context.Context
+	sendCancel context.CancelFunc
+	senders    sync.WaitGroup
+}
+
+// Start starts a node on the state in cfg.Storage. A persistent state machine is
+// expected to hold what the log was compacted into, and the entries after it are
+// applied again; any other asks the leader for a snapshot first.
+func Start(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft node needs an id")
+	}
+	if cfg.Storage == nil || cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft node needs storage, a transport and a state machine")
+	}
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = DefaultTickInterval
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = DefaultElectionTicks
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = DefaultHeartbeatTicks
+	}
+	if cfg.HeartbeatTicks >= cfg.ElectionTicks {
+		return nil, fmt.Errorf("heartbeat ticks (%d) must be fewer than election ticks (%d)", cfg.HeartbeatTicks, cfg.ElectionTicks)
+	}
+	if cfg.SnapshotEntries == 0 {
+		cfg.SnapshotEntries = DefaultSnapshotEntries
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	state, snapshot, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft state: %w", err)
+	}
+	if state == (HardState{}) && snapshot.Index == 0 && snapshot.Members == nil && len(entries) == 0 && len(cfg.Members) > 0 {
+		// A new group: its members form the configuration before the first entry
+		snapshot = Snapshot{Members: slices.Clone(cfg.Members)}
+		if err := cfg.Storage.SetSnapshot(snapshot); err != nil {
+			return nil, fmt.Errorf("failed to store initial raft configuration: %w", err)
+		}
+	}
+	behind := snapshot.Index > 0 && !cfg.StateMachine.Persistent()
+
+	n := &Node{
+		id:           cfg.ID,
+		cfg:          cfg,
+		logger:       cfg.Logger.With("raft", cfg.ID),
+		storage:      cfg.Storage,
+		transport:    cfg.Transport,
+		stateMachine: cfg.StateMachine,
+		term:         state.Term,
+		vote:         state.Vote,
+		snapshot:     snapshot,
+		log:          entries,
+		commit:       snapshot.Index,
+		applied:      snapshot.Index,
+		behind:       behind,
+		waiters:      make(map[uint64]waiter),
+		remoteReads:  make(map[uint64]chan error),
+		recvc:        make(chan Message, recvBuffer),
+		propc:        make(chan proposal),
+		readc:        make(chan chan error),
+		statusc:      make(chan chan Status),
+		snapc:        make(chan snapshotRequest),
+		sentc:        make(chan snapshotSent),
+		stopc:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if behind {
+		n.applied = 0
+		n.logger.Info("raft state machine lost the compacted log, waiting for a snapshot", "index", snapshot.Index)
+	}
+	n.sendCtx, n.sendCancel = context.WithCancel(context.Background())
+	n.members = n.membersAt(n.lastIndex())
+	n.resetElectionTimeout()
+	go n.run()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Stop stops the node and waits for it to finish. Pending requests fail with
+// ErrStopped.
+func (n *Node) Stop() {
+	select {
+	case <-n.stopc:
+	default:
+		close(n.stopc)
+	}
+	<-n.done
+}
+
+// Done is closed once the node has stopped, through Stop or because its storage failed.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Err returns the error that stopped the node, or nil while it runs or after Stop.
+func (n *Node) Err() error {
+	select {
+	case <-n.done:
+		return n.failure
+	default:
+		return nil
+	}
+}
+
+// stopped is the error for requests to a node that has stopped. Called once done is
+// closed, or on the run loop.
+func (n *Node) stopped() error {
+	if n.failure != nil {
+		return fmt.Errorf("%w: %w", ErrStopped, n.failure)
+	}
+	return ErrStopped
+}
+
+// Step hands a message from another node to this one. It never blocks: if the node is
+// too far behind the message is dropped, as the network could have done.
+func (n *Node) Step(msg Message) {
+	select {
+	case n.recvc <- msg:
+	default:
+	}
+}
+
+// InstallSnapshot hands a MsgSnap from the leader to this node, with the snapshot data
+// read from r. It returns once the state machine restored it, or failed to.
+func (n *Node) InstallSnapshot(ctx context.Context, msg Message, r io.Reader) error {
+	req := snapshotRequest{msg: msg, r: r, done: make(chan error, 1)}
+	select {
+	case n.snapc <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return n.stopped()
+	}
+	// The node is reading r: wait for it whatever ctx does
+	select {
+	case err := <-req.done:
+		return err
+	case <-n.done:
+		return n.stopped()
+	}
+}
+
+// Propose appends a command to the log and waits until it is applied on this node,
+// returning what the state machine returned for it. Only the leader accepts
+// proposals. If ctx ends first the command may still be applied later.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	return n.propose(ctx, proposal{typ: EntryCommand, data: data})
+}
+
+// AddMember makes id a voting member once the change is in the leader's log, and
+// waits until the change is applied. The new node is started without Members and
+// receives the log, or a snapshot, from the leader. Only one change can be in progress
+// at a time.
+func (n *Node) AddMember(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, proposal{typ: EntryConfig, change: &memberChange{id: id}})
+	return err
+}
+
+// RemoveMember removes id from the group. A leader that removes itself steps down once
+// the change is committed.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, proposal{typ: EntryConfig, change: &memberChange{id: id, remove: true}})
+	return err
+}
+
+func (n *Node) propose(ctx context.Context, p proposal) (any, error) {
+	p.result = make(chan proposalResult, 1)
+	select {
+	case n.propc <- p:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.done:
+		return nil, n.stopped()
+	}
+	select {
+	case r := <-p.result:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.done:
+		return nil, n.stopped()
+	}
+}
+
+// ReadIndex waits until the state machine on this node reflects every entry committed
+// before the call, so that reading it afterwards is linearizable. The leader confirms
+// it still leads by hearing from a quorum; other nodes ask the leader.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case n.readc <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return n.stopped()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return n.stopped()
+	}
+}
+
+func (n *Node) Status() Status {
+	c := make(chan Status, 1)
+	select {
+	case n.statusc <- c:
+		return <-c
+	case <-n.done:
+		return Status{ID: n.id}
+	}
+}
+
+func (n *Node) run() {
+	defer close(n.done)
+	defer n.senders.Wait()
+	defer n.sendCancel()
+
+	ticker := time.NewTicker(n.cfg.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case msg := <-n.recvc:
+			n.step(msg)
+		case p := <-n.propc:
+			n.handleProposal(p)
+		case done := <-n.readc:
+			n.handleLocalRead(done)
+		case c := <-n.statusc:
+			c <- n.status()
+		case req := <-n.snapc:
+			req.done <- n.installSnapshot(req.msg, req.r)
+		case sent := <-n.sentc:
+			n.handleSnapshotSent(sent)
+		case <-n.stopc:
+			n.shutdown()
+			return
+		}
+		if n.failure != nil {
+			n.shutdown()
+			return
+		}
+		n.applyCommitted()
+	}
+}
+
+func (n *Node) status() Status {
+	return Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		Members:       slices.Clone(n.members),
+		Commit:        n.commit,
+		Applied:       n.applied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+func (n *Node) shutdown() {
+	err := n.stopped()
+	for index, w := range n.waiters {
+		w.result <- proposalResult{err: err}
+		delete(n.waiters, index)
+	}
+	n.failReads(err)
+	for id, done := range n.remoteReads {
+		done <- err
+		delete(n.remoteReads, id)
+	}
+	for _, w := range n.readWaits {
+		w.done <- err
+	}
+	n.readWaits = nil
+}
+
+func (n *Node) tick() {
+	n.electionElapsed++
+	if n.role != Leader {
+		if n.electionElapsed >= n.electionTimeout {
+			n.campaign()
+		}
+		return
+	}
+
+	n.heartbeatTicks++
+	if n.heartbeatTicks >= n.cfg.HeartbeatTicks {
+		n.heartbeatTicks = 0
+		n.broadcastAppend()
+	}
+	if n.electionElapsed >= n.cfg.ElectionTicks {
+		// A leader cut off from a quorum steps down rather than keep accepting
+		// proposals it cannot commit.
+		n.electionElapsed = 0
+		n.active[n.id] = true
+		if !n.hasQuorum(func(id string) bool { return n.active[id] }) {
+			n.logger.Warn("raft leader lost contact with a quorum, stepping down", "term", n.term)
+			n.becomeFollower(n.term, "")
+			return
+		}
+		clear(n.active)
+	}
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.cfg.ElectionTicks + rand.IntN(n.cfg.ElectionTicks)
+}
+
+func (n *Node) campaign() {
+	n.resetElectionTimeout()
+	if !slices.Contains(n.members, n.id) {
+		return // Not a voter (yet, or any more)
+	}
+	if n.behind {
+		return // Could not serve as leader without the state
+	}
+
+	if err := n.setHardState(n.term+1, n.id); err != nil {
+		return
+	}
+	n.role = Candidate
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.logger.Info("raft election started", "term", n.term)
+	if n.hasQuorum(func(id string) bool { return n.votes[id] }) {
+		n.becomeLeader()
+		return
+	}
+	lastIndex := n.lastIndex()
+	lastTerm, _ := n.termAt(lastIndex)
+	for _, id := range n.members {
+		if id != n.id {
+			n.send(Message{Type: MsgVote, To: id, LogIndex: lastIndex, LogTerm: lastTerm})
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		if err := n.setHardState(term, ""); err != nil {
+			return
+		}
+		for id, done := range n.remoteReads {
+			done <- fmt.Errorf("%w: term changed", ErrNotLeader)
+			delete(n.remoteReads, id)
+		}
+	}
+	if n.role == Leader {
+		n.failReads(fmt.Errorf("%w: stepped down", ErrNotLeader))
+	}
+	if n.role != Follower || n.leader != leader {
+		n.logger.Info("raft node following", "term", n.term, "leader", leader)
+	}
+	n.role = Follower
+	n.leader = leader
+	n.resetElectionTimeout()
+}
+
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.id
+	n.heartbeatTicks = 0
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.acks = make(map[string]uint64)
+	n.active = make(map[string]bool)
+	n.sending = make(map[string]bool)
+	for _, id := range n.members {
+		if id != n.id {
+			n.next[id] = n.lastIndex() + 1
+		}
+	}
+	n.logger.Info("raft node became leader", "term", n.term)
+
+	// Entries of earlier terms only commit along with one of this term
+	if _, err := n.appendEntry(EntryCommand, nil); err != nil {
+		n.logger.Error("raft leader cannot write to its log, stepping down", "term", n.term, "error", err)
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+// failReads fails the read requests waiting for the leader to confirm it leads.
+func (n *Node) failReads(err error) {
+	for _, req := range append(n.reads, n.deferredReads...) {
+		if req.done != nil {
+			req.done <- err
+		} else {
+			n.send(Message{Type: MsgReadIndexResp, To: req.from, Seq: req.id, Reject: true})
+		}
+	}
+	n.reads, n.deferredReads = nil, nil
+}
+
+// setHardState stores the term and vote before the node acts on them. If storage fails
+// the node stops: answering without the vote on disk could let it vote twice in a term.
+func (n *Node) setHardState(term uint64, vote string) error {
+	if err := n.storage.SetHardState(HardState{Term: term, Vote: vote}); err != nil {
+		return n.fail(fmt.Errorf("failed to store raft hard state: %w", err))
+	}
+	n.term, n.vote = term, vote
+	return nil
+}
+
+// fail stops the node after the run loop finishes the current event, with err failing
+// its pending requests and reported by Err. The first failure wins.
+func (n *Node) fail(err error) error {
+	if n.failure == nil {
+		n.failure = err
+		n.logger.Error("raft node stopping", "error", err)
+	}
+	return err
+}
+
+func (n *Node) send(msg Message) {
+	if n.failure != nil {
+		return // What the node meant to say may not be on disk
+	}
+	msg.From = n.id
+	msg.Term = n.term
+	n.transport.Send(msg)
+}
+
+func (n *Node) step(msg Message) {
+	switch {
+	case msg.Term > n.term:
+		if msg.Type == MsgVote && n.leader != "" && n.electionElapsed < n.cfg.ElectionTicks {
+			// Heard from a live leader lately: a candidate that has not is probably
+			// partitioned or removed, and must not depose it.
+			return
+		}
+		leader := ""
+		if msg.Type == MsgApp || msg.Type == MsgSnap {
+			leader = msg.From
+		}
+		n.becomeFollower(msg.Term, leader)
+		if n.failure != nil {
+			return
+		}
+	case msg.Term < n.term:
+		// Let a stale leader or candidate know about the newer term
+		switch msg.Type {
+		case MsgApp, MsgSnap:
+			n.send(Message{Type: MsgAppResp, To: msg.From, Reject: true})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: true})
+		case MsgReadIndex:
+			n.send(Message{Type: MsgReadIndexResp, To: msg.From, Seq: msg.Seq, Reject: true})
+		}
+		return
+	}
+
+	switch msg.Type {
+	case MsgVote:
+		n.handleVote(msg)
+	case MsgVoteResp:
+		n.handleVoteResp(msg)
+	case MsgApp:
+		n.handleAppend(msg)
+	case MsgAppResp:
+		n.handleAppendResp(msg)
+	case MsgSnapRequest:
+		if _, ok := n.next[msg.From]; ok && n.role == Leader {
+			n.sendSnapshot(msg.From)
+		}
+	case MsgReadIndex:
+		if n.role != Leader {
+			n.send(Message{Type: MsgReadIndexResp, To: msg.From, Seq: msg.Seq, Reject: true})
+			return
+		}
+		n.leaderRead(readRequest{from: msg.From, id: msg.Seq})
+	case MsgReadIndexResp:
+		n.handleReadIndexResp(msg)
+	}
+}
+
+func (n *Node) handleVote(msg Message) {
+	lastIndex := n.lastIndex()
+	lastTerm, _ := n.termAt(lastIndex)
+	upToDate := msg.LogTerm > lastTerm || (msg.LogTerm == lastTerm && msg.LogIndex >= lastIndex)
+	grant := (n.vote == "" || n.vote == msg.From) && n.leader == "" && upToDate
+	if grant {
+		if err := n.setHardState(n.term, msg.From); err != nil {
+			return
+		}
+		n.resetElectionTimeout()
+	}
+	n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: !grant})
+}
+
+func (n *Node) handleVoteResp(msg Message) {
+	if n.role != Candidate {
+		return
+	}
+	n.votes[msg.From] = !msg.Reject
+	switch {
+	case n.hasQuorum(func(id string) bool { return n.votes[id] }):
+		n.becomeLeader()
+	case n.hasQuorum(func(id string) bool { granted, voted := n.votes[id]; return voted && !granted }):
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) handleAppend(msg Message) {
+	if n.role != Follower || n.leader != msg.From {
+		n.becomeFollower(n.term, msg.From)
+	}
+	n.electionElapsed = 0
+
+	resp := Message{Type: MsgAppResp, To: msg.From, Seq: msg.Seq}
+	prevIndex, prevTerm, entries := msg.LogIndex, msg.LogTerm, msg.Entries
+	if prevIndex < n.snapshot.Index {
+		// Compacted entries are committed, so they match the leader's
+		skip := n.snapshot.Index - prevIndex
+		if uint64(len(entries)) <= skip {
+			resp.Index = prevIndex + uint64(len(entries))
+			n.send(resp)
+			return
+		}
+		prevIndex, prevTerm, entries = n.snapshot.Index, n.snapshot.Term, entries[skip:]
+	}
+	if term, ok := n.termAt(prevIndex); !ok || term != prevTerm {
+		resp.Reject = true
+		resp.Index = min(prevIndex-1, n.lastIndex())
+		n.send(resp)
+		return
+	}
+
+	for i, e := range entries {
+		if term, ok := n.termAt(e.Index); ok && term == e.Term {
+			continue
+		}
+		if err := n.truncateAndAppend(entries[i:]); err != nil {
+			return
+		}
+		break
+	}
+	lastNew := prevIndex + uint64(len(entries))
+	if msg.Commit > n.commit {
+		n.commit = max(n.commit, min(msg.Commit, lastNew))
+	}
+	resp.Index = lastNew
+	n.send(resp)
+	if n.behind {
+		n.send(Message{Type: MsgSnapRequest, To: msg.From})
+	}
+}
+
+// truncateAndAppend replaces the log from entries[0].Index on. The node stops if that
+// would drop a committed entry or storage fails.
+func (n *Node) truncateAndAppend(entries []Entry) error {
+	from := entries[0].Index
+	if from <= n.commit {
+		return n.fail(fmt.Errorf("raft leader overwrites committed entry %d", from))
+	}
+	if err := n.storage.Append(from, entries); err != nil {
+		return n.fail(fmt.Errorf("failed to store raft log entries: %w", err))
+	}
+	n.log = append(n.log[:from-n.snapshot.Index-1], entries...)
+	n.members = n.membersAt(n.lastIndex())
+	return nil
+}
+
+func (n *Node) handleAppendResp(msg Message) {
+	if n.role != Leader {
+		return
+	}
+	n.active[msg.From] = true
+	if msg.Seq > n.acks[msg.From] {
+		n.acks[msg.From] = msg.Seq
+		n.checkReads()
+	}
+	if _, ok := n.next[msg.From]; !ok {
+		return // No longer a member
+	}
+
+	if msg.Reject {
+		// Back up to the follower's last entry, or one before what was tried
+		next := min(n.next[msg.From]-1, msg.Index+1)
+		n.next[msg.From] = max(next, n.match[msg.From]+1, 1)
+		n.sendAppend(msg.From)
+		return
+	}
+	if msg.Index > n.match[msg.From] {
+		n.match[msg.From] = msg.Index
+		n.maybeCommit()
+	}
+	n.next[msg.From] = max(n.next[msg.From], msg.Index+1)
+	if n.next[msg.From] <= n.lastIndex() {
+		n.sendAppend(msg.From)
+	}
+}
+
+// installSnapshot handles a MsgSnap arriving through InstallSnapshot, as step would.
+func (n *Node) installSnapshot(msg Message, r io.Reader) error {
+	switch {
+	case msg.Type != MsgSnap || msg.Snapshot == nil:
+		return errors.New("not a raft snapshot message")
+	case msg.Term < n.term:
+		n.send(Message{Type: MsgAppResp, To: msg.From, Reject: true})
+		return fmt.Errorf("raft snapshot from term %d, now in term %d", msg.Term, n.term)
+	case msg.Term > n.term:
+		n.becomeFollower(msg.Term, msg.From)
+		if n.failure != nil {
+			return n.failure
+		}
+	}
+	return n.handleSnapshot(msg, r)
+}
+
+func (n *Node) handleSnapshot(msg Message, r io.Reader) error {
+	if n.role != Follower || n.leader != msg.From {
+		n.becomeFollower(n.term, msg.From)
+	}
+	n.electionElapsed = 0
+
+	s := msg.Snapshot
+	switch {
+	case n.behind && s.Index < n.snapshot.Index:
+		// Installing it would drop entries the log holds and the snapshot lacks
+		return fmt.Errorf("raft snapshot at index %d is older than the log, compacted at %d", s.Index, n.snapshot.Index)
+	case !n.behind && s.Index <= n.commit:
+		n.send(Message{Type: MsgAppResp, To: msg.From, Index: n.commit})
+		return nil
+	}
+	err := n.stateMachine.Restore(s.Index, r)
+	if err == nil && n.stateMachine.Persistent() {
+		err = n.stateMachine.Sync()
+	}
+	if err != nil {
+		// The state machine may be part way there: only a whole snapshot repairs it
+		if !n.behind {
+			n.behind, n.applied = true, 0
+		}
+		n.logger.Error("failed to restore raft snapshot", "index", s.Index, "error", err)
+		return fmt.Errorf("failed to restore raft snapshot: %w", err)
+	}
+	if term, ok := n.termAt(s.Index); ok && term == s.Term {
+		n.log = slices.Clone(n.log[s.Index-n.snapshot.Index:])
+		n.commit = max(n.commit, s.Index)
+	} else {
+		n.log = nil
+		if err := n.storage.Append(n.snapshot.Index+1, nil); err != nil {
+			return n.fail(fmt.Errorf("failed to truncate raft log: %w", err))
+		}
+		n.commit = s.Index
+	}
+	if err := n.storage.SetSnapshot(*s); err != nil {
+		return n.fail(fmt.Errorf("failed to store raft snapshot: %w", err))
+	}
+	n.snapshot = *s
+	n.applied, n.behind = s.Index, false
+	n.members = n.membersAt(n.lastIndex())
+	for index, w := range n.waiters {
+		if index <= s.Index {
+			w.result <- proposalResult{err: ErrProposalDropped}
+			delete(n.waiters, index)
+		}
+	}
+	n.logger.Info("raft snapshot installed", "index", s.Index, "term", s.Term)
+	n.send(Message{Type: MsgAppResp, To: msg.From, Index: s.Index})
+	return nil
+}
+
+func (n *Node) handleProposal(p proposal) {
+	if n.role != Leader {
+		p.result <- proposalResult{err: n.notLeader()}
+		return
+	}
+
+	data := p.data
+	if p.change != nil {
+		members, err := n.changeMembers(*p.change)
+		if err != nil {
+			p.result <- proposalResult{err: err}
+			return
+		}
+		if data, err = json.Marshal(members); err != nil {
+			p.result <- proposalResult{err: err}
+			return
+		}
+	}
+	index, err := n.appendEntry(p.typ, data)
+	if err != nil {
+		p.result <- proposalResult{err: err}
+		return
+	}
+	n.waiters[index] = waiter{term: n.term, result: p.result}
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+func (n *Node) notLeader() error {
+	if n.leader == "" {
+		return ErrNoLeader
+	}
+	return fmt.Errorf("%w (leader is %s)", ErrNotLeader, n.leader)
+}
+
+func (n *Node) changeMembers(change memberChange) ([]string, error) {
+	// Until an entry of its term commits, a new leader may hold an uncommitted change
+	// from an earlier term that it does not know is pending: another change on top of
+	// it could let two majorities decide at once.
+	if term, _ := n.termAt(n.commit); term != n.term {
+		return nil, ErrConfigChangePending
+	}
+	for _, e := range n.log {
+		if e.Type == EntryConfig && e.Index > n.commit {
+			return nil, ErrConfigChangePending
+		}
+	}
+	if change.id == "" {
+		return nil, errors.New("member id must not be empty")
+	}
+	isMember := slices.Contains(n.members, change.id)
+	switch {
+	case change.remove && !isMember:
+		return nil, fmt.Errorf("%s is not a member", change.id)
+	case change.remove:
+		return slices.DeleteFunc(slices.Clone(n.members), func(id string) bool { return id == change.id }), nil
+	case isMember:
+		return nil, fmt.Errorf("%s is a member already", change.id)
+	}
+	return append(slices.Clone(n.members), change.id), nil
+}
+
+// appendEntry appends an entry of the current term to the leader's log. If storage
+// fails the log is left as it was.
+func (n *Node) appendEntry(typ EntryType, data []byte) (uint64, error) {
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.storage.Append(entry.Index, []Entry{entry}); err != nil {
+		return 0, fmt.Errorf("failed to store raft log entry: %w", err)
+	}
+	n.log = append(n.log, entry)
+	if typ == EntryConfig {
+		n.members = n.membersAt(entry.Index)
+		for _, id := range n.members {
+			if _, ok := n.next[id]; !ok && id != n.id {
+				n.next[id] = entry.Index
+			}
+		}
+	}
+	return entry.Index, nil
+}
+
+func (n *Node) broadcastAppend() {
+	for id := range n.next {
+		n.sendAppend(id)
+	}
+}
+
+// sendAppend sends the entries to follow what to is known to have, or the snapshot if
+// they were compacted. The next index moves on optimistically; if the message is
+// lost the follower rejects the next one and it moves back.
+func (n *Node) sendAppend(to string) {
+	next := n.next[to]
+	if next <= n.snapshot.Index {
+		n.sendSnapshot(to)
+		return
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	from := next - n.snapshot.Index - 1
+	entries := slices.Clone(n.log[from:min(len(n.log), int(from)+maxAppendEntries)])
+	n.send(Message{
+		Type:     MsgApp,
+		To:       to,
+		LogIndex: next - 1,
+		LogTerm:  prevTerm,
+		Entries:  entries,
+		Commit:   n.commit,
+		Seq:      n.readSeq,
+	})
+	n.next[to] = next + uint64(len(entries))
+}
+
+// sendSnapshot sends a snapshot of the state machine as of the last applied entry to to,
+// unless one is on its way there already. The data is written on a goroutine of its
+// own; meanwhile the next index moves on optimistically, as in sendAppend.
+func (n *Node) sendSnapshot(to string) {
+	if n.sending[to] {
+		return
+	}
+	data, err := n.stateMachine.Snapshot()
+	if err != nil {
+		n.logger.Error("failed to snapshot raft state machine", "index", n.applied, "error", err)
+		return
+	}
+	term, _ := n.termAt(n.applied)
+	s := Snapshot{Index: n.applied, Term: term, Members: n.membersAt(n.applied)}
+	msg := Message{Type: MsgSnap, From: n.id, To: to, Term: n.term, Snapshot: &s, Seq: n.readSeq}
+	n.sending[to] = true
+	n.next[to] = s.Index + 1
+	n.logger.Info("sending raft snapshot", "to", to, "index", s.Index)
+
+	n.senders.Add(1)
+	go func() {
+		defer n.senders.Done()
+		err := n.transport.SendSnapshot(n.sendCtx, msg, data)
+		data.Close()
+		select {
+		case n.sentc <- snapshotSent{to: to, err: err}:
+		case <-n.stopc:
+		}
+	}()
+}
+
+func (n *Node) handleSnapshotSent(sent snapshotSent) {
+	if n.role != Leader {
+		return
+	}
+	delete(n.sending, sent.to)
+	if sent.err != nil {
+		n.logger.Warn("failed to send raft snapshot", "to", sent.to, "error", sent.err)
+		if _, ok := n.next[sent.to]; ok {
+			n.next[sent.to] = n.match[sent.to] + 1
+		}
+	}
+}
+
+// hasQuorum reports whether a majority of the members satisfy fn.
+func (n *Node) hasQuorum(fn func(id string) bool) bool {
+	count := 0
+	for _, id := range n.members {
+		if fn(id) {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *Node) maybeCommit() {
+	matches := make([]uint64, 0, len(n.members))
+	for _, id := range n.members {
+		if id == n.id {
+			matches = append(matches, n.lastIndex())
+		} else {
+			matches = append(matches, n.match[id])
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	slices.Sort(matches)
+	index := matches[(len(matches)-1)/2] // Highest index a majority has
+	if term, _ := n.termAt(index); index <= n.commit || term != n.term {
+		return
+	}
+	n.commit = index
+	n.broadcastAppend()
+
+	deferred := n.deferredReads
+	n.deferredReads = nil
+	for _, req := range deferred {
+		n.leaderRead(req)
+	}
+}
+
+func (n *Node) handleLocalRead(done chan error) {
+	switch {
+	case n.role == Leader:
+		n.leaderRead(readRequest{from: n.id, done: done})
+	case n.leader == "":
+		done <- ErrNoLeader
+	default:
+		n.lastReadID++
+		n.remoteReads[n.lastReadID] = done
+		n.send(Message{Type: MsgReadIndex, To: n.leader, Seq: n.lastReadID})
+	}
+}
+
+// leaderRead starts a read-index round for req: once a quorum acknowledges a
+// heartbeat sent after it arrived, no other leader can have committed anything, and
+// the commit index at arrival is safe to read at.
+func (n *Node) leaderRead(req readRequest) {
+	if term, _ := n.termAt(n.commit); term != n.term {
+		// Until an entry of its term commits, the leader may not know the latest commit index
+		n.deferredReads = append(n.deferredReads, req)
+		return
+	}
+	n.readSeq++
+	req.seq, req.index = n.readSeq, n.commit
+	n.reads = append(n.reads, req)
+	n.broadcastAppend()
+	n.checkReads()
+}
+
+// checkReads completes the read requests whose round a quorum acknowledged.
+func (n *Node) checkReads() {
+	done := 0
+	for _, req := range n.reads {
+		if !n.hasQuorum(func(id string) bool { return id == n.id || n.acks[id] >= req.seq }) {
+			break // Later requests have later rounds
+		}
+		if req.done != nil {
+			n.readWaits = append(n.readWaits, readWait{index: req.index, done: req.done})
+		} else {
+			n.send(Message{Type: MsgReadIndexResp, To: req.from, Seq: req.id, Index: req.index})
+		}
+		done++
+	}
+	n.reads = n.reads[done:]
+}
+
+func (n *Node) handleReadIndexResp(msg Message) {
+	done, ok := n.remoteReads[msg.Seq]
+	if !ok {
+		return
+	}
+	delete(n.remoteReads, msg.Seq)
+	if msg.Reject {
+		done <- n.notLeader()
+		return
+	}
+	n.readWaits = append(n.readWaits, readWait{index: msg.Index, done: done})
+}
+
+func (n *Node) applyCommitted() {
+	if n.behind {
+		return
+	}
+	for n.applied < n.commit {
+		e := n.log[n.applied-n.snapshot.Index]
+		var value any
+		switch {
+		case e.Type == EntryConfig:
+			n.pruneProgress()
+		case len(e.Data) > 0:
+			value = n.stateMachine.Apply(e.Index, e.Data)
+		}
+		n.applied = e.Index
+
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.result <- proposalResult{value: value}
+			} else {
+				w.result <- proposalResult{err: ErrProposalDropped}
+			}
+		}
+	}
+
+	n.readWaits = slices.DeleteFunc(n.readWaits, func(w readWait) bool {
+		if w.index > n.applied {
+			return false
+		}
+		w.done <- nil
+		return true
+	})
+
+	if n.cfg.SnapshotEntries > 0 && n.applied-n.snapshot.Index >= uint64(n.cfg.SnapshotEntries) {
+		n.compact()
+	}
+}
+
+// pruneProgress runs when a configuration commits. The leader stops replicating to
+// removed nodes, and steps down if it removed itself.
+func (n *Node) pruneProgress() {
+	if n.role != Leader {
+		return
+	}
+	for id := range n.next {
+		if !slices.Contains(n.members, id) {
+			delete(n.next, id)
+			delete(n.match, id)
+		}
+	}
+	if !slices.Contains(n.members, n.id) {
+		n.logger.Info("raft leader removed from the group, stepping down", "term", n.term)
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// compact drops the applied entries from the log, leaving a snapshot that marks their
+// end. A persistent state machine is synced first, so that it holds them on restart.
+func (n *Node) compact() {
+	if n.stateMachine.Persistent() {
+		if err := n.stateMachine.Sync(); err != nil {
+			n.logger.Error("failed to sync raft state machine", "index", n.applied, "error", err)
+			return
+		}
+	}
+	term, _ := n.termAt(n.applied)
+	s := Snapshot{Index: n.applied, Term: term, Members: n.membersAt(n.applied)}
+	if err := n.storage.SetSnapshot(s); err != nil {
+		n.logger.Error("failed to store raft snapshot", "index", s.Index, "error", err)
+		return
+	}
+	n.log = slices.Clone(n.log[s.Index-n.snapshot.Index:])
+	n.snapshot = s
+	n.logger.Debug("raft log compacted", "index", s.Index)
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+// termAt returns the term of the entry at index, if it is in the log or the last one
+// covered by the snapshot.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snapshot.Index:
+		return n.snapshot.Term, true
+	case index < n.snapshot.Index || index > n.lastIndex():
+		return 0, false
+	}
+	return n.log[index-n.snapshot.Index-1].Term, true
+}
+
+// membersAt returns the configuration in effect at index.
+func (n *Node) membersAt(index uint64) []string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		e := n.log[i]
+		if e.Index > index || e.Type != EntryConfig {
+			continue
+		}
+		var members []string
+		if err := json.Unmarshal(e.Data, &members); err != nil {
+			panic(fmt.Sprintf("raft: invalid configuration entry %d: %v", e.Index, err))
+		}
+		return members
+	}
+	return slices.Clone(n.snapshot.Members)
+}
@@ -0,0 +1,560 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// kvMachine is a state machine of "key=value" commands. A persistent one is kept
+// across restarts by the cluster, as if it were on disk.
+type kvMachine struct {
+	mu         sync.Mutex
+	data       map[string]string
+	persistent atomic.Bool
+	restores   atomic.Int32
+	synced     map[string]string // What a persistent machine would find on restart
+}
+
+func newKVMachine() *kvMachine {
+	return &kvMachine{data: make(map[string]string)}
+}
+
+func (m *kvMachine) Apply(index uint64, data []byte) any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, value, _ := strings.Cut(string(data), "=")
+	m.data[key] = value
+	return index
+}
+
+func (m *kvMachine) Persistent() bool {
+	return m.persistent.Load()
+}
+
+func (m *kvMachine) Sync() error {
+	data := m.snapshot()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.synced = data
+	return nil
+}
+
+func (m *kvMachine) Snapshot() (SnapshotData, error) {
+	return kvSnapshot(m.snapshot()), nil
+}
+
+func (m *kvMachine) Restore(index uint64, r io.Reader) error {
+	data := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = data
+	m.restores.Add(1)
+	return nil
+}
+
+type kvSnapshot map[string]string
+
+func (s kvSnapshot) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(map[string]string(s))
+	if err != nil {
+		return 0, err
+	}
+	written, err := w.Write(data)
+	return int64(written), err
+}
+
+func (s kvSnapshot) Close() error {
+	return nil
+}
+
+func (m *kvMachine) get(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[key]
+}
+
+func (m *kvMachine) snapshot() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.data)
+}
+
+// cluster runs nodes in this process over a MemoryNetwork.
+type cluster struct {
+	t               *testing.T
+	net             *MemoryNetwork
+	nodes           map[string]*Node
+	storages        map[string]*MemoryStorage
+	machines        map[string]*kvMachine
+	snapshotEntries int
+}
+
+func newCluster(t *testing.T, snapshotEntries int, ids ...string) *cluster {
+	c := &cluster{
+		t:               t,
+		net:             NewMemoryNetwork(),
+		nodes:           make(map[string]*Node),
+		storages:        make(map[string]*MemoryStorage),
+		machines:        make(map[string]*kvMachine),
+		snapshotEntries: snapshotEntries,
+	}
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// start starts id, on the storage it had before if it ran already.
+func (c *cluster) start(id string, members []string) *Node {
+	c.t.Helper()
+	if c.storages[id] == nil {
+		c.storages[id] = NewMemoryStorage()
+	}
+	if m := c.machines[id]; m == nil || !m.Persistent() {
+		c.machines[id] = newKVMachine()
+	}
+	n, err := Start(Config{
+		ID:              id,
+		Members:         members,
+		Storage:         c.storages[id],
+		Transport:       c.net.Transport(id),
+		StateMachine:    c.machines[id],
+		TickInterval:    5 * time.Millisecond,
+		SnapshotEntries: c.snapshotEntries,
+		Logger:          slog.New(slog.DiscardHandler),
+	})
+	if err != nil {
+		c.t.Fatalf("Start(%s) error = %v", id, err)
+	}
+	c.nodes[id] = n
+	c.net.Attach(n)
+	return n
+}
+
+func (c *cluster) stop(id string) {
+	c.net.Detach(id)
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+// leader waits for exactly one of the given nodes to lead, and for the others to
+// follow it.
+func (c *cluster) leader(ids ...string) *Node {
+	c.t.Helper()
+	var leader *Node
+	waitFor(c.t, "a single leader", func() bool {
+		leader = nil
+		var term uint64
+		for _, id := range ids {
+			s := c.nodes[id].Status()
+			if s.Role == Leader {
+				if leader != nil {
+					return false
+				}
+				leader, term = c.nodes[id], s.Term
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range ids {
+			if s := c.nodes[id].Status(); s.Leader != leader.ID() || s.Term != term {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func (c *cluster) propose(n *Node, command string) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := n.Propose(ctx, []byte(command)); err != nil {
+		c.t.Fatalf("Propose(%q) on %s error = %v", command, n.ID(), err)
+	}
+}
+
+// converged waits for the state machines of the given nodes to hold want.
+func (c *cluster) converged(want map[string]string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		waitFor(c.t, fmt.Sprintf("%s to apply every command", id), func() bool {
+			return maps.Equal(c.machines[id].snapshot(), want)
+		})
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func others(ids []string, id string) []string {
+	return slices.DeleteFunc(slices.Clone(ids), func(other string) bool { return other == id })
+}
+
+func TestElection(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 0, ids...)
+
+	first := c.leader(ids...)
+	firstTerm := first.Status().Term
+
+	// A leader cut off from the others steps down, and they elect a new one
+	c.net.Isolate(first.ID())
+	rest := others(ids, first.ID())
+	second := c.leader(rest...)
+	if s := second.Status(); s.Term <= firstTerm {
+		t.Errorf("new leader term = %d, want more than %d", s.Term, firstTerm)
+	}
+	waitFor(t, "the isolated leader to step down", func() bool {
+		return first.Status().Role != Leader
+	})
+
+	c.net.Heal()
+	c.leader(ids...)
+}
+
+func TestReplication(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 0, ids...)
+	leader := c.leader(ids...)
+
+	want := make(map[string]string)
+	for i := range 10 {
+		key, value := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		c.propose(leader, key+"="+value)
+		want[key] = value
+	}
+	c.converged(want, ids...)
+
+	follower := c.nodes[others(ids, leader.ID())[0]]
+	_, err := follower.Propose(context.Background(), []byte("k=v"))
+	if !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Propose() on a follower error = %v, want %v", err, ErrNotLeader)
+	}
+
+	// The remaining majority keeps committing; the isolated follower catches up later
+	c.net.Isolate(follower.ID())
+	for i := range 10 {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(leader, key+"=updated")
+		want[key] = "updated"
+	}
+	c.converged(want, others(ids, follower.ID())...)
+	if got := c.machines[follower.ID()].get("k0"); got != "v0" {
+		t.Errorf("isolated follower k0 = %q, want %q", got, "v0")
+	}
+	c.net.Heal()
+	c.converged(want, ids...)
+}
+
+func TestReplicationLossyNetwork(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 20, ids...)
+	c.net.SetDropRate(0.2)
+
+	want := make(map[string]string)
+	for i := range 50 {
+		key := fmt.Sprintf("k%d", i%10)
+		command := fmt.Sprintf("%s=v%d", key, i)
+		waitFor(t, fmt.Sprintf("%q to commit", command), func() bool {
+			for _, n := range c.nodes {
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				_, err := n.Propose(ctx, []byte(command))
+				cancel()
+				if err == nil {
+					return true
+				}
+			}
+			return false
+		})
+		want[key] = fmt.Sprintf("v%d", i)
+	}
+	c.converged(want, ids...)
+}
+
+func TestReadIndex(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 0, ids...)
+	leader := c.leader(ids...)
+
+	for _, id := range ids {
+		c.propose(leader, "k="+id)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.nodes[id].ReadIndex(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("ReadIndex() on %s error = %v", id, err)
+		}
+		if got := c.machines[id].get("k"); got != id {
+			t.Errorf("%s after ReadIndex() k = %q, want %q", id, got, id)
+		}
+	}
+
+	// A leader that cannot reach a quorum must not serve reads
+	c.net.Isolate(leader.ID())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := leader.ReadIndex(ctx); err == nil {
+		t.Errorf("ReadIndex() on an isolated leader error = nil, want an error")
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 5, ids...)
+	leader := c.leader(ids...)
+
+	want := make(map[string]string)
+	for i := range 20 {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(leader, key+"=v")
+		want[key] = "v"
+	}
+
+	// The new node starts without members and gets the compacted log as a snapshot
+	c.start("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.AddMember(ctx, "n4"); err != nil {
+		t.Fatalf("AddMember(n4) error = %v", err)
+	}
+	if err := leader.AddMember(ctx, "n4"); err == nil {
+		t.Errorf("AddMember(n4) twice error = nil, want an error")
+	}
+	ids = append(ids, "n4")
+	c.converged(want, ids...)
+	waitFor(t, "n4 to learn the configuration", func() bool {
+		return slices.Equal(c.nodes["n4"].Status().Members, ids)
+	})
+
+	// A leader removing itself steps down and the others carry on
+	if err := leader.RemoveMember(ctx, leader.ID()); err != nil {
+		t.Fatalf("RemoveMember(%s) error = %v", leader.ID(), err)
+	}
+	c.stop(leader.ID())
+	ids = others(ids, leader.ID())
+	leader = c.leader(ids...)
+	if got := leader.Status().Members; !slices.Equal(got, ids) {
+		t.Errorf("members = %v, want %v", got, ids)
+	}
+	c.propose(leader, "after=removal")
+	want["after"] = "removal"
+	c.converged(want, ids...)
+
+	if err := leader.RemoveMember(ctx, "n9"); err == nil {
+		t.Errorf("RemoveMember(n9) error = nil, want an error")
+	}
+}
+
+func TestMembershipChangeAfterElection(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 0, ids...)
+	first := c.leader(ids...)
+	c.propose(first, "k=v")
+	firstTerm := first.Status().Term
+
+	// While no append reaches a follower, the leaders elected meanwhile cannot commit
+	// an entry of their term, and so refuse membership changes
+	c.net.SetDrop(func(msg Message) bool { return msg.Type == MsgApp })
+	waitFor(t, "a leader to refuse a membership change", func() bool {
+		for _, n := range c.nodes {
+			if s := n.Status(); s.Role != Leader || s.Term == firstTerm {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err := n.AddMember(ctx, "n4")
+			cancel()
+			switch {
+			case errors.Is(err, ErrConfigChangePending):
+				return true
+			case !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrNoLeader):
+				t.Fatalf("AddMember(n4) on a leader without a committed entry error = %v, want %v", err, ErrConfigChangePending)
+			}
+		}
+		return false
+	})
+
+	// Once the new leader commits an entry of its term, changes go through
+	c.net.SetDrop(nil)
+	c.start("n4", nil)
+	waitFor(t, "AddMember(n4) to succeed", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := c.leader(ids...).AddMember(ctx, "n4")
+		if err != nil && !errors.Is(err, ErrConfigChangePending) && !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrProposalDropped) {
+			t.Fatalf("AddMember(n4) error = %v", err)
+		}
+		return err == nil
+	})
+	ids = append(ids, "n4")
+	c.converged(map[string]string{"k": "v"}, ids...)
+}
+
+// failingStorage fails appends while fail is set, and hard state updates while
+// failHardState is.
+type failingStorage struct {
+	*MemoryStorage
+	fail          atomic.Bool
+	failHardState atomic.Bool
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (s *failingStorage) Append(from uint64, entries []Entry) error {
+	if s.fail.Load() {
+		return errDiskFull
+	}
+	return s.MemoryStorage.Append(from, entries)
+}
+
+func (s *failingStorage) SetHardState(state HardState) error {
+	if s.failHardState.Load() {
+		return errDiskFull
+	}
+	return s.MemoryStorage.SetHardState(state)
+}
+
+func TestProposeStorageFailure(t *testing.T) {
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	machine := newKVMachine()
+	n, err := Start(Config{
+		ID:           "n1",
+		Members:      []string{"n1"},
+		Storage:      storage,
+		Transport:    NewMemoryNetwork().Transport("n1"),
+		StateMachine: machine,
+		TickInterval: 5 * time.Millisecond,
+		Logger:       slog.New(slog.DiscardHandler),
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer n.Stop()
+	waitFor(t, "n1 to lead", func() bool { return n.Status().Role == Leader })
+
+	// The proposer gets the storage error, and the node keeps running
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	storage.fail.Store(true)
+	if _, err := n.Propose(ctx, []byte("k=lost")); !errors.Is(err, errDiskFull) {
+		t.Errorf("Propose() with failing storage error = %v, want %v", err, errDiskFull)
+	}
+	storage.fail.Store(false)
+	if _, err := n.Propose(ctx, []byte("k=v")); err != nil {
+		t.Fatalf("Propose() after storage recovered error = %v", err)
+	}
+	if got := machine.get("k"); got != "v" {
+		t.Errorf("k = %q, want %q", got, "v")
+	}
+}
+
+func TestHardStateStorageFailure(t *testing.T) {
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	storage.failHardState.Store(true)
+	n, err := Start(Config{
+		ID:           "n1",
+		Members:      []string{"n1"},
+		Storage:      storage,
+		Transport:    NewMemoryNetwork().Transport("n1"),
+		StateMachine: newKVMachine(),
+		TickInterval: 5 * time.Millisecond,
+		Logger:       slog.New(slog.DiscardHandler),
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer n.Stop()
+
+	// The first election cannot store its vote, so the node stops with the error
+	select {
+	case <-n.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Node did not stop after its storage failed")
+	}
+	if err := n.Err(); !errors.Is(err, errDiskFull) {
+		t.Errorf("Err() = %v, want %v", err, errDiskFull)
+	}
+	if _, err := n.Propose(context.Background(), []byte("k=v")); !errors.Is(err, ErrStopped) || !errors.Is(err, errDiskFull) {
+		t.Errorf("Propose() on failed node error = %v, want ErrStopped wrapping %v", err, errDiskFull)
+	}
+}
+
+func TestSnapshotAndRestart(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newCluster(t, 5, ids...)
+	leader := c.leader(ids...)
+
+	want := make(map[string]string)
+	for i := range 12 {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(leader, key+"=v")
+		want[key] = "v"
+	}
+	c.converged(want, ids...)
+	if s := leader.Status(); s.SnapshotIndex == 0 || s.LastIndex-s.SnapshotIndex >= 5 {
+		t.Errorf("after 12 commands snapshot index = %d, last index = %d, want the log compacted", s.SnapshotIndex, s.LastIndex)
+	}
+
+	// A restarted follower that kept nothing gets a snapshot from the leader, and
+	// catches up on what it missed
+	follower := others(ids, leader.ID())[0]
+	c.stop(follower)
+	for i := range 12 {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(leader, key+"=w")
+		want[key] = "w"
+	}
+	c.start(follower, ids)
+	c.converged(want, ids...)
+	if c.machines[follower].restores.Load() == 0 {
+		t.Errorf("follower restored no snapshot, want one")
+	}
+
+	// One whose state persists replays its log from the compaction point instead
+	c.machines[follower].persistent.Store(true)
+	c.machines[follower].restores.Store(0)
+	for i := 0; i == 0 || leader.Status().LastIndex > leader.Status().SnapshotIndex; i++ {
+		c.propose(leader, fmt.Sprintf("k%d=x", i))
+		want[fmt.Sprintf("k%d", i)] = "x"
+	}
+	c.converged(want, ids...)
+	c.stop(follower)
+	for i := range 2 {
+		c.propose(leader, fmt.Sprintf("k%d=y", i))
+		want[fmt.Sprintf("k%d", i)] = "y"
+	}
+	c.start(follower, ids)
+	c.converged(want, ids...)
+	if got := c.machines[follower].restores.Load(); got != 0 {
+		t.Errorf("persistent follower restored %d snapshots after a restart, want 0", got)
+	}
+}
@@ -0,0 +1,80 @@
+package raft
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// HardState is the part of a node's state that must survive restarts besides its log.
+type HardState struct {
+	Term uint64
+	Vote string // Candidate voted for in Term, empty if none
+}
+
+// Storage keeps a node's durable state. A node calls it from a single goroutine and
+// only answers messages once its writes returned, so implementations must not return
+// before the data is durable.
+type Storage interface {
+	// Load returns everything stored: the hard state, the latest snapshot and the
+	// entries following it.
+	Load() (HardState, Snapshot, []Entry, error)
+	SetHardState(state HardState) error
+	// Append stores entries from index from on, replacing those stored at or after it.
+	// With no entries it only truncates.
+	Append(from uint64, entries []Entry) error
+	// SetSnapshot stores snapshot and drops the entries it covers.
+	SetSnapshot(snapshot Snapshot) error
+}
+
+// MemoryStorage keeps everything in memory, for tests and for groups whose members
+// never restart. Reusing it for a new node of the same id simulates a restart.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	state    HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snapshot, slices.Clone(s.entries), nil
+}
+
+func (s *MemoryStorage) SetHardState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemoryStorage) Append(from uint64, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := s.snapshot.Index + 1
+	if from < first || from > first+uint64(len(s.entries)) {
+		return fmt.Errorf("cannot append at index %d to a log holding %d to %d", from, first, first+uint64(len(s.entries))-1)
+	}
+	s.entries = append(s.entries[:from-first:from-first], entries...)
+	return nil
+}
+
+func (s *MemoryStorage) SetSnapshot(snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []Entry
+	for _, e := range s.entries {
+		if e.Index > snapshot.Index {
+			kept = append(kept, e)
+		}
+	}
+	s.snapshot, s.entries = snapshot, kept
+	return nil
+}
@@ -0,0 +1,532 @@
+// Package replication keeps a follower's store in step with a leader zapstore-server.
+// The follower copies a snapshot of the leader's log files, then streams every later
+// record from the leader's /admin/changes and applies it with its original version.
+// Followers refuse writes of their own; reads may lag behind the leader.
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/bitcask"
+	"zap-store/internal/zapstore"
+)
+
+// SnapshotPath is the leader endpoint serving snapshots. The position they cover up
+// to is sent in the PositionHeader response header, formatted by FormatPosition.
+const (
+	SnapshotPath   = "/admin/replication/snapshot"
+	PositionHeader = "X-Zapstore-Log-Position"
+)
+
+const (
+	minBackoff        = time.Second // Wait before reconnecting, doubled on every failure
+	maxBackoff        = 30 * time.Second
+	applyBatchSize    = 1000             // Changes applied per engine lock
+	saveInterval      = time.Second      // How often the position is persisted while streaming
+	lagPollInterval   = 5 * time.Second  // How often the leader's log end is fetched
+	streamIdleTimeout = 45 * time.Second // Silence, keepalives included, after which the leader is considered gone
+)
+
+// States a follower reports in Status.
+const (
+	StateConnecting    = "connecting"
+	StateBootstrapping = "bootstrapping"
+	StateStreaming     = "streaming"
+	StateDisconnected  = "disconnected"
+)
+
+// FormatPosition formats pos as "<fileId>:<offset>".
+func FormatPosition(pos storage.LogPosition) string {
+	return fmt.Sprintf("%d:%d", pos.FileID, pos.Offset)
+}
+
+// ParsePosition reads a position formatted by FormatPosition.
+func ParsePosition(s string) (storage.LogPosition, error) {
+	fileId, offset, ok := strings.Cut(s, ":")
+	var pos storage.LogPosition
+	var err error
+	if pos.FileID, err = strconv.ParseInt(fileId, 10, 64); err != nil || !ok || pos.FileID <= 0 {
+		return pos, fmt.Errorf("invalid position %q (want <fileId>:<offset>)", s)
+	}
+	if pos.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || pos.Offset < 0 {
+		return pos, fmt.Errorf("invalid position %q (want <fileId>:<offset>)", s)
+	}
+	return pos, nil
+}
+
+// before reports whether a comes before b in a change log.
+func before(a, b storage.LogPosition) bool {
+	return a.FileID < b.FileID || a.FileID == b.FileID && a.Offset < b.Offset
+}
+
+// lagBytes returns how many bytes of the leader's log lie between pos and end, given
+// the sizes of the leader's log files.
+func lagBytes(pos, end storage.LogPosition, segments []storage.SegmentStats) int64 {
+	if !before(pos, end) {
+		return 0
+	}
+	if pos.FileID == end.FileID {
+		return end.Offset - pos.Offset
+	}
+	lag := end.Offset
+	for _, seg := range segments {
+		switch {
+		case seg.FileID == pos.FileID:
+			lag += max(seg.Bytes-pos.Offset, 0)
+		case seg.FileID > pos.FileID && seg.FileID < end.FileID:
+			lag += seg.Bytes
+		}
+	}
+	return lag
+}
+
+// Status describes how far a follower has got.
+type Status struct {
+	Leader      string              `json:"leader"`
+	State       string              `json:"state"`
+	Position    storage.LogPosition `json:"position"`   // Next record of the leader's log to apply
+	LagBytes    int64               `json:"lagBytes"`   // Leader log bytes not applied yet, as of the last poll
+	LagSeconds  float64             `json:"lagSeconds"` // How far behind the leader the applied data is
+	LastContact time.Time           `json:"lastContact,omitzero"`
+	LastError   string              `json:"lastError,omitempty"`
+}
+
+// savedState is the content of the state file.
+type savedState struct {
+	Leader   string              `json:"leader"`
+	Position storage.LogPosition `json:"position"`
+}
+
+// Follower replicates a leader into a local store.
+type Follower struct {
+	kv        *zapstore.ZapStore
+	leader    string // Base URL, without a trailing slash
+	token     string
+	client    *http.Client
+	stateFile string
+	logger    *slog.Logger
+	started   time.Time
+
+	mu          sync.Mutex
+	state       string
+	pos         storage.LogPosition
+	synced      bool // Whether the local data matches the leader's log up to pos
+	lastContact time.Time
+	lastErr     error
+	lag         int64               // lagBytes as of the last poll
+	polledEnd   storage.LogPosition // Leader log end at the last poll
+	polledAt    time.Time
+	caughtUp    time.Time // When the leader's log last ended where the follower is now
+}
+
+// Option configures a Follower.
+type Option func(*Follower)
+
+// WithToken authenticates to the leader with a bearer token, which needs admin rights.
+func WithToken(token string) Option {
+	return func(f *Follower) { f.token = token }
+}
+
+// WithHTTPClient sets the client used to reach the leader, e.g. to trust its CA. It
+// must not have a Timeout, since the change stream stays open.
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *Follower) { f.client = client }
+}
+
+// WithStateFile persists the replication position in path, so that a follower with a
+// durable engine resumes where it stopped instead of copying a new snapshot.
+func WithStateFile(path string) Option {
+	return func(f *Follower) { f.stateFile = path }
+}
+
+// WithLogger sets the logger. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(f *Follower) { f.logger = logger }
+}
+
+// NewFollower returns a follower of the server at leader, an http or https URL, and
+// makes kv read-only. Call Run to start replicating.
+func NewFollower(kv *zapstore.ZapStore, leader string, opts ...Option) (*Follower, error) {
+	u, err := url.Parse(leader)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid leader URL %q (want http:// or https://)", leader)
+	}
+	f := &Follower{
+		kv:      kv,
+		leader:  strings.TrimSuffix(leader, "/"),
+		client:  http.DefaultClient,
+		logger:  slog.Default(),
+		started: time.Now(),
+		state:   StateConnecting,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if f.stateFile != "" {
+		data, err := os.ReadFile(f.stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read replication state: %w", err)
+		}
+		var saved savedState
+		if err == nil {
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("failed to parse replication state %s: %w", f.stateFile, err)
+			}
+		}
+		// A position in another leader's log means nothing here
+		if saved.Leader == f.leader && saved.Position != (storage.LogPosition{}) {
+			f.pos, f.synced = saved.Position, true
+		}
+	}
+
+	kv.SetReadOnly("this server is a replica of " + f.leader)
+	return f, nil
+}
+
+// Health returns an error wrapping storage.ErrNotReady until the follower holds a copy
+// of the leader's data. A follower that lost its connection stays ready, serving what
+// it has.
+func (f *Follower) Health() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.synced {
+		return fmt.Errorf("%w: replica is copying the leader's data", storage.ErrNotReady)
+	}
+	return nil
+}
+
+// Status reports the follower's state and lag.
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := Status{
+		Leader:      f.leader,
+		State:       f.state,
+		Position:    f.pos,
+		LagBytes:    f.lag,
+		LastContact: f.lastContact,
+	}
+	if f.lastErr != nil {
+		status.LastError = f.lastErr.Error()
+	}
+	if f.lag > 0 || !f.synced {
+		since := f.caughtUp
+		if since.IsZero() {
+			since = f.started
+		}
+		status.LagSeconds = time.Since(since).Seconds()
+	}
+	return status
+}
+
+// Run replicates until ctx ends, reconnecting with backoff whenever the connection to
+// the leader fails. It saves the position before returning.
+func (f *Follower) Run(ctx context.Context) {
+	go f.pollLag(ctx)
+
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			if err := f.save(); err != nil {
+				f.logger.Error("failed to save replication state", "error", err)
+			}
+			return
+		}
+
+		f.mu.Lock()
+		f.state, f.lastErr = StateDisconnected, err
+		f.mu.Unlock()
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff // The connection worked for a while
+		}
+		f.logger.Warn("replication interrupted", "leader", f.leader, "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			continue // Saves and returns above
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// follow bootstraps from a snapshot if needed and streams changes until it fails.
+func (f *Follower) follow(ctx context.Context) error {
+	for {
+		f.mu.Lock()
+		f.state = StateConnecting
+		synced := f.synced
+		f.mu.Unlock()
+
+		if !synced {
+			if err := f.bootstrap(ctx); err != nil {
+				return err
+			}
+		}
+		err := f.stream(ctx)
+		if !errors.Is(err, storage.ErrLogPositionLost) {
+			return err
+		}
+		f.logger.Warn("leader no longer has the replication position, copying a new snapshot", "leader", f.leader, "error", err)
+		f.mu.Lock()
+		f.synced = false
+		f.mu.Unlock()
+	}
+}
+
+// get requests path from the leader, turning answers other than 200 into errors.
+func (f *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, fmt.Errorf("leader answered %s to %s: %w", resp.Status, path, storage.ErrLogPositionLost)
+		}
+		return nil, fmt.Errorf("leader answered %s to %s: %s", resp.Status, path, bytes.TrimSpace(body))
+	}
+
+	f.mu.Lock()
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+	return resp, nil
+}
+
+// bootstrap replaces the local data with a snapshot of the leader's.
+func (f *Follower) bootstrap(ctx context.Context) error {
+	f.mu.Lock()
+	f.state = StateBootstrapping
+	f.mu.Unlock()
+
+	resp, err := f.get(ctx, SnapshotPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	end, err := ParsePosition(resp.Header.Get(PositionHeader))
+	if err != nil {
+		return fmt.Errorf("leader sent a snapshot without a valid position: %w", err)
+	}
+
+	// Until the snapshot is loaded a restart has to start over
+	if f.stateFile != "" {
+		if err := os.Remove(f.stateFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove replication state: %w", err)
+		}
+	}
+	f.logger.Info("copying snapshot from leader", "leader", f.leader, "position", FormatPosition(end))
+	start := time.Now()
+	if err := f.kv.Reset(); err != nil {
+		return fmt.Errorf("failed to clear local data: %w", err)
+	}
+
+	batch := make([]storage.Change, 0, applyBatchSize)
+	records := 0
+	err = bitcask.ReadSnapshot(resp.Body, func(change storage.Change) error {
+		batch = append(batch, change)
+		records++
+		if len(batch) < applyBatchSize {
+			return nil
+		}
+		err := f.kv.Apply(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err == nil && len(batch) > 0 {
+		err = f.kv.Apply(batch)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	f.mu.Lock()
+	f.pos, f.synced = end, true
+	f.mu.Unlock()
+	f.logger.Info("loaded snapshot from leader", "records", records, "duration", time.Since(start))
+	return f.save()
+}
+
+// stream applies the changes the leader logs from the current position on, until the
+// connection fails or ctx ends.
+func (f *Follower) stream(ctx context.Context) error {
+	f.mu.Lock()
+	pos := f.pos
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := f.get(ctx, fmt.Sprintf("/admin/changes?fileId=%d&offset=%d", pos.FileID, pos.Offset))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f.mu.Lock()
+	f.state, f.lastErr = StateStreaming, nil
+	f.mu.Unlock()
+	f.logger.Info("streaming changes from leader", "leader", f.leader, "position", FormatPosition(pos))
+
+	// The leader sends empty lines while idle, so silence means the connection is dead
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	reader := bufio.NewReaderSize(resp.Body, 64<<10)
+	batch := make([]storage.Change, 0, applyBatchSize)
+	lastSave := time.Now()
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil && !idle.Stop() {
+				return fmt.Errorf("no data from leader for %s", streamIdleTimeout)
+			}
+			return fmt.Errorf("change stream ended: %w", err)
+		}
+		idle.Reset(streamIdleTimeout)
+		f.mu.Lock()
+		f.lastContact = time.Now()
+		f.mu.Unlock()
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var change storage.Change
+			if err := json.Unmarshal(line, &change); err != nil {
+				return fmt.Errorf("invalid change from leader: %w", err)
+			}
+			batch = append(batch, change)
+		}
+		// Apply once everything received so far is decoded
+		if len(batch) > 0 && (reader.Buffered() == 0 || len(batch) == applyBatchSize) {
+			if err := f.apply(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if time.Since(lastSave) >= saveInterval {
+			if err := f.save(); err != nil {
+				return err
+			}
+			lastSave = time.Now()
+		}
+	}
+}
+
+// apply applies a batch of streamed changes and moves the position past them.
+func (f *Follower) apply(batch []storage.Change) error {
+	if err := f.kv.Apply(batch); err != nil {
+		return fmt.Errorf("failed to apply changes: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pos = batch[len(batch)-1].Next
+	if !before(f.pos, f.polledEnd) {
+		f.lag = 0
+		if f.polledAt.After(f.caughtUp) {
+			f.caughtUp = f.polledAt
+		}
+	}
+	return nil
+}
+
+// save persists the position, after syncing the engine so that the data it covers is
+// durable too.
+func (f *Follower) save() error {
+	f.mu.Lock()
+	pos, synced := f.pos, f.synced
+	f.mu.Unlock()
+	if f.stateFile == "" || !synced {
+		return nil
+	}
+
+	if engine, ok := f.kv.StorageEngine.(interface{ Sync() error }); ok {
+		if err := engine.Sync(); err != nil {
+			return fmt.Errorf("failed to sync replicated data: %w", err)
+		}
+	}
+	data, err := json.Marshal(savedState{Leader: f.leader, Position: pos})
+	if err != nil {
+		return err
+	}
+	tmp := f.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write replication state: %w", err)
+	}
+	if err := os.Rename(tmp, f.stateFile); err != nil {
+		return fmt.Errorf("failed to write replication state: %w", err)
+	}
+	return nil
+}
+
+// leaderStats is the part of the leader's /admin/stats the lag is computed from.
+type leaderStats struct {
+	LogEnd   *storage.LogPosition   `json:"logEnd"`
+	Segments []storage.SegmentStats `json:"segments"`
+}
+
+// pollLag fetches the leader's log end every lagPollInterval until ctx ends.
+func (f *Follower) pollLag(ctx context.Context) {
+	ticker := time.NewTicker(lagPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.updateLag(ctx); err != nil && ctx.Err() == nil {
+			f.logger.Debug("failed to fetch leader stats", "leader", f.leader, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateLag compares the leader's log end with the follower's position.
+func (f *Follower) updateLag(ctx context.Context) error {
+	polledAt := time.Now()
+	resp, err := f.get(ctx, "/admin/stats")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var stats leaderStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return fmt.Errorf("invalid stats from leader: %w", err)
+	}
+	if stats.LogEnd == nil {
+		return errors.New("leader does not report its log end")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.polledEnd, f.polledAt = *stats.LogEnd, polledAt
+	f.lag = lagBytes(f.pos, f.polledEnd, stats.Segments)
+	if f.lag == 0 && f.synced {
+		f.caughtUp = polledAt
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package replication
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/inmem"
+	"zap-store/internal/zapstore"
+)
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    storage.LogPosition
+		wantErr bool
+	}{
+		{input: "3:1024", want: storage.LogPosition{FileID: 3, Offset: 1024}},
+		{input: "1:0", want: storage.LogPosition{FileID: 1}},
+		{input: "0:10", wantErr: true},
+		{input: "3", wantErr: true},
+		{input: "3:-1", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePosition(tt.input)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("ParsePosition(%q) = %+v, %v, want %+v, error %v", tt.input, got, err, tt.want, tt.wantErr)
+		}
+		if !tt.wantErr && FormatPosition(got) != tt.input {
+			t.Errorf("FormatPosition(%+v) = %q, want %q", got, FormatPosition(got), tt.input)
+		}
+	}
+}
+
+func TestLagBytes(t *testing.T) {
+	segments := []storage.SegmentStats{{FileID: 1, Bytes: 100}, {FileID: 2, Bytes: 200}, {FileID: 3, Bytes: 50}}
+	tests := []struct {
+		name     string
+		pos, end storage.LogPosition
+		want     int64
+	}{
+		{name: "caught_up", pos: storage.LogPosition{FileID: 3, Offset: 50}, end: storage.LogPosition{FileID: 3, Offset: 50}, want: 0},
+		{name: "ahead_of_poll", pos: storage.LogPosition{FileID: 3, Offset: 60}, end: storage.LogPosition{FileID: 3, Offset: 50}, want: 0},
+		{name: "same_file", pos: storage.LogPosition{FileID: 3, Offset: 20}, end: storage.LogPosition{FileID: 3, Offset: 50}, want: 30},
+		{name: "across_files", pos: storage.LogPosition{FileID: 1, Offset: 40}, end: storage.LogPosition{FileID: 3, Offset: 50}, want: 60 + 200 + 50},
+		{name: "from_nothing", pos: storage.LogPosition{}, end: storage.LogPosition{FileID: 3, Offset: 50}, want: 350},
+	}
+
+	for _, tt := range tests {
+		if got := lagBytes(tt.pos, tt.end, segments); got != tt.want {
+			t.Errorf("lagBytes(%+v, %+v) %s = %d, want %d", tt.pos, tt.end, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewFollower(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "replication.json")
+	os.WriteFile(stateFile, []byte(`{"leader":"http://leader:8080","position":{"fileId":4,"offset":128}}`), 0644)
+
+	tests := []struct {
+		name      string
+		leader    string
+		wantErr   bool
+		wantReady bool
+	}{
+		{name: "resumes_saved_position", leader: "http://leader:8080/", wantReady: true},
+		{name: "other_leader", leader: "http://other:8080"},
+		{name: "not_a_url", leader: "leader:8080", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvs := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+			f, err := NewFollower(kvs, tt.leader, WithStateFile(stateFile))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFollower(%q) error = %v, wantErr %v", tt.leader, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ready := f.Health() == nil; ready != tt.wantReady {
+				t.Errorf("Health() = %v, want ready %v", f.Health(), tt.wantReady)
+			}
+			if err := kvs.Set("k", "v"); !errors.Is(err, storage.ErrReadOnly) {
+				t.Errorf("Set() on a follower error = %v, want ErrReadOnly", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"zap-store/internal/auth"
+)
+
+type principalKey struct{}
+
+// authMiddleware rejects requests without a valid bearer token with 401 and stores
+// the caller's principal in the request context for the handlers' permission checks.
+// Failures to look the token up are reported like any other storage error.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = ""
+		}
+
+		principal, err := s.auth.Authenticate(strings.TrimSpace(token))
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zapstore"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.principal = principal.Name
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// authorize checks that the caller may perform an operation needing perm on key and
+// writes a 403 response if not. Requests carry no principal when authentication is
+// disabled, in which case everything is allowed.
+func authorize(w http.ResponseWriter, r *http.Request, perm auth.Permission, key string) bool {
+	principal, ok := r.Context().Value(principalKey{}).(*auth.Principal)
+	if !ok {
+		return true
+	}
+	if err := principal.Authorize(perm, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// tokensHandler manages tokens stored in the reserved keyspace. POST creates a token
+// and returns it once; DELETE ?id= revokes one. Both need admin rights on every key.
+func tokensHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a == nil {
+			http.Error(w, "authentication is disabled", http.StatusNotFound)
+			return
+		}
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req auth.Principal
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			token, id, err := a.CreateToken(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"id": id, "token": token})
+
+		case http.MethodDelete:
+			if err := a.RevokeToken(r.URL.Query().Get("id")); err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, auth.ErrInvalidTokenID) {
+					status = http.StatusBadRequest
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"zap-store/internal/auth"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+// maxBatchKeys caps the number of keys in one /mget or /mset request.
+const maxBatchKeys = 1000
+
+// mgetResult is one element of the /mget response. Value is omitted for missing keys.
+type mgetResult struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Found bool    `json:"found"`
+}
+
+// decodeBatch reads a JSON array request body into v, answering 400 or 413 on failure.
+func decodeBatch(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkBatchKeys validates the keys of a batch and the caller's rights on every one.
+func checkBatchKeys(w http.ResponseWriter, r *http.Request, perm auth.Permission, keys []string) bool {
+	if len(keys) > maxBatchKeys {
+		http.Error(w, fmt.Sprintf("too many keys (%d, at most %d)", len(keys), maxBatchKeys), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	for _, key := range keys {
+		if key == "" {
+			http.Error(w, "keys cannot be empty", http.StatusBadRequest)
+			return false
+		}
+		if !authorize(w, r, perm, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// mgetHandler takes a JSON array of keys and returns, in the same order, an array of
+// {"key", "value", "found"} objects.
+func mgetHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if !decodeBatch(w, r, &keys) || !checkBatchKeys(w, r, auth.Read, keys) {
+			return
+		}
+
+		results, err := kvs.MGetContext(r.Context(), keys)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+
+		resp := make([]mgetResult, len(keys))
+		for i, key := range keys {
+			resp[i] = mgetResult{Key: key, Found: results[i].Found}
+			if results[i].Found {
+				resp[i].Value = &results[i].Value
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// msetHandler takes a JSON array of {"key", "value"} objects and stores them all.
+func msetHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var pairs []storage.KeyValue
+		if !decodeBatch(w, r, &pairs) {
+			return
+		}
+		keys := make([]string, len(pairs))
+		for i, pair := range pairs {
+			keys[i] = pair.Key
+		}
+		if !checkBatchKeys(w, r, auth.Write, keys) {
+			return
+		}
+
+		if err := kvs.MSetContext(r.Context(), pairs); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"zap-store/internal/auth"
+	"zap-store/internal/cdc"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+// changesPosition reads the starting position of /admin/changes: ?fileId= and ?offset=,
+// or ?from=start or ?from=end (the default).
+func changesPosition(r *http.Request, kvs *zapstore.ZapStore) (storage.LogPosition, error) {
+	query := r.URL.Query()
+	if fileId := query.Get("fileId"); fileId != "" {
+		var pos storage.LogPosition
+		var err error
+		if pos.FileID, err = strconv.ParseInt(fileId, 10, 64); err != nil || pos.FileID <= 0 {
+			return pos, fmt.Errorf("invalid fileId %q", fileId)
+		}
+		if offset := query.Get("offset"); offset != "" {
+			if pos.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || pos.Offset < 0 {
+				return pos, fmt.Errorf("invalid offset %q", offset)
+			}
+		}
+		return pos, nil
+	}
+
+	switch from := query.Get("from"); from {
+	case "start":
+		return storage.LogPosition{}, nil
+	case "", "end":
+		return kvs.LogEnd()
+	default:
+		return storage.LogPosition{}, fmt.Errorf("invalid from %q (want start or end)", from)
+	}
+}
+
+// changesHandler streams the engine's change log as newline delimited JSON changes,
+// following it until the client disconnects. Each change carries the position to
+// resume from. Empty lines are sent while idle. Needs admin rights on every key.
+func (s *Server) changesHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		from, err := changesPosition(r, kvs)
+		if errors.Is(err, errors.ErrUnsupported) {
+			writeStorageError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reader, err := kvs.Tail(from)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		defer reader.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer context.AfterFunc(s.streams, cancel)()
+
+		// Poll once before answering, so a lost position gets a proper status
+		poll, stop := context.WithCancel(ctx)
+		stop()
+		first, err := reader.Next(poll)
+		if errors.Is(err, storage.ErrLogPositionLost) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			writeStorageError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		sink := cdc.NewStreamSink(w, http.NewResponseController(w).Flush, true)
+		if err == nil {
+			err = sink.Write(first) // A change was already waiting
+		}
+		if err == nil || errors.Is(err, context.Canceled) {
+			err = cdc.Copy(ctx, sink, reader, watchHeartbeat)
+		}
+		if ctx.Err() == nil {
+			s.logger.Error("change stream failed", "request_id", RequestID(r.Context()), "error", err)
+			panic(http.ErrAbortHandler) // Let the client see a broken stream rather than its end
+		}
+	}
+}
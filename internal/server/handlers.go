@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"zap-store/internal/auth"
+	"zap-store/internal/zapstore"
+)
+
+func setHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Write, req.Key) {
+			return
+		}
+
+		if err := kvs.SetContext(r.Context(), req.Key, req.Value); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	}
+}
+
+func getHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Read, key) {
+			return
+		}
+		value, err := kvs.GetContext(r.Context(), key)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.Write([]byte(value))
+	}
+}
+
+func deleteHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Write, key) {
+			return
+		}
+		err := kvs.DeleteContext(r.Context(), key)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/replication"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+// probePaths are served without authentication so orchestrators can reach them.
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// healthzHandler reports that the process is up and serving HTTP.
+func healthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// engineHealth returns why kvs cannot serve requests, or nil if it can.
+func engineHealth(kvs *zapstore.ZapStore) error {
+	if checker, ok := kvs.StorageEngine.(storage.HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// readyzHandler answers 503 while the engine is loading or has stopped taking writes,
+// and on followers until they have copied the leader's data. replica may be nil.
+func readyzHandler(kvs *zapstore.ZapStore, replica *replication.Follower) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := engineHealth(kvs)
+		if err == nil && replica != nil {
+			err = replica.Health()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// statsResponse is the body of /admin/stats.
+type statsResponse struct {
+	storage.Stats
+	DataBytes     int64   `json:"dataBytes"`
+	DeadBytes     int64   `json:"deadBytes"`
+	Ready         bool    `json:"ready"`
+	Status        string  `json:"status,omitempty"` // Why the engine is not ready
+	StartedAt     string  `json:"startedAt"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+
+	LogEnd      *storage.LogPosition `json:"logEnd,omitempty"`      // Where the next write will be logged
+	Replication *replication.Status  `json:"replication,omitempty"` // Only on followers
+}
+
+// statsHandler returns engine statistics, and on followers the replication state, as
+// JSON. It needs admin rights on every key.
+func statsHandler(kvs *zapstore.ZapStore, replica *replication.Follower, started time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+
+		resp := statsResponse{
+			Ready:         true,
+			StartedAt:     started.UTC().Format(time.RFC3339),
+			UptimeSeconds: time.Since(started).Seconds(),
+		}
+		health := engineHealth(kvs)
+		if health != nil {
+			resp.Ready, resp.Status = false, health.Error()
+		}
+		// Stats waits for a loading engine, so only ask once it has loaded
+		if reporter, ok := kvs.StorageEngine.(storage.StatsReporter); ok && !errors.Is(health, storage.ErrNotReady) {
+			resp.Stats = reporter.Stats()
+			resp.DataBytes, resp.DeadBytes = resp.Stats.DataBytes(), resp.Stats.DeadBytes()
+		}
+		if end, err := kvs.LogEnd(); err == nil && health == nil {
+			resp.LogEnd = &end
+		}
+		if replica != nil {
+			status := replica.Status()
+			resp.Replication = &status
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
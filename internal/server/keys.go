@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"zap-store/internal/auth"
+	"zap-store/internal/bulk"
+	"zap-store/internal/raft"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+// maxValueSize caps the request body of a PUT.
+const maxValueSize = 32 << 20 // 32 MiB
+
+// formatETag renders a record version as a strong entity tag.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 16) + `"`
+}
+
+// etagMatches reports whether header, "*" or a comma separated list of entity tags,
+// matches the current state of a key. Weak tags (W/"...") only match when weak is
+// set: If-None-Match compares weakly, If-Match strongly.
+func etagMatches(header string, version uint64, exists, weak bool) bool {
+	if !exists {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	current := formatETag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// conditions holds the If-Match and If-None-Match headers of a request.
+type conditions struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+func requestConditions(r *http.Request) conditions {
+	return conditions{ifMatch: r.Header.Get("If-Match"), ifNoneMatch: r.Header.Get("If-None-Match")}
+}
+
+// precondition returns check, or nil for a request without conditions: under Raft a
+// precondition costs a linearizable read and makes the write fail if the key changes
+// before it commits.
+func (c conditions) precondition() storage.Precondition {
+	if c.ifMatch == "" && c.ifNoneMatch == "" {
+		return nil
+	}
+	return c.check
+}
+
+// check is the storage.Precondition of a conditional write.
+func (c conditions) check(version uint64, exists bool) error {
+	if c.ifMatch != "" && !etagMatches(c.ifMatch, version, exists, false) {
+		return storage.ErrPreconditionFailed
+	}
+	if c.ifNoneMatch != "" && etagMatches(c.ifNoneMatch, version, exists, true) {
+		return storage.ErrPreconditionFailed
+	}
+	return nil
+}
+
+// writeStorageError maps an engine error onto an HTTP status.
+func writeStorageError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, storage.ErrEmptyKey):
+		status = http.StatusBadRequest
+	case errors.Is(err, storage.ErrReadOnly), errors.Is(err, storage.ErrNotReady):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// The request gave up waiting for the store; the client has usually gone too
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, errors.ErrUnsupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, raft.ErrConfigChangePending):
+		status = http.StatusConflict
+	case isRaftError(err):
+		// Writes go to the leader, named in the error when known
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// wantsJSON reports whether the client prefers a JSON document over the raw value.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// keyResponse is the JSON representation of a key.
+type keyResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// keyGetHandler serves GET and HEAD /v1/keys/{key}. The value is returned raw, or as
+// JSON when the client accepts application/json, with its version as the ETag.
+func keyGetHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Read, key) {
+			return
+		}
+
+		value, version, err := kvs.GetVersionedContext(r.Context(), key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			writeStorageError(w, err)
+			return
+		}
+
+		cond := requestConditions(r)
+		if cond.ifMatch != "" && !etagMatches(cond.ifMatch, version, exists, false) {
+			http.Error(w, storage.ErrPreconditionFailed.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if !exists {
+			writeStorageError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", formatETag(version))
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Vary", "Accept")
+		if cond.ifNoneMatch != "" && etagMatches(cond.ifNoneMatch, version, exists, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		body := []byte(value)
+		contentType := "application/octet-stream"
+		if wantsJSON(r) {
+			body, _ = json.Marshal(keyResponse{Key: key, Value: value})
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}
+}
+
+// keyPutHandler serves PUT /v1/keys/{key}. The body is the raw value, or a JSON
+// {"value": ...} document when sent as application/json. It answers 201 when the key
+// was created and 204 when it was replaced, with the new version as the ETag.
+func keyPutHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Write, key) {
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value := string(body)
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			var req struct {
+				Value *string `json:"value"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil || req.Value == nil {
+				http.Error(w, `body must be a JSON object with a string "value"`, http.StatusBadRequest)
+				return
+			}
+			value = *req.Value
+		}
+
+		version, created, err := kvs.PutContext(r.Context(), key, value, requestConditions(r).precondition())
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", formatETag(version))
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// keyDeleteHandler serves DELETE /v1/keys/{key}, answering 404 if the key is absent.
+func keyDeleteHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, auth.Write, key) {
+			return
+		}
+
+		if err := kvs.DeleteIfContext(r.Context(), key, requestConditions(r).precondition()); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// keyScanHandler serves GET /v1/keys?prefix=, streaming the keys under the prefix and
+// their values in key order as NDJSON. Needs read rights on the prefix; keys the token
+// cannot read are left out. A failure part way aborts the response, so the client sees
+// a truncated stream rather than a short one.
+func keyScanHandler(kvs *zapstore.ZapStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if !authorize(w, r, auth.Read, prefix) {
+			return
+		}
+		principal, _ := r.Context().Value(principalKey{}).(*auth.Principal)
+
+		w.Header().Set("Content-Type", bulk.NDJSON.ContentType())
+		w.Header().Set("Cache-Control", "no-store")
+		writer := bulk.NewWriter(w, bulk.NDJSON)
+		flusher := http.NewResponseController(w)
+		var scanned int
+		err := kvs.ScanContext(r.Context(), prefix, func(key, value string) error {
+			if principal != nil && principal.Authorize(auth.Read, key) != nil {
+				return nil
+			}
+			if err := writer.Write(storage.KeyValue{Key: key, Value: value}); err != nil {
+				return err
+			}
+			scanned++
+			if scanned%exportFlushEvery == 0 {
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil && scanned == 0 {
+			writeStorageError(w, err)
+			return
+		}
+		if err != nil {
+			logger.Error("scan failed", "request_id", RequestID(r.Context()), "scanned", scanned, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"zap-store/internal/metrics"
+	"zap-store/internal/replication"
+	"zap-store/internal/storage"
+)
+
+// httpMetrics holds the per-request metric families.
+type httpMetrics struct {
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+}
+
+func newHTTPMetrics(reg *metrics.Registry) *httpMetrics {
+	return &httpMetrics{
+		requests: reg.NewCounterVec("zapstore_http_requests_total",
+			"HTTP requests served, by operation and status code.", "op", "code"),
+		latency: reg.NewHistogramVec("zapstore_http_request_duration_seconds",
+			"HTTP request latency, by operation.", metrics.DefaultBuckets, "op"),
+	}
+}
+
+// instrument records the count, status and latency of requests handled by next as op.
+func (m *httpMetrics) instrument(op string, next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		m.requests.WithLabelValues(op, strconv.Itoa(rec.statusCode())).Inc()
+		m.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	})
+}
+
+// engineStats holds the engine's Stats for the duration of a scrape. The first engine
+// gauge refreshes it and the others read it, so a scrape computes Stats once: for
+// bitcask that lists the data directory and stats every file under the engine lock.
+type engineStats struct {
+	reporter storage.StatsReporter
+	mu       sync.Mutex
+	stats    storage.Stats
+}
+
+// refresh computes the Stats anew and returns them.
+func (e *engineStats) refresh() storage.Stats {
+	stats := e.reporter.Stats()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stats = stats
+	return stats
+}
+
+// get returns the Stats computed by the last refresh.
+func (e *engineStats) get() storage.Stats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+// registerEngineGauges exposes the engine's Stats as gauges, if it reports any.
+func registerEngineGauges(reg *metrics.Registry, engine storage.StorageEngine) {
+	reporter, ok := engine.(storage.StatsReporter)
+	if !ok {
+		return
+	}
+	cache := &engineStats{reporter: reporter}
+
+	// Gauges are collected in the order they are registered, so this one goes first.
+	reg.NewGaugeFunc("zapstore_keys", "Number of live keys.", func() float64 {
+		return float64(cache.refresh().Keys)
+	})
+	reg.NewGaugeFunc("zapstore_keydir_bytes", "Approximate memory used by the key index.", func() float64 {
+		return float64(cache.get().KeyDirBytes)
+	})
+	reg.NewGaugeFunc("zapstore_open_files", "File handles held open by the engine.", func() float64 {
+		return float64(cache.get().OpenFiles)
+	})
+	reg.NewGaugeVecFunc("zapstore_segment_bytes", "Size of each data file.", []string{"segment"},
+		func(emit func(float64, ...string)) {
+			for _, seg := range cache.get().Segments {
+				emit(float64(seg.Bytes), strconv.FormatInt(seg.FileID, 10))
+			}
+		})
+	reg.NewGaugeVecFunc("zapstore_segment_dead_bytes", "Reclaimable bytes in each data file.", []string{"segment"},
+		func(emit func(float64, ...string)) {
+			for _, seg := range cache.get().Segments {
+				emit(float64(seg.DeadBytes), strconv.FormatInt(seg.FileID, 10))
+			}
+		})
+	reg.NewGaugeFunc("zapstore_dead_bytes_ratio", "Share of data file bytes that a merge would reclaim.", func() float64 {
+		stats := cache.get()
+		if stats.DataBytes() == 0 {
+			return 0
+		}
+		return float64(stats.DeadBytes()) / float64(stats.DataBytes())
+	})
+}
+
+// registerReplicationGauges exposes the lag and connection state of a follower.
+func registerReplicationGauges(reg *metrics.Registry, f *replication.Follower) {
+	reg.NewGaugeFunc("zapstore_replication_lag_bytes", "Leader log bytes the follower has not applied yet.", func() float64 {
+		return float64(f.Status().LagBytes)
+	})
+	reg.NewGaugeFunc("zapstore_replication_lag_seconds", "How far behind the leader the follower's data is.", func() float64 {
+		return f.Status().LagSeconds
+	})
+	reg.NewGaugeFunc("zapstore_replication_connected", "Whether the follower is streaming changes from the leader.", func() float64 {
+		if f.Status().State == replication.StateStreaming {
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. to flush).
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in as a request passes through the middleware chain and
+// read back by the access log.
+type requestInfo struct {
+	id        string
+	principal string // Set by authMiddleware once the caller is known
+}
+
+// RequestID returns the ID the access log assigned to the request carrying ctx.
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a client supplied ID is safe to reuse in logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog tags each request with an ID, echoed in the X-Request-ID response header,
+// and logs its outcome once it completes. Requests slower than the slow threshold are
+// also logged as warnings, except for watches; probes are only logged at debug level
+// to keep the log quiet.
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{id: id}
+		w.Header().Set(requestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		// Logged from a defer so aborted handlers (http.ErrAbortHandler) still show up
+		defer func() {
+			took := time.Since(start)
+			attrs := []any{
+				"request_id", id,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.statusCode(),
+				"bytes", rec.bytes,
+				"duration", took,
+				"remote", r.RemoteAddr,
+			}
+			if info.principal != "" {
+				attrs = append(attrs, "principal", info.principal)
+			}
+
+			level := slog.LevelInfo
+			if probePaths[r.URL.Path] || quietPaths[r.URL.Path] {
+				level = slog.LevelDebug
+			}
+			s.logger.Log(r.Context(), level, "request", attrs...)
+			if threshold := s.SlowThreshold(); threshold > 0 && took > threshold && !streamPaths[r.URL.Path] {
+				s.logger.Warn("slow request", append(attrs, "threshold", threshold)...)
+			}
+		}()
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/raft"
+)
+
+// raftMemberTimeout bounds how long a membership change waits to be applied.
+const raftMemberTimeout = 30 * time.Second
+
+// quietPaths are requested so often, by the other members of a Raft group, that they
+// are only logged at debug level.
+var quietPaths = map[string]bool{raft.MessagesPath: true}
+
+// raftMessagesHandler serves POST raft.MessagesPath, handing the messages of the other
+// members to the node. Needs admin rights on every key.
+func (s *Server) raftMessagesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		msgs, err := raft.DecodeMessages(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, msg := range msgs {
+			if msg.To == s.raft.ID() {
+				s.raft.Step(msg)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// raftSnapshotHandler serves POST raft.SnapshotPath, installing the snapshot the
+// leader streams in the body. Needs admin rights on every key.
+func (s *Server) raftSnapshotHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		msg, err := raft.DecodeSnapshotMessage(r.Header.Get(raft.SnapshotHeader))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if msg.To != s.raft.ID() {
+			http.Error(w, fmt.Sprintf("snapshot for %s sent to %s", msg.To, s.raft.ID()), http.StatusBadRequest)
+			return
+		}
+		if err := s.raft.InstallSnapshot(r.Context(), msg, r.Body); err != nil {
+			s.logger.Warn("raft snapshot not installed", "from", msg.From, "error", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// raftStatusHandler serves GET /admin/raft, the node's view of its group. Needs admin
+// rights on every key.
+func (s *Server) raftStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		status := s.raft.Status()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":            status.ID,
+			"role":          status.Role.String(),
+			"term":          status.Term,
+			"leader":        status.Leader,
+			"members":       status.Members,
+			"commit":        status.Commit,
+			"applied":       status.Applied,
+			"lastIndex":     status.LastIndex,
+			"snapshotIndex": status.SnapshotIndex,
+		})
+	}
+}
+
+// raftMembersHandler changes the members of the group: POST ?id= adds the member with
+// that base URL, DELETE ?id= removes one. It must be sent to the leader, and answers
+// once the change is applied there. Needs admin rights on every key.
+func (s *Server) raftMembersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if u, err := url.Parse(id); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, fmt.Sprintf("member id %q is not an http:// or https:// URL", id), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), raftMemberTimeout)
+		defer cancel()
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			err = s.raft.AddMember(ctx, id)
+		case http.MethodDelete:
+			err = s.raft.RemoveMember(ctx, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil && !isRaftError(err) && !errors.Is(err, context.DeadlineExceeded) {
+			// The id is not a member, or already one
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// isRaftError reports whether err comes from the state of the Raft group rather than
+// from the request, and is worth retrying, possibly on the leader.
+func isRaftError(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrNoLeader) ||
+		errors.Is(err, raft.ErrProposalDropped) || errors.Is(err, raft.ErrConfigChangePending) ||
+		errors.Is(err, raft.ErrStopped)
+}
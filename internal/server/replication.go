@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"zap-store/internal/auth"
+	"zap-store/internal/replication"
+	"zap-store/internal/zapstore"
+)
+
+// snapshotHandler serves a snapshot of the engine's data for followers to bootstrap
+// from, as a tar archive of its log files. The PositionHeader tells where to stream
+// /admin/changes from afterwards. Needs admin rights on every key.
+func (s *Server) snapshotHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		snapshot, err := kvs.Snapshot()
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		defer snapshot.Close()
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(replication.PositionHeader, replication.FormatPosition(snapshot.End()))
+		if _, err := snapshot.WriteTo(w); err != nil {
+			if r.Context().Err() == nil {
+				s.logger.Error("snapshot failed", "request_id", RequestID(r.Context()), "error", err)
+			}
+			panic(http.ErrAbortHandler) // Don't let a truncated snapshot look complete
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package server implements the ZapStore HTTP API.
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/metrics"
+	"zap-store/internal/raft"
+	"zap-store/internal/replication"
+	"zap-store/internal/zapstore"
+)
+
+// Server routes HTTP requests to a ZapStore.
+type Server struct {
+	kv      *zapstore.ZapStore
+	mux     *http.ServeMux
+	auth    *auth.Authenticator   // nil when authentication is disabled
+	metrics *metrics.Registry     // nil when /metrics is disabled
+	replica *replication.Follower // nil unless the server follows a leader
+	raft    *raft.Node            // nil unless the server is a Raft member
+	http    *httpMetrics
+	started time.Time
+	handler http.Handler // mux wrapped in the middleware chain
+
+	logger        *slog.Logger
+	slowThreshold atomic.Int64 // time.Duration, 0 disables the slow request log
+
+	streams      context.Context // Cancelled by CloseWatches to end open watches
+	closeStreams context.CancelFunc
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAuthenticator requires every request to carry a bearer token accepted by a,
+// and checks the token's rules before each operation.
+func WithAuthenticator(a *auth.Authenticator) Option {
+	return func(s *Server) { s.auth = a }
+}
+
+// WithMetrics records request and engine metrics in reg and serves them on /metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Server) { s.metrics = reg }
+}
+
+// WithLogger sets the logger used for the access log. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithSlowThreshold logs a warning for every request taking longer than d.
+func WithSlowThreshold(d time.Duration) Option {
+	return func(s *Server) { s.slowThreshold.Store(int64(d)) }
+}
+
+// WithFollower reports the replication state of f in /admin/stats, /readyz and the
+// metrics of a server that follows a leader.
+func WithFollower(f *replication.Follower) Option {
+	return func(s *Server) { s.replica = f }
+}
+
+// WithRaft serves the endpoints of node's Raft group: the messages of the other
+// members, the node's status and membership changes.
+func WithRaft(node *raft.Node) Option {
+	return func(s *Server) { s.raft = node }
+}
+
+// New creates a Server serving kv.
+func New(kv *zapstore.ZapStore, opts ...Option) *Server {
+	s := &Server{
+		kv:      kv,
+		mux:     http.NewServeMux(),
+		started: time.Now(),
+		logger:  slog.Default(),
+	}
+	s.streams, s.closeStreams = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.metrics != nil {
+		s.http = newHTTPMetrics(s.metrics)
+		registerEngineGauges(s.metrics, kv.StorageEngine)
+		if s.replica != nil {
+			registerReplicationGauges(s.metrics, s.replica)
+		}
+	}
+	s.routes()
+
+	s.handler = s.mux
+	if s.auth != nil {
+		s.handler = s.authMiddleware(s.handler)
+	}
+	s.handler = s.accessLog(s.handler)
+	return s
+}
+
+// SlowThreshold returns the latency above which requests are logged as slow.
+func (s *Server) SlowThreshold() time.Duration {
+	return time.Duration(s.slowThreshold.Load())
+}
+
+// SetSlowThreshold changes the slow request threshold of a running server. Zero disables it.
+func (s *Server) SetSlowThreshold(d time.Duration) {
+	s.slowThreshold.Store(int64(d))
+}
+
+// CloseWatches ends every open watch request. Register it with
+// http.Server.RegisterOnShutdown so that a graceful shutdown does not wait for them.
+func (s *Server) CloseWatches() {
+	s.closeStreams()
+}
+
+func (s *Server) routes() {
+	// GET also matches HEAD; the body is dropped for HEAD requests
+	s.handle("GET /v1/keys/{key...}", "get", keyGetHandler(s.kv))
+	s.handle("PUT /v1/keys/{key...}", "set", keyPutHandler(s.kv))
+	s.handle("DELETE /v1/keys/{key...}", "delete", keyDeleteHandler(s.kv))
+	s.handle("GET /v1/keys", "scan", keyScanHandler(s.kv, s.logger))
+
+	s.handle("GET /v1/watch", "watch", s.watchHandler(s.kv))
+
+	s.handle("/mget", "mget", mgetHandler(s.kv))
+	s.handle("/mset", "mset", msetHandler(s.kv))
+
+	// Original endpoints, kept for existing clients
+	s.handle("/set", "set", setHandler(s.kv))
+	s.handle("/get", "get", getHandler(s.kv))
+	s.handle("/delete", "delete", deleteHandler(s.kv))
+	s.handle("/admin/tokens", "tokens", tokensHandler(s.auth))
+	s.handle("/admin/stats", "stats", statsHandler(s.kv, s.replica, s.started))
+	s.handle("/admin/import", "import", importHandler(s.kv))
+	s.handle("/admin/export", "export", exportHandler(s.kv, s.logger))
+	s.handle("GET /admin/changes", "changes", s.changesHandler(s.kv))
+	s.handle("GET "+replication.SnapshotPath, "snapshot", s.snapshotHandler(s.kv))
+	if s.raft != nil {
+		s.handle("POST "+raft.MessagesPath, "raft_messages", s.raftMessagesHandler())
+		s.handle("POST "+raft.SnapshotPath, "raft_snapshot", s.raftSnapshotHandler())
+		s.handle("GET /admin/raft", "raft_status", s.raftStatusHandler())
+		s.handle("/admin/raft/members", "raft_members", s.raftMembersHandler())
+	}
+	s.mux.Handle("/healthz", healthzHandler())
+	s.mux.Handle("/readyz", readyzHandler(s.kv, s.replica))
+	if s.metrics != nil {
+		s.mux.Handle("/metrics", s.metrics.Handler())
+	}
+}
+
+// handle registers h for pattern, recording its metrics under op.
+func (s *Server) handle(pattern, op string, h http.Handler) {
+	s.mux.Handle(pattern, s.http.instrument(op, h))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,999 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/metrics"
+	"zap-store/internal/raft"
+	"zap-store/internal/replication"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/bitcask"
+	"zap-store/internal/storage/inmem"
+	"zap-store/internal/watch"
+	"zap-store/internal/zapstore"
+)
+
+// newTestServer starts an httptest server backed by an in-memory ZapStore
+func newTestServer(t *testing.T) (*httptest.Server, *zapstore.ZapStore) {
+	t.Helper()
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	ts := httptest.NewServer(New(kv))
+	t.Cleanup(ts.Close)
+	return ts, kv
+}
+
+func doRequest(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	return doAuthRequest(t, method, url, "", body)
+}
+
+// doAuthRequest sends a request carrying token as a bearer token, if not empty
+func doAuthRequest(t *testing.T, method, url, token, body string) (int, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("NewRequest(%s %s) failed: %v", method, url, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading response of %s %s failed: %v", method, url, err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestServerSetGetDelete(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "set", method: http.MethodPost, path: "/set", body: `{"key":"foo","value":"bar"}`, wantStatus: http.StatusOK},
+		{name: "get", method: http.MethodGet, path: "/get?key=foo", wantStatus: http.StatusOK, wantBody: "bar"},
+		{name: "get_missing_param", method: http.MethodGet, path: "/get", wantStatus: http.StatusBadRequest},
+		{name: "set_wrong_method", method: http.MethodGet, path: "/set", wantStatus: http.StatusMethodNotAllowed},
+		{name: "set_bad_json", method: http.MethodPost, path: "/set", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "delete", method: http.MethodDelete, path: "/delete?key=foo", wantStatus: http.StatusOK},
+		{name: "get_deleted", method: http.MethodGet, path: "/get?key=foo", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, tt.method, ts.URL+tt.path, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d (body %q)", tt.method, tt.path, status, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	authenticator, err := auth.NewAuthenticator([]auth.StaticToken{
+		{Name: "root", Token: "root-token", Rules: []auth.Rule{{Prefix: "", Permission: auth.Admin}}},
+		{Name: "reader", Token: "read-token", Rules: []auth.Rule{{Prefix: "", Permission: auth.Read}}},
+		{Name: "app", Token: "app-token", Rules: []auth.Rule{{Prefix: "app/", Permission: auth.Write}}},
+	}, kv)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+	ts := httptest.NewServer(New(kv, WithAuthenticator(authenticator)))
+	t.Cleanup(ts.Close)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{name: "no_token", method: http.MethodGet, path: "/get?key=app/x", wantStatus: http.StatusUnauthorized},
+		{name: "bad_token", method: http.MethodGet, path: "/get?key=app/x", token: "nope", wantStatus: http.StatusUnauthorized},
+		{name: "app_writes_own_prefix", method: http.MethodPost, path: "/set", token: "app-token", body: `{"key":"app/x","value":"1"}`, wantStatus: http.StatusOK},
+		{name: "app_writes_elsewhere", method: http.MethodPost, path: "/set", token: "app-token", body: `{"key":"other","value":"1"}`, wantStatus: http.StatusForbidden},
+		{name: "reader_reads", method: http.MethodGet, path: "/get?key=app/x", token: "read-token", wantStatus: http.StatusOK},
+		{name: "reader_cannot_delete", method: http.MethodDelete, path: "/delete?key=app/x", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "engine_error_not_auth", method: http.MethodGet, path: "/get?key=missing", token: "read-token", wantStatus: http.StatusNotFound},
+		{name: "reader_cannot_read_reserved", method: http.MethodGet, path: "/get?key=" + auth.ReservedPrefix + "x", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "app_cannot_manage_tokens", method: http.MethodPost, path: "/admin/tokens", token: "app-token", body: `{"name":"x"}`, wantStatus: http.StatusForbidden},
+		{name: "app_puts_own_prefix", method: http.MethodPut, path: "/v1/keys/app/y", token: "app-token", body: "1", wantStatus: http.StatusCreated},
+		{name: "app_puts_elsewhere", method: http.MethodPut, path: "/v1/keys/other", token: "app-token", body: "1", wantStatus: http.StatusForbidden},
+		{name: "reader_gets_resource", method: http.MethodGet, path: "/v1/keys/app/y", token: "read-token", wantStatus: http.StatusOK},
+		{name: "app_mset_mixed_prefixes", method: http.MethodPost, path: "/mset", token: "app-token", body: `[{"key":"app/z","value":"1"},{"key":"other","value":"1"}]`, wantStatus: http.StatusForbidden},
+		{name: "reader_mgets", method: http.MethodPost, path: "/mget", token: "read-token", body: `["app/x"]`, wantStatus: http.StatusOK},
+		{name: "reader_cannot_export", method: http.MethodGet, path: "/admin/export", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "reader_cannot_snapshot", method: http.MethodGet, path: "/admin/replication/snapshot", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "app_cannot_import", method: http.MethodPost, path: "/admin/import", token: "app-token", body: `{"key":"app/q","value":"1"}`, wantStatus: http.StatusForbidden},
+		{name: "app_watches_own_prefix", method: http.MethodGet, path: "/v1/watch?prefix=app/&timeout=1ms", token: "app-token", wantStatus: http.StatusOK},
+		{name: "app_scans_own_prefix", method: http.MethodGet, path: "/v1/keys?prefix=app/", token: "app-token", wantStatus: http.StatusOK},
+		{name: "app_cannot_scan_everything", method: http.MethodGet, path: "/v1/keys", token: "app-token", wantStatus: http.StatusForbidden},
+		{name: "app_cannot_watch_everything", method: http.MethodGet, path: "/v1/watch?timeout=1ms", token: "app-token", wantStatus: http.StatusForbidden},
+		{name: "probes_need_no_token", method: http.MethodGet, path: "/readyz", wantStatus: http.StatusOK},
+		{name: "stats_need_a_token", method: http.MethodGet, path: "/admin/stats", wantStatus: http.StatusUnauthorized},
+		{name: "reader_cannot_read_stats", method: http.MethodGet, path: "/admin/stats", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "root_deletes", method: http.MethodDelete, path: "/delete?key=app/x", token: "root-token", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doAuthRequest(t, tt.method, ts.URL+tt.path, tt.token, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d (body %q)", tt.method, tt.path, status, tt.wantStatus, body)
+			}
+		})
+	}
+
+	// Tokens created through the admin endpoint work straight away
+	status, body := doAuthRequest(t, http.MethodPost, ts.URL+"/admin/tokens", "root-token",
+		`{"name":"svc","rules":[{"prefix":"svc/","permission":"write"}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Creating token: status = %d (body %q)", status, body)
+	}
+	var created struct{ ID, Token string }
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("Decoding created token failed: %v", err)
+	}
+	if status, _ := doAuthRequest(t, http.MethodPost, ts.URL+"/set", created.Token, `{"key":"svc/a","value":"1"}`); status != http.StatusOK {
+		t.Errorf("Set with created token: status = %d, want 200", status)
+	}
+	if status, _ := doAuthRequest(t, http.MethodDelete, ts.URL+"/admin/tokens?id="+created.ID, "root-token", ""); status != http.StatusOK {
+		t.Errorf("Revoking token: status = %d, want 200", status)
+	}
+	if status, _ := doAuthRequest(t, http.MethodGet, ts.URL+"/get?key=svc/a", created.Token, ""); status != http.StatusUnauthorized {
+		t.Errorf("Get with revoked token: status = %d, want 401", status)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	ts := httptest.NewServer(New(kv, WithMetrics(metrics.NewRegistry())))
+	t.Cleanup(ts.Close)
+
+	doRequest(t, http.MethodPost, ts.URL+"/set", `{"key":"foo","value":"bar"}`)
+	doRequest(t, http.MethodGet, ts.URL+"/get?key=foo", "")
+	doRequest(t, http.MethodGet, ts.URL+"/get?key=missing", "")
+
+	status, body := doRequest(t, http.MethodGet, ts.URL+"/metrics", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want 200", status)
+	}
+	for _, line := range []string{
+		`zapstore_http_requests_total{op="set",code="200"} 1`,
+		`zapstore_http_requests_total{op="get",code="200"} 1`,
+		`zapstore_http_requests_total{op="get",code="404"} 1`,
+		`zapstore_http_request_duration_seconds_count{op="get"} 2`,
+		`zapstore_keys 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+// countingStatsEngine is an in-memory engine counting its Stats calls
+type countingStatsEngine struct {
+	*inmem.InMemStorageEngine
+	calls *atomic.Int64
+}
+
+func (e countingStatsEngine) Stats() storage.Stats {
+	e.calls.Add(1)
+	return e.InMemStorageEngine.Stats()
+}
+
+func TestServerMetricsStatsOncePerScrape(t *testing.T) {
+	engine := countingStatsEngine{InMemStorageEngine: inmem.NewInMemStorageEngine(), calls: new(atomic.Int64)}
+	ts := httptest.NewServer(New(zapstore.NewZapStore(engine), WithMetrics(metrics.NewRegistry())))
+	t.Cleanup(ts.Close)
+
+	for scrape := int64(1); scrape <= 3; scrape++ {
+		if status, _ := doRequest(t, http.MethodGet, ts.URL+"/metrics", ""); status != http.StatusOK {
+			t.Fatalf("GET /metrics status = %d, want 200", status)
+		}
+		if got := engine.calls.Load(); got != scrape {
+			t.Errorf("Stats() called %d times after %d scrapes, want %d", got, scrape, scrape)
+		}
+	}
+}
+
+// unhealthyEngine is an in-memory engine reporting a fixed health error
+type unhealthyEngine struct {
+	*inmem.InMemStorageEngine
+	err error
+}
+
+func (e unhealthyEngine) Health() error { return e.err }
+
+// failingEngine fails every read with err.
+type failingEngine struct {
+	storage.StorageEngine
+	err error
+}
+
+func (e failingEngine) Get(key string) (string, error) { return "", e.err }
+
+func TestServerGetEngineError(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		wantStatus int
+	}{
+		{storage.ErrNotFound, http.StatusNotFound},
+		{storage.ErrNotReady, http.StatusServiceUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	} {
+		engine := failingEngine{inmem.NewInMemStorageEngine(), tc.err}
+		ts := httptest.NewServer(New(zapstore.NewZapStore(engine)))
+		if status, body := doRequest(t, http.MethodGet, ts.URL+"/get?key=k", ""); status != tc.wantStatus {
+			t.Errorf("GET /get with engine error %v = %d %q, want %d", tc.err, status, body, tc.wantStatus)
+		}
+		ts.Close()
+	}
+}
+
+func TestServerAuthEngineError(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		wantStatus int
+	}{
+		{storage.ErrNotReady, http.StatusServiceUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	} {
+		kv := zapstore.NewZapStore(failingEngine{inmem.NewInMemStorageEngine(), tc.err})
+		authenticator, err := auth.NewAuthenticator(nil, kv)
+		if err != nil {
+			t.Fatalf("NewAuthenticator failed: %v", err)
+		}
+		ts := httptest.NewServer(New(kv, WithAuthenticator(authenticator)))
+		// A token that can't be looked up is a server problem, not a bad credential
+		if status, body := doAuthRequest(t, http.MethodGet, ts.URL+"/get?key=k", "some-token", ""); status != tc.wantStatus {
+			t.Errorf("GET /get with engine error %v = %d %q, want %d", tc.err, status, body, tc.wantStatus)
+		}
+		ts.Close()
+	}
+}
+
+func TestServerHealthAndStats(t *testing.T) {
+	ts, kv := newTestServer(t)
+	kv.Set("foo", "bar")
+
+	if status, body := doRequest(t, http.MethodGet, ts.URL+"/healthz", ""); status != http.StatusOK {
+		t.Errorf("GET /healthz status = %d, want 200 (body %q)", status, body)
+	}
+	if status, body := doRequest(t, http.MethodGet, ts.URL+"/readyz", ""); status != http.StatusOK {
+		t.Errorf("GET /readyz status = %d, want 200 (body %q)", status, body)
+	}
+
+	status, body := doRequest(t, http.MethodGet, ts.URL+"/admin/stats", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /admin/stats status = %d, want 200 (body %q)", status, body)
+	}
+	var stats struct {
+		Engine string
+		Keys   int
+		Ready  bool
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatalf("Decoding /admin/stats failed: %v", err)
+	}
+	if stats.Engine != "inmem" || stats.Keys != 1 || !stats.Ready {
+		t.Errorf("/admin/stats = %+v, want engine inmem, 1 key, ready", stats)
+	}
+
+	for _, err := range []error{storage.ErrNotReady, storage.ErrReadOnly} {
+		engine := unhealthyEngine{inmem.NewInMemStorageEngine(), err}
+		unready := httptest.NewServer(New(zapstore.NewZapStore(engine)))
+		if status, _ := doRequest(t, http.MethodGet, unready.URL+"/readyz", ""); status != http.StatusServiceUnavailable {
+			t.Errorf("GET /readyz with engine health %v: status = %d, want 503", err, status)
+		}
+		if status, _ := doRequest(t, http.MethodGet, unready.URL+"/healthz", ""); status != http.StatusOK {
+			t.Errorf("GET /healthz with engine health %v: status = %d, want 200", err, status)
+		}
+		unready.Close()
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	ts := httptest.NewServer(New(kv, WithLogger(logger), WithSlowThreshold(time.Nanosecond)))
+	t.Cleanup(ts.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/get?key=missing", nil)
+	req.Header.Set("X-Request-ID", "client-id-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /get failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-ID"); got != "client-id-1" {
+		t.Errorf("X-Request-ID = %q, want the client's %q", got, "client-id-1")
+	}
+
+	resp, err = http.Get(ts.URL + "/get?key=missing")
+	if err != nil {
+		t.Fatalf("GET /get failed: %v", err)
+	}
+	resp.Body.Close()
+	generated := resp.Header.Get("X-Request-ID")
+	if generated == "" || generated == "client-id-1" {
+		t.Errorf("X-Request-ID = %q, want a freshly generated ID", generated)
+	}
+
+	var requests, slow int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+			Status    int    `json:"status"`
+			Path      string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line %q is not JSON: %v", line, err)
+		}
+		switch entry.Msg {
+		case "request":
+			requests++
+			if entry.Status != http.StatusNotFound || entry.Path != "/get" || entry.RequestID == "" {
+				t.Errorf("Access log entry = %+v, want a 404 for /get with a request ID", entry)
+			}
+		case "slow request":
+			slow++
+		}
+	}
+	if requests != 2 || slow != 2 {
+		t.Errorf("Logged %d requests and %d slow requests, want 2 of each:\n%s", requests, slow, buf.String())
+	}
+}
+
+// doHeaderRequest sends a request with extra headers and returns the status, response
+// headers and body
+func doHeaderRequest(t *testing.T, method, url string, headers map[string]string, body string) (int, http.Header, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest(%s %s) failed: %v", method, url, err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading response of %s %s failed: %v", method, url, err)
+	}
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+func TestServerKeysResource(t *testing.T) {
+	ts, _ := newTestServer(t)
+	url := ts.URL + "/v1/keys/app/greeting"
+
+	status, header, _ := doHeaderRequest(t, http.MethodPut, url, map[string]string{"If-None-Match": "*"}, "hello")
+	if status != http.StatusCreated {
+		t.Fatalf("PUT new key status = %d, want 201", status)
+	}
+	etag := header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("PUT response has no ETag")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "get", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "hello"},
+		{name: "get_json", method: http.MethodGet, headers: map[string]string{"Accept": "application/json"}, wantStatus: http.StatusOK,
+			wantBody: `{"key":"app/greeting","value":"hello"}`},
+		{name: "head", method: http.MethodHead, wantStatus: http.StatusOK},
+		{name: "not_modified", method: http.MethodGet, headers: map[string]string{"If-None-Match": etag}, wantStatus: http.StatusNotModified},
+		{name: "not_modified_weak", method: http.MethodGet, headers: map[string]string{"If-None-Match": "W/" + etag}, wantStatus: http.StatusNotModified},
+		{name: "create_only_exists", method: http.MethodPut, headers: map[string]string{"If-None-Match": "*"}, body: "x", wantStatus: http.StatusPreconditionFailed},
+		{name: "stale_if_match", method: http.MethodPut, headers: map[string]string{"If-Match": `"0"`}, body: "x", wantStatus: http.StatusPreconditionFailed},
+		{name: "weak_if_match", method: http.MethodPut, headers: map[string]string{"If-Match": "W/" + etag}, body: "x", wantStatus: http.StatusPreconditionFailed},
+		{name: "if_match", method: http.MethodPut, headers: map[string]string{"If-Match": etag}, body: "bye", wantStatus: http.StatusNoContent},
+		{name: "get_updated", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "bye"},
+		{name: "old_etag_modified", method: http.MethodGet, headers: map[string]string{"If-None-Match": etag}, wantStatus: http.StatusOK, wantBody: "bye"},
+		{name: "put_json", method: http.MethodPut, headers: map[string]string{"Content-Type": "application/json"}, body: `{"value":"json"}`, wantStatus: http.StatusNoContent},
+		{name: "put_bad_json", method: http.MethodPut, headers: map[string]string{"Content-Type": "application/json"}, body: `{"val":1}`, wantStatus: http.StatusBadRequest},
+		{name: "get_json_value", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "json"},
+		{name: "delete_stale", method: http.MethodDelete, headers: map[string]string{"If-Match": etag}, wantStatus: http.StatusPreconditionFailed},
+		{name: "delete", method: http.MethodDelete, wantStatus: http.StatusNoContent},
+		{name: "delete_missing", method: http.MethodDelete, wantStatus: http.StatusNotFound},
+		{name: "get_missing", method: http.MethodGet, wantStatus: http.StatusNotFound},
+		{name: "if_match_missing", method: http.MethodGet, headers: map[string]string{"If-Match": "*"}, wantStatus: http.StatusPreconditionFailed},
+		{name: "wrong_method", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := doHeaderRequest(t, tt.method, url, tt.headers, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("%s %v status = %d, want %d (body %q)", tt.method, tt.headers, status, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("%s %v body = %q, want %q", tt.method, tt.headers, body, tt.wantBody)
+			}
+		})
+	}
+
+	// The original endpoints still see keys written through the new ones
+	doHeaderRequest(t, http.MethodPut, ts.URL+"/v1/keys/shared", nil, "value")
+	if status, body := doRequest(t, http.MethodGet, ts.URL+"/get?key=shared", ""); status != http.StatusOK || body != "value" {
+		t.Errorf("GET /get?key=shared = %d %q, want 200 %q", status, body, "value")
+	}
+}
+
+func TestServerRequestContext(t *testing.T) {
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	kv.Set("foo", "bar")
+	handler := New(kv)
+
+	// A request whose client has gone away is not served
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		req := httptest.NewRequestWithContext(ctx, method, "/v1/keys/foo", strings.NewReader("baz"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s /v1/keys/foo with a cancelled context status = %d, want %d", method, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if got, err := kv.Get("foo"); err != nil || got != "bar" {
+		t.Errorf("Get(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+	}
+}
+
+func TestServerKeyScan(t *testing.T) {
+	ts, kv := newTestServer(t)
+	for _, key := range []string{"app/b", "app/a", "apple", "other"} {
+		if err := kv.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Set(%q) failed: %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantBody string
+	}{
+		{name: "prefix", path: "/v1/keys?prefix=app/", wantBody: `{"key":"app/a","value":"v-app/a"}` + "\n" + `{"key":"app/b","value":"v-app/b"}` + "\n"},
+		{name: "all", path: "/v1/keys", wantBody: `{"key":"app/a","value":"v-app/a"}` + "\n" + `{"key":"app/b","value":"v-app/b"}` + "\n" +
+			`{"key":"apple","value":"v-apple"}` + "\n" + `{"key":"other","value":"v-other"}` + "\n"},
+		{name: "no_match", path: "/v1/keys?prefix=zzz", wantBody: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, http.MethodGet, ts.URL+tt.path, "")
+			if status != http.StatusOK || body != tt.wantBody {
+				t.Errorf("GET %s = %d %q, want 200 %q", tt.path, status, body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerMGetMSet(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "mset", method: http.MethodPost, path: "/mset", body: `[{"key":"a","value":"1"},{"key":"b","value":""}]`, wantStatus: http.StatusOK},
+		{name: "mget", method: http.MethodPost, path: "/mget", body: `["a","missing","b"]`, wantStatus: http.StatusOK,
+			wantBody: `[{"key":"a","value":"1","found":true},{"key":"missing","found":false},{"key":"b","value":"","found":true}]` + "\n"},
+		{name: "mget_empty_key", method: http.MethodPost, path: "/mget", body: `["a",""]`, wantStatus: http.StatusBadRequest},
+		{name: "mget_not_array", method: http.MethodPost, path: "/mget", body: `{"keys":["a"]}`, wantStatus: http.StatusBadRequest},
+		{name: "mset_wrong_method", method: http.MethodGet, path: "/mset", wantStatus: http.StatusMethodNotAllowed},
+		{name: "mget_too_many", method: http.MethodPost, path: "/mget", body: `[` + strings.Repeat(`"k",`, maxBatchKeys) + `"k"]`, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, tt.method, ts.URL+tt.path, tt.body)
+			if status != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d (body %q)", tt.method, tt.path, status, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerImportExport(t *testing.T) {
+	ts, kv := newTestServer(t)
+
+	status, body := doRequest(t, http.MethodPost, ts.URL+"/admin/import",
+		"{\"key\":\"a/1\",\"value\":\"one\"}\n{\"key\":\"a/2\",\"value\":\"two\"}\n{\"key\":\"b\",\"value\":\"bee\"}\n")
+	if status != http.StatusOK || body != `{"imported":3}`+"\n" {
+		t.Fatalf("POST /admin/import = %d %q, want 200 with 3 imported", status, body)
+	}
+	if value, _ := kv.Get("a/2"); value != "two" {
+		t.Errorf("Get(%q) after import = %q, want %q", "a/2", value, "two")
+	}
+
+	status, body = doRequest(t, http.MethodPost, ts.URL+"/admin/import", "{\"key\":\"c\",\"value\":\"sea\"}\nbroken\n")
+	if status != http.StatusBadRequest || !strings.Contains(body, `"imported":0`) {
+		t.Errorf("POST /admin/import with a bad record = %d %q, want 400 with 0 imported", status, body)
+	}
+	// The batch holding the bad record is not written
+	if _, err := kv.Get("c"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after a failed import = %v, want ErrNotFound", "c", err)
+	}
+
+	status, body = doRequest(t, http.MethodGet, ts.URL+"/admin/export?prefix=a/", "")
+	want := `{"key":"a/1","value":"one"}` + "\n" + `{"key":"a/2","value":"two"}` + "\n"
+	if status != http.StatusOK || body != want {
+		t.Errorf("GET /admin/export?prefix=a/ = %d %q, want 200 %q", status, body, want)
+	}
+
+	// A binary export imports into a fresh server unchanged
+	_, binary := doRequest(t, http.MethodGet, ts.URL+"/admin/export?format=binary", "")
+	other, otherKV := newTestServer(t)
+	status, _, body = doHeaderRequest(t, http.MethodPost, other.URL+"/admin/import", map[string]string{"Content-Type": "application/octet-stream"}, binary)
+	if status != http.StatusOK || body != `{"imported":3}`+"\n" {
+		t.Fatalf("Importing the binary export = %d %q, want 200 with 3 imported", status, body)
+	}
+	if value, _ := otherKV.Get("b"); value != "bee" {
+		t.Errorf("Get(%q) on the restored server = %q, want %q", "b", value, "bee")
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	ts, kv := newTestServer(t)
+	start := kv.WatchSeq()
+	kv.Set("app/a", "1")
+	kv.Set("other", "x")
+	kv.Delete("app/a")
+
+	var resp watchResponse
+	status, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/v1/watch?prefix=app/&after=%d", ts.URL, start), "")
+	if err := json.Unmarshal([]byte(body), &resp); status != http.StatusOK || err != nil {
+		t.Fatalf("Long-poll = %d %q, want 200 with JSON", status, body)
+	}
+	if len(resp.Events) != 2 || resp.Events[0].Key != "app/a" || resp.Events[1].Type != watch.Delete || resp.Seq != kv.WatchSeq() {
+		t.Errorf("Long-poll events = %+v seq %d, want set and delete of app/a, seq %d", resp.Events, resp.Seq, kv.WatchSeq())
+	}
+
+	// Nothing new: the poll times out empty and keeps the cursor
+	status, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/v1/watch?prefix=app/&after=%d&timeout=10ms", ts.URL, resp.Seq), "")
+	if want := fmt.Sprintf(`{"events":[],"seq":%d}`, resp.Seq) + "\n"; status != http.StatusOK || body != want {
+		t.Errorf("Idle long-poll = %d %q, want 200 %q", status, body, want)
+	}
+
+	// A poll waiting for events returns once one is written
+	done := make(chan string)
+	go func() {
+		_, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/v1/watch?after=%d", ts.URL, resp.Seq), "")
+		done <- body
+	}()
+	time.Sleep(20 * time.Millisecond)
+	kv.Set("late", "1")
+	select {
+	case body := <-done:
+		if !strings.Contains(body, `"key":"late"`) {
+			t.Errorf("Waiting long-poll = %q, want the event of late", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting long-poll did not return after a write")
+	}
+
+	for _, after := range []string{"1", "99999999999999999"} {
+		status, body = doRequest(t, http.MethodGet, ts.URL+"/v1/watch?after="+after, "")
+		if status != http.StatusGone || !strings.Contains(body, fmt.Sprintf(`"seq":%d`, kv.WatchSeq())) {
+			t.Errorf("Long-poll after %s = %d %q, want 410 with the current seq", after, status, body)
+		}
+	}
+	if status, _ = doRequest(t, http.MethodGet, ts.URL+"/v1/watch?after=x", ""); status != http.StatusBadRequest {
+		t.Errorf("Long-poll after=x = %d, want 400", status)
+	}
+}
+
+func TestServerWatchEventStream(t *testing.T) {
+	kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+	srv := New(kv)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	start := kv.WatchSeq()
+	kv.Set("app/a", "1")
+
+	// Reconnecting EventSources send the last ID they saw
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/watch?prefix=app/", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", fmt.Sprint(start))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/watch failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	readEvent := func() []string {
+		var event []string
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		return event
+	}
+
+	want := []string{fmt.Sprintf("id: %d", start+1), "event: set"}
+	if got := readEvent(); len(got) != 3 || got[0] != want[0] || got[1] != want[1] || !strings.Contains(got[2], `"value":"1"`) {
+		t.Errorf("First event = %q, want %q and its data", got, want)
+	}
+	kv.Set("other", "skipped")
+	kv.Delete("app/a")
+	if got := readEvent(); len(got) != 3 || got[0] != fmt.Sprintf("id: %d", start+3) || got[1] != "event: delete" {
+		t.Errorf("Second event = %q, want the delete of app/a", got)
+	}
+
+	// Shutting down ends the stream
+	srv.CloseWatches()
+	for lines.Scan() {
+	}
+	if err := lines.Err(); err != nil {
+		t.Errorf("Stream ended with %v after CloseWatches, want a clean end", err)
+	}
+}
+
+func TestServerChanges(t *testing.T) {
+	engine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create bitcask engine: %v", err)
+	}
+	defer engine.Close()
+	kv := zapstore.NewZapStore(engine)
+	srv := New(kv)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	defer srv.CloseWatches()
+
+	kv.Set("a", "1")
+	kv.Delete("a")
+
+	resp, err := http.Get(ts.URL + "/admin/changes?from=start")
+	if err != nil {
+		t.Fatalf("GET /admin/changes failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/changes = %d, want 200", resp.StatusCode)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	readChange := func() storage.Change {
+		t.Helper()
+		for lines.Scan() {
+			if lines.Text() == "" {
+				continue // Keepalive
+			}
+			var change storage.Change
+			if err := json.Unmarshal(lines.Bytes(), &change); err != nil {
+				t.Fatalf("Decoding change %q failed: %v", lines.Text(), err)
+			}
+			return change
+		}
+		t.Fatalf("Change stream ended: %v", lines.Err())
+		return storage.Change{}
+	}
+
+	if c := readChange(); c.Type != storage.ChangeSet || c.Key != "a" || c.Value != "1" {
+		t.Errorf("First change = %+v, want set a=1", c)
+	}
+	deleted := readChange()
+	if deleted.Type != storage.ChangeDelete || deleted.Key != "a" {
+		t.Errorf("Second change = %+v, want delete a", deleted)
+	}
+	kv.Set("b", "2")
+	if c := readChange(); c.Key != "b" || c.At != deleted.Next {
+		t.Errorf("Change written while streaming = %+v, want set b at %+v", c, deleted.Next)
+	}
+
+	status, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/changes?fileId=999", "")
+	if status != http.StatusGone {
+		t.Errorf("GET /admin/changes from a missing file = %d, want 410", status)
+	}
+	status, _ = doRequest(t, http.MethodGet, ts.URL+"/admin/changes?fileId=x", "")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET /admin/changes?fileId=x = %d, want 400", status)
+	}
+
+	inmemServer, _ := newTestServer(t)
+	status, _ = doRequest(t, http.MethodGet, inmemServer.URL+"/admin/changes", "")
+	if status != http.StatusNotImplemented {
+		t.Errorf("GET /admin/changes on inmem = %d, want 501", status)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerReplication(t *testing.T) {
+	leaderEngine, err := bitcask.NewBitCaskStorageEngine(t.TempDir(), bitcask.WithMaxFileSize(64))
+	if err != nil {
+		t.Fatalf("Failed to create leader engine: %v", err)
+	}
+	defer leaderEngine.Close()
+	leader := zapstore.NewZapStore(leaderEngine)
+	leaderSrv := New(leader)
+	leaderServer := httptest.NewServer(leaderSrv)
+	t.Cleanup(leaderServer.Close)
+	defer leaderSrv.CloseWatches()
+
+	leader.Set("a", "1")
+	leader.Set("b", "2")
+	leader.Delete("a")
+
+	// startFollower runs a bitcask follower on dataDir until the returned func is called
+	followerDir := t.TempDir()
+	startFollower := func() (*httptest.Server, *zapstore.ZapStore, func()) {
+		t.Helper()
+		engine, err := bitcask.NewBitCaskStorageEngine(followerDir)
+		if err != nil {
+			t.Fatalf("Failed to open follower engine: %v", err)
+		}
+		kv := zapstore.NewZapStore(engine)
+		follower, err := replication.NewFollower(kv, leaderServer.URL,
+			replication.WithStateFile(filepath.Join(followerDir, "replication.json")))
+		if err != nil {
+			t.Fatalf("NewFollower() error = %v", err)
+		}
+		ts := httptest.NewServer(New(kv, WithFollower(follower)))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			follower.Run(ctx)
+		}()
+		return ts, kv, func() {
+			cancel()
+			<-done
+			ts.Close()
+			engine.Close()
+		}
+	}
+	hasValue := func(kv *zapstore.ZapStore, key, want string) func() bool {
+		return func() bool {
+			value, err := kv.Get(key)
+			return err == nil && value == want
+		}
+	}
+
+	followerServer, follower, stop := startFollower()
+	waitFor(t, "the snapshot", hasValue(follower, "b", "2"))
+	leader.Set("c", "3")
+	waitFor(t, "a streamed change", hasValue(follower, "c", "3"))
+	// Bytes that are not valid UTF-8 stream unchanged, as they do in the snapshot
+	leader.Set("bin\xff", "\xff\x00\xfe")
+	waitFor(t, "a streamed binary value", hasValue(follower, "bin\xff", "\xff\x00\xfe"))
+	if _, err := follower.Get("a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Follower Get(%q) error = %v, want ErrNotFound", "a", err)
+	}
+	_, leaderVersion, _ := leader.GetVersioned("c")
+	if _, version, _ := follower.GetVersioned("c"); version != leaderVersion {
+		t.Errorf("Follower version of %q = %d, want the leader's %d", "c", version, leaderVersion)
+	}
+
+	if status, body := doRequest(t, http.MethodPut, followerServer.URL+"/v1/keys/x", "1"); status != http.StatusServiceUnavailable || !strings.Contains(body, "replica") {
+		t.Errorf("PUT on follower = %d %q, want 503 naming the replica", status, body)
+	}
+	if status, _ := doRequest(t, http.MethodGet, followerServer.URL+"/readyz", ""); status != http.StatusOK {
+		t.Errorf("GET /readyz on follower = %d, want 200", status)
+	}
+	_, body := doRequest(t, http.MethodGet, followerServer.URL+"/admin/stats", "")
+	var stats struct {
+		Replication replication.Status `json:"replication"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil || stats.Replication.State != replication.StateStreaming {
+		t.Errorf("Follower stats replication = %+v (%v), want state streaming", stats.Replication, err)
+	}
+	stop()
+
+	// A restarted follower resumes from its saved position
+	leader.Set("d", "4")
+	_, follower, stop = startFollower()
+	waitFor(t, "a change made while stopped", hasValue(follower, "d", "4"))
+	stop()
+
+	// Once a merge removed its position it copies a new snapshot
+	leader.Set("e", "5")
+	leader.Delete("b")
+	if err := leaderEngine.Merge(); err != nil {
+		t.Fatalf("Merge() failed: %v", err)
+	}
+	_, follower, stop = startFollower()
+	defer stop()
+	waitFor(t, "a snapshot after the merge", hasValue(follower, "e", "5"))
+	if _, err := follower.Get("b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Follower Get(%q) after re-bootstrap error = %v, want ErrNotFound", "b", err)
+	}
+}
+
+func TestServerRaft(t *testing.T) {
+	// Members are named by their URLs, known once their servers listen
+	type member struct {
+		ts      *httptest.Server
+		handler atomic.Pointer[http.Handler]
+		kv      *zapstore.ZapStore
+		node    *raft.Node
+	}
+	members := make(map[string]*member)
+	var ids []string
+	for range 4 {
+		m := &member{}
+		m.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h := m.handler.Load(); h != nil {
+				(*h).ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(m.ts.Close)
+		members[m.ts.URL] = m
+		ids = append(ids, m.ts.URL)
+	}
+	start := func(id string, group []string) {
+		t.Helper()
+		m := members[id]
+		m.kv = zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+		transport := raft.NewHTTPTransport(raft.WithLogger(slog.New(slog.DiscardHandler)))
+		node, err := m.kv.StartRaft(raft.Config{
+			ID:              id,
+			Members:         group,
+			Storage:         raft.NewMemoryStorage(),
+			Transport:       transport,
+			TickInterval:    5 * time.Millisecond,
+			SnapshotEntries: 5,
+			Logger:          slog.New(slog.DiscardHandler),
+		})
+		if err != nil {
+			t.Fatalf("StartRaft(%s) error = %v", id, err)
+		}
+		t.Cleanup(func() {
+			node.Stop()
+			transport.Close()
+		})
+		m.node = node
+		var h http.Handler = New(m.kv, WithRaft(node), WithLogger(slog.New(slog.DiscardHandler)))
+		m.handler.Store(&h)
+	}
+	group := ids[:3]
+	for _, id := range group {
+		start(id, group)
+	}
+
+	var leader string
+	waitFor(t, "a leader", func() bool {
+		_, body := doRequest(t, http.MethodGet, members[ids[0]].ts.URL+"/admin/raft", "")
+		var status struct {
+			Leader string `json:"leader"`
+		}
+		json.Unmarshal([]byte(body), &status)
+		leader = status.Leader
+		return leader != ""
+	})
+	follower := group[0]
+	if follower == leader {
+		follower = group[1]
+	}
+
+	// Writes go through the leader and reach every member; followers refuse them
+	waitFor(t, "a write on the leader", func() bool {
+		status, _ := doRequest(t, http.MethodPut, leader+"/v1/keys/k", "v")
+		return status == http.StatusNoContent || status == http.StatusOK
+	})
+	if status, body := doRequest(t, http.MethodPut, follower+"/v1/keys/k", "w"); status != http.StatusServiceUnavailable || !strings.Contains(body, leader) {
+		t.Errorf("PUT on a follower = %d %q, want 503 naming the leader", status, body)
+	}
+
+	// Unconditional writes racing on one key all succeed, without a precondition to
+	// fail when the other commits first
+	if status, _ := doRequest(t, http.MethodPut, leader+"/v1/keys/race", "0"); status != http.StatusCreated {
+		t.Errorf("PUT of a new key = %d, want 201", status)
+	}
+	var wg sync.WaitGroup
+	statuses := make([]int, 8)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPut, leader+"/v1/keys/race", strings.NewReader(fmt.Sprint(i)))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	for i, status := range statuses {
+		if status != http.StatusNoContent {
+			t.Errorf("Racing PUT #%d = %d, want 204", i, status)
+		}
+	}
+
+	// A new member joins through the leader and catches up from a snapshot, as the
+	// log is compacted
+	if status, _ := doRequest(t, http.MethodPost, leader+"/admin/raft/members?id=n4", ""); status != http.StatusBadRequest {
+		t.Errorf("POST /admin/raft/members?id=n4 = %d, want 400", status)
+	}
+	start(ids[3], nil)
+	waitFor(t, "the new member to be added", func() bool {
+		status, _ := doRequest(t, http.MethodPost, leader+"/admin/raft/members?id="+ids[3], "")
+		return status == http.StatusOK
+	})
+	for _, id := range ids {
+		waitFor(t, id+" to apply the write", func() bool {
+			value, err := members[id].kv.Get("k")
+			return err == nil && value == "v"
+		})
+	}
+	_, body := doRequest(t, http.MethodGet, ids[3]+"/admin/raft", "")
+	var status struct {
+		SnapshotIndex uint64 `json:"snapshotIndex"`
+	}
+	if json.Unmarshal([]byte(body), &status); status.SnapshotIndex == 0 {
+		t.Errorf("new member snapshot index = 0, want the snapshot it was sent")
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"zap-store/internal/auth"
+	"zap-store/internal/bulk"
+	"zap-store/internal/storage"
+	"zap-store/internal/zapstore"
+)
+
+// exportFlushEvery is how many records the export writes between flushes to the client.
+const exportFlushEvery = 1000
+
+// requestFormat picks the bulk format from ?format=, falling back to the given media type.
+func requestFormat(r *http.Request, mediaType string) (bulk.Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return bulk.ParseFormat(name)
+	}
+	return bulk.FormatForContentType(mediaType), nil
+}
+
+// importHandler streams NDJSON or binary pairs from the request body into the store in
+// batches and reports how many were imported. Needs admin rights on every key.
+func importHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		format, err := requestFormat(r, r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		reader := bulk.NewReader(r.Body, format)
+		var decodeErr error
+		imported, err := kvs.ImportContext(r.Context(), func() (storage.KeyValue, error) {
+			pair, err := reader.Next()
+			if err == nil && pair.Key == "" {
+				err = fmt.Errorf("keys cannot be empty")
+			}
+			if err != nil && err != io.EOF {
+				decodeErr = err
+			}
+			return pair, err
+		})
+
+		resp := struct {
+			Imported int    `json:"imported"`
+			Error    string `json:"error,omitempty"`
+		}{Imported: imported}
+		status := http.StatusOK
+		if err != nil {
+			resp.Error = err.Error()
+			status = http.StatusInternalServerError
+			if decodeErr != nil {
+				status = http.StatusBadRequest
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// exportHandler streams every live pair, optionally limited to ?prefix=, as NDJSON or
+// binary depending on ?format= or the Accept header. Needs admin rights on every key.
+// A failure part way aborts the response so the client sees a truncated transfer.
+func exportHandler(kvs *zapstore.ZapStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, r, auth.Admin, "") {
+			return
+		}
+		format, err := requestFormat(r, r.Header.Get("Accept"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType())
+		writer := bulk.NewWriter(w, format)
+		flusher := http.NewResponseController(w)
+		var exported int
+		err = kvs.ScanContext(r.Context(), r.URL.Query().Get("prefix"), func(key, value string) error {
+			if err := writer.Write(storage.KeyValue{Key: key, Value: value}); err != nil {
+				return err
+			}
+			exported++
+			if exported%exportFlushEvery == 0 {
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			logger.Error("export failed", "request_id", RequestID(r.Context()), "exported", exported, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
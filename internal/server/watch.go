@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"zap-store/internal/auth"
+	"zap-store/internal/watch"
+	"zap-store/internal/zapstore"
+)
+
+const (
+	watchDefaultTimeout = 30 * time.Second // How long a long-poll waits for events
+	watchMaxTimeout     = 5 * time.Minute
+	watchBatchEvents    = 1000             // Events per long-poll response or SSE write
+	watchHeartbeat      = 15 * time.Second // Idle time after which SSE streams send a comment
+)
+
+// streamPaths hold requests open by design, so they are never logged as slow.
+var streamPaths = map[string]bool{"/v1/watch": true, "/admin/changes": true}
+
+// watchResponse is the body of a long-poll. Seq is the cursor to pass as ?after= next.
+type watchResponse struct {
+	Events []watch.Event `json:"events"`
+	Seq    uint64        `json:"seq"`
+}
+
+// watchGone is the body of a 410 answer and the data of an SSE "reset" event: the
+// requested events are lost and the client has to resynchronise. Reading the keys
+// and then watching from Seq misses nothing.
+type watchGone struct {
+	Error string `json:"error"`
+	Seq   uint64 `json:"seq"`
+}
+
+// wantsEventStream reports whether the client asked for Server-Sent Events.
+func wantsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// readable drops the events of keys the caller may not read, for watches on a prefix
+// containing narrower rules. Without authentication every event is kept.
+func readable(r *http.Request, events []watch.Event) []watch.Event {
+	principal, ok := r.Context().Value(principalKey{}).(*auth.Principal)
+	if !ok {
+		return events
+	}
+	kept := events[:0]
+	for _, e := range events {
+		if principal.Authorize(auth.Read, e.Key) == nil {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// watchHandler serves GET /v1/watch?prefix=, reporting changes to the keys under the
+// prefix. It resumes after the sequence given as ?after= or, for SSE reconnects, the
+// Last-Event-ID header, and otherwise starts from now. Clients accepting
+// text/event-stream get an endless SSE stream; others a long-poll answered as soon as
+// there are events, or empty after ?timeout=. Needs read rights on the prefix.
+func (s *Server) watchHandler(kvs *zapstore.ZapStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if !authorize(w, r, auth.Read, prefix) {
+			return
+		}
+
+		after := r.URL.Query().Get("after")
+		if after == "" {
+			after = r.Header.Get("Last-Event-ID")
+		}
+		var watcher *watch.Watcher
+		if after == "" {
+			watcher = kvs.Watch(prefix)
+		} else {
+			seq, err := strconv.ParseUint(after, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid sequence %q", after), http.StatusBadRequest)
+				return
+			}
+			if watcher, err = kvs.WatchFrom(prefix, seq); err != nil {
+				writeWatchGone(w, kvs, err)
+				return
+			}
+		}
+		defer watcher.Close()
+
+		// Shutting the server down ends open watches instead of waiting for them
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer context.AfterFunc(s.streams, cancel)()
+
+		if wantsEventStream(r) {
+			s.streamEvents(ctx, w, r, watcher)
+			return
+		}
+
+		timeout := watchDefaultTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", value), http.StatusBadRequest)
+				return
+			}
+			timeout = min(d, watchMaxTimeout)
+		}
+		ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+
+		resp := watchResponse{Events: []watch.Event{}}
+		for len(resp.Events) == 0 {
+			events, err := watcher.Next(ctx, watchBatchEvents)
+			if errors.Is(err, watch.ErrSequenceUnavailable) {
+				writeWatchGone(w, kvs, err)
+				return
+			}
+			if err != nil {
+				break // Timed out, or the client or server went away
+			}
+			resp.Events = readable(r, events)
+		}
+		resp.Seq = watcher.Seq()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// writeWatchGone answers 410 Gone with the sequence to watch from after resynchronising.
+func writeWatchGone(w http.ResponseWriter, kvs *zapstore.ZapStore, err error) {
+	if !errors.Is(err, watch.ErrSequenceUnavailable) {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(watchGone{Error: err.Error(), Seq: kvs.WatchSeq()})
+}
+
+// streamEvents writes events as Server-Sent Events, with the sequence as the event ID
+// so that EventSource reconnects resume where they left off, until ctx ends. A client
+// falling behind the retained events gets a "reset" event and the stream ends.
+func (s *Server) streamEvents(ctx context.Context, w http.ResponseWriter, r *http.Request, watcher *watch.Watcher) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	if err := flusher.Flush(); err != nil {
+		return
+	}
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, watchHeartbeat)
+		events, err := watcher.Next(waitCtx, watchBatchEvents)
+		cancel()
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, context.DeadlineExceeded):
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case errors.Is(err, watch.ErrSequenceUnavailable):
+			data, _ := json.Marshal(watchGone{Error: err.Error(), Seq: s.kv.WatchSeq()})
+			fmt.Fprintf(w, "event: reset\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		case err != nil:
+			return
+		default:
+			for _, e := range readable(r, events) {
+				data, _ := json.Marshal(e)
+				if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"zap-store/internal/bulk"
+)
+
+// ErrRebalancing is returned when the ring cannot change because a rebalance is
+// running, or did not finish.
+var ErrRebalancing = errors.New("a rebalance is in progress")
+
+// States a rebalance reports in RebalanceStatus.
+const (
+	RebalanceRunning = "running"
+	RebalanceDone    = "done"
+	RebalanceFailed  = "failed"
+)
+
+// RebalanceStatus describes the latest rebalance.
+type RebalanceStatus struct {
+	Op       string    `json:"op"` // "add" or "remove"
+	Node     string    `json:"node"`
+	State    string    `json:"state"`
+	Moved    int64     `json:"moved"` // Keys moved so far
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AddNode puts node on the ring and moves the keys it now owns to it, returning once
+// they have all moved. The router serves every key meanwhile.
+func (rt *Router) AddNode(ctx context.Context, node string) error {
+	if err := rt.begin("add", node); err != nil {
+		return err
+	}
+	return rt.migrate(ctx)
+}
+
+// RemoveNode takes node off the ring and moves its keys to the remaining nodes,
+// returning once they have all moved. The node can be shut down afterwards.
+func (rt *Router) RemoveNode(ctx context.Context, node string) error {
+	if err := rt.begin("remove", node); err != nil {
+		return err
+	}
+	return rt.migrate(ctx)
+}
+
+// Rebalance resumes a rebalance that failed, or was interrupted by a restart. Until it
+// finishes the ring cannot change again.
+func (rt *Router) Rebalance(ctx context.Context) error {
+	if err := rt.resume(); err != nil {
+		return err
+	}
+	return rt.migrate(ctx)
+}
+
+// begin swaps in the ring with node added or removed, keeping the current one to find
+// the keys that have not moved yet.
+func (rt *Router) begin(op, node string) error {
+	node, err := parseNode(node)
+	if err != nil {
+		return err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	switch {
+	case rt.running:
+		return ErrRebalancing
+	case rt.previous != nil:
+		return fmt.Errorf("%w: the last one did not finish, resume it first", ErrRebalancing)
+	}
+
+	var next *Ring
+	switch {
+	case op == "add" && rt.ring.Has(node):
+		return fmt.Errorf("node %s is on the ring already", node)
+	case op == "add":
+		next = rt.ring.With(node)
+	case !rt.ring.Has(node):
+		return fmt.Errorf("node %s is not on the ring", node)
+	case len(rt.ring.Nodes()) == 1:
+		return fmt.Errorf("cannot remove %s, the last node", node)
+	default:
+		next = rt.ring.Without(node)
+	}
+	if err := rt.saveState(next, rt.ring); err != nil {
+		return err
+	}
+
+	rt.previous, rt.ring, rt.running = rt.ring, next, true
+	rt.rebalance = &RebalanceStatus{Op: op, Node: node, State: RebalanceRunning, Started: time.Now()}
+	rt.logger.Info("rebalance started", "op", op, "node", node, "nodes", next.Nodes())
+	return nil
+}
+
+// resume marks an unfinished rebalance as running again.
+func (rt *Router) resume() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	switch {
+	case rt.running:
+		return ErrRebalancing
+	case rt.previous == nil:
+		return errors.New("no rebalance to resume")
+	}
+
+	rt.running = true
+	if rt.rebalance == nil {
+		rt.rebalance = &RebalanceStatus{Op: "resume"}
+	}
+	rt.rebalance.State, rt.rebalance.Error = RebalanceRunning, ""
+	rt.rebalance.Started, rt.rebalance.Finished = time.Now(), time.Time{}
+	rt.logger.Info("rebalance resumed", "nodes", rt.ring.Nodes())
+	return nil
+}
+
+// migrate moves every key of the previous ring's nodes that now belongs to another
+// node, and forgets the previous ring once none is left.
+func (rt *Router) migrate(ctx context.Context) error {
+	rt.mu.RLock()
+	previous, ring := rt.previous, rt.ring
+	rt.mu.RUnlock()
+
+	var err error
+	for _, source := range previous.Nodes() {
+		var keys []string
+		keys, err = rt.keysToMove(ctx, source, ring)
+		if err != nil {
+			break
+		}
+		for _, key := range keys {
+			unlock := rt.lockKeys(key)
+			err = rt.moveKey(ctx, key, source, ring.Owner(key))
+			unlock()
+			if err != nil {
+				break
+			}
+			rt.mu.Lock()
+			rt.rebalance.Moved++
+			rt.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rt.saveState(ring, nil)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.running = false
+	rt.rebalance.Finished = time.Now()
+	if err != nil {
+		rt.rebalance.State, rt.rebalance.Error = RebalanceFailed, err.Error()
+		rt.logger.Error("rebalance failed", "moved", rt.rebalance.Moved, "error", err)
+		return err
+	}
+	rt.previous = nil
+	rt.rebalance.State = RebalanceDone
+	rt.logger.Info("rebalance done", "moved", rt.rebalance.Moved, "nodes", ring.Nodes())
+	return nil
+}
+
+// keysToMove lists the keys on source that ring gives to another node. Only the keys
+// are kept, so the export stream is not held open while they move. The export is
+// binary, which keeps keys that are not valid UTF-8 intact.
+func (rt *Router) keysToMove(ctx context.Context, source string, ring *Ring) ([]string, error) {
+	resp, err := rt.nodeRequest(ctx, http.MethodGet, source+"/admin/export?format=binary", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &nodeError{node: source, status: resp.StatusCode, message: readMessage(resp.Body)}
+	}
+
+	var keys []string
+	reader := bulk.NewReader(resp.Body, bulk.Binary)
+	for {
+		pair, err := reader.Next()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the keys of node %s: %w", source, err)
+		}
+		if ring.Owner(pair.Key) != source {
+			keys = append(keys, pair.Key)
+		}
+	}
+}
+
+// moveKey copies key from one node to another and deletes it from the first. The copy
+// only creates the key, so a value written to the new owner meanwhile wins, and the
+// delete only removes the version that was copied. Moving a key that is gone, or
+// moved already, does nothing.
+func (rt *Router) moveKey(ctx context.Context, key, from, to string) error {
+	path := "/v1/keys/" + url.PathEscape(key)
+	resp, err := rt.nodeRequest(ctx, http.MethodGet, from+path, nil, nil)
+	if err != nil {
+		return err
+	}
+	value, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return &nodeError{node: from, status: resp.StatusCode, message: string(value)}
+	case readErr != nil:
+		return fmt.Errorf("failed to read key '%s' from node %s: %w", key, from, readErr)
+	}
+	etag := resp.Header.Get("ETag")
+
+	steps := []struct {
+		method, url, header, value string
+		body                       []byte
+	}{
+		{http.MethodPut, to + path, "If-None-Match", "*", value},
+		{http.MethodDelete, from + path, "If-Match", etag, nil},
+	}
+	for _, step := range steps {
+		resp, err := rt.nodeRequest(ctx, step.method, step.url, step.body, http.Header{step.header: {step.value}})
+		if err != nil {
+			return err
+		}
+		message := readMessage(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPreconditionFailed && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("failed to move key '%s' from %s to %s: %s answered %d: %s", key, from, to, step.url, resp.StatusCode, message)
+		}
+	}
+	return nil
+}
+
+// nodeRequest sends a request of the router itself to a node.
+func (rt *Router) nodeRequest(ctx context.Context, method, url string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if rt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.token)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return resp, nil
+}
+
+// saveState writes the ring, and the previous one while keys move, to the state file.
+func (rt *Router) saveState(ring, previous *Ring) error {
+	if rt.stateFile == "" {
+		return nil
+	}
+	state := savedState{Nodes: ring.Nodes()}
+	if previous != nil {
+		state.PreviousNodes = previous.Nodes()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := rt.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write shard state: %w", err)
+	}
+	if err := os.Rename(tmp, rt.stateFile); err != nil {
+		return fmt.Errorf("failed to write shard state: %w", err)
+	}
+	return nil
+}
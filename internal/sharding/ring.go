@@ -0,0 +1,108 @@
+// Package sharding partitions keys across several zapstore-server nodes with
+// consistent hashing, and routes requests to the node owning each key.
+package sharding
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is how many points each node gets on the ring. More points
+// spread the keys more evenly, at the cost of a larger ring.
+const DefaultVirtualNodes = 128
+
+// point is one virtual node: a position on the ring owned by a node.
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring maps keys onto nodes by consistent hashing. Every node is placed on the ring
+// at several pseudo-random points, and a key belongs to the node of the first point
+// at or after the key's hash, so adding or removing a node only moves the keys next
+// to its points. A Ring is immutable; With and Without return new ones.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []point
+}
+
+// NewRing places nodes on a ring with vnodes points each, DefaultVirtualNodes if
+// vnodes is not positive.
+func NewRing(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{vnodes: vnodes}
+	for _, node := range nodes {
+		if !slices.Contains(r.nodes, node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	slices.Sort(r.nodes)
+
+	r.points = make([]point, 0, len(r.nodes)*vnodes)
+	for _, node := range r.nodes {
+		for i := range vnodes {
+			r.points = append(r.points, point{hash: hashKey(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		if c := cmp.Compare(a.hash, b.hash); c != 0 {
+			return c
+		}
+		return strings.Compare(a.node, b.node)
+	})
+	return r
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Has reports whether node is on the ring.
+func (r *Ring) Has(node string) bool {
+	return slices.Contains(r.nodes, node)
+}
+
+// Owner returns the node owning key, or "" if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0 // Wrap around
+	}
+	return r.points[i].node
+}
+
+// With returns a ring that also has node.
+func (r *Ring) With(node string) *Ring {
+	return NewRing(r.vnodes, append(r.Nodes(), node)...)
+}
+
+// Without returns a ring without node.
+func (r *Ring) Without(node string) *Ring {
+	return NewRing(r.vnodes, slices.DeleteFunc(r.Nodes(), func(n string) bool { return n == node })...)
+}
+
+// hashKey hashes s with FNV-1a, then mixes the bits so that similar strings, such as
+// the names of the virtual nodes, land far apart.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,673 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"zap-store/internal/storage"
+)
+
+const (
+	maxBodySize    = 32 << 20 // Largest request body forwarded, as much as a node accepts
+	maxBatchKeys   = 1000     // Keys in one /mget or /mset, as on a node
+	keyLockStripes = 256      // Locks the keys are spread over, see lockKeys
+	healthTimeout  = 2 * time.Second
+)
+
+// hopHeaders are the hop-by-hop headers a proxy must not forward.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// mgetResult is one element of a node's /mget response.
+type mgetResult struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Found bool    `json:"found"`
+}
+
+// Status describes the ring and the latest rebalance.
+type Status struct {
+	Nodes         []string         `json:"nodes"`
+	PreviousNodes []string         `json:"previousNodes,omitempty"` // Ring of an unfinished rebalance
+	Rebalance     *RebalanceStatus `json:"rebalance,omitempty"`
+}
+
+// savedState is the content of the state file.
+type savedState struct {
+	Nodes         []string `json:"nodes"`
+	PreviousNodes []string `json:"previousNodes,omitempty"`
+}
+
+// Router is an http.Handler that serves the key API of zapstore-server by forwarding
+// every request to the node owning its key. /mget and /mset are split by node. Other
+// endpoints, such as watches and the admin API of the nodes, are not routed.
+//
+// While a rebalance moves keys, a key may still be on the node that owned it before:
+// reads that miss on the owner try that node too, and writes first move the key, so
+// that neither a newer value nor a delete can be undone by the move. Writes to a key
+// and its move by the rebalance wait for each other.
+type Router struct {
+	client    *http.Client
+	token     string
+	vnodes    int
+	stateFile string
+	logger    *slog.Logger
+	mux       *http.ServeMux
+
+	mu        sync.RWMutex
+	ring      *Ring
+	previous  *Ring // Ring before an unfinished rebalance, nil if none
+	running   bool  // Whether a rebalance is moving keys
+	rebalance *RebalanceStatus
+
+	keyLocks [keyLockStripes]sync.Mutex
+}
+
+// Option configures a Router.
+type Option func(*Router)
+
+// WithToken sets the bearer token the router uses to move keys between nodes, which
+// needs admin rights on them. The router's own /admin/shards endpoints then require it
+// too. Other requests are forwarded with the client's Authorization header.
+func WithToken(token string) Option {
+	return func(rt *Router) { rt.token = token }
+}
+
+// WithHTTPClient sets the client used to reach the nodes, e.g. to trust their CA.
+func WithHTTPClient(client *http.Client) Option {
+	return func(rt *Router) { rt.client = client }
+}
+
+// WithVirtualNodes sets how many points each node gets on the ring. Every router of a
+// cluster, and every client hashing keys itself, must use the same value.
+func WithVirtualNodes(n int) Option {
+	return func(rt *Router) { rt.vnodes = n }
+}
+
+// WithStateFile persists the ring in path, so that nodes added or removed at runtime,
+// and an unfinished rebalance, survive a restart. A saved ring takes precedence over
+// the nodes passed to NewRouter.
+func WithStateFile(path string) Option {
+	return func(rt *Router) { rt.stateFile = path }
+}
+
+// WithLogger sets the logger. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(rt *Router) { rt.logger = logger }
+}
+
+// NewRouter returns a router spreading keys over nodes, the http or https base URLs
+// of zapstore-server instances.
+func NewRouter(nodes []string, opts ...Option) (*Router, error) {
+	rt := &Router{
+		client: http.DefaultClient,
+		logger: slog.Default(),
+		mux:    http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+
+	if rt.stateFile != "" {
+		data, err := os.ReadFile(rt.stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read shard state: %w", err)
+		}
+		if err == nil {
+			var saved savedState
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("failed to parse shard state %s: %w", rt.stateFile, err)
+			}
+			nodes = saved.Nodes
+			if saved.PreviousNodes != nil {
+				previous, err := parseNodes(saved.PreviousNodes)
+				if err != nil {
+					return nil, err
+				}
+				rt.previous = NewRing(rt.vnodes, previous...)
+			}
+		}
+	}
+	parsed, err := parseNodes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("at least one node is needed")
+	}
+	rt.ring = NewRing(rt.vnodes, parsed...)
+
+	rt.mux.HandleFunc("/v1/keys/{key...}", rt.keyHandler)
+	rt.mux.HandleFunc("/get", rt.legacyHandler)
+	rt.mux.HandleFunc("/delete", rt.legacyHandler)
+	rt.mux.HandleFunc("/set", rt.legacySetHandler)
+	rt.mux.HandleFunc("POST /mget", rt.mgetHandler)
+	rt.mux.HandleFunc("POST /mset", rt.msetHandler)
+	rt.mux.HandleFunc("GET /admin/shards", rt.statusHandler)
+	rt.mux.HandleFunc("POST /admin/shards/nodes", rt.addNodeHandler)
+	rt.mux.HandleFunc("DELETE /admin/shards/nodes", rt.removeNodeHandler)
+	rt.mux.HandleFunc("POST /admin/shards/rebalance", rt.rebalanceHandler)
+	rt.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	rt.mux.HandleFunc("/readyz", rt.readyzHandler)
+	return rt, nil
+}
+
+// parseNodes validates node URLs and strips their trailing slashes.
+func parseNodes(nodes []string) ([]string, error) {
+	parsed := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		node, err := parseNode(node)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, node)
+	}
+	return parsed, nil
+}
+
+func parseNode(node string) (string, error) {
+	u, err := url.Parse(node)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid node URL %q (want http:// or https://)", node)
+	}
+	return strings.TrimSuffix(node, "/"), nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// Status returns the ring and the latest rebalance.
+func (rt *Router) Status() Status {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	status := Status{Nodes: rt.ring.Nodes()}
+	if rt.previous != nil {
+		status.PreviousNodes = rt.previous.Nodes()
+	}
+	if rt.rebalance != nil {
+		rebalance := *rt.rebalance
+		status.Rebalance = &rebalance
+	}
+	return status
+}
+
+// Owner returns the node owning key.
+func (rt *Router) Owner(key string) string {
+	owner, _ := rt.route(key)
+	return owner
+}
+
+// route returns the node owning key, and the node that owned it before an unfinished
+// rebalance if that is another one.
+func (rt *Router) route(key string) (owner, previous string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	owner = rt.ring.Owner(key)
+	if rt.previous != nil {
+		if p := rt.previous.Owner(key); p != owner {
+			previous = p
+		}
+	}
+	return owner, previous
+}
+
+// readBody reads a request body to forward, answering 413 if it is too large.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+func (rt *Router) keyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	rt.serveKey(w, r, key, body)
+}
+
+// legacyHandler routes /get and /delete, which take the key as a query parameter.
+func (rt *Router) legacyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+	rt.serveKey(w, r, key, nil)
+}
+
+// legacySetHandler routes /set, which takes the key in its JSON body.
+func (rt *Router) legacySetHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rt.serveKey(w, r, req.Key, body)
+}
+
+// lockKeys locks keys against other writes and moves, returning the function that
+// unlocks them. A write holds the lock from routing the key to the owner's answer and
+// a move from reading the key to deleting it on its previous owner, so a move cannot
+// copy a value that a write deleted or replaced meanwhile and bring it back. Keys
+// share keyLockStripes locks, taken in order so that batches cannot deadlock.
+func (rt *Router) lockKeys(keys ...string) (unlock func()) {
+	stripes := make([]int, len(keys))
+	for i, key := range keys {
+		stripes[i] = int(hashKey(key) % keyLockStripes)
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, stripe := range stripes {
+		rt.keyLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			rt.keyLocks[stripe].Unlock()
+		}
+	}
+}
+
+// serveKey forwards a request about a single key to the node owning it.
+func (rt *Router) serveKey(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if !read {
+		defer rt.lockKeys(key)()
+	}
+	owner, previous := rt.route(key)
+	if previous != "" && !read {
+		if err := rt.moveKey(r.Context(), key, previous, owner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	resp, err := rt.forward(r, owner, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if read && previous != "" && resp.StatusCode == http.StatusNotFound {
+		// Not moved yet, or moved in the meantime: ask the previous owner, then the
+		// owner again
+		for _, node := range []string{previous, owner} {
+			resp.Body.Close()
+			if resp, err = rt.forward(r, node, body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			if resp.StatusCode != http.StatusNotFound {
+				break
+			}
+		}
+	}
+	defer resp.Body.Close()
+	copyResponse(w, resp)
+}
+
+// forward sends r to node with body, and the client's headers.
+func (rt *Router) forward(r *http.Request, node string, body []byte) (*http.Response, error) {
+	target := node + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("node %s unreachable: %w", node, err)
+	}
+	return resp, nil
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// postJSON posts v as JSON to path on node, with the Authorization header of r, and
+// decodes the response into out if it is not nil.
+func (rt *Router) postJSON(r *http.Request, node, path string, v, out any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, node+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s unreachable: %w", node, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &nodeError{node: node, status: resp.StatusCode, message: readMessage(resp.Body)}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from node %s: %w", node, err)
+	}
+	return nil
+}
+
+// nodeError is an error answer of a node, passed on to the client with its status.
+type nodeError struct {
+	node    string
+	status  int
+	message string
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("node %s answered %d: %s", e.node, e.status, e.message)
+}
+
+func readMessage(r io.Reader) string {
+	body, _ := io.ReadAll(io.LimitReader(r, 1024))
+	return strings.TrimSpace(string(body))
+}
+
+// writeNodeError answers with the status of a node's error, or 502 if a node could
+// not be reached.
+func writeNodeError(w http.ResponseWriter, err error) {
+	var nodeErr *nodeError
+	if errors.As(err, &nodeErr) {
+		http.Error(w, err.Error(), nodeErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// groupKeys returns the positions of keys by the node node returns for them, leaving
+// out those it returns "" for.
+func groupKeys(keys []string, node func(i int, key string) string) map[string][]int {
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		if n := node(i, key); n != "" {
+			groups[n] = append(groups[n], i)
+		}
+	}
+	return groups
+}
+
+// owner is Owner for groupKeys.
+func (rt *Router) owner(_ int, key string) string {
+	return rt.Owner(key)
+}
+
+// mgetFrom looks up the keys at the given positions on every node of groups, at the
+// same time, filling in results.
+func (rt *Router) mgetFrom(r *http.Request, keys []string, groups map[string][]int, results []mgetResult) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(groups))
+	for node, positions := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([]string, len(positions))
+			for i, pos := range positions {
+				batch[i] = keys[pos]
+			}
+			var found []mgetResult
+			if err := rt.postJSON(r, node, "/mget", batch, &found); err != nil {
+				errs <- err
+				return
+			}
+			if len(found) != len(batch) {
+				errs <- fmt.Errorf("node %s answered %d results for %d keys", node, len(found), len(batch))
+				return
+			}
+			for i, pos := range positions {
+				results[pos] = found[i]
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (rt *Router) mgetHandler(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&keys); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxBatchKeys {
+		http.Error(w, fmt.Sprintf("too many keys (%d, at most %d)", len(keys), maxBatchKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]mgetResult, len(keys))
+	err := rt.mgetFrom(r, keys, groupKeys(keys, rt.owner), results)
+	if err == nil {
+		// Keys missing on their owner may not have moved yet
+		missing := groupKeys(keys, func(i int, key string) string {
+			if _, previous := rt.route(key); previous != "" && !results[i].Found {
+				return previous
+			}
+			return ""
+		})
+		err = rt.mgetFrom(r, keys, missing, results)
+	}
+	if err != nil {
+		writeNodeError(w, err)
+		return
+	}
+	for i := range results {
+		results[i].Key = keys[i]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// msetHandler stores the pairs of every node with one /mset each. The batch is not
+// atomic across nodes: if one node fails the others may have stored their pairs.
+func (rt *Router) msetHandler(w http.ResponseWriter, r *http.Request) {
+	var pairs []storage.KeyValue
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&pairs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(pairs) > maxBatchKeys {
+		http.Error(w, fmt.Sprintf("too many keys (%d, at most %d)", len(pairs), maxBatchKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+	defer rt.lockKeys(keys...)()
+	for _, pair := range pairs {
+		if owner, previous := rt.route(pair.Key); previous != "" {
+			if err := rt.moveKey(r.Context(), pair.Key, previous, owner); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	groups := groupKeys(keys, rt.owner)
+	errs := make(chan error, len(groups))
+	for node, positions := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([]storage.KeyValue, len(positions))
+			for i, pos := range positions {
+				batch[i] = pairs[pos]
+			}
+			if err := rt.postJSON(r, node, "/mset", batch, nil); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		writeNodeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorizeAdmin checks the router's token on its admin endpoints, if it has one.
+func (rt *Router) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if rt.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(rt.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="zapstore"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (rt *Router) writeStatus(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rt.Status())
+}
+
+func (rt *Router) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if rt.authorizeAdmin(w, r) {
+		rt.writeStatus(w, http.StatusOK)
+	}
+}
+
+// startRebalance answers a request changing the ring: 202 once keys start moving in
+// the background, or 409 if a rebalance is in the way.
+func (rt *Router) startRebalance(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrRebalancing):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	go rt.migrate(context.Background())
+	rt.writeStatus(w, http.StatusAccepted)
+}
+
+func (rt *Router) addNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if rt.authorizeAdmin(w, r) {
+		rt.startRebalance(w, rt.begin("add", r.URL.Query().Get("node")))
+	}
+}
+
+func (rt *Router) removeNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if rt.authorizeAdmin(w, r) {
+		rt.startRebalance(w, rt.begin("remove", r.URL.Query().Get("node")))
+	}
+}
+
+func (rt *Router) rebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if rt.authorizeAdmin(w, r) {
+		rt.startRebalance(w, rt.resume())
+	}
+}
+
+// readyzHandler answers 200 once every node is ready, 503 otherwise.
+func (rt *Router) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failures []string
+	for _, node := range rt.Status().Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := rt.checkReady(ctx, node)
+			if err != nil {
+				mu.Lock()
+				failures = append(failures, err.Error())
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+func (rt *Router) checkReady(ctx context.Context, node string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s unreachable: %w", node, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node %s not ready: %s", node, readMessage(resp.Body))
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package sharding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zap-store/internal/server"
+	"zap-store/internal/storage/inmem"
+	"zap-store/internal/zapstore"
+)
+
+func TestRingOwner(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	ring := NewRing(0, nodes...)
+
+	if got := NewRing(0).Owner("key"); got != "" {
+		t.Errorf("Owner() on an empty ring = %q, want \"\"", got)
+	}
+	if got, want := ring.Owner("key"), NewRing(0, "http://c", "http://b", "http://a").Owner("key"); got != want {
+		t.Errorf("Owner(key) = %q on one ring, %q on the same nodes in another order", got, want)
+	}
+
+	// Keys spread evenly, and a new node only takes keys from the others
+	counts := make(map[string]int)
+	bigger := ring.With("http://d")
+	back := bigger.Without("http://d")
+	moved := 0
+	const keys = 10000
+	for i := range keys {
+		key := fmt.Sprintf("key-%d", i)
+		owner := ring.Owner(key)
+		counts[owner]++
+		if newOwner := bigger.Owner(key); newOwner != owner {
+			moved++
+			if newOwner != "http://d" {
+				t.Fatalf("Owner(%q) moved from %s to %s, want only moves to the new node", key, owner, newOwner)
+			}
+		}
+		if got := back.Owner(key); got != owner {
+			t.Fatalf("Owner(%q) after removing the new node = %s, want %s", key, got, owner)
+		}
+	}
+	for _, node := range nodes {
+		if share := float64(counts[node]) / keys; share < 0.2 || share > 0.47 {
+			t.Errorf("node %s owns %.0f%% of the keys, want about a third", node, share*100)
+		}
+	}
+	if share := float64(moved) / keys; share < 0.15 || share > 0.35 {
+		t.Errorf("adding a fourth node moved %.0f%% of the keys, want about a quarter", share*100)
+	}
+}
+
+// startNodes starts n in-memory servers.
+func startNodes(t *testing.T, n int) ([]string, map[string]*zapstore.ZapStore) {
+	t.Helper()
+	var urls []string
+	stores := make(map[string]*zapstore.ZapStore)
+	for range n {
+		kv := zapstore.NewZapStore(inmem.NewInMemStorageEngine())
+		ts := httptest.NewServer(server.New(kv, server.WithLogger(slog.New(slog.DiscardHandler))))
+		t.Cleanup(ts.Close)
+		urls = append(urls, ts.URL)
+		stores[ts.URL] = kv
+	}
+	return urls, stores
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest(%s %s) failed: %v", method, url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// checkPlacement checks that every key is on its owner, and only there.
+func checkPlacement(t *testing.T, rt *Router, stores map[string]*zapstore.ZapStore, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		owner := rt.Owner(key)
+		for node, kv := range stores {
+			got, err := kv.Get(key)
+			switch {
+			case node == owner && (err != nil || got != value):
+				t.Errorf("owner %s of %q holds %q, %v, want %q", node, key, got, err, value)
+			case node != owner && err == nil:
+				t.Errorf("%s holds %q, owned by %s", node, key, owner)
+			}
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	nodes, stores := startNodes(t, 4)
+	stateFile := filepath.Join(t.TempDir(), "shards.json")
+	rt, err := NewRouter(nodes[:3], WithStateFile(stateFile), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+
+	want := make(map[string]string)
+	for i := range 50 {
+		key, value := fmt.Sprintf("key/%d", i), fmt.Sprintf("value-%d", i)
+		if status, body := request(t, http.MethodPut, ts.URL+"/v1/keys/"+key, value); status != http.StatusCreated {
+			t.Fatalf("PUT %s = %d %s, want 201", key, status, body)
+		}
+		want[key] = value
+	}
+	if status, body := request(t, http.MethodPost, ts.URL+"/set", `{"key": "legacy", "value": "old api"}`); status != http.StatusOK {
+		t.Fatalf("POST /set = %d %s, want 200", status, body)
+	}
+	want["legacy"] = "old api"
+	if status, body := request(t, http.MethodPost, ts.URL+"/mset", `[{"key": "m1", "value": "1"}, {"key": "m2", "value": "2"}]`); status != http.StatusOK {
+		t.Fatalf("POST /mset = %d %s, want 200", status, body)
+	}
+	want["m1"], want["m2"] = "1", "2"
+	checkPlacement(t, rt, stores, want)
+
+	if status, body := request(t, http.MethodGet, ts.URL+"/get?key=legacy", ""); status != http.StatusOK || body != "old api" {
+		t.Errorf("GET /get?key=legacy = %d %q, want 200 %q", status, body, "old api")
+	}
+	status, body := request(t, http.MethodPost, ts.URL+"/mget", `["m1", "missing", "key/7"]`)
+	if want := `[{"key":"m1","value":"1","found":true},{"key":"missing","found":false},{"key":"key/7","value":"value-7","found":true}]`; status != http.StatusOK || strings.TrimSpace(body) != want {
+		t.Errorf("POST /mget = %d %s, want 200 %s", status, body, want)
+	}
+
+	// Adding a node moves the keys it now owns
+	if err := rt.AddNode(context.Background(), nodes[3]); err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	if err := rt.AddNode(context.Background(), nodes[3]); err == nil {
+		t.Errorf("AddNode() of a node on the ring error = nil, want an error")
+	}
+	checkPlacement(t, rt, stores, want)
+	if s := rt.Status(); len(s.Nodes) != 4 || s.PreviousNodes != nil || s.Rebalance.State != RebalanceDone || s.Rebalance.Moved == 0 {
+		t.Errorf("Status() after AddNode = %+v, want 4 nodes and a finished rebalance", s)
+	}
+
+	// While a rebalance has not moved a key, reads find it on its previous owner and
+	// writes move it first
+	if err := rt.begin("remove", nodes[0]); err != nil {
+		t.Fatalf("begin(remove) error = %v", err)
+	}
+	if err := rt.begin("add", "http://other"); err == nil {
+		t.Errorf("begin() during a rebalance error = nil, want an error")
+	}
+	var onRemoved []string
+	for key := range want {
+		if _, previous := rt.route(key); previous == nodes[0] {
+			onRemoved = append(onRemoved, key)
+		}
+	}
+	if len(onRemoved) < 2 {
+		t.Fatalf("only %d keys on the removed node, want at least 2", len(onRemoved))
+	}
+	if status, body := request(t, http.MethodGet, ts.URL+"/v1/keys/"+onRemoved[0], ""); status != http.StatusOK || body != want[onRemoved[0]] {
+		t.Errorf("GET of a key not moved yet = %d %q, want 200 %q", status, body, want[onRemoved[0]])
+	}
+	if status, _ := request(t, http.MethodDelete, ts.URL+"/v1/keys/"+onRemoved[1], ""); status != http.StatusNoContent {
+		t.Errorf("DELETE of a key not moved yet = %d, want 204", status)
+	}
+	delete(want, onRemoved[1])
+	if status, _ := request(t, http.MethodGet, ts.URL+"/v1/keys/"+onRemoved[1], ""); status != http.StatusNotFound {
+		t.Errorf("GET of a deleted key = %d, want 404", status)
+	}
+
+	// A restarted router resumes the rebalance from its state file
+	restarted, err := NewRouter(nodes[:1], WithStateFile(stateFile), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("NewRouter() from the state file error = %v", err)
+	}
+	if s := restarted.Status(); len(s.Nodes) != 3 || len(s.PreviousNodes) != 4 {
+		t.Fatalf("restarted router status = %+v, want 3 nodes and 4 previous ones", s)
+	}
+	if err := restarted.Rebalance(context.Background()); err != nil {
+		t.Fatalf("Rebalance() error = %v", err)
+	}
+	if s := restarted.Status(); s.PreviousNodes != nil || s.Rebalance.State != RebalanceDone {
+		t.Errorf("Status() after Rebalance = %+v, want it finished", s)
+	}
+	checkPlacement(t, restarted, stores, want)
+	if keys, _ := stores[nodes[0]].MGet([]string{onRemoved[0]}); keys[0].Found {
+		t.Errorf("removed node still holds %q", onRemoved[0])
+	}
+}
+
+func TestRouterAdmin(t *testing.T) {
+	nodes, _ := startNodes(t, 2)
+	rt, err := NewRouter(nodes[:1], WithToken("secret"), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+
+	if status, _ := request(t, http.MethodGet, ts.URL+"/admin/shards", ""); status != http.StatusUnauthorized {
+		t.Errorf("GET /admin/shards without the token = %d, want 401", status)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "status", method: http.MethodGet, path: "/admin/shards", wantStatus: http.StatusOK},
+		{name: "add_invalid", method: http.MethodPost, path: "/admin/shards/nodes?node=ftp://x", wantStatus: http.StatusBadRequest},
+		{name: "remove_last", method: http.MethodDelete, path: "/admin/shards/nodes?node=" + nodes[0], wantStatus: http.StatusBadRequest},
+		{name: "resume_nothing", method: http.MethodPost, path: "/admin/shards/rebalance", wantStatus: http.StatusBadRequest},
+		{name: "add", method: http.MethodPost, path: "/admin/shards/nodes?node=" + nodes[1], wantStatus: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", tt.method, tt.path, err)
+		}
+		var status Status
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.Status().Rebalance.State == RebalanceRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := rt.Status(); s.Rebalance.State != RebalanceDone || len(s.Nodes) != 2 {
+		t.Errorf("Status() after adding a node = %+v, want 2 nodes and a finished rebalance", s)
+	}
+	if status, body := request(t, http.MethodGet, ts.URL+"/readyz", ""); status != http.StatusOK {
+		t.Errorf("GET /readyz = %d %s, want 200", status, body)
+	}
+}
+
+// blockingTransport holds the first response to a GET of path until release is
+// closed, signalling held when it starts holding it.
+type blockingTransport struct {
+	path    string
+	holding atomic.Bool
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (bt *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if req.Method == http.MethodGet && req.URL.Path == bt.path {
+		if bt.holding.CompareAndSwap(false, true) {
+			close(bt.held)
+			<-bt.release
+		}
+	}
+	return resp, err
+}
+
+// TestRouterDeleteDuringMove deletes a key while the rebalance is moving it: the
+// move must not copy the value it read before the delete back to the new owner.
+func TestRouterDeleteDuringMove(t *testing.T) {
+	nodes, stores := startNodes(t, 2)
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key-%d", i); NewRing(0, nodes...).Owner(k) == nodes[1] {
+			key = k
+		}
+	}
+	stores[nodes[0]].Set(key, "v1")
+
+	bt := &blockingTransport{path: "/v1/keys/" + key, held: make(chan struct{}), release: make(chan struct{})}
+	rt, err := NewRouter(nodes[:1], WithHTTPClient(&http.Client{Transport: bt}), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+
+	added := make(chan error, 1)
+	go func() { added <- rt.AddNode(context.Background(), nodes[1]) }()
+	<-bt.held // The migrator has read v1 and not copied it yet
+	deleted := make(chan int, 1)
+	go func() {
+		status, _ := request(t, http.MethodDelete, ts.URL+"/v1/keys/"+key, "")
+		deleted <- status
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the delete run, unless it waits for the move
+	close(bt.release)
+
+	if err := <-added; err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	if status := <-deleted; status != http.StatusNoContent {
+		t.Errorf("DELETE during the move = %d, want 204", status)
+	}
+	for node, kv := range stores {
+		if got, err := kv.Get(key); err == nil {
+			t.Errorf("%s holds deleted key %q = %q", node, key, got)
+		}
+	}
+}
+
+func TestRouterMovesBinaryKeys(t *testing.T) {
+	nodes, stores := startNodes(t, 2)
+	rt, err := NewRouter(nodes[:1], WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	want := make(map[string]string)
+	for i := range 20 {
+		key, value := fmt.Sprintf("bin\xff%d", i), fmt.Sprintf("\xfe%d", i)
+		stores[nodes[0]].Set(key, value)
+		want[key] = value
+	}
+
+	if err := rt.AddNode(context.Background(), nodes[1]); err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	if s := rt.Status(); s.Rebalance.Moved == 0 {
+		t.Errorf("Status() after AddNode = %+v, want keys moved", s)
+	}
+	checkPlacement(t, rt, stores, want)
+}
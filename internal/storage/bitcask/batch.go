@@ -0,0 +1,127 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
+)
+
+// Keys returns the live keys starting with prefix, sorted.
+func (bcse *BitCaskStorageEngine) Keys(prefix string) ([]string, error) {
+	bcse.mu.RLock()
+	defer bcse.mu.RUnlock()
+
+	if bcse.loadErr != nil {
+		return nil, bcse.loadErr
+	}
+
+	keys := make([]string, 0, len(bcse.keyDir))
+	for key := range bcse.keyDir {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// MGet looks up every key under a single read lock, opening each log file at most once.
+func (bcse *BitCaskStorageEngine) MGet(keys []string) ([]storage.Result, error) {
+	return bcse.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, giving up if ctx ends while waiting for the lock or the disk.
+func (bcse *BitCaskStorageEngine) MGetContext(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if err := storage.RLock(ctx, &bcse.mu); err != nil {
+		return nil, err
+	}
+	return readContext(ctx, func() ([]storage.Result, error) {
+		defer bcse.mu.RUnlock()
+		return bcse.mgetLocked(ctx, keys)
+	})
+}
+
+// mgetLocked reads the values of keys, stopping early if ctx ends. Called when
+// holding the read lock.
+func (bcse *BitCaskStorageEngine) mgetLocked(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if bcse.loadErr != nil {
+		return nil, bcse.loadErr
+	}
+
+	readers := make(map[int64]vfs.File)
+	defer func() {
+		for _, f := range readers {
+			f.Close()
+			bcse.openReaders.Add(-1)
+		}
+	}()
+
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		keyData, ok := bcse.keyDir[key]
+		if !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reader, ok := bcse.files[keyData.fileId] // Held open by a read-only engine
+		if !ok {
+			reader, ok = readers[keyData.fileId]
+		}
+		if !ok {
+			var err error
+			reader, err = vfs.Open(bcse.fs, logFilePath(bcse.dataDir, keyData.fileId))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open log file for key '%s': %w", key, err)
+			}
+			bcse.openReaders.Add(1)
+			readers[keyData.fileId] = reader
+		}
+
+		value := make([]byte, keyData.valueSize)
+		if _, err := reader.ReadAt(value, keyData.valuePosition); err != nil {
+			return nil, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+		}
+		results[i] = storage.Result{Value: string(value), Found: true}
+	}
+	return results, nil
+}
+
+// MSet writes every pair under a single write lock and, with SyncAlways, a single
+// fsync. Nothing is written if a pair is invalid, e.g. its key is empty. If a write
+// fails the pairs before it stay written and the engine turns read-only.
+func (bcse *BitCaskStorageEngine) MSet(pairs []storage.KeyValue) error {
+	return bcse.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, giving up if ctx ends while waiting for the lock. Once the
+// pairs are being written, they are all written.
+func (bcse *BitCaskStorageEngine) MSetContext(ctx context.Context, pairs []storage.KeyValue) error {
+	if bcse.readOnly {
+		return errOpenedReadOnly
+	}
+	for _, pair := range pairs {
+		if err := checkWrite(pair.Key, pair.Value); err != nil {
+			return err
+		}
+	}
+	if err := storage.Lock(ctx, &bcse.mu); err != nil {
+		return err
+	}
+	defer bcse.mu.Unlock()
+
+	for _, pair := range pairs {
+		if _, err := bcse.setLocked(pair.Key, pair.Value, nil); err != nil {
+			return err
+		}
+	}
+	if err := bcse.syncIfAlwaysLocked(); err != nil {
+		return fmt.Errorf("failed to sync batch: %w", err)
+	}
+	return nil
+}
@@ -2,17 +2,23 @@ package bitcask
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync" // Import sync package
+	"sync/atomic"
 	"time"
 
-	"github.com/gofrs/flock" // Import a file locking library
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
 )
 
 type DataDirFileLogEntry struct {
@@ -72,17 +78,17 @@ func (ddfle *DataDirFileLogEntry) toBytes() ([]byte, error) {
 
 type Log struct {
 	writerPosition int64
-	file           *os.File
+	file           vfs.File
 	fileId         int64
 	filePath       string
 }
 
-func openLogFile(dataDir string, fileId int64) (*Log, error) {
+func openLogFile(fsys vfs.FS, dataDir string, fileId int64) (*Log, error) {
 	fileName := fmt.Sprintf("%016d.log", fileId)
 	filePath := filepath.Join(dataDir, fileName)
 
 	// Use O_APPEND for efficient writes, O_RDWR needed for potential future ReadAt on active file
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	file, err := fsys.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open log file %s: %w", filePath, err)
 	}
@@ -139,13 +145,13 @@ func (l *Log) setLogEntry(dataDirFileLogEntry *DataDirFileLogEntry) (valueStartO
 
 // getLogEntry reads ONLY the value from a specific offset in a *potentially inactive* file.
 // It opens the file read-only on demand. Called when holding the engine's read lock.
-func getLogValue(dataDir string, fileId int64, valueOffset int64, valueSize int64) (string, error) {
+func getLogValue(fsys vfs.FS, dataDir string, fileId int64, valueOffset int64, valueSize int64) (string, error) {
 	// Construct file path (must match naming scheme used in openLogFile)
 	fileName := fmt.Sprintf("%016d.log", fileId)
 	filePath := filepath.Join(dataDir, fileName)
 
 	// Open read-only
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0) // No need for 0755 on read-only
+	file, err := vfs.Open(fsys, filePath)
 	if err != nil {
 		// Handle file not found specifically?
 		return "", fmt.Errorf("failed to open log file %s for reading: %w", filePath, err)
@@ -170,6 +176,17 @@ func getLogValue(dataDir string, fileId int64, valueOffset int64, valueSize int6
 	return string(value), nil
 }
 
+// Sync flushes the log file to stable storage. Called when holding the engine's write lock.
+func (l *Log) Sync() error {
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log file %s: %w", l.filePath, err)
+	}
+	return nil
+}
+
 // Close closes the underlying file handle. Called when holding the engine's write lock (e.g., during rotation or engine Close).
 func (l *Log) Close() error {
 	if l.file != nil {
@@ -191,11 +208,7 @@ type KeyDir struct {
 }
 
 // readEntry reads a full entry (header, key, value) from a given position. Used for KeyDir rebuild.
-func readEntry(f *os.File, position int64) (*DataDirFileLogEntry, int64, error) {
-	// Fixed header size
-	// Fixed header size: crc(4) + ts(8) + ksz(8) + vsz(8) = 28 bytes
-	headerSize := int64(28)
-
+func readEntry(f io.ReadSeeker, position int64) (*DataDirFileLogEntry, int64, error) {
 	// Seek to the start of the entry
 	_, err := f.Seek(position, io.SeekStart)
 	if err != nil {
@@ -205,9 +218,17 @@ func readEntry(f *os.File, position int64) (*DataDirFileLogEntry, int64, error)
 		}
 		return nil, 0, fmt.Errorf("seek failed at pos %d: %w", position, err)
 	}
+	return decodeEntry(f, position)
+}
+
+// decodeEntry reads the entry starting at position from r, which must be positioned
+// there. It returns io.EOF if r ends before the header is complete.
+func decodeEntry(r io.Reader, position int64) (*DataDirFileLogEntry, int64, error) {
+	// Fixed header size: crc(4) + ts(8) + ksz(8) + vsz(8) = 28 bytes
+	headerSize := int64(28)
 
 	header := make([]byte, headerSize)
-	_, err = io.ReadFull(f, header)
+	_, err := io.ReadFull(r, header)
 	if err != nil {
 		// Distinguish between clean EOF (tried to read header past end) and other errors
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -239,14 +260,14 @@ func readEntry(f *os.File, position int64) (*DataDirFileLogEntry, int64, error)
 	}
 
 	keyBytes := make([]byte, entry.keySize)
-	_, err = io.ReadFull(f, keyBytes)
+	_, err = io.ReadFull(r, keyBytes)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed reading key (%d bytes) at pos %d: %w", entry.keySize, position+headerSize, err)
 	}
 	entry.key = string(keyBytes)
 
 	valueBytes := make([]byte, entry.valueSize)
-	_, err = io.ReadFull(f, valueBytes)
+	_, err = io.ReadFull(r, valueBytes)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed reading value (%d bytes) at pos %d: %w", entry.valueSize, position+headerSize+entry.keySize, err)
 	}
@@ -258,18 +279,43 @@ func readEntry(f *os.File, position int64) (*DataDirFileLogEntry, int64, error)
 	return &entry, entrySize, nil
 }
 
+// lastWrite is the newest entry of a data directory. New entries are stamped after it,
+// and a merge keeps it if it is a tombstone, so no version is ever handed out twice.
+type lastWrite struct {
+	timeStamp  int64
+	deletedKey string // The key the entry deleted, if it is a tombstone
+}
+
+// record notes that an entry for key stamped timeStamp was written, a tombstone if
+// deleted. An older entry for the tombstone's key leaves it alone: the tombstone still
+// holds the newest timestamp, which a merge has to keep.
+func (lw *lastWrite) record(key string, timeStamp int64, deleted bool) {
+	if timeStamp < lw.timeStamp {
+		return
+	}
+	lw.timeStamp, lw.deletedKey = timeStamp, ""
+	if deleted {
+		lw.deletedKey = key
+	}
+}
+
 // getKeyDir rebuilds the KeyDir map from existing log files. Called during init.
-func getKeyDir(dataDir string) (map[string]KeyDir, int64, error) {
+// A file's scan stops at the first entry that is cut short, cannot be decoded or fails
+// its CRC, typically a write torn by a crash, with a warning on logger. Errors of the
+// file system fail the load instead, as skipping the rest of a file would lose the
+// keys written there.
+func getKeyDir(fsys vfs.FS, dataDir string, logger *slog.Logger) (map[string]KeyDir, int64, lastWrite, error) {
 	keyDir := make(map[string]KeyDir)
 	var maxFileId int64 = 0 // Track the latest file ID found
+	var last lastWrite
 
-	files, err := os.ReadDir(dataDir)
+	files, err := fsys.ReadDir(dataDir)
 	if err != nil {
 		// If the directory doesn't exist yet, that's okay for init, return empty map
 		if os.IsNotExist(err) {
-			return keyDir, maxFileId, nil
+			return keyDir, maxFileId, last, nil
 		}
-		return nil, maxFileId, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
+		return nil, maxFileId, last, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
 	}
 
 	for _, dirEntry := range files {
@@ -284,7 +330,7 @@ func getKeyDir(dataDir string) (map[string]KeyDir, int64, error) {
 		fileId, err := strconv.ParseInt(baseName, 10, 64)
 		if err != nil {
 			// Log warning about potentially invalid file names
-			fmt.Fprintf(os.Stderr, "Warning: Skipping file with invalid name format: %s (%v)\n", fileName, err)
+			logger.Warn("skipping file with invalid name format", "file", fileName, "error", err)
 			continue
 		}
 
@@ -294,11 +340,9 @@ func getKeyDir(dataDir string) (map[string]KeyDir, int64, error) {
 		}
 
 		filePath := filepath.Join(dataDir, fileName)
-		file, err := os.Open(filePath) // Open read-only for scanning
+		file, err := vfs.Open(fsys, filePath) // Open read-only for scanning
 		if err != nil {
-			// Log warning, skip file if unreadable
-			fmt.Fprintf(os.Stderr, "Warning: Skipping unreadable file %s: %v\n", filePath, err)
-			continue
+			return nil, maxFileId, last, fmt.Errorf("failed to open log file: %w", err)
 		}
 
 		var position int64 = 0
@@ -307,12 +351,21 @@ func getKeyDir(dataDir string) (map[string]KeyDir, int64, error) {
 			if err == io.EOF {
 				break // End of this file
 			}
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) { // The disk failed, not the record
+				file.Close()
+				return nil, maxFileId, last, fmt.Errorf("failed to read log file: %w", err)
+			}
+			if err == nil && crc32.ChecksumIEEE([]byte(entry.value)) != entry.crc {
+				err = fmt.Errorf("checksum mismatch at pos %d", position)
+			}
 			if err != nil {
 				// Log warning about corrupted entry/file, stop processing this file
-				fmt.Fprintf(os.Stderr, "Warning: Error reading entry from %s at pos %d, stopping scan for this file: %v\n", filePath, position, err)
+				logger.Warn("error reading entry, stopping scan for this file", "file", filePath, "position", position, "error", err)
 				break
 			}
 
+			last.record(entry.key, entry.timeStamp, entry.value == "<DELETED>")
 			if entry.value == "<DELETED>" {
 				delete(keyDir, entry.key)
 			} else {
@@ -338,182 +391,673 @@ func getKeyDir(dataDir string) (map[string]KeyDir, int64, error) {
 		file.Close() // Close after scanning each file
 	}
 
-	return keyDir, maxFileId, nil
+	return keyDir, maxFileId, last, nil
 }
 
 // Lock file name
 const lockFileName = "bitcask.lock"
 
+// ErrLocked is returned when opening a data directory another process has open.
+var ErrLocked = errors.New("data directory is locked by another process")
+
+// lockDataDir takes the exclusive lock of dataDir, without waiting for it.
+func lockDataDir(fsys vfs.FS, dataDir string) (io.Closer, error) {
+	lockPath := filepath.Join(dataDir, lockFileName)
+	// Try to lock exclusively, non-blocking
+	fLock, err := fsys.Lock(lockPath)
+	if errors.Is(err, vfs.ErrLocked) {
+		// Lock is already held by another process
+		return nil, fmt.Errorf("%w: %s (lock file: %s)", ErrLocked, dataDir, lockPath)
+	}
+	if err != nil {
+		// Error acquiring lock (e.g., permissions)
+		return nil, fmt.Errorf("failed to check or acquire file lock %s: %w", lockPath, err)
+	}
+	return fLock, nil
+}
+
+// ErrEngineClosed is returned by operations on an engine that has been closed.
+var ErrEngineClosed = errors.New("bitcask engine is closed")
+
+// ErrReservedValue is returned by writes of the value that marks deleted keys in the
+// log, which would read back as a deletion.
+var ErrReservedValue = errors.New(`value "<DELETED>" is reserved`)
+
+// checkWrite rejects a pair the log cannot hold.
+func checkWrite(key, value string) error {
+	if key == "" {
+		return storage.ErrEmptyKey
+	}
+	if value == "<DELETED>" {
+		return fmt.Errorf("%w: key '%s'", ErrReservedValue, key)
+	}
+	return nil
+}
+
 type BitCaskStorageEngine struct {
 	keyDir    map[string]KeyDir
 	activeLog *Log         // Pointer to the current active log file
 	dataDir   string       // Store dataDir path
+	fs        vfs.FS       // File system all I/O goes through, from the options
 	mu        sync.RWMutex // Mutex for goroutine safety (intra-process)
-	fLock     *flock.Flock // File lock for single writer (inter-process)
+	fLock     io.Closer    // File lock for single writer (inter-process)
+	opts      Options      // Guarded by mu
+	readOnly  bool         // Opened with WithReadOnly: no lock, no active log
+
+	// A read-only engine holds the log files it indexed open and remembers how far it
+	// has read them. Both are guarded by mu; files is nil once closed.
+	files   map[int64]vfs.File
+	readPos storage.LogPosition
+
+	last        lastWrite       // Newest entry written or loaded, guarded by mu
+	liveBytes   map[int64]int64 // Bytes of live entries per file id, guarded by mu
+	keyBytes    int64           // Total length of all keys in keyDir, guarded by mu
+	openReaders atomic.Int64    // Log files currently opened by Get
+
+	bgMu     sync.Mutex // Guards the background loops below
+	syncer   *periodic  // Periodic fsync, running only with SyncInterval
+	merger   *periodic  // Scheduled merges, running only when MergeInterval > 0
+	follower *periodic  // Picks up new writes, running only when read-only with FollowInterval > 0
+	closed   bool       // Set once Close has stopped the background loops
+
+	loading atomic.Bool           // Set while a background load holds the write lock
+	loadErr error                 // Why the background load failed, guarded by mu
+	failure atomic.Pointer[error] // Set once a failed load or write stopped the engine taking writes
 }
 
-func NewBitCaskStorageEngine(dataDir string) (*BitCaskStorageEngine, error) {
+func NewBitCaskStorageEngine(dataDir string, options ...Option) (*BitCaskStorageEngine, error) {
+	opts := defaultOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid bitcask options: %w", err)
+	}
+
+	// A read-only engine leaves the directory as it is: it neither creates nor locks it,
+	// so the writer can hold the lock meanwhile.
+	if opts.ReadOnly {
+		return openReadOnly(dataDir, opts)
+	}
+
 	// 1. Ensure data directory exists
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := opts.FS.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory %s: %w", dataDir, err)
 	}
 
 	// 2. Acquire Inter-Process Lock (Single Writer)
-	lockPath := filepath.Join(dataDir, lockFileName)
-	fLock := flock.New(lockPath)
-	// Try to lock exclusively, non-blocking
-	locked, err := fLock.TryLock()
+	fLock, err := lockDataDir(opts.FS, dataDir)
 	if err != nil {
-		// Error acquiring lock (e.g., permissions)
-		return nil, fmt.Errorf("failed to check or acquire file lock %s: %w", lockPath, err)
-	}
-	if !locked {
-		// Lock is already held by another process
-		return nil, fmt.Errorf("data directory %s is locked by another process (lock file: %s)", dataDir, lockPath)
+		return nil, err
 	}
 	// If successful, fLock is held. It MUST be released on Close.
 
-	// 3. Load KeyDir from existing files
-	keyDir, lastFileId, err := getKeyDir(dataDir)
-	if err != nil {
-		fLock.Unlock() // Release lock if KeyDir load fails
-		return nil, fmt.Errorf("failed to load key directory: %w", err)
+	// 3. Create the engine instance
+	engine := &BitCaskStorageEngine{
+		dataDir: dataDir,
+		fs:      opts.FS,
+		fLock:   fLock,
+		opts:    opts,
+		// mu is implicitly initialized
 	}
 
-	// 4. Open the next log file for writing
-	// If no files existed, start with ID 1. Otherwise, start with lastFileId + 1.
-	nextFileId := lastFileId + 1
-	if nextFileId == 1 && len(keyDir) == 0 { // Handle the very first run case explicitly
-		// Could start with 0 or 1, let's use 1
-	} else if lastFileId == 0 { // If directory existed but was empty or had invalid files
-		nextFileId = 1
+	// 4. Load the KeyDir and open the active log, in the background if asked to. The
+	// loader holds the write lock until it is done, so operations wait for it.
+	if err := engine.load(engine.loadLocked); err != nil {
+		fLock.Close() // Release lock if loading fails
+		return nil, err
 	}
 
-	activeLog, err := openLogFile(dataDir, nextFileId)
+	engine.bgMu.Lock()
+	engine.restartSyncerLocked(opts.SyncPolicy, opts.SyncInterval)
+	engine.restartMergerLocked(opts.MergeInterval)
+	engine.bgMu.Unlock()
+
+	return engine, nil
+}
+
+// openReadOnly opens an engine as WithReadOnly describes.
+func openReadOnly(dataDir string, opts Options) (*BitCaskStorageEngine, error) {
+	info, err := opts.FS.Stat(dataDir)
 	if err != nil {
-		fLock.Unlock() // Release lock if opening log fails
-		return nil, fmt.Errorf("failed to open active log file: %w", err)
+		return nil, fmt.Errorf("failed to open data directory %s: %w", dataDir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("data directory %s is not a directory", dataDir)
 	}
 
-	// 5. Create the engine instance
 	engine := &BitCaskStorageEngine{
-		keyDir:    keyDir,
-		activeLog: activeLog,
-		dataDir:   dataDir,
-		fLock:     fLock,
-		// mu is implicitly initialized
+		dataDir:  dataDir,
+		fs:       opts.FS,
+		opts:     opts,
+		readOnly: true,
+	}
+	if err := engine.load(engine.loadReadOnlyLocked); err != nil {
+		return nil, err
 	}
 
+	if opts.FollowInterval > 0 {
+		engine.bgMu.Lock()
+		engine.follower = startPeriodic(opts.FollowInterval, func() {
+			if err := engine.Refresh(); err != nil {
+				engine.opts.Logger.Error("following the data directory failed", "error", err)
+			}
+		})
+		engine.bgMu.Unlock()
+	}
 	return engine, nil
 }
 
+// load runs loadLocked, in the background if the options ask for it, in which case
+// the write lock is held until it is done so that operations wait for it.
+func (bcse *BitCaskStorageEngine) load(loadLocked func() error) error {
+	if !bcse.opts.BackgroundLoad {
+		return loadLocked()
+	}
+	bcse.mu.Lock()
+	bcse.loading.Store(true)
+	go func() {
+		defer bcse.mu.Unlock()
+		defer bcse.loading.Store(false)
+		if err := loadLocked(); err != nil {
+			bcse.loadErr = err
+			bcse.failure.Store(&err)
+		}
+	}()
+	return nil
+}
+
+// loadLocked rebuilds the KeyDir from the data directory and opens the next log file
+// for writing. Called when holding the write lock (or before the engine is shared).
+func (bcse *BitCaskStorageEngine) loadLocked() error {
+	keyDir, lastFileId, last, err := getKeyDir(bcse.fs, bcse.dataDir, bcse.opts.Logger)
+	if err != nil {
+		return fmt.Errorf("failed to load key directory: %w", err)
+	}
+
+	// If no files existed, start with ID 1. Otherwise, start with lastFileId + 1.
+	activeLog, err := openLogFile(bcse.fs, bcse.dataDir, lastFileId+1)
+	if err != nil {
+		return fmt.Errorf("failed to open active log file: %w", err)
+	}
+
+	bcse.keyDir = keyDir
+	bcse.activeLog = activeLog
+	bcse.last = last
+	bcse.resetLiveStatsLocked()
+	return nil
+}
+
+// WaitLoaded blocks until the KeyDir has been loaded and returns the error that
+// stopped it from loading, if any. It returns immediately unless BackgroundLoad is set.
+func (bcse *BitCaskStorageEngine) WaitLoaded() error {
+	bcse.mu.RLock()
+	defer bcse.mu.RUnlock()
+	return bcse.loadErr
+}
+
+// Health reports storage.ErrNotReady while the KeyDir is loading, and the reason the
+// engine stopped accepting writes once it has. It never blocks.
+func (bcse *BitCaskStorageEngine) Health() error {
+	if bcse.loading.Load() {
+		return storage.ErrNotReady
+	}
+	if err := bcse.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// setFailure switches the engine to read-only after an error left the active log in an
+// unknown state; appending after a partial write would corrupt it. The first cause wins.
+func (bcse *BitCaskStorageEngine) setFailure(cause error) {
+	err := fmt.Errorf("%w: %v", storage.ErrReadOnly, cause)
+	bcse.failure.CompareAndSwap(nil, &err)
+}
+
+// SetSyncPolicy changes the fsync policy of a running engine.
+func (bcse *BitCaskStorageEngine) SetSyncPolicy(policy SyncPolicy, interval time.Duration) error {
+	opts := bcse.options()
+	opts.SyncPolicy, opts.SyncInterval = policy, interval
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	bcse.mu.Lock()
+	bcse.opts.SyncPolicy, bcse.opts.SyncInterval = policy, interval
+	bcse.mu.Unlock()
+
+	bcse.bgMu.Lock()
+	defer bcse.bgMu.Unlock()
+	if !bcse.closed {
+		bcse.restartSyncerLocked(policy, interval)
+	}
+	return nil
+}
+
+// SetMergeInterval changes how often Merge runs in the background. Zero disables scheduled merges.
+func (bcse *BitCaskStorageEngine) SetMergeInterval(interval time.Duration) error {
+	opts := bcse.options()
+	opts.MergeInterval = interval
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	bcse.mu.Lock()
+	bcse.opts.MergeInterval = interval
+	bcse.mu.Unlock()
+
+	bcse.bgMu.Lock()
+	defer bcse.bgMu.Unlock()
+	if !bcse.closed {
+		bcse.restartMergerLocked(interval)
+	}
+	return nil
+}
+
+// SetSchedule changes the fsync policy and the merge interval together. Both are
+// validated first, so a rejected value leaves the engine as it was.
+func (bcse *BitCaskStorageEngine) SetSchedule(policy SyncPolicy, syncInterval, mergeInterval time.Duration) error {
+	opts := bcse.options()
+	opts.SyncPolicy, opts.SyncInterval, opts.MergeInterval = policy, syncInterval, mergeInterval
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	bcse.mu.Lock()
+	bcse.opts.SyncPolicy, bcse.opts.SyncInterval, bcse.opts.MergeInterval = policy, syncInterval, mergeInterval
+	bcse.mu.Unlock()
+
+	bcse.bgMu.Lock()
+	defer bcse.bgMu.Unlock()
+	if !bcse.closed {
+		bcse.restartSyncerLocked(policy, syncInterval)
+		bcse.restartMergerLocked(mergeInterval)
+	}
+	return nil
+}
+
+func (bcse *BitCaskStorageEngine) options() Options {
+	bcse.mu.RLock()
+	defer bcse.mu.RUnlock()
+	return bcse.opts
+}
+
+// restartSyncerLocked replaces the periodic fsync loop. Called when holding bgMu.
+func (bcse *BitCaskStorageEngine) restartSyncerLocked(policy SyncPolicy, interval time.Duration) {
+	bcse.syncer.Stop()
+	bcse.syncer = nil
+	if policy != SyncInterval {
+		return
+	}
+	bcse.syncer = startPeriodic(interval, func() {
+		if err := bcse.Sync(); err != nil {
+			bcse.opts.Logger.Error("periodic sync failed", "error", err)
+		}
+	})
+}
+
+// restartMergerLocked replaces the scheduled merge loop. Called when holding bgMu.
+func (bcse *BitCaskStorageEngine) restartMergerLocked(interval time.Duration) {
+	bcse.merger.Stop()
+	bcse.merger = nil
+	if interval <= 0 {
+		return
+	}
+	bcse.merger = startPeriodic(interval, func() {
+		if err := bcse.Merge(); err != nil {
+			bcse.opts.Logger.Error("scheduled merge failed", "error", err)
+		}
+	})
+}
+
+// Sync flushes the active log to stable storage.
+func (bcse *BitCaskStorageEngine) Sync() error {
+	bcse.mu.Lock()
+	defer bcse.mu.Unlock()
+
+	if bcse.activeLog == nil {
+		return nil
+	}
+	return bcse.syncLocked(bcse.activeLog)
+}
+
+// syncLocked fsyncs l and reports the time taken to the sync hook. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) syncLocked(l *Log) error {
+	start := time.Now()
+	err := l.Sync()
+	if bcse.opts.Hooks.Sync != nil {
+		bcse.opts.Hooks.Sync(time.Since(start), err)
+	}
+	return err
+}
+
+// appendEntry writes an entry to the active log, rotating it first when it is full
+// and syncing afterwards if the policy asks for it. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) appendEntry(entry *DataDirFileLogEntry) (int64, error) {
+	valuePosition, err := bcse.writeEntryLocked(entry)
+	if err != nil {
+		return -1, err
+	}
+	if err := bcse.syncIfAlwaysLocked(); err != nil {
+		return -1, err
+	}
+	return valuePosition, nil
+}
+
+// writeEntryLocked writes an entry to the active log, rotating it first when it is
+// full, without syncing. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) writeEntryLocked(entry *DataDirFileLogEntry) (int64, error) {
+	if err := bcse.failure.Load(); err != nil {
+		return -1, *err
+	}
+	if bcse.activeLog == nil {
+		return -1, ErrEngineClosed
+	}
+	if bcse.opts.MaxFileSize > 0 && bcse.activeLog.writerPosition >= bcse.opts.MaxFileSize {
+		if err := bcse.rotateLocked(); err != nil {
+			bcse.setFailure(err)
+			return -1, err
+		}
+	}
+
+	valuePosition, _, err := bcse.activeLog.setLogEntry(entry)
+	if err != nil {
+		bcse.setFailure(err)
+		return -1, err
+	}
+	return valuePosition, nil
+}
+
+// syncIfAlwaysLocked fsyncs the active log when the policy is SyncAlways. Called when
+// holding the write lock.
+func (bcse *BitCaskStorageEngine) syncIfAlwaysLocked() error {
+	if bcse.opts.SyncPolicy != SyncAlways {
+		return nil
+	}
+	if err := bcse.syncLocked(bcse.activeLog); err != nil {
+		bcse.setFailure(err)
+		return err
+	}
+	return nil
+}
+
+// rotateLocked seals the active log and opens the next one. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) rotateLocked() error {
+	nextFileId := bcse.activeLog.fileId + 1
+	if err := bcse.syncLocked(bcse.activeLog); err != nil {
+		return err
+	}
+	if err := bcse.activeLog.Close(); err != nil {
+		return err
+	}
+
+	activeLog, err := openLogFile(bcse.fs, bcse.dataDir, nextFileId)
+	if err != nil {
+		bcse.activeLog = nil
+		return fmt.Errorf("failed to rotate active log: %w", err)
+	}
+	bcse.activeLog = activeLog
+	return nil
+}
+
 func (bcse *BitCaskStorageEngine) Set(key string, value string) error {
+	return bcse.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set, giving up if ctx ends while waiting for the lock.
+func (bcse *BitCaskStorageEngine) SetContext(ctx context.Context, key string, value string) error {
+	_, err := bcse.SetIfContext(ctx, key, value, nil)
+	return err
+}
+
+// SetIf stores value under key if pre holds and returns the new version, which is the
+// entry's timestamp. Versions survive restarts and merges.
+func (bcse *BitCaskStorageEngine) SetIf(key string, value string, pre storage.Precondition) (uint64, error) {
+	return bcse.SetIfContext(context.Background(), key, value, pre)
+}
+
+// SetIfContext is SetIf, giving up if ctx ends while waiting for the lock, e.g. behind
+// a merge. Once the entry is being written, it is written and synced regardless.
+func (bcse *BitCaskStorageEngine) SetIfContext(ctx context.Context, key string, value string, pre storage.Precondition) (uint64, error) {
+	if bcse.readOnly {
+		return 0, errOpenedReadOnly
+	}
+	if err := checkWrite(key, value); err != nil {
+		return 0, err
+	}
 	// Acquire exclusive lock for writing (goroutine safety)
-	bcse.mu.Lock()
+	if err := storage.Lock(ctx, &bcse.mu); err != nil {
+		return 0, err
+	}
 	defer bcse.mu.Unlock()
 
-	// TODO: Add logic here to check if bcse.activeLog.writerPosition exceeds a threshold.
-	// If so:
-	// 1. Call bcse.activeLog.Close()
-	// 2. Determine the next file ID
-	// 3. Call newLogFile = openLogFile(bcse.dataDir, nextFileId)
-	// 4. Update bcse.activeLog = newLogFile
-	// Handle errors at each step.
+	version, err := bcse.setLocked(key, value, pre)
+	if err != nil {
+		return 0, err
+	}
+	if err := bcse.syncIfAlwaysLocked(); err != nil {
+		return 0, fmt.Errorf("failed to sync log entry for key '%s': %w", key, err)
+	}
+	return version, nil
+}
+
+// nextTimeStampLocked returns the timestamp of a new entry. Timestamps double as
+// versions, so they must keep increasing even if the clock does not move (or moves
+// back) between two writes, also across keys: a key deleted and written again must
+// not get a version it had before, which a stale If-Match would take for current.
+// Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) nextTimeStampLocked() int64 {
+	return max(time.Now().UnixNano(), bcse.last.timeStamp+1)
+}
+
+// setLocked appends an entry for key and updates the KeyDir, without syncing. Called
+// when holding the write lock.
+func (bcse *BitCaskStorageEngine) setLocked(key string, value string, pre storage.Precondition) (uint64, error) {
+	old, exists := bcse.keyDir[key]
+	if pre != nil {
+		if err := pre(uint64(old.timeStamp), exists); err != nil {
+			return 0, err
+		}
+	}
 
 	// Prepare the entry
 	dataDirFileLogEntry := newDataDirFileLogEntry(key, value)
+	dataDirFileLogEntry.timeStamp = bcse.nextTimeStampLocked()
 
-	// Write to the active log file
-	valuePosition, _, err := bcse.activeLog.setLogEntry(dataDirFileLogEntry)
+	// Write to the active log file, rotating it first if it has grown past MaxFileSize
+	valuePosition, err := bcse.writeEntryLocked(dataDirFileLogEntry)
 	if err != nil {
 		// This is a critical error, might indicate disk issues
-		return fmt.Errorf("failed to write log entry for key '%s': %w", key, err)
+		return 0, fmt.Errorf("failed to write log entry for key '%s': %w", key, err)
 	}
+	bcse.last.record(key, dataDirFileLogEntry.timeStamp, false)
 
 	// Update the in-memory KeyDir
-	bcse.keyDir[key] = KeyDir{
+	bcse.putKeyDirLocked(key, KeyDir{
 		fileId:        bcse.activeLog.fileId,
 		valueSize:     dataDirFileLogEntry.valueSize,
 		valuePosition: valuePosition, // Store the start position of the value
 		timeStamp:     dataDirFileLogEntry.timeStamp,
-	}
+	})
 
-	return nil
+	return uint64(dataDirFileLogEntry.timeStamp), nil
 }
 
 func (bcse *BitCaskStorageEngine) Get(key string) (string, error) {
+	return bcse.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, giving up if ctx ends while waiting for the lock or the disk.
+func (bcse *BitCaskStorageEngine) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := bcse.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersioned returns the value of key together with its version.
+func (bcse *BitCaskStorageEngine) GetVersioned(key string) (string, uint64, error) {
+	return bcse.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext is GetVersioned, giving up if ctx ends while waiting for the
+// lock, e.g. behind a merge, or for the value to be read from disk.
+func (bcse *BitCaskStorageEngine) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
 	// Acquire shared lock for reading (goroutine safety)
-	bcse.mu.RLock()
-	defer bcse.mu.RUnlock()
+	if err := storage.RLock(ctx, &bcse.mu); err != nil {
+		return "", 0, err
+	}
+
+	if bcse.loadErr != nil {
+		bcse.mu.RUnlock()
+		return "", 0, bcse.loadErr
+	}
 
 	// Look up key in the in-memory index
 	keyData, ok := bcse.keyDir[key]
 	if !ok {
-		return "", fmt.Errorf("key not found: %s", key) // Consider defining a specific ErrNotFound
+		bcse.mu.RUnlock()
+		return "", 0, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
 	}
 
-	// Read the value from the appropriate log file using the stored position and size
-	value, err := getLogValue(bcse.dataDir, keyData.fileId, keyData.valuePosition, keyData.valueSize)
+	// Read the value from the appropriate log file using the stored position and size.
+	// The read lock keeps a merge from removing the file, so it is held until the read
+	// is over, even if the caller gave up on it before.
+	value, err := readContext(ctx, func() (string, error) {
+		defer bcse.mu.RUnlock()
+		return bcse.readValueLocked(keyData)
+	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return "", 0, err
+		}
 		// Error reading from disk
-		return "", fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+		return "", 0, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
 	}
 
 	if value == "<DELETED>" {
-		return "", fmt.Errorf("key not found")
+		return "", 0, storage.ErrNotFound
 	}
 
-	return value, nil
+	return value, uint64(keyData.timeStamp), nil
+}
+
+// readContext runs read and returns its result, or ctx.Err() if ctx ends first. read
+// then goes on in the background; it runs in its own goroutine only if ctx can end.
+func readContext[T any](ctx context.Context, read func() (T, error)) (T, error) {
+	if ctx.Done() == nil {
+		return read()
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := read()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
 }
 
 func (bcse *BitCaskStorageEngine) Delete(key string) error {
+	return bcse.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, giving up if ctx ends while waiting for the lock.
+func (bcse *BitCaskStorageEngine) DeleteContext(ctx context.Context, key string) error {
+	err := bcse.DeleteIfContext(ctx, key, nil)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Deleting a non-existent key is treated as success (idempotent)
+	}
+	return err
+}
+
+// DeleteIf removes key if pre holds. Unlike Delete it reports a missing key.
+func (bcse *BitCaskStorageEngine) DeleteIf(key string, pre storage.Precondition) error {
+	return bcse.DeleteIfContext(context.Background(), key, pre)
+}
+
+// DeleteIfContext is DeleteIf, giving up if ctx ends while waiting for the lock.
+func (bcse *BitCaskStorageEngine) DeleteIfContext(ctx context.Context, key string, pre storage.Precondition) error {
+	if bcse.readOnly {
+		return errOpenedReadOnly
+	}
 	// Acquire exclusive lock (goroutine safety) - as Delete modifies KeyDir and writes a tombstone
-	bcse.mu.Lock()
+	if err := storage.Lock(ctx, &bcse.mu); err != nil {
+		return err
+	}
 	defer bcse.mu.Unlock()
 
-	// 1. Check if key exists
-	_, ok := bcse.keyDir[key]
+	// 1. Check the precondition and whether the key exists
+	old, ok := bcse.keyDir[key]
+	if pre != nil {
+		if err := pre(uint64(old.timeStamp), ok); err != nil {
+			return err
+		}
+	}
 	if !ok {
-		return nil // Deleting a non-existent key is often treated as success (idempotent)
-		// Alternatively: return fmt.Errorf("key not found: %s", key)
+		return storage.ErrNotFound
 	}
 
 	// 2. Write a "tombstone" entry to the log
-	// A common practice is to write the key with a special marker value or an empty value.
-	// Let's use an empty value string "" as the tombstone marker.
 	tombstoneEntry := newDataDirFileLogEntry(key, "<DELETED>") // <DELETED> marks deletion
+	tombstoneEntry.timeStamp = bcse.nextTimeStampLocked()
 
-	_, _, err := bcse.activeLog.setLogEntry(tombstoneEntry)
+	_, err := bcse.appendEntry(tombstoneEntry)
 	if err != nil {
 		return fmt.Errorf("failed to write tombstone entry for key '%s': %w", key, err)
 	}
+	bcse.last.record(key, tombstoneEntry.timeStamp, true)
 
 	// 3. Remove the key from the in-memory KeyDir
-	delete(bcse.keyDir, key)
+	bcse.deleteKeyDirLocked(key)
 
 	return nil
 }
 
 // Close releases resources (file lock, active log file). Crucial!
 func (bcse *BitCaskStorageEngine) Close() error {
+	// Stop background loops first: they take the engine lock themselves
+	bcse.bgMu.Lock()
+	bcse.closed = true
+	bcse.syncer.Stop()
+	bcse.merger.Stop()
+	bcse.follower.Stop()
+	bcse.syncer, bcse.merger, bcse.follower = nil, nil, nil
+	bcse.bgMu.Unlock()
+
 	// Acquire exclusive lock to prevent operations during close
 	bcse.mu.Lock()
 	defer bcse.mu.Unlock()
 
 	var firstError error
 
-	// Close the active log file
+	// Flush and close the active log file
 	if bcse.activeLog != nil {
-		if err := bcse.activeLog.Close(); err != nil {
+		if err := bcse.syncLocked(bcse.activeLog); err != nil {
+			firstError = err
+		}
+		if err := bcse.activeLog.Close(); err != nil && firstError == nil {
 			firstError = fmt.Errorf("failed closing active log %s: %w", bcse.activeLog.filePath, err)
 		}
 		bcse.activeLog = nil // Mark as closed
 	}
 
+	// Close the files a read-only engine holds
+	if err := bcse.closeFilesLocked(); err != nil && firstError == nil {
+		firstError = fmt.Errorf("failed closing log files: %w", err)
+	}
+
 	// Release the inter-process file lock
 	if bcse.fLock != nil {
-		if err := bcse.fLock.Unlock(); err != nil {
-			err = fmt.Errorf("failed releasing file lock %s: %w", bcse.fLock.Path(), err)
+		if err := bcse.fLock.Close(); err != nil {
+			err = fmt.Errorf("failed releasing file lock %s: %w", filepath.Join(bcse.dataDir, lockFileName), err)
 			// Chain errors if log closing also failed
 			if firstError != nil {
 				firstError = fmt.Errorf("%v; additionally: %w", firstError, err)
@@ -1,13 +1,25 @@
 package bitcask
 
 import (
-	// Import errors package for Is/As if needed
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/storagetest"
+	"zap-store/internal/storage/vfs"
 )
 
 // Helper function to create and close an engine instance for simple tests
@@ -88,6 +100,48 @@ func TestBitCaskStorageEngine_SetGet(t *testing.T) {
 	}
 }
 
+func TestBitCaskStorageEngine_Conformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Engine{
+		Open: func(t *testing.T, dir string) storage.StorageEngine {
+			db, err := NewBitCaskStorageEngine(dir)
+			if err != nil {
+				t.Fatalf("NewBitCaskStorageEngine(%q) failed: %v", dir, err)
+			}
+			return db
+		},
+		Durable: true,
+	})
+}
+
+// TestBitCaskStorageEngine_ConformanceMemFS runs the suite on the in-memory file
+// system the fault tests use, checking it behaves like the real one.
+func TestBitCaskStorageEngine_ConformanceMemFS(t *testing.T) {
+	m := vfs.NewMemFS()
+	storagetest.Run(t, storagetest.Engine{
+		Open: func(t *testing.T, dir string) storage.StorageEngine {
+			db, err := NewBitCaskStorageEngine(dir, WithFS(m))
+			if err != nil {
+				t.Fatalf("NewBitCaskStorageEngine(%q) failed: %v", dir, err)
+			}
+			return db
+		},
+		Durable: true,
+	})
+}
+
+func TestBitCaskStorageEngine_ReservedValue(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("k", "<DELETED>"); !errors.Is(err, ErrReservedValue) {
+		t.Errorf("Set(%q, %q) = %v, want %v", "k", "<DELETED>", err, ErrReservedValue)
+	}
+	if err := db.MSet([]storage.KeyValue{{Key: "a", Value: "1"}, {Key: "k", Value: "<DELETED>"}}); !errors.Is(err, ErrReservedValue) {
+		t.Errorf("MSet() with a reserved value = %v, want %v", err, ErrReservedValue)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after a rejected MSet() = %v, want %v", "a", err, storage.ErrNotFound)
+	}
+}
+
 func TestBitCaskStorageEngine_Overwrite(t *testing.T) {
 	t.Run("overwrite existing key", func(t *testing.T) {
 		db, _ := setupTestEngine(t)
@@ -417,3 +471,1217 @@ func TestBitCaskStorageEngine_Concurrency(t *testing.T) {
 		}
 	}
 }
+
+// countLogFiles returns how many "*.log" segment files exist in dir
+func countLogFiles(t *testing.T, dir string) int {
+	t.Helper()
+	ids, err := listLogFileIds(vfs.OS, dir)
+	if err != nil {
+		t.Fatalf("Failed to list log files in %s: %v", dir, err)
+	}
+	return len(ids)
+}
+
+func TestBitCaskStorageEngine_Rotation(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir, WithMaxFileSize(256))
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+
+	for i := range 50 {
+		if err := db.Set(fmt.Sprintf("rot_key_%d", i), fmt.Sprintf("rot_val_%d", i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	if got := countLogFiles(t, tempDir); got < 2 {
+		t.Fatalf("Expected the active log to rotate into several files, found %d", got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// All keys must still be readable after reopening across several segments
+	db2, err := NewBitCaskStorageEngine(tempDir, WithMaxFileSize(256))
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer db2.Close()
+
+	for i := range 50 {
+		key, want := fmt.Sprintf("rot_key_%d", i), fmt.Sprintf("rot_val_%d", i)
+		got, err := db2.Get(key)
+		if err != nil || got != want {
+			t.Errorf("Get(%q) after rotation = %q, %v; want %q", key, got, err, want)
+		}
+	}
+}
+
+func TestBitCaskStorageEngine_Merge(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir, WithMaxFileSize(512))
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+
+	// Overwrite and delete plenty of keys so the merge has garbage to drop
+	for round := range 5 {
+		for i := range 20 {
+			if err := db.Set(fmt.Sprintf("merge_key_%d", i), fmt.Sprintf("v%d_%d", round, i)); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+	}
+	for i := 10; i < 20; i++ {
+		if err := db.Delete(fmt.Sprintf("merge_key_%d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	before := countLogFiles(t, tempDir)
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	after := countLogFiles(t, tempDir)
+	if after >= before {
+		t.Errorf("Merge did not reduce the number of log files: before=%d after=%d", before, after)
+	}
+
+	check := func(t *testing.T, db *BitCaskStorageEngine) {
+		t.Helper()
+		for i := range 10 {
+			key, want := fmt.Sprintf("merge_key_%d", i), fmt.Sprintf("v4_%d", i)
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+			}
+		}
+		for i := 10; i < 20; i++ {
+			key := fmt.Sprintf("merge_key_%d", i)
+			if _, err := db.Get(key); err == nil {
+				t.Errorf("Get(%q) succeeded after delete and merge", key)
+			}
+		}
+	}
+	check(t, db)
+
+	// Writes after a merge land in a new active log
+	if err := db.Set("after_merge", "yes"); err != nil {
+		t.Fatalf("Set after merge failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db2, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer db2.Close()
+	check(t, db2)
+	if got, err := db2.Get("after_merge"); err != nil || got != "yes" {
+		t.Errorf("Get(after_merge) = %q, %v; want %q", got, err, "yes")
+	}
+}
+
+func TestBitCaskStorageEngine_ScheduledMergeAndSync(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir,
+		WithSyncPolicy(SyncInterval, 5*time.Millisecond),
+		WithMergeInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer db.Close()
+
+	for i := range 10 {
+		if err := db.Set("sched_key", fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// A scheduled merge moves the key out of the first file
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(logFilePath(tempDir, 1)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Scheduled merge did not run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := db.SetMergeInterval(0); err != nil {
+		t.Fatalf("SetMergeInterval failed: %v", err)
+	}
+	if err := db.SetSyncPolicy(SyncAlways, 0); err != nil {
+		t.Fatalf("SetSyncPolicy failed: %v", err)
+	}
+	if err := db.SetSyncPolicy(SyncInterval, 0); err == nil {
+		t.Errorf("SetSyncPolicy(SyncInterval, 0) succeeded, want validation error")
+	}
+	// A rejected schedule changes neither setting
+	if err := db.SetSchedule(SyncNever, 0, -time.Second); err == nil {
+		t.Errorf("SetSchedule with a negative merge interval succeeded, want validation error")
+	}
+	if opts := db.options(); opts.SyncPolicy != SyncAlways || opts.MergeInterval != 0 {
+		t.Errorf("Options after rejected SetSchedule = %v/%s, want %v/0s", opts.SyncPolicy, opts.MergeInterval, SyncAlways)
+	}
+	if got, err := db.Get("sched_key"); err != nil || got != "v9" {
+		t.Errorf("Get(sched_key) = %q, %v; want %q", got, err, "v9")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SyncPolicy
+		wantErr bool
+	}{
+		{in: "always", want: SyncAlways},
+		{in: "Never", want: SyncNever},
+		{in: "interval", want: SyncInterval},
+		{in: "", want: SyncNever},
+		{in: "sometimes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSyncPolicy(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSyncPolicy(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseSyncPolicy(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBitCaskStorageEngine_Stats(t *testing.T) {
+	var merges, syncs int
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir,
+		WithSyncPolicy(SyncAlways, 0),
+		WithHooks(Hooks{
+			Merge: func(time.Duration, error) { merges++ },
+			Sync:  func(time.Duration, error) { syncs++ },
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer db.Close()
+
+	for i := range 10 {
+		if err := db.Set(fmt.Sprintf("stats_key_%d", i), "value"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	// Overwrite and delete to create dead bytes
+	if err := db.Set("stats_key_0", "value2"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := db.Delete("stats_key_1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	stats := db.Stats()
+	if stats.Keys != 9 {
+		t.Errorf("Stats().Keys = %d, want 9", stats.Keys)
+	}
+	if stats.OpenFiles != 1 {
+		t.Errorf("Stats().OpenFiles = %d, want 1 (the active log)", stats.OpenFiles)
+	}
+	// Dead: the first stats_key_0 entry, the stats_key_1 entry and its tombstone
+	wantDead := entrySize("stats_key_0", 5) + entrySize("stats_key_1", 5) + entrySize("stats_key_1", int64(len("<DELETED>")))
+	if got := stats.DeadBytes(); got != wantDead {
+		t.Errorf("Stats().DeadBytes() = %d, want %d", got, wantDead)
+	}
+	if syncs != 12 {
+		t.Errorf("Sync hook called %d times, want 12 (once per write)", syncs)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	// The merge keeps the tombstone of stats_key_1, the last entry written
+	stats = db.Stats()
+	if want := entrySize("stats_key_1", int64(len("<DELETED>"))); stats.DeadBytes() != want {
+		t.Errorf("Stats().DeadBytes() after merge = %d, want %d", stats.DeadBytes(), want)
+	}
+	if stats.Keys != 9 {
+		t.Errorf("Stats().Keys after merge = %d, want 9", stats.Keys)
+	}
+	if merges != 1 {
+		t.Errorf("Merge hook called %d times, want 1", merges)
+	}
+}
+
+func TestBitCaskStorageEngine_BackgroundLoad(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	if err := db.Set("loaded_key", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	db.Close()
+
+	db, err = NewBitCaskStorageEngine(tempDir, WithBackgroundLoad())
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer db.Close()
+
+	// Operations wait for the load, after which the engine reports healthy
+	if got, err := db.Get("loaded_key"); err != nil || got != "value" {
+		t.Errorf("Get(%q) = %q, %v, want %q, nil", "loaded_key", got, err, "value")
+	}
+	if err := db.WaitLoaded(); err != nil {
+		t.Errorf("WaitLoaded() = %v, want nil", err)
+	}
+	if err := db.Health(); err != nil {
+		t.Errorf("Health() after load = %v, want nil", err)
+	}
+}
+
+func TestBitCaskStorageEngine_ReadOnlyAfterWriteFailure(t *testing.T) {
+	db, err := NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer db.Close() // Fails to sync the closed log, which is expected here
+	if err := db.Set("before", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Pull the active log out from under the engine to make the next write fail
+	db.activeLog.file.Close()
+	if err := db.Set("failing", "value"); err == nil {
+		t.Fatalf("Set on a closed log file succeeded, want error")
+	}
+
+	if err := db.Health(); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Health() = %v, want %v", err, storage.ErrReadOnly)
+	}
+	if err := db.Set("after", "value"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Set after failure = %v, want %v", err, storage.ErrReadOnly)
+	}
+	if err := db.Delete("before"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Delete after failure = %v, want %v", err, storage.ErrReadOnly)
+	}
+	if got, err := db.Get("before"); err != nil || got != "value" {
+		t.Errorf("Get(%q) after failure = %q, %v, want %q, nil", "before", got, err, "value")
+	}
+}
+
+func TestBitCaskStorageEngine_LogsSkippedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "backup.log"), []byte("not a segment"), 0644); err != nil {
+		t.Fatalf("Failed to write stray file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	db, err := NewBitCaskStorageEngine(tempDir, WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer db.Close()
+
+	if out := buf.String(); !strings.Contains(out, "level=WARN") || !strings.Contains(out, "file=backup.log") {
+		t.Errorf("Expected a warning about backup.log, got log output %q", out)
+	}
+}
+
+func TestBitCaskStorageEngine_VersionsSurviveReopenAndMerge(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+
+	var last uint64
+	for i := range 5 {
+		version, err := db.SetIf("counter", fmt.Sprint(i), nil)
+		if err != nil {
+			t.Fatalf("SetIf failed: %v", err)
+		}
+		if version <= last {
+			t.Fatalf("SetIf #%d returned version %d, want more than %d", i, version, last)
+		}
+		last = version
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	db.Close()
+
+	db, err = NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer db.Close()
+	if value, version, err := db.GetVersioned("counter"); err != nil || value != "4" || version != last {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", "counter", value, version, err, "4", last)
+	}
+}
+
+// TestBitCaskStorageEngine_VersionsNeverRepeat recreates a deleted key after the clock
+// stepped back, simulated by applying a change stamped an hour ahead: the new version
+// must be above every version the engine handed out, across reopens and merges too.
+func TestBitCaskStorageEngine_VersionsNeverRepeat(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	ahead := uint64(time.Now().Add(time.Hour).UnixNano())
+	if _, err := db.Apply([]storage.Change{{Type: storage.ChangeSet, Key: "key", Value: "v1", Version: ahead}}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	last := ahead
+	for i, step := range []string{"delete", "set", "delete", "merge", "reopen", "set"} {
+		var version uint64
+		switch step {
+		case "set":
+			version, err = db.SetIf("key", fmt.Sprint(i), nil)
+		case "delete":
+			if err = db.Delete("key"); err == nil {
+				version = uint64(db.last.timeStamp)
+			}
+		case "merge":
+			err = db.Merge()
+		case "reopen":
+			if err = db.Close(); err == nil {
+				db, err = NewBitCaskStorageEngine(tempDir)
+			}
+		}
+		if err != nil {
+			t.Fatalf("step %d (%s) failed: %v", i, step, err)
+		}
+		if version == 0 {
+			continue
+		}
+		if version <= last {
+			t.Fatalf("step %d (%s) got version %d, want more than %d", i, step, version, last)
+		}
+		last = version
+	}
+}
+
+// TestBitCaskStorageEngine_ApplyAfterDeleteSurvivesMerge deletes every key and applies
+// them back with older versions, as a replica restoring a snapshot does: the values
+// must survive a merge and a reopen, although the newest entry is a tombstone.
+func TestBitCaskStorageEngine_ApplyAfterDeleteSurvivesMerge(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	for _, key := range []string{"a", "k"} {
+		if err := db.Set(key, "old"); err != nil {
+			t.Fatalf("Set(%q) failed: %v", key, err)
+		}
+	}
+	for _, key := range []string{"a", "k"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) failed: %v", key, err)
+		}
+	}
+	changes := []storage.Change{
+		{Type: storage.ChangeSet, Key: "a", Value: "v5", Version: 5},
+		{Type: storage.ChangeSet, Key: "k", Value: "v6", Version: 6},
+	}
+	if applied, err := db.Apply(changes); err != nil || fmt.Sprint(applied) != "[true true]" {
+		t.Fatalf("Apply() = %v, %v, want both applied", applied, err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	db.Close()
+
+	if db, err = NewBitCaskStorageEngine(tempDir); err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	for _, change := range changes {
+		value, version, err := db.GetVersioned(change.Key)
+		if err != nil || value != change.Value || version != change.Version {
+			t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", change.Key, value, version, err, change.Value, change.Version)
+		}
+	}
+	// New versions still come after the tombstones
+	if version, err := db.SetIf("b", "new", nil); err != nil || version <= uint64(time.Now().Add(-time.Minute).UnixNano()) {
+		t.Errorf("SetIf() after reopen = %d, %v, want a version after the deletes", version, err)
+	}
+}
+
+func TestBitCaskStorageEngine_MSetSyncsOnce(t *testing.T) {
+	var syncs int
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir,
+		WithSyncPolicy(SyncAlways, 0),
+		WithMaxFileSize(64), // Rotate part way through the batch
+		WithHooks(Hooks{Sync: func(time.Duration, error) { syncs++ }}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer db.Close()
+
+	var pairs []storage.KeyValue
+	for i := range 10 {
+		pairs = append(pairs, storage.KeyValue{Key: fmt.Sprintf("batch_key_%d", i), Value: "value"})
+	}
+	if err := db.MSet(pairs); err != nil {
+		t.Fatalf("MSet failed: %v", err)
+	}
+	// One fsync per sealed file on rotation, plus one for the whole batch
+	files := countLogFiles(t, tempDir)
+	if files < 2 || syncs != files {
+		t.Errorf("MSet across %d files did %d fsyncs, want %d", files, syncs, files)
+	}
+
+	keys := []string{"batch_key_9", "nope", "batch_key_0"}
+	results, err := db.MGet(keys)
+	if err != nil {
+		t.Fatalf("MGet failed: %v", err)
+	}
+	for i, want := range []storage.Result{{Value: "value", Found: true}, {}, {Value: "value", Found: true}} {
+		if results[i] != want {
+			t.Errorf("MGet(%q) = %+v, want %+v", keys[i], results[i], want)
+		}
+	}
+	if open := db.Stats().OpenFiles; open != 1 {
+		t.Errorf("Stats().OpenFiles after MGet = %d, want 1", open)
+	}
+}
+
+func TestBitCaskStorageEngine_Tail(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir, WithMaxFileSize(64)) // Rotate every record or two
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	readChanges := func(tailer *Tailer, n int) []string {
+		t.Helper()
+		var got []string
+		for range n {
+			change, err := tailer.Next(ctx)
+			if err != nil {
+				t.Fatalf("Next() after %v failed: %v", got, err)
+			}
+			got = append(got, fmt.Sprintf("%s %s=%s", change.Type, change.Key, change.Value))
+		}
+		return got
+	}
+
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Delete("a")
+	db.Set("c", strings.Repeat("x", 100))
+
+	// From the start, across rotated files
+	tailer := NewTailer(tempDir, storage.LogPosition{}, time.Millisecond)
+	defer tailer.Close()
+	want := []string{"set a=1", "set b=2", "delete a=", "set c=" + strings.Repeat("x", 100)}
+	if got := readChanges(tailer, 4); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Tailed changes = %v, want %v", got, want)
+	}
+	end, err := db.LogEnd()
+	if err != nil || tailer.Position() != end {
+		t.Errorf("Tailer position = %+v, want LogEnd() = %+v, %v", tailer.Position(), end, err)
+	}
+
+	// Following writes made while it waits
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.Set("d", "4")
+	}()
+	if got := readChanges(tailer, 1); got[0] != "set d=4" {
+		t.Errorf("Change written while tailing = %q, want %q", got[0], "set d=4")
+	}
+
+	// Resuming from a saved position
+	resumed := NewTailer(tempDir, end, time.Millisecond)
+	defer resumed.Close()
+	if got := readChanges(resumed, 1); got[0] != "set d=4" {
+		t.Errorf("Change after resuming at %+v = %q, want %q", end, got[0], "set d=4")
+	}
+
+	// A tailer that is up to date carries on into the merged files; positions older
+	// than the merge are lost
+	old := NewTailer(tempDir, storage.LogPosition{FileID: 1}, time.Millisecond)
+	defer old.Close()
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge() failed: %v", err)
+	}
+	db.Set("e", "5")
+	got := readChanges(tailer, 4) // b, c and d again, then e
+	if got[3] != "set e=5" {
+		t.Errorf("Changes after a merge = %v, want the live keys again and then set e=5", got)
+	}
+	if _, err := old.Next(ctx); !errors.Is(err, storage.ErrLogPositionLost) {
+		t.Errorf("Next() from a merged position = %v, want ErrLogPositionLost", err)
+	}
+}
+
+func TestBitCaskStorageEngine_SnapshotAndApply(t *testing.T) {
+	leader, err := NewBitCaskStorageEngine(t.TempDir(), WithMaxFileSize(64))
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer leader.Close()
+
+	leader.Set("a", "1")
+	leader.Set("b", "2")
+	leader.Delete("a")
+	leader.Set("c", "3")
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() failed: %v", err)
+	}
+	defer snap.Close()
+	end, _ := leader.LogEnd()
+	if snap.End() != end {
+		t.Errorf("Snapshot End() = %+v, want LogEnd() = %+v", snap.End(), end)
+	}
+	leader.Set("d", "written after the snapshot")
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() failed: %v", err)
+	}
+	var changes []storage.Change
+	if err := ReadSnapshot(&buf, func(c storage.Change) error {
+		changes = append(changes, c)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadSnapshot() failed: %v", err)
+	}
+	if len(changes) != 4 || changes[3].Next != snap.End() {
+		t.Fatalf("ReadSnapshot() returned %+v, want 4 changes ending at %+v", changes, snap.End())
+	}
+
+	replicaDir := t.TempDir()
+	replica, err := NewBitCaskStorageEngine(replicaDir)
+	if err != nil {
+		t.Fatalf("Failed to create replica: %v", err)
+	}
+	applied, err := replica.Apply(changes)
+	if err != nil || fmt.Sprint(applied) != "[true true true true]" {
+		t.Errorf("Apply() = %v, %v, want all applied", applied, err)
+	}
+	// Replaying them brings back the deleted key only until its delete is replayed
+	if applied, _ := replica.Apply(changes); fmt.Sprint(applied) != "[true false true false]" {
+		t.Errorf("Apply() of the same changes again = %v, want only a's set and delete applied", applied)
+	}
+
+	// The replica keeps the leader's versions, across a reopen too
+	replica.Close()
+	replica, err = NewBitCaskStorageEngine(replicaDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen replica: %v", err)
+	}
+	defer replica.Close()
+	for _, key := range []string{"b", "c"} {
+		value, version, _ := leader.GetVersioned(key)
+		gotValue, gotVersion, err := replica.GetVersioned(key)
+		if err != nil || gotValue != value || gotVersion != version {
+			t.Errorf("Replica GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", key, gotValue, gotVersion, err, value, version)
+		}
+	}
+	if _, err := replica.Get("a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Replica Get(%q) error = %v, want ErrNotFound", "a", err)
+	}
+
+	// Older changes than the replica holds are skipped
+	_, version, _ := replica.GetVersioned("b")
+	stale := []storage.Change{
+		{Type: storage.ChangeSet, Key: "b", Value: "old", Version: version - 1},
+		{Type: storage.ChangeDelete, Key: "c", Version: 1},
+		{Type: storage.ChangeDelete, Key: "missing", Version: version + 1},
+	}
+	if applied, _ := replica.Apply(stale); fmt.Sprint(applied) != "[false false false]" {
+		t.Errorf("Apply() of stale changes = %v, want none applied", applied)
+	}
+	if value, _ := replica.Get("b"); value != "2" {
+		t.Errorf("Replica Get(%q) after stale set = %q, want %q", "b", value, "2")
+	}
+
+	// A truncated snapshot is an error, not a smaller data set
+	buf.Reset()
+	snap.WriteTo(&buf)
+	truncated := bytes.NewReader(buf.Bytes()[:600])
+	if err := ReadSnapshot(truncated, func(storage.Change) error { return nil }); err == nil {
+		t.Errorf("ReadSnapshot() of a truncated snapshot succeeded, want error")
+	}
+}
+
+func TestBitCaskStorageEngine_Context(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Hold the write lock as a merge would
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetContext(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := db.SetIfContext(ctx, "foo", "baz", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetIfContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := db.MSetContext(ctx, []storage.KeyValue{{Key: "foo", Value: "baz"}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MSetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	db.mu.Unlock()
+
+	if got, err := db.GetContext(context.Background(), "foo"); err != nil || got != "bar" {
+		t.Errorf("GetContext(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+	}
+	if err := db.DeleteContext(context.Background(), "foo"); err != nil {
+		t.Errorf("DeleteContext(%q) = %v, want nil", "foo", err)
+	}
+	if _, err := db.GetContext(context.Background(), "foo"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetContext after delete = %v, want %v", err, storage.ErrNotFound)
+	}
+}
+
+func TestBitCaskStorageEngine_Offline(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Set("a", "3")
+	db.Delete("b")
+	if _, err := LockDir(tempDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("LockDir of an open directory = %v, want %v", err, ErrLocked)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	unlock, err := LockDir(tempDir)
+	if err != nil {
+		t.Fatalf("LockDir failed: %v", err)
+	}
+	defer unlock()
+
+	ids, err := LogFileIDs(tempDir)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("LogFileIDs() = %v, %v, want one file", ids, err)
+	}
+	var records []Record
+	end, err := ReadLog(tempDir, ids[0], func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadLog failed: %v", err)
+	}
+	want := []struct {
+		key, value string
+		deleted    bool
+	}{{"a", "1", false}, {"b", "2", false}, {"a", "3", false}, {"b", "", true}}
+	if len(records) != len(want) {
+		t.Fatalf("ReadLog read %d records, want %d", len(records), len(want))
+	}
+	var offset int64
+	for i, w := range want {
+		r := records[i]
+		if r.Key != w.key || r.Value != w.value || r.Deleted != w.deleted || r.Offset != offset {
+			t.Errorf("record %d = %+v, want key %q value %q deleted %v at offset %d", i, r, w.key, w.value, w.deleted, offset)
+		}
+		offset += r.Size
+	}
+	if end != offset {
+		t.Errorf("ReadLog() end = %d, want %d", end, offset)
+	}
+
+	stats, err := ReadStats(tempDir, slog.Default())
+	if err != nil {
+		t.Fatalf("ReadStats failed: %v", err)
+	}
+	if stats.Keys != 1 || stats.DeadBytes() != end-entrySize("a", 1) {
+		t.Errorf("ReadStats() = %d keys, %d dead bytes, want 1, %d", stats.Keys, stats.DeadBytes(), end-entrySize("a", 1))
+	}
+
+	// A torn write at the end stops the records before it
+	path := LogFilePath(tempDir, ids[0])
+	if err := os.Truncate(path, end-3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	lastOffset := records[len(records)-1].Offset
+	if got, err := ReadLog(tempDir, ids[0], func(Record) error { return nil }); !errors.Is(err, ErrCorrupt) || got != lastOffset {
+		t.Errorf("ReadLog() of a torn file = %d, %v, want %d, %v", got, err, lastOffset, ErrCorrupt)
+	}
+
+	// So does a value that no longer matches its CRC
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data = data[:lastOffset]
+	data[len(data)-1] ^= 0xff // The value of the third record
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if got, err := ReadLog(tempDir, ids[0], func(Record) error { return nil }); !errors.Is(err, ErrCorrupt) || got != records[2].Offset {
+		t.Errorf("ReadLog() of a corrupt value = %d, %v, want %d, %v", got, err, records[2].Offset, ErrCorrupt)
+	}
+}
+
+func TestBitCaskStorageEngine_ReadOnly(t *testing.T) {
+	tempDir := t.TempDir()
+	writer, err := NewBitCaskStorageEngine(tempDir, WithMaxFileSize(64))
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	defer writer.Close()
+	writer.Set("a", "1")
+	writer.Set("b", "2")
+
+	if _, err := NewBitCaskStorageEngine(filepath.Join(tempDir, "missing"), WithReadOnly()); err == nil {
+		t.Errorf("Opening a missing directory read-only succeeded")
+	}
+	if _, err := NewBitCaskStorageEngine(tempDir, WithFollowInterval(time.Second)); err == nil {
+		t.Errorf("WithFollowInterval without WithReadOnly was accepted")
+	}
+
+	// A reader opens next to the writer and leaves the directory as it is
+	files := countLogFiles(t, tempDir)
+	reader, err := NewBitCaskStorageEngine(tempDir, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Opening read-only next to a writer failed: %v", err)
+	}
+	defer reader.Close()
+	if got := countLogFiles(t, tempDir); got != files {
+		t.Errorf("Opening read-only left %d log files, want %d", got, files)
+	}
+	if got, err := reader.Get("a"); err != nil || got != "1" {
+		t.Errorf("reader.Get(%q) = %q, %v, want %q", "a", got, err, "1")
+	}
+
+	writes := map[string]func() error{
+		"Set":    func() error { return reader.Set("c", "3") },
+		"Delete": func() error { return reader.Delete("a") },
+		"MSet":   func() error { return reader.MSet([]storage.KeyValue{{Key: "c", Value: "3"}}) },
+		"Merge":  reader.Merge,
+		"Apply": func() error {
+			_, err := reader.Apply([]storage.Change{{Type: storage.ChangeSet, Key: "c", Value: "3", Version: 1}})
+			return err
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, storage.ErrReadOnly) {
+			t.Errorf("reader.%s() = %v, want %v", name, err, storage.ErrReadOnly)
+		}
+	}
+	if err := reader.Health(); err != nil {
+		t.Errorf("reader.Health() = %v, want nil", err)
+	}
+
+	// New writes, across rotations, show up once the reader refreshes
+	writer.Delete("a")
+	for i := range 10 {
+		writer.Set(fmt.Sprintf("k%d", i), strings.Repeat("v", i))
+	}
+	if got, err := reader.Get("a"); err != nil || got != "1" {
+		t.Errorf("reader.Get(%q) before Refresh = %q, %v, want %q", "a", got, err, "1")
+	}
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if _, err := reader.Get("a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("reader.Get(%q) after Refresh = %v, want %v", "a", err, storage.ErrNotFound)
+	}
+	if got, err := reader.Get("k9"); err != nil || got != strings.Repeat("v", 9) {
+		t.Errorf("reader.Get(%q) = %q, %v, want %q", "k9", got, err, strings.Repeat("v", 9))
+	}
+	if got, want := mustLogEnd(t, reader), mustLogEnd(t, writer); got != want {
+		t.Errorf("reader.LogEnd() = %+v, want the writer's %+v", got, want)
+	}
+
+	// A merge removes the files the reader read, which it still holds open
+	if err := writer.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if got, err := reader.Get("b"); err != nil || got != "2" {
+		t.Errorf("reader.Get(%q) after a merge = %q, %v, want %q", "b", got, err, "2")
+	}
+	writer.Set("b", "20")
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Refresh after a merge failed: %v", err)
+	}
+	results, err := reader.MGet([]string{"b", "k3", "a"})
+	if err != nil {
+		t.Fatalf("MGet failed: %v", err)
+	}
+	want := []storage.Result{{Value: "20", Found: true}, {Value: "vvv", Found: true}, {}}
+	for i, w := range want {
+		if results[i] != w {
+			t.Errorf("reader.MGet() result %d = %+v, want %+v", i, results[i], w)
+		}
+	}
+	keys, _ := writer.Keys("")
+	if got, _ := reader.Keys(""); len(got) != len(keys) {
+		t.Errorf("reader.Keys() = %v, want %v", got, keys)
+	}
+	if stats := reader.Stats(); stats.OpenFiles > countLogFiles(t, tempDir) {
+		t.Errorf("reader holds %d files open after a merge, want at most the %d left", stats.OpenFiles, countLogFiles(t, tempDir))
+	}
+
+	// A following reader picks up writes by itself
+	follower, err := NewBitCaskStorageEngine(tempDir, WithReadOnly(), WithFollowInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Opening a following reader failed: %v", err)
+	}
+	defer follower.Close()
+	writer.Set("followed", "yes")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := follower.Get("followed")
+		if err == nil && got == "yes" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower.Get(%q) = %q, %v, want %q", "followed", got, err, "yes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Readers do not keep a writer from reopening the directory
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	writer, err = NewBitCaskStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Reopening the writer next to readers failed: %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("reader.Close() = %v", err)
+	}
+	if err := reader.Refresh(); !errors.Is(err, ErrEngineClosed) {
+		t.Errorf("Refresh after Close = %v, want %v", err, ErrEngineClosed)
+	}
+}
+
+func mustLogEnd(t *testing.T, db *BitCaskStorageEngine) storage.LogPosition {
+	t.Helper()
+	end, err := db.LogEnd()
+	if err != nil {
+		t.Fatalf("LogEnd failed: %v", err)
+	}
+	return end
+}
+
+// openMemEngine opens an engine on the data directory "/data" of m.
+func openMemEngine(t *testing.T, m *vfs.MemFS, options ...Option) *BitCaskStorageEngine {
+	t.Helper()
+	options = append([]Option{WithFS(m), WithLogger(slog.New(slog.DiscardHandler))}, options...)
+	db, err := NewBitCaskStorageEngine("/data", options...)
+	if err != nil {
+		t.Fatalf("Failed to initialize engine: %v", err)
+	}
+	return db
+}
+
+// crash simulates a power cut under db with tear, then lets db go.
+func crash(db *BitCaskStorageEngine, tear func()) {
+	tear()
+	db.Close() // Fails: the files it had open went with the crash
+}
+
+// contents returns every key of db with its value.
+func contents(t *testing.T, db *BitCaskStorageEngine) map[string]string {
+	t.Helper()
+	keys, err := db.Keys("")
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	got := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if got[key], err = db.Get(key); err != nil {
+			t.Fatalf("Get(%q) failed: %v", key, err)
+		}
+	}
+	return got
+}
+
+func eio(kind vfs.OpKind) vfs.FaultFunc {
+	return func(op vfs.Op) *vfs.Fault {
+		if op.Kind == kind && filepath.Ext(op.Name) == ".log" {
+			return &vfs.Fault{Err: syscall.EIO}
+		}
+		return nil
+	}
+}
+
+func TestBitCaskStorageEngine_CrashKeepsSyncedWrites(t *testing.T) {
+	for _, tt := range []struct {
+		policy SyncPolicy
+		want   map[string]string
+	}{
+		{SyncAlways, map[string]string{"a": "1", "b": "2", "c": "3"}},
+		{SyncNever, map[string]string{"a": "1", "b": "2"}}, // Synced by hand before "c"
+	} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			m := vfs.NewMemFS()
+			db := openMemEngine(t, m, WithSyncPolicy(tt.policy, 0))
+			db.Set("a", "1")
+			db.Set("b", "2")
+			if err := db.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			db.Set("c", "3")
+			crash(db, m.Crash)
+
+			db = openMemEngine(t, m)
+			defer db.Close()
+			if got := contents(t, db); !maps.Equal(got, tt.want) {
+				t.Errorf("contents after crash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBitCaskStorageEngine_CrashTearing crashes after random writes, keeping a random
+// part of the unsynced ones with the last of those torn, and checks that the engine
+// recovers the state after some write since the last sync.
+func TestBitCaskStorageEngine_CrashTearing(t *testing.T) {
+	for seed := int64(0); seed < 100; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		m := vfs.NewMemFS()
+		db := openMemEngine(t, m, WithMaxFileSize(256))
+
+		model := map[string]string{}
+		states := []map[string]string{{}} // The state after every write
+		synced := 0
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key%d", r.Intn(5))
+			if _, ok := model[key]; ok && r.Intn(4) == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatalf("seed %d: Delete(%q) failed: %v", seed, key, err)
+				}
+				delete(model, key)
+			} else {
+				value := strings.Repeat(fmt.Sprint(i), r.Intn(10)+1)
+				if err := db.Set(key, value); err != nil {
+					t.Fatalf("seed %d: Set(%q) failed: %v", seed, key, err)
+				}
+				model[key] = value
+			}
+			states = append(states, maps.Clone(model))
+			if r.Intn(10) == 0 {
+				db.Sync()
+				synced = len(states) - 1
+			}
+		}
+		crash(db, func() { m.CrashTearing(r) })
+
+		db = openMemEngine(t, m, WithMaxFileSize(256))
+		got := contents(t, db)
+		if !slices.ContainsFunc(states[synced:], func(s map[string]string) bool { return maps.Equal(s, got) }) {
+			t.Fatalf("seed %d: contents after crash = %v, want the state after one of the writes since the sync at %d", seed, got, synced)
+		}
+
+		// Writes after recovery land behind the torn tail and survive the next reopen
+		if err := db.Set("after", "crash"); err != nil {
+			t.Fatalf("seed %d: Set after recovery failed: %v", seed, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("seed %d: Close failed: %v", seed, err)
+		}
+		db = openMemEngine(t, m)
+		got["after"] = "crash"
+		if reopened := contents(t, db); !maps.Equal(reopened, got) {
+			t.Errorf("seed %d: contents after reopening = %v, want %v", seed, reopened, got)
+		}
+		db.Close()
+	}
+}
+
+func TestBitCaskStorageEngine_DiskFull(t *testing.T) {
+	m := vfs.NewMemFS()
+	db := openMemEngine(t, m, WithSyncPolicy(SyncAlways, 0))
+	m.SetCapacity(1000)
+
+	want := map[string]string{}
+	var err error
+	for i := 0; err == nil; i++ {
+		key, value := fmt.Sprintf("key%03d", i), strings.Repeat("v", 50)
+		if err = db.Set(key, value); err == nil {
+			want[key] = value
+		}
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Set on a full disk = %v, want ENOSPC", err)
+	}
+	if err := db.Health(); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Health() on a full disk = %v, want %v", err, storage.ErrReadOnly)
+	}
+	if got := contents(t, db); !maps.Equal(got, want) {
+		t.Errorf("contents on a full disk = %v, want the %d keys written before it filled up", got, len(want))
+	}
+	db.Close()
+
+	// With space freed the torn entry is skipped and writing resumes
+	m.SetCapacity(0)
+	db = openMemEngine(t, m)
+	defer db.Close()
+	if got := contents(t, db); !maps.Equal(got, want) {
+		t.Errorf("contents after reopening = %v, want the %d keys written before the disk filled up", got, len(want))
+	}
+	if err := db.Set("more", "space"); err != nil {
+		t.Errorf("Set after freeing space failed: %v", err)
+	}
+}
+
+func TestBitCaskStorageEngine_SyncFailure(t *testing.T) {
+	m := vfs.NewMemFS()
+	db := openMemEngine(t, m, WithSyncPolicy(SyncAlways, 0))
+	db.Set("a", "1")
+
+	m.SetFault(eio(vfs.OpSync))
+	if err := db.Set("b", "2"); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Set with a failing fsync = %v, want EIO", err)
+	}
+	if err := db.Health(); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Health() after a failed fsync = %v, want %v", err, storage.ErrReadOnly)
+	}
+	crash(db, m.Crash)
+	m.SetFault(nil)
+
+	db = openMemEngine(t, m)
+	defer db.Close()
+	if got, want := contents(t, db), map[string]string{"a": "1"}; !maps.Equal(got, want) {
+		t.Errorf("contents after crash = %v, want %v", got, want)
+	}
+}
+
+func TestBitCaskStorageEngine_ReadErrors(t *testing.T) {
+	m := vfs.NewMemFS()
+	db := openMemEngine(t, m)
+	db.Set("a", "1")
+	db.Set("b", "2")
+
+	m.SetFault(eio(vfs.OpRead))
+	if _, err := db.Get("a"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Get with a failing disk = %v, want EIO", err)
+	}
+	if _, err := db.MGet([]string{"a", "b"}); !errors.Is(err, syscall.EIO) {
+		t.Errorf("MGet with a failing disk = %v, want EIO", err)
+	}
+	if err := db.Health(); err != nil {
+		t.Errorf("Health() after failed reads = %v, want nil", err)
+	}
+	m.SetFault(nil)
+	if got, err := db.Get("a"); err != nil || got != "1" {
+		t.Errorf("Get(%q) once the disk recovered = %q, %v, want %q, nil", "a", got, err, "1")
+	}
+	db.Close()
+
+	// Loading must not drop the keys of a file it cannot read
+	for _, kind := range []vfs.OpKind{vfs.OpOpen, vfs.OpRead} {
+		m.SetFault(eio(kind))
+		if db, err := NewBitCaskStorageEngine("/data", WithFS(m)); !errors.Is(err, syscall.EIO) {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("NewBitCaskStorageEngine with failing %s = %v, want EIO", kind, err)
+		}
+	}
+	m.SetFault(nil)
+	db = openMemEngine(t, m)
+	defer db.Close()
+	if got, want := contents(t, db), map[string]string{"a": "1", "b": "2"}; !maps.Equal(got, want) {
+		t.Errorf("contents once the disk recovered = %v, want %v", got, want)
+	}
+}
+
+func TestBitCaskStorageEngine_ChecksumMismatch(t *testing.T) {
+	m := vfs.NewMemFS()
+	db := openMemEngine(t, m)
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Set("a", "3")
+	path := db.activeLog.filePath
+	db.Close()
+
+	// Garble the last byte of the file, the value of the last entry
+	f, err := m.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.Seek(-1, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+
+	db = openMemEngine(t, m)
+	defer db.Close()
+	if got, want := contents(t, db), map[string]string{"a": "1", "b": "2"}; !maps.Equal(got, want) {
+		t.Errorf("contents after corruption = %v, want %v", got, want)
+	}
+}
+
+func TestBitCaskStorageEngine_MergeFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		fault vfs.FaultFunc
+	}{
+		{"disk full", nil},
+		{"remove fails", eio(vfs.OpRemove)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := vfs.NewMemFS()
+			db := openMemEngine(t, m, WithMaxFileSize(100))
+			want := map[string]string{}
+			for i := 0; i < 20; i++ {
+				key, value := fmt.Sprintf("key%d", i%7), fmt.Sprint(i)
+				db.Set(key, value)
+				want[key] = value
+			}
+			db.Delete("key0")
+			delete(want, "key0")
+
+			if tt.fault != nil {
+				m.SetFault(tt.fault)
+			} else {
+				m.SetCapacity(m.Used() + 50)
+			}
+			if err := db.Merge(); err == nil {
+				t.Fatalf("Merge succeeded, want error")
+			}
+			if got := contents(t, db); !maps.Equal(got, want) {
+				t.Errorf("contents after the failed merge = %v, want %v", got, want)
+			}
+			crash(db, m.Crash)
+			m.SetFault(nil)
+			m.SetCapacity(0)
+
+			db = openMemEngine(t, m)
+			defer db.Close()
+			if got := contents(t, db); !maps.Equal(got, want) {
+				t.Errorf("contents after crashing = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"zap-store/internal/storage/vfs"
+)
+
+// listLogFileIds returns the ids of every "%016d.log" file in dataDir, unsorted.
+func listLogFileIds(fsys vfs.FS, dataDir string) ([]int64, error) {
+	files, err := fsys.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
+	}
+
+	var ids []int64
+	for _, dirEntry := range files {
+		if dirEntry.IsDir() || filepath.Ext(dirEntry.Name()) != ".log" {
+			continue
+		}
+		fileName := dirEntry.Name()
+		fileId, err := strconv.ParseInt(fileName[:len(fileName)-len(".log")], 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, fileId)
+	}
+	return ids, nil
+}
+
+func logFilePath(dataDir string, fileId int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%016d.log", fileId))
+}
+
+// Merge compacts the data directory. Every live key is rewritten, with its original
+// timestamp, into fresh log files and all older files (including the previously active
+// one) are removed, reclaiming the space taken by overwritten values and tombstones.
+// Only the newest tombstone is kept if it is the last entry written, so that the engine
+// does not stamp writes after a restart with timestamps it already used.
+//
+// The engine is blocked for the duration of the merge. If the merge fails part way the
+// old files are left untouched and the partial output is removed, so the data directory
+// stays readable by getKeyDir either way.
+func (bcse *BitCaskStorageEngine) Merge() (err error) {
+	if bcse.readOnly {
+		return errOpenedReadOnly
+	}
+	bcse.mu.Lock()
+	defer bcse.mu.Unlock()
+
+	if err := bcse.failure.Load(); err != nil {
+		return *err
+	}
+	if bcse.activeLog == nil {
+		return ErrEngineClosed
+	}
+
+	if hook := bcse.opts.Hooks.Merge; hook != nil {
+		start := time.Now()
+		defer func() { hook(time.Since(start), err) }()
+	}
+
+	// 1. Seal the active log so every existing file becomes immutable.
+	sealedUpTo := bcse.activeLog.fileId
+	if err := bcse.activeLog.Sync(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	if err := bcse.activeLog.Close(); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	bcse.activeLog = nil
+
+	// 2. Rewrite live entries into new files numbered after the sealed ones.
+	newKeyDir, lastMergedId, err := bcse.writeMergedFiles(sealedUpTo + 1)
+	if err != nil {
+		// Old files are intact; resume writing after whatever the failed merge created.
+		if reopenErr := bcse.reopenActiveLog(lastMergedId + 1); reopenErr != nil {
+			return fmt.Errorf("merge failed: %w; additionally failed to reopen active log: %v", err, reopenErr)
+		}
+		return fmt.Errorf("merge failed: %w", err)
+	}
+
+	// 3. Switch the engine over to the merged files and a fresh active log.
+	bcse.keyDir = newKeyDir
+	bcse.resetLiveStatsLocked()
+	if err := bcse.reopenActiveLog(lastMergedId + 1); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+
+	// 4. Remove the files the merge superseded.
+	ids, err := listLogFileIds(bcse.fs, bcse.dataDir)
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	for _, fileId := range ids {
+		if fileId > sealedUpTo {
+			continue
+		}
+		if err := bcse.fs.Remove(logFilePath(bcse.dataDir, fileId)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("merge: failed to remove merged log file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeMergedFiles copies every live value into log files starting at firstFileId and
+// returns the KeyDir describing them together with the last file id used. On error the
+// partially written files are removed. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) writeMergedFiles(firstFileId int64) (map[string]KeyDir, int64, error) {
+	readers := make(map[int64]vfs.File)
+	defer func() {
+		for _, f := range readers {
+			f.Close()
+		}
+	}()
+
+	out, err := openLogFile(bcse.fs, bcse.dataDir, firstFileId)
+	if err != nil {
+		return nil, firstFileId, err
+	}
+	written := []int64{firstFileId}
+
+	cleanup := func(cause error) (map[string]KeyDir, int64, error) {
+		out.Close()
+		for _, fileId := range written {
+			bcse.fs.Remove(logFilePath(bcse.dataDir, fileId))
+		}
+		return nil, written[len(written)-1], cause
+	}
+
+	// The newest tombstone keeps the newest timestamp. It goes first, as its key may
+	// have been written again since with an older version, e.g. by Apply after the
+	// keys were deleted for a snapshot restore, and that value has to win on reload.
+	if key := bcse.last.deletedKey; key != "" {
+		entry := newDataDirFileLogEntry(key, "<DELETED>")
+		entry.timeStamp = bcse.last.timeStamp
+		if _, _, err := out.setLogEntry(entry); err != nil {
+			return cleanup(err)
+		}
+	}
+
+	newKeyDir := make(map[string]KeyDir, len(bcse.keyDir))
+	for key, keyData := range bcse.keyDir {
+		if bcse.opts.MaxFileSize > 0 && out.writerPosition >= bcse.opts.MaxFileSize {
+			if err := out.Sync(); err != nil {
+				return cleanup(err)
+			}
+			if err := out.Close(); err != nil {
+				return cleanup(err)
+			}
+			nextFileId := out.fileId + 1
+			out, err = openLogFile(bcse.fs, bcse.dataDir, nextFileId)
+			if err != nil {
+				return cleanup(err)
+			}
+			written = append(written, nextFileId)
+		}
+
+		reader, ok := readers[keyData.fileId]
+		if !ok {
+			reader, err = vfs.Open(bcse.fs, logFilePath(bcse.dataDir, keyData.fileId))
+			if err != nil {
+				return cleanup(fmt.Errorf("failed to open log file for key '%s': %w", key, err))
+			}
+			readers[keyData.fileId] = reader
+		}
+
+		value := make([]byte, keyData.valueSize)
+		if _, err := reader.ReadAt(value, keyData.valuePosition); err != nil {
+			return cleanup(fmt.Errorf("failed reading value for key '%s': %w", key, err))
+		}
+
+		entry := newDataDirFileLogEntry(key, string(value))
+		entry.timeStamp = keyData.timeStamp // Keep the original write time
+		valuePosition, _, err := out.setLogEntry(entry)
+		if err != nil {
+			return cleanup(err)
+		}
+		newKeyDir[key] = KeyDir{
+			fileId:        out.fileId,
+			valueSize:     entry.valueSize,
+			valuePosition: valuePosition,
+			timeStamp:     entry.timeStamp,
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := out.Close(); err != nil {
+		return cleanup(err)
+	}
+	return newKeyDir, out.fileId, nil
+}
+
+// reopenActiveLog opens fileId as the new active log. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) reopenActiveLog(fileId int64) error {
+	activeLog, err := openLogFile(bcse.fs, bcse.dataDir, fileId)
+	if err != nil {
+		return fmt.Errorf("failed to open active log file: %w", err)
+	}
+	bcse.activeLog = activeLog
+	return nil
+}
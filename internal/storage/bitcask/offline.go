@@ -0,0 +1,126 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"sort"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
+)
+
+// The functions below work on a data directory no engine has open, for the tools
+// that inspect and fix one. Callers hold the directory with LockDir meanwhile.
+
+// ErrCorrupt is returned by ReadLog for a log file whose records stop before its end.
+var ErrCorrupt = errors.New("corrupt log file")
+
+// Record is one entry of a log file.
+type Record struct {
+	Offset    int64 // Where the entry starts in the file
+	Size      int64 // Bytes the entry takes, header included
+	Timestamp int64 // Write time in Unix nanoseconds, which is also the version
+	Key       string
+	Value     string // Empty for deletes
+	Deleted   bool
+	CRC       uint32
+}
+
+// LockDir takes the exclusive lock of dataDir, failing with ErrLocked if a server or
+// another tool has it open, and returns the function releasing it.
+func LockDir(dataDir string) (func() error, error) {
+	fLock, err := lockDataDir(vfs.OS, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return fLock.Close, nil
+}
+
+// LogFileIDs returns the ids of the log files in dataDir, oldest first.
+func LogFileIDs(dataDir string) ([]int64, error) {
+	ids, err := listLogFileIds(vfs.OS, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// LogFilePath returns the path of the log file fileId in dataDir.
+func LogFilePath(dataDir string, fileId int64) string {
+	return logFilePath(dataDir, fileId)
+}
+
+// ReadLog calls fn with every record of the log file fileId, in order, checking the
+// CRC of each, and returns the offset where the valid records end. If that is before
+// the end of the file, because a record is cut short, cannot be decoded or fails its
+// CRC, the error matches ErrCorrupt. Errors of fn are returned as they are.
+func ReadLog(dataDir string, fileId int64, fn func(Record) error) (int64, error) {
+	path := logFilePath(dataDir, fileId)
+	f, err := vfs.Open(vfs.OS, path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var position int64
+	for position < info.Size() {
+		entry, size, err := readEntry(f, position)
+		if err == io.EOF {
+			return position, fmt.Errorf("%w: %s: entry at offset %d cut short at %d bytes", ErrCorrupt, path, position, info.Size())
+		}
+		if err != nil {
+			return position, fmt.Errorf("%w: %s: %v", ErrCorrupt, path, err)
+		}
+		if crc := crc32.ChecksumIEEE([]byte(entry.value)); crc != entry.crc {
+			return position, fmt.Errorf("%w: %s: entry at offset %d has CRC %08x, want %08x", ErrCorrupt, path, position, crc, entry.crc)
+		}
+
+		record := Record{
+			Offset:    position,
+			Size:      size,
+			Timestamp: entry.timeStamp,
+			Key:       entry.key,
+			Value:     entry.value,
+			CRC:       entry.crc,
+		}
+		if entry.value == "<DELETED>" {
+			record.Value, record.Deleted = "", true
+		}
+		if err := fn(record); err != nil {
+			return position, err
+		}
+		position += size
+	}
+	return position, nil
+}
+
+// ReadStats reports the keys of dataDir and the live and dead bytes of its log files,
+// as Stats would for an engine opening it. Unreadable entries are skipped with a
+// warning on logger, as when opening it.
+func ReadStats(dataDir string, logger *slog.Logger) (storage.Stats, error) {
+	keyDir, _, _, err := getKeyDir(vfs.OS, dataDir, logger)
+	if err != nil {
+		return storage.Stats{}, err
+	}
+
+	liveBytes := make(map[int64]int64)
+	var keyBytes int64
+	for key, keyData := range keyDir {
+		liveBytes[keyData.fileId] += entrySize(key, keyData.valueSize)
+		keyBytes += int64(len(key))
+	}
+	return storage.Stats{
+		Engine:      "bitcask",
+		Keys:        len(keyDir),
+		KeyDirBytes: keyBytes + int64(len(keyDir))*keyDirEntryOverhead,
+		DataDir:     dataDir,
+		Segments:    segmentStats(vfs.OS, dataDir, liveBytes),
+	}, nil
+}
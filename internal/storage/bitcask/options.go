@@ -0,0 +1,212 @@
+package bitcask
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"zap-store/internal/storage/vfs"
+)
+
+// DefaultMaxFileSize is the size at which the active log is sealed and a new one is opened.
+const DefaultMaxFileSize int64 = 64 << 20 // 64 MiB
+
+// SyncPolicy controls when writes to the active log are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs the active log after every write.
+	SyncAlways
+	// SyncInterval fsyncs the active log periodically in the background.
+	SyncInterval
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+// ParseSyncPolicy converts "never", "always" or "interval" into a SyncPolicy.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "never", "":
+		return SyncNever, nil
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	default:
+		return SyncNever, fmt.Errorf("unknown sync policy %q (want never, always or interval)", s)
+	}
+}
+
+// Options holds the tunables of a BitCaskStorageEngine.
+type Options struct {
+	// MaxFileSize is the size in bytes after which the active log is rotated. Zero disables rotation.
+	MaxFileSize int64
+	// SyncPolicy decides when the active log is fsynced.
+	SyncPolicy SyncPolicy
+	// SyncInterval is the fsync period used with SyncInterval.
+	SyncInterval time.Duration
+	// MergeInterval schedules a background Merge. Zero disables scheduled merges.
+	MergeInterval time.Duration
+	// BackgroundLoad makes the constructor return before the KeyDir is rebuilt. Operations
+	// wait for the load to finish; Health reports storage.ErrNotReady in the meantime.
+	BackgroundLoad bool
+	// ReadOnly opens the data directory for reading only, next to the process writing it.
+	ReadOnly bool
+	// FollowInterval is how often a read-only engine picks up new writes. Zero leaves it
+	// at the data it found when opened, until Refresh is called.
+	FollowInterval time.Duration
+	// Hooks observe maintenance work, e.g. to export timings as metrics.
+	Hooks Hooks
+	// Logger receives warnings about skipped files and failed background work.
+	Logger *slog.Logger
+	// FS is the file system the engine does all its I/O through.
+	FS vfs.FS
+}
+
+// Hooks are called synchronously after maintenance operations complete.
+type Hooks struct {
+	Merge func(took time.Duration, err error)
+	Sync  func(took time.Duration, err error)
+}
+
+// Option configures a BitCaskStorageEngine.
+type Option func(*Options)
+
+func defaultOptions() Options {
+	return Options{
+		MaxFileSize:  DefaultMaxFileSize,
+		SyncPolicy:   SyncNever,
+		SyncInterval: time.Second,
+		Logger:       slog.Default(),
+		FS:           vfs.OS,
+	}
+}
+
+// WithMaxFileSize sets the size at which the active log is rotated.
+func WithMaxFileSize(size int64) Option {
+	return func(o *Options) { o.MaxFileSize = size }
+}
+
+// WithSyncPolicy sets the fsync policy. The interval is only used by SyncInterval.
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(o *Options) {
+		o.SyncPolicy = policy
+		o.SyncInterval = interval
+	}
+}
+
+// WithMergeInterval schedules Merge to run in the background every interval.
+func WithMergeInterval(interval time.Duration) Option {
+	return func(o *Options) { o.MergeInterval = interval }
+}
+
+// WithBackgroundLoad rebuilds the KeyDir in the background instead of in the constructor.
+func WithBackgroundLoad() Option {
+	return func(o *Options) { o.BackgroundLoad = true }
+}
+
+// WithReadOnly opens the data directory without taking its lock or writing anything to
+// it, so it can be read while a server has it open. The engine builds its own KeyDir
+// from the log files and rejects writes with an error matching storage.ErrReadOnly. It
+// keeps every log file it indexed open, so its reads keep working when a merge removes
+// the files.
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+// WithFollowInterval makes a read-only engine pick up the writes made to the data
+// directory every interval.
+func WithFollowInterval(interval time.Duration) Option {
+	return func(o *Options) { o.FollowInterval = interval }
+}
+
+// WithHooks installs callbacks that observe merges and fsyncs.
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) { o.Hooks = hooks }
+}
+
+// WithLogger sets the logger used for warnings and background failures.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// WithFS makes the engine do its I/O through fsys instead of the operating system,
+// e.g. a vfs.MemFS injecting faults in tests.
+func WithFS(fsys vfs.FS) Option {
+	return func(o *Options) { o.FS = fsys }
+}
+
+func (o Options) validate() error {
+	if o.Logger == nil {
+		return fmt.Errorf("logger must not be nil")
+	}
+	if o.FS == nil {
+		return fmt.Errorf("file system must not be nil")
+	}
+	if o.MaxFileSize < 0 {
+		return fmt.Errorf("max file size cannot be negative (got %d)", o.MaxFileSize)
+	}
+	if o.SyncPolicy == SyncInterval && o.SyncInterval <= 0 {
+		return fmt.Errorf("sync interval must be positive when using the interval sync policy")
+	}
+	if o.MergeInterval < 0 {
+		return fmt.Errorf("merge interval cannot be negative (got %s)", o.MergeInterval)
+	}
+	if o.ReadOnly && o.MergeInterval > 0 {
+		return fmt.Errorf("a read-only engine cannot merge")
+	}
+	if o.FollowInterval < 0 {
+		return fmt.Errorf("follow interval cannot be negative (got %s)", o.FollowInterval)
+	}
+	if o.FollowInterval > 0 && !o.ReadOnly {
+		return fmt.Errorf("only a read-only engine can follow the data directory")
+	}
+	return nil
+}
+
+// periodic runs a function on a fixed interval until stopped.
+type periodic struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startPeriodic(interval time.Duration, fn func()) *periodic {
+	p := &periodic{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stop halts the loop and waits for an in-flight run to finish. Safe on a nil receiver.
+func (p *periodic) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
@@ -0,0 +1,164 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
+)
+
+// errOpenedReadOnly is returned by writes to an engine opened with WithReadOnly.
+var errOpenedReadOnly = fmt.Errorf("%w: data directory opened read-only", storage.ErrReadOnly)
+
+// loadReadOnlyLocked builds the KeyDir from the log files without opening any of them
+// for writing. Called when holding the write lock (or before the engine is shared).
+func (bcse *BitCaskStorageEngine) loadReadOnlyLocked() error {
+	bcse.keyDir = make(map[string]KeyDir)
+	bcse.files = make(map[int64]vfs.File)
+	bcse.resetLiveStatsLocked()
+	if err := bcse.catchUpLocked(); err != nil {
+		bcse.closeFilesLocked()
+		return fmt.Errorf("failed to load key directory: %w", err)
+	}
+	return nil
+}
+
+// Refresh picks up the writes made to the data directory since a read-only engine was
+// opened or last refreshed. Engines that can write are always up to date.
+func (bcse *BitCaskStorageEngine) Refresh() error {
+	if !bcse.readOnly {
+		return nil
+	}
+	bcse.mu.Lock()
+	defer bcse.mu.Unlock()
+
+	if bcse.loadErr != nil {
+		return bcse.loadErr
+	}
+	if bcse.files == nil {
+		return ErrEngineClosed
+	}
+	return bcse.catchUpLocked()
+}
+
+// catchUpLocked applies the records written since the last call to the KeyDir: the
+// rest of the file it stopped in, then every newer file. The writer seals a file
+// before it starts the next, so once a newer file exists the older one is complete.
+// Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) catchUpLocked() error {
+	ids, err := listLogFileIds(bcse.fs, bcse.dataDir)
+	if err != nil {
+		return err
+	}
+	slices.Sort(ids)
+	newest := int64(0)
+	if len(ids) > 0 {
+		newest = ids[len(ids)-1]
+	}
+
+	// The file read last is read through the handle held on it, so the records written
+	// to it just before a merge removed it are not missed.
+	if f := bcse.files[bcse.readPos.FileID]; f != nil {
+		bcse.readPos.Offset = bcse.followLogLocked(f, bcse.readPos, newest > bcse.readPos.FileID)
+	}
+	for _, fileId := range ids {
+		if fileId <= bcse.readPos.FileID {
+			continue
+		}
+		f, err := vfs.Open(bcse.fs, logFilePath(bcse.dataDir, fileId))
+		if os.IsNotExist(err) {
+			continue // Removed by a merge since it was listed
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		bcse.files[fileId] = f
+		bcse.readPos = storage.LogPosition{FileID: fileId}
+		bcse.readPos.Offset = bcse.followLogLocked(f, bcse.readPos, fileId != newest)
+	}
+	bcse.releaseFilesLocked()
+	return nil
+}
+
+// followLogLocked applies the records of f from position from on to the KeyDir and
+// returns the offset after the last complete one. A record that is not complete yet
+// ends the file for now; in a sealed file it ends it for good, with a warning as when
+// the engine opens it. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) followLogLocked(f vfs.File, from storage.LogPosition, sealed bool) int64 {
+	position := from.Offset
+	for {
+		entry, size, err := readEntry(f, position)
+		if err == nil && crc32.ChecksumIEEE([]byte(entry.value)) != entry.crc {
+			err = fmt.Errorf("checksum mismatch at pos %d", position)
+		}
+		if err != nil {
+			if sealed && !(err == io.EOF && atEnd(f, position)) {
+				bcse.opts.Logger.Warn("error reading entry, stopping scan for this file", "file", f.Name(), "position", position, "error", err)
+			}
+			return position
+		}
+
+		if entry.value == "<DELETED>" {
+			bcse.deleteKeyDirLocked(entry.key)
+		} else if old, ok := bcse.keyDir[entry.key]; !ok || entry.timeStamp >= old.timeStamp {
+			// An entry as old as the one held is its copy made by a merge, which outlives it
+			bcse.putKeyDirLocked(entry.key, KeyDir{
+				fileId:        from.FileID,
+				valueSize:     entry.valueSize,
+				valuePosition: position + 28 + entry.keySize,
+				timeStamp:     entry.timeStamp,
+			})
+		}
+		position += size
+	}
+}
+
+// atEnd reports whether position is the end of f.
+func atEnd(f vfs.File, position int64) bool {
+	info, err := f.Stat()
+	return err == nil && info.Size() == position
+}
+
+// releaseFilesLocked closes the files before the one being read that no longer hold a
+// live value, e.g. because a merge copied their values elsewhere. Called when holding
+// the write lock.
+func (bcse *BitCaskStorageEngine) releaseFilesLocked() {
+	for fileId, f := range bcse.files {
+		if fileId < bcse.readPos.FileID && bcse.liveBytes[fileId] <= 0 {
+			f.Close()
+			delete(bcse.files, fileId)
+			delete(bcse.liveBytes, fileId)
+		}
+	}
+}
+
+// closeFilesLocked closes every file a read-only engine holds. Called when holding the
+// write lock.
+func (bcse *BitCaskStorageEngine) closeFilesLocked() error {
+	var errs []error
+	for _, f := range bcse.files {
+		errs = append(errs, f.Close())
+	}
+	bcse.files = nil
+	return errors.Join(errs...)
+}
+
+// readValueLocked reads the value keyData points to, through the handle held on its
+// file if the engine is read-only. Called when holding the read lock.
+func (bcse *BitCaskStorageEngine) readValueLocked(keyData KeyDir) (string, error) {
+	f := bcse.files[keyData.fileId]
+	if f == nil {
+		bcse.openReaders.Add(1)
+		defer bcse.openReaders.Add(-1)
+		return getLogValue(bcse.fs, bcse.dataDir, keyData.fileId, keyData.valuePosition, keyData.valueSize)
+	}
+	value := make([]byte, keyData.valueSize)
+	if _, err := f.ReadAt(value, keyData.valuePosition); err != nil {
+		return "", fmt.Errorf("failed reading value from %s at offset %d: %w", f.Name(), keyData.valuePosition, err)
+	}
+	return string(value), nil
+}
@@ -0,0 +1,99 @@
+package bitcask
+
+import (
+	"sort"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
+)
+
+// keyDirEntryOverhead approximates the memory one keyDir entry takes besides its key:
+// the KeyDir struct, the string header and the map's own bookkeeping.
+const keyDirEntryOverhead = 64
+
+// entrySize is the on-disk size of an entry for key with a value of valueSize bytes.
+func entrySize(key string, valueSize int64) int64 {
+	// Fixed header size: crc(4) + ts(8) + ksz(8) + vsz(8) = 28 bytes
+	return 28 + int64(len(key)) + valueSize
+}
+
+// putKeyDirLocked records the new location of key, keeping the live byte accounting in
+// step. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) putKeyDirLocked(key string, keyData KeyDir) {
+	if old, ok := bcse.keyDir[key]; ok {
+		bcse.liveBytes[old.fileId] -= entrySize(key, old.valueSize)
+	} else {
+		bcse.keyBytes += int64(len(key))
+	}
+	bcse.keyDir[key] = keyData
+	bcse.liveBytes[keyData.fileId] += entrySize(key, keyData.valueSize)
+}
+
+// deleteKeyDirLocked forgets key. Called when holding the write lock.
+func (bcse *BitCaskStorageEngine) deleteKeyDirLocked(key string) {
+	old, ok := bcse.keyDir[key]
+	if !ok {
+		return
+	}
+	bcse.liveBytes[old.fileId] -= entrySize(key, old.valueSize)
+	bcse.keyBytes -= int64(len(key))
+	delete(bcse.keyDir, key)
+}
+
+// resetLiveStatsLocked recomputes the accounting from scratch after the keyDir was
+// replaced wholesale. Called when holding the write lock (or before the engine is shared).
+func (bcse *BitCaskStorageEngine) resetLiveStatsLocked() {
+	bcse.liveBytes = make(map[int64]int64)
+	bcse.keyBytes = 0
+	for key, keyData := range bcse.keyDir {
+		bcse.liveBytes[keyData.fileId] += entrySize(key, keyData.valueSize)
+		bcse.keyBytes += int64(len(key))
+	}
+}
+
+// Stats reports the number of keys, the approximate size of the keyDir and, for every
+// log file, its size and how much of it is dead (overwritten values and tombstones).
+func (bcse *BitCaskStorageEngine) Stats() storage.Stats {
+	bcse.mu.RLock()
+	defer bcse.mu.RUnlock()
+
+	stats := storage.Stats{
+		Engine:      "bitcask",
+		Keys:        len(bcse.keyDir),
+		KeyDirBytes: bcse.keyBytes + int64(len(bcse.keyDir))*keyDirEntryOverhead,
+		DataDir:     bcse.dataDir,
+		OpenFiles:   int(bcse.openReaders.Load()) + len(bcse.files),
+	}
+	if bcse.activeLog != nil {
+		stats.OpenFiles++
+	}
+
+	stats.Segments = segmentStats(bcse.fs, bcse.dataDir, bcse.liveBytes)
+	return stats
+}
+
+// segmentStats reports the size of every log file in dataDir and how much of it is
+// dead, given the bytes of live entries per file id.
+func segmentStats(fsys vfs.FS, dataDir string, liveBytes map[int64]int64) []storage.SegmentStats {
+	ids, err := listLogFileIds(fsys, dataDir)
+	if err != nil {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var segments []storage.SegmentStats
+	for _, fileId := range ids {
+		info, err := fsys.Stat(logFilePath(dataDir, fileId))
+		if err != nil {
+			continue
+		}
+		dead := info.Size() - liveBytes[fileId]
+		if dead < 0 {
+			dead = 0
+		}
+		segments = append(segments, storage.SegmentStats{
+			FileID:    fileId,
+			Bytes:     info.Size(),
+			DeadBytes: dead,
+		})
+	}
+	return segments
+}
@@ -0,0 +1,245 @@
+package bitcask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/vfs"
+)
+
+// defaultTailPollInterval is how often a Tailer looks for new records once it has
+// caught up with the active log.
+const defaultTailPollInterval = 100 * time.Millisecond
+
+// ErrCorruptRecord is returned by a Tailer for a record whose checksum or sizes are wrong.
+var ErrCorruptRecord = errors.New("corrupt log record")
+
+// Tailer follows the log files of a data directory as a stream of changes, starting
+// from a (file id, offset) position. It keeps up with the active log as it grows and
+// moves on to the next file once the engine rotates it. Tailing needs no lock, so it
+// works from another process as well as next to a running engine.
+//
+// A merge rewrites every live key into new files and removes the old ones. A Tailer
+// that had read everything before the merge carries on into the merged files, which
+// report each live key again with its original version; consumers should apply
+// changes idempotently, e.g. ignore versions older than the one they hold for a key.
+// One that was further behind returns storage.ErrLogPositionLost, since deletes it
+// had not read yet are gone.
+type Tailer struct {
+	fs           vfs.FS
+	dataDir      string
+	pollInterval time.Duration
+	pos          storage.LogPosition
+	file         vfs.File // Open log file pos.FileID, or nil before the first read
+}
+
+// NewTailer returns a Tailer reading the log files of dataDir from position from, or
+// from the oldest file when from is the zero LogPosition. pollInterval is how often it
+// checks for new records once caught up; zero means every 100ms.
+func NewTailer(dataDir string, from storage.LogPosition, pollInterval time.Duration) *Tailer {
+	if pollInterval <= 0 {
+		pollInterval = defaultTailPollInterval
+	}
+	return &Tailer{fs: vfs.OS, dataDir: dataDir, pollInterval: pollInterval, pos: from}
+}
+
+// Position returns where the next record will be read from.
+func (t *Tailer) Position() storage.LogPosition {
+	return t.pos
+}
+
+// Next returns the next change, waiting for one to be written if the tailer has read
+// everything. It returns ctx.Err() if ctx ends first.
+func (t *Tailer) Next(ctx context.Context) (storage.Change, error) {
+	for {
+		change, ok, err := t.read()
+		if err != nil || ok {
+			return change, err
+		}
+		select {
+		case <-time.After(t.pollInterval):
+		case <-ctx.Done():
+			return storage.Change{}, ctx.Err()
+		}
+	}
+}
+
+// read returns the next change if there is one, moving on to newer files as needed.
+func (t *Tailer) read() (storage.Change, bool, error) {
+	if t.file == nil {
+		if err := t.open(); err != nil || t.file == nil {
+			return storage.Change{}, false, err
+		}
+	}
+
+	for {
+		change, ok, err := t.readRecord()
+		if err != nil || ok {
+			return change, ok, err
+		}
+
+		// Nothing complete past the position. Once a newer file exists the engine has
+		// moved on, so read again in case the last records landed in between, then
+		// leave a torn tail behind as getKeyDir does.
+		next, err := t.nextFileId()
+		if err != nil || next == 0 {
+			return storage.Change{}, false, err
+		}
+		if change, ok, err := t.readRecord(); err != nil || ok {
+			return change, ok, err
+		}
+		if next != t.pos.FileID+1 {
+			return storage.Change{}, false, fmt.Errorf("%w: log files after %d were removed, probably by a merge", storage.ErrLogPositionLost, t.pos.FileID)
+		}
+		t.file.Close()
+		t.file = nil
+		t.pos = storage.LogPosition{FileID: next}
+		if err := t.open(); err != nil {
+			return storage.Change{}, false, err
+		}
+	}
+}
+
+// readRecord decodes the record at the current position, reporting false if it is not
+// completely written yet.
+func (t *Tailer) readRecord() (storage.Change, bool, error) {
+	entry, size, err := readEntry(t.file, t.pos.Offset)
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return storage.Change{}, false, nil
+	}
+	if err != nil {
+		return storage.Change{}, false, fmt.Errorf("%w in %s: %v", ErrCorruptRecord, logFilePath(t.dataDir, t.pos.FileID), err)
+	}
+	change, err := entryChange(entry, t.pos, size)
+	if err != nil {
+		return storage.Change{}, false, fmt.Errorf("%w in %s", err, logFilePath(t.dataDir, t.pos.FileID))
+	}
+	t.pos = change.Next
+	return change, true, nil
+}
+
+// entryChange verifies an entry read at position at, size bytes long, and turns it
+// into a Change.
+func entryChange(entry *DataDirFileLogEntry, at storage.LogPosition, size int64) (storage.Change, error) {
+	if crc32.ChecksumIEEE([]byte(entry.value)) != entry.crc {
+		return storage.Change{}, fmt.Errorf("%w: checksum mismatch at pos %d", ErrCorruptRecord, at.Offset)
+	}
+	change := storage.Change{
+		Type:    storage.ChangeSet,
+		Key:     entry.key,
+		Value:   entry.value,
+		Version: uint64(entry.timeStamp),
+		At:      at,
+		Next:    storage.LogPosition{FileID: at.FileID, Offset: at.Offset + size},
+	}
+	if entry.value == "<DELETED>" {
+		change.Type, change.Value = storage.ChangeDelete, ""
+	}
+	return change, nil
+}
+
+// open opens the log file at the current position. Starting from the zero position it
+// picks the oldest file, and leaves t.file nil if there are no files yet.
+func (t *Tailer) open() error {
+	if t.pos == (storage.LogPosition{}) {
+		ids, err := listLogFileIds(t.fs, t.dataDir)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		t.pos.FileID = slices.Min(ids)
+	}
+
+	file, err := vfs.Open(t.fs, logFilePath(t.dataDir, t.pos.FileID))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: log file %d does not exist", storage.ErrLogPositionLost, t.pos.FileID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open log file for tailing: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file for tailing: %w", err)
+	}
+	if t.pos.Offset > info.Size() {
+		file.Close()
+		return fmt.Errorf("%w: offset %d is past the end of log file %d (%d bytes)", storage.ErrLogPositionLost, t.pos.Offset, t.pos.FileID, info.Size())
+	}
+	t.file = file
+	return nil
+}
+
+// nextFileId returns the lowest log file id above the current one, or 0 if there is none.
+func (t *Tailer) nextFileId() (int64, error) {
+	ids, err := listLogFileIds(t.fs, t.dataDir)
+	if err != nil {
+		return 0, err
+	}
+	var next int64
+	for _, id := range ids {
+		if id > t.pos.FileID && (next == 0 || id < next) {
+			next = id
+		}
+	}
+	return next, nil
+}
+
+// Close releases the open log file.
+func (t *Tailer) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// LogEnd returns the position after the last record of the newest log file in dataDir.
+func LogEnd(dataDir string) (storage.LogPosition, error) {
+	ids, err := listLogFileIds(vfs.OS, dataDir)
+	if err != nil || len(ids) == 0 {
+		return storage.LogPosition{}, err
+	}
+	last := slices.Max(ids)
+	info, err := vfs.OS.Stat(logFilePath(dataDir, last))
+	if err != nil {
+		return storage.LogPosition{}, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	return storage.LogPosition{FileID: last, Offset: info.Size()}, nil
+}
+
+// Tail follows the engine's log from position from; see Tailer.
+func (bcse *BitCaskStorageEngine) Tail(from storage.LogPosition) (storage.ChangeReader, error) {
+	t := NewTailer(bcse.dataDir, from, 0)
+	t.fs = bcse.fs
+	return t, nil
+}
+
+// LogEnd returns the position the next write will be logged at or, for a read-only
+// engine, the position after the last record it has read.
+func (bcse *BitCaskStorageEngine) LogEnd() (storage.LogPosition, error) {
+	bcse.mu.RLock()
+	defer bcse.mu.RUnlock()
+	return bcse.endLocked()
+}
+
+// endLocked implements LogEnd. Called when holding the read lock.
+func (bcse *BitCaskStorageEngine) endLocked() (storage.LogPosition, error) {
+	if bcse.readOnly {
+		if bcse.files == nil {
+			return storage.LogPosition{}, ErrEngineClosed
+		}
+		return bcse.readPos, nil
+	}
+	if bcse.activeLog == nil {
+		return storage.LogPosition{}, ErrEngineClosed
+	}
+	return storage.LogPosition{FileID: bcse.activeLog.fileId, Offset: bcse.activeLog.writerPosition}, nil
+}
@@ -0,0 +1,666 @@
+// Package btree implements a storage engine based on a B+tree of fixed-size pages in
+// a single file.
+//
+// Leaves hold the keys, in order, with their values; values too big for a quarter of
+// a page go to a chain of overflow pages. Updates are copy-on-write: a write
+// transaction copies every page it changes to a free page, then commits by writing one
+// of two meta pages, which alternate, to point at the new root. A crash therefore
+// leaves the file at its last commit, with nothing to replay. Pages a commit stops
+// using are recorded in a freelist and reused by later commits. Decoded pages are
+// cached in a buffer pool.
+//
+// Readers never wait for a commit's fsyncs, only for it to swap the root; writes are
+// serialized, and every write is a commit of its own, so batches should use MSet.
+package btree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"zap-store/internal/storage"
+
+	"github.com/gofrs/flock"
+)
+
+// File names in the data directory
+const (
+	dbFileName   = "btree.db"
+	lockFileName = "btree.lock"
+)
+
+var (
+	// ErrLocked is returned when opening a data directory another process has open.
+	ErrLocked = errors.New("data directory is locked by another process")
+	// ErrEngineClosed is returned by operations on an engine that has been closed.
+	ErrEngineClosed = errors.New("btree engine is closed")
+)
+
+type BTreeStorageEngine struct {
+	dataDir  string
+	opts     Options
+	fLock    *flock.Flock
+	file     *os.File
+	pageSize int
+	pool     *bufferPool
+
+	writeMu       sync.Mutex   // Serializes write transactions
+	mu            sync.RWMutex // Held by readers while they walk the tree, and by commits to swap it
+	meta          meta         // Current commit, guarded by mu; the writer may read it holding writeMu only
+	free          []pgid       // Free pages, highest first; guarded like meta
+	freelistPages []pgid       // Pages holding the freelist; writer only
+	closed        bool         // Set holding both locks, so either guards it
+
+	failure atomic.Pointer[error] // Set once a failed commit stopped the engine taking writes
+}
+
+// NewBTreeStorageEngine opens, or creates, an engine in dataDir.
+func NewBTreeStorageEngine(dataDir string, options ...Option) (*BTreeStorageEngine, error) {
+	opts := defaultOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid btree options: %w", err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %s: %w", dataDir, err)
+	}
+	lockPath := filepath.Join(dataDir, lockFileName)
+	fLock := flock.New(lockPath)
+	locked, err := fLock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check or acquire file lock %s: %w", lockPath, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: %s (lock file: %s)", ErrLocked, dataDir, lockPath)
+	}
+
+	path := filepath.Join(dataDir, dbFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fLock.Unlock()
+		return nil, fmt.Errorf("failed to open database file %s: %w", path, err)
+	}
+	engine := &BTreeStorageEngine{
+		dataDir: dataDir,
+		opts:    opts,
+		fLock:   fLock,
+		file:    file,
+		pool:    newBufferPool(opts.CacheSize),
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		if info.Size() == 0 {
+			err = engine.create()
+		} else {
+			err = engine.load(info.Size())
+		}
+	}
+	if err != nil {
+		file.Close()
+		fLock.Unlock()
+		return nil, fmt.Errorf("failed to open database file %s: %w", path, err)
+	}
+	return engine, nil
+}
+
+// create initializes an empty file: both meta pages, an empty root leaf and an empty
+// freelist.
+func (e *BTreeStorageEngine) create() error {
+	e.pageSize = e.opts.PageSize
+	e.meta = meta{pageSize: e.pageSize, root: 2, freelist: 3, pageCount: 4}
+	e.freelistPages = []pgid{3}
+
+	page := make([]byte, e.pageSize)
+	(&node{leaf: true}).encode(page)
+	if err := e.writePage(2, page); err != nil {
+		return err
+	}
+	clear(page)
+	setHeader(page, pageFreelist, 0, 0)
+	if err := e.writePage(3, page); err != nil {
+		return err
+	}
+	for txid := range uint64(2) {
+		m := e.meta
+		m.txid = txid
+		clear(page)
+		m.encode(page)
+		if err := e.writePage(pgid(txid), page); err != nil {
+			return err
+		}
+		e.meta = m
+	}
+	if err := e.file.Sync(); err != nil {
+		return err
+	}
+	return syncDir(e.dataDir)
+}
+
+// load picks the current meta page of an existing file, the valid one with the
+// highest txid, and reads the freelist.
+func (e *BTreeStorageEngine) load(fileSize int64) error {
+	buf := make([]byte, min(fileSize, 2*maxPageSize))
+	if _, err := e.file.ReadAt(buf, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	m0, err0 := decodeMeta(buf, 0)
+	var m1 meta
+	err1 := fmt.Errorf("%w: no valid meta page 1", ErrCorrupt)
+	for size := minPageSize; size <= maxPageSize && size < len(buf); size *= 2 {
+		if err0 == nil && size != m0.pageSize {
+			continue
+		}
+		if m, err := decodeMeta(buf[size:], 1); err == nil && m.pageSize == size {
+			m1, err1 = m, nil
+			break
+		} else if err0 == nil {
+			err1 = err
+		}
+	}
+
+	switch {
+	case err0 != nil && err1 != nil:
+		return errors.Join(err0, err1)
+	case err0 != nil:
+		e.opts.Logger.Warn("meta page is damaged, using the other one", "page", 0, "error", err0)
+		e.meta = m1
+	case err1 != nil:
+		e.opts.Logger.Warn("meta page is damaged, using the other one", "page", 1, "error", err1)
+		e.meta = m0
+	case m1.txid > m0.txid:
+		e.meta = m1
+	default:
+		e.meta = m0
+	}
+	e.pageSize = e.meta.pageSize
+	if need := int64(e.meta.pageCount) * int64(e.pageSize); fileSize < need {
+		return fmt.Errorf("%w: file has %d bytes, its meta page needs %d", ErrCorrupt, fileSize, need)
+	}
+
+	for id := e.meta.freelist; id != 0; {
+		page, err := e.readPage(id, pageFreelist)
+		if err != nil {
+			return err
+		}
+		e.freelistPages = append(e.freelistPages, id)
+		e.free = append(e.free, decodeFreelist(page)...)
+		id = pageNext(page)
+	}
+	slices.Sort(e.free)
+	slices.Reverse(e.free)
+	return nil
+}
+
+// syncDir syncs the entries of a directory, making a new file in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// readPage reads page id and checks its CRC and type.
+func (e *BTreeStorageEngine) readPage(id pgid, types ...byte) ([]byte, error) {
+	page := make([]byte, e.pageSize)
+	if _, err := e.file.ReadAt(page, int64(id)*int64(e.pageSize)); err != nil {
+		return nil, fmt.Errorf("failed reading page %d: %w", id, err)
+	}
+	if err := checkPage(page, id, types...); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// readNode returns the node of page id, from the buffer pool if it has it.
+func (e *BTreeStorageEngine) readNode(id pgid) (*node, error) {
+	if n, ok := e.pool.get(id); ok {
+		return n, nil
+	}
+	page, err := e.readPage(id, pageBranch, pageLeaf)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(page, id)
+	if err != nil {
+		return nil, err
+	}
+	e.pool.put(id, n)
+	return n, nil
+}
+
+// readValue returns the value of v, reading its overflow pages if it has any.
+func (e *BTreeStorageEngine) readValue(v leafValue) (string, error) {
+	if v.overflow == 0 {
+		return v.value, nil
+	}
+	var value strings.Builder
+	value.Grow(v.size)
+	for id := v.overflow; value.Len() < v.size; {
+		if id == 0 {
+			return "", fmt.Errorf("%w: overflow value ends after %d of %d bytes", ErrCorrupt, value.Len(), v.size)
+		}
+		page, err := e.readPage(id, pageOverflow)
+		if err != nil {
+			return "", err
+		}
+		data := page[pageHeaderSize:]
+		value.Write(data[:min(len(data), v.size-value.Len())])
+		id = pageNext(page)
+	}
+	return value.String(), nil
+}
+
+// writePage seals page and writes it as page id.
+func (e *BTreeStorageEngine) writePage(id pgid, page []byte) error {
+	sealPage(page)
+	if _, err := e.file.WriteAt(page, int64(id)*int64(e.pageSize)); err != nil {
+		return fmt.Errorf("failed writing page %d: %w", id, err)
+	}
+	return nil
+}
+
+// syncFile fsyncs the file, unless the engine was opened with NoSync.
+func (e *BTreeStorageEngine) syncFile() error {
+	if e.opts.NoSync {
+		return nil
+	}
+	if err := e.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database file: %w", err)
+	}
+	return nil
+}
+
+// lookup walks the tree from root, reading nodes with nodeOf, to the value of key.
+func lookup(root pgid, nodeOf func(pgid) (*node, error), key string) (leafValue, bool, error) {
+	n, err := nodeOf(root)
+	for err == nil && !n.leaf {
+		n, err = nodeOf(n.children[n.childIndex(key)])
+	}
+	if err != nil {
+		return leafValue{}, false, err
+	}
+	i, found := n.search(key)
+	if !found {
+		return leafValue{}, false, nil
+	}
+	return n.values[i], true, nil
+}
+
+// Health reports the reason the engine stopped accepting writes, if it did.
+func (e *BTreeStorageEngine) Health() error {
+	if err := e.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// setFailure switches the engine to read-only after a commit failed part way; what
+// the file holds past the last commit is then unknown, so nothing more is written.
+func (e *BTreeStorageEngine) setFailure(cause error) {
+	err := fmt.Errorf("%w: %v", storage.ErrReadOnly, cause)
+	e.failure.CompareAndSwap(nil, &err)
+}
+
+// update runs fn in a write transaction and commits it, unless fn fails.
+func (e *BTreeStorageEngine) update(ctx context.Context, fn func(tx *tx) error) error {
+	if err := storage.Lock(ctx, &e.writeMu); err != nil {
+		return err
+	}
+	defer e.writeMu.Unlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+	if err := e.failure.Load(); err != nil {
+		return *err
+	}
+	tx := e.begin()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		e.setFailure(err)
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// checkKey rejects keys the tree cannot hold.
+func (e *BTreeStorageEngine) checkKey(key string) error {
+	if key == "" {
+		return storage.ErrEmptyKey
+	}
+	if len(key) > maxKeySize(e.pageSize) {
+		return fmt.Errorf("%w: %d bytes, at most %d fit in a page of %d", ErrKeyTooLong, len(key), maxKeySize(e.pageSize), e.pageSize)
+	}
+	return nil
+}
+
+func (e *BTreeStorageEngine) Get(key string) (string, error) {
+	return e.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := e.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersioned returns the value of key together with its version.
+func (e *BTreeStorageEngine) GetVersioned(key string) (string, uint64, error) {
+	return e.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext is GetVersioned, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
+	if err := storage.RLock(ctx, &e.mu); err != nil {
+		return "", 0, err
+	}
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return "", 0, ErrEngineClosed
+	}
+	v, found, err := lookup(e.meta.root, e.readNode, key)
+	if err == nil && found {
+		var value string
+		if value, err = e.readValue(v); err == nil {
+			return value, v.version, nil
+		}
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+	}
+	return "", 0, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+}
+
+func (e *BTreeStorageEngine) Set(key string, value string) error {
+	return e.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) SetContext(ctx context.Context, key string, value string) error {
+	_, err := e.SetIfContext(ctx, key, value, nil)
+	return err
+}
+
+// SetIf stores value under key if pre holds and returns the new version.
+func (e *BTreeStorageEngine) SetIf(key string, value string, pre storage.Precondition) (uint64, error) {
+	return e.SetIfContext(context.Background(), key, value, pre)
+}
+
+// SetIfContext is SetIf, giving up if ctx ends while waiting for the lock. Once the
+// commit has started it runs to the end regardless.
+func (e *BTreeStorageEngine) SetIfContext(ctx context.Context, key string, value string, pre storage.Precondition) (uint64, error) {
+	if err := e.checkKey(key); err != nil {
+		return 0, err
+	}
+	var version uint64
+	err := e.update(ctx, func(tx *tx) error {
+		if pre != nil {
+			old, exists, err := tx.get(key)
+			if err != nil {
+				return fmt.Errorf("failed to read key '%s': %w", key, err)
+			}
+			if err := pre(old.version, exists); err != nil {
+				return err
+			}
+		}
+		version = tx.meta.lastVersion + 1
+		return tx.put(key, value, version)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func (e *BTreeStorageEngine) Delete(key string) error {
+	return e.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) DeleteContext(ctx context.Context, key string) error {
+	err := e.DeleteIfContext(ctx, key, nil)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Deleting a non-existent key is treated as success (idempotent)
+	}
+	return err
+}
+
+// DeleteIf removes key if pre holds. Unlike Delete it reports a missing key.
+func (e *BTreeStorageEngine) DeleteIf(key string, pre storage.Precondition) error {
+	return e.DeleteIfContext(context.Background(), key, pre)
+}
+
+// DeleteIfContext is DeleteIf, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) DeleteIfContext(ctx context.Context, key string, pre storage.Precondition) error {
+	return e.update(ctx, func(tx *tx) error {
+		old, exists, err := tx.get(key)
+		if err != nil {
+			return fmt.Errorf("failed to read key '%s': %w", key, err)
+		}
+		if pre != nil {
+			if err := pre(old.version, exists); err != nil {
+				return err
+			}
+		}
+		if !exists {
+			return storage.ErrNotFound
+		}
+		return tx.delete(key, tx.meta.lastVersion+1)
+	})
+}
+
+// MGet looks up every key while taking the read lock once.
+func (e *BTreeStorageEngine) MGet(keys []string) ([]storage.Result, error) {
+	return e.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, giving up if ctx ends while waiting for the lock or between keys.
+func (e *BTreeStorageEngine) MGetContext(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if err := storage.RLock(ctx, &e.mu); err != nil {
+		return nil, err
+	}
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v, found, err := lookup(e.meta.root, e.readNode, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+		}
+		if !found {
+			continue
+		}
+		if results[i].Value, err = e.readValue(v); err != nil {
+			return nil, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+		}
+		results[i].Found = true
+	}
+	return results, nil
+}
+
+// MSet writes every pair in a single commit. Nothing is written if a key is invalid.
+func (e *BTreeStorageEngine) MSet(pairs []storage.KeyValue) error {
+	return e.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, giving up if ctx ends while waiting for the lock.
+func (e *BTreeStorageEngine) MSetContext(ctx context.Context, pairs []storage.KeyValue) error {
+	for _, pair := range pairs {
+		if err := e.checkKey(pair.Key); err != nil {
+			return err
+		}
+	}
+	return e.update(ctx, func(tx *tx) error {
+		for _, pair := range pairs {
+			if err := tx.put(pair.Key, pair.Value, tx.meta.lastVersion+1); err != nil {
+				return fmt.Errorf("failed to write key '%s': %w", pair.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Apply writes changes read from another engine's log in a single commit, keeping
+// their versions.
+func (e *BTreeStorageEngine) Apply(changes []storage.Change) ([]bool, error) {
+	for _, change := range changes {
+		if err := e.checkKey(change.Key); err != nil {
+			return make([]bool, len(changes)), err
+		}
+	}
+	var applied []bool
+	err := e.update(context.Background(), func(tx *tx) error {
+		applied = make([]bool, len(changes))
+		for i, change := range changes {
+			old, exists, err := tx.get(change.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read key '%s': %w", change.Key, err)
+			}
+			if exists && old.version >= change.Version {
+				continue // Already holds this version or a newer one
+			}
+			switch change.Type {
+			case storage.ChangeSet:
+				err = tx.put(change.Key, change.Value, change.Version)
+			case storage.ChangeDelete:
+				if !exists {
+					continue
+				}
+				err = tx.delete(change.Key, change.Version)
+			default:
+				err = fmt.Errorf("unknown change type %q for key '%s'", change.Type, change.Key)
+			}
+			if err != nil {
+				return err
+			}
+			applied[i] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return make([]bool, len(changes)), err
+	}
+	return applied, nil
+}
+
+// Keys returns the live keys starting with prefix, sorted.
+func (e *BTreeStorageEngine) Keys(prefix string) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	keys := []string{}
+	c, err := e.seek(prefix)
+	for ; err == nil && c.valid() && strings.HasPrefix(c.key(), prefix); err = c.next() {
+		keys = append(keys, c.key())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Range calls fn with every key from start up to, but not including, end, in order,
+// with its value. An empty end means no upper bound. It stops at the first error fn
+// returns and returns it. The engine is read-locked meanwhile, so fn must not write
+// to it.
+func (e *BTreeStorageEngine) Range(start, end string, fn func(key, value string) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+	c, err := e.seek(start)
+	for ; err == nil && c.valid() && (end == "" || c.key() < end); err = c.next() {
+		value, err := e.readValue(c.value())
+		if err != nil {
+			return err
+		}
+		if err := fn(c.key(), value); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Stats reports the database file as a single segment, whose free pages are dead
+// bytes, and the buffer pool as the in-memory index.
+func (e *BTreeStorageEngine) Stats() storage.Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return storage.Stats{
+		Engine:      "btree",
+		Keys:        int(e.meta.keys),
+		KeyDirBytes: int64(e.pool.len()) * int64(e.pageSize),
+		DataDir:     e.dataDir,
+		Segments: []storage.SegmentStats{{
+			Bytes:     int64(e.meta.pageCount) * int64(e.pageSize),
+			DeadBytes: int64(len(e.free)) * int64(e.pageSize),
+		}},
+		OpenFiles: 1,
+	}
+}
+
+// Sync fsyncs the database file, making every commit so far durable when the engine
+// was opened with NoSync.
+func (e *BTreeStorageEngine) Sync() error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	if e.closed {
+		return ErrEngineClosed
+	}
+	if err := e.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database file: %w", err)
+	}
+	return nil
+}
+
+// Close waits for the running commit and for readers, syncs the file and closes it.
+func (e *BTreeStorageEngine) Close() error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	var errs []error
+	if err := e.file.Sync(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to sync database file: %w", err))
+	}
+	errs = append(errs, e.file.Close())
+	if err := e.fLock.Unlock(); err != nil {
+		errs = append(errs, fmt.Errorf("failed releasing file lock %s: %w", e.fLock.Path(), err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,661 @@
+package btree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/storagetest"
+)
+
+// setupTestEngine opens an engine in a temporary directory and closes it when the
+// test finishes.
+func setupTestEngine(t *testing.T, options ...Option) (*BTreeStorageEngine, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	db, err := NewBTreeStorageEngine(tempDir, options...)
+	if err != nil {
+		t.Fatalf("Failed to initialize test engine in %s: %v", tempDir, err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing test engine in %s: %v", tempDir, err)
+		}
+	})
+	return db, tempDir
+}
+
+// reopen opens the engine in dir, closing it when the test finishes.
+func reopen(t *testing.T, dir string, options ...Option) *BTreeStorageEngine {
+	t.Helper()
+	db, err := NewBTreeStorageEngine(dir, options...)
+	if err != nil {
+		t.Fatalf("Reopen of %s failed: %v", dir, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// smallOptions make the tree a few levels deep after a few hundred keys.
+func smallOptions() []Option {
+	return []Option{WithPageSize(minPageSize), WithCacheSize(16), WithNoSync()}
+}
+
+// check verifies that every page of the file is used exactly once, by the tree, the
+// freelist or a meta page, and that the keys are in order.
+func check(t *testing.T, db *BTreeStorageEngine) {
+	t.Helper()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	used := map[pgid]string{0: "meta", 1: "meta"}
+	mark := func(id pgid, what string) {
+		if prev, ok := used[id]; ok {
+			t.Fatalf("page %d used as %s and %s", id, prev, what)
+		}
+		if id >= db.meta.pageCount {
+			t.Fatalf("%s page %d is past the end, %d", what, id, db.meta.pageCount)
+		}
+		used[id] = what
+	}
+	var walk func(id pgid, low, high string, depth int) int
+	walk = func(id pgid, low, high string, depth int) int {
+		mark(id, "node")
+		n, err := db.readNode(id)
+		if err != nil {
+			t.Fatalf("readNode(%d) failed: %v", id, err)
+		}
+		for i := 1; i < len(n.keys); i++ {
+			if n.keys[i-1] >= n.keys[i] {
+				t.Fatalf("keys of page %d are out of order: %q", id, n.keys)
+			}
+		}
+		if len(n.keys) > 0 && (n.keys[0] < low || high != "" && n.keys[len(n.keys)-1] >= high) {
+			t.Fatalf("keys of page %d are outside [%q, %q): %q", id, low, high, n.keys)
+		}
+		if n.leaf {
+			for _, v := range n.values {
+				for next := v.overflow; next != 0; {
+					mark(next, "overflow")
+					page, err := db.readPage(next, pageOverflow)
+					if err != nil {
+						t.Fatalf("readPage(%d) failed: %v", next, err)
+					}
+					next = pageNext(page)
+				}
+			}
+			return depth
+		}
+		leafDepth := -1
+		for i, child := range n.children {
+			childLow, childHigh := n.keys[i], high
+			if i == 0 {
+				childLow = low
+			}
+			if i+1 < len(n.keys) {
+				childHigh = n.keys[i+1]
+			}
+			d := walk(child, childLow, childHigh, depth+1)
+			if leafDepth >= 0 && d != leafDepth {
+				t.Fatalf("leaves under page %d at depths %d and %d", id, leafDepth, d)
+			}
+			leafDepth = d
+		}
+		return leafDepth
+	}
+	walk(db.meta.root, "", "", 0)
+	for _, id := range db.freelistPages {
+		mark(id, "freelist")
+	}
+	for _, id := range db.free {
+		mark(id, "free")
+	}
+	if len(used) != int(db.meta.pageCount) {
+		t.Fatalf("%d of %d pages accounted for", len(used), db.meta.pageCount)
+	}
+}
+
+func TestBTreeStorageEngine_SetGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		set     bool
+		wantErr error
+	}{
+		{name: "simple set/get", key: "key1", value: "value1", set: true},
+		{name: "set/get empty value", key: "key2", value: "", set: true},
+		{name: "set/get unicode", key: "你好", value: "世界", set: true},
+		{name: "set/get overflow value", key: "big", value: strings.Repeat("0123456789", 2000), set: true},
+		{name: "get non-existent", key: "non_existent_key", wantErr: storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestEngine(t)
+			if tt.set {
+				if err := db.Set(tt.key, tt.value); err != nil {
+					t.Fatalf("Set(%q, %q) = %v, want nil", tt.key, tt.value, err)
+				}
+			}
+			got, err := db.Get(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get(%q) error = %v, want %v", tt.key, err, tt.wantErr)
+			}
+			if got != tt.value {
+				t.Errorf("Get(%q) = %d bytes, want %d", tt.key, len(got), len(tt.value))
+			}
+		})
+	}
+
+	db, _ := setupTestEngine(t, smallOptions()...)
+	if err := db.Set("", "value"); err == nil {
+		t.Errorf("Set(%q) = nil, want error", "")
+	}
+	if err := db.Set(strings.Repeat("k", 200), "value"); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Set() of a 200 byte key = %v, want %v", err, ErrKeyTooLong)
+	}
+}
+
+func TestBTreeStorageEngine_Conformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Engine{
+		Open: func(t *testing.T, dir string) storage.StorageEngine {
+			db, err := NewBTreeStorageEngine(dir, WithNoSync(), WithCacheSize(16))
+			if err != nil {
+				t.Fatalf("NewBTreeStorageEngine(%q) failed: %v", dir, err)
+			}
+			return db
+		},
+		Durable: true,
+	})
+}
+
+func TestBTreeStorageEngine_Delete(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := db.Delete("foo"); err != nil {
+		t.Fatalf("Delete(%q) = %v, want nil", "foo", err)
+	}
+	if _, err := db.Get("foo"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after delete = %v, want %v", "foo", err, storage.ErrNotFound)
+	}
+	if err := db.Delete("foo"); err != nil {
+		t.Errorf("Delete(%q) of deleted key = %v, want nil", "foo", err)
+	}
+	if err := db.DeleteIf("foo", nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteIf(%q) of deleted key = %v, want %v", "foo", err, storage.ErrNotFound)
+	}
+}
+
+func TestBTreeStorageEngine_Versions(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	ifVersion := func(want uint64) storage.Precondition {
+		return func(version uint64, exists bool) error {
+			if version != want {
+				return storage.ErrPreconditionFailed
+			}
+			return nil
+		}
+	}
+
+	v1, err := db.SetIf("k", "1", ifVersion(0))
+	if err != nil || v1 == 0 {
+		t.Fatalf("SetIf(%q) on a new key = %d, %v, want a version, nil", "k", v1, err)
+	}
+	if _, err := db.SetIf("k", "2", ifVersion(0)); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("SetIf(%q) with a stale version = %v, want %v", "k", err, storage.ErrPreconditionFailed)
+	}
+	v2, err := db.SetIf("k", "2", ifVersion(v1))
+	if err != nil || v2 <= v1 {
+		t.Errorf("SetIf(%q) = %d, %v, want a version above %d, nil", "k", v2, err, v1)
+	}
+	if value, version, err := db.GetVersioned("k"); value != "2" || version != v2 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", "k", value, version, err, "2", v2)
+	}
+	if err := db.DeleteIf("k", ifVersion(v1)); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("DeleteIf(%q) with a stale version = %v, want %v", "k", err, storage.ErrPreconditionFailed)
+	}
+	if err := db.DeleteIf("k", ifVersion(v2)); err != nil {
+		t.Errorf("DeleteIf(%q) = %v, want nil", "k", err)
+	}
+}
+
+func TestBTreeStorageEngine_Random(t *testing.T) {
+	db, tempDir := setupTestEngine(t, smallOptions()...)
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	// Mostly small values, some big enough for overflow pages
+	for i := range 3000 {
+		key := fmt.Sprintf("key%04d", rng.Intn(800))
+		if rng.Intn(3) == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatalf("Delete(%q) failed: %v", key, err)
+			}
+			delete(want, key)
+			continue
+		}
+		value := strings.Repeat(fmt.Sprint(i), 1+rng.Intn(20))
+		if rng.Intn(20) == 0 {
+			value = strings.Repeat(value, 50)
+		}
+		if err := db.Set(key, value); err != nil {
+			t.Fatalf("Set(%q) failed: %v", key, err)
+		}
+		want[key] = value
+		if i%500 == 0 {
+			check(t, db)
+		}
+	}
+
+	verify := func(db *BTreeStorageEngine) {
+		t.Helper()
+		check(t, db)
+		for i := range 800 {
+			key := fmt.Sprintf("key%04d", i)
+			got, err := db.Get(key)
+			if value, ok := want[key]; ok && (got != value || err != nil) {
+				t.Fatalf("Get(%q) = %q, %v, want %q, nil", key, got, err, value)
+			} else if !ok && !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("Get(%q) of deleted key = %q, %v, want %v", key, got, err, storage.ErrNotFound)
+			}
+		}
+		var wantKeys []string
+		for key := range want {
+			wantKeys = append(wantKeys, key)
+		}
+		sort.Strings(wantKeys)
+		if keys, err := db.Keys(""); err != nil || !reflect.DeepEqual(keys, wantKeys) {
+			t.Fatalf("Keys(%q) = %d keys, %v, want %d keys", "", len(keys), err, len(wantKeys))
+		}
+		if stats := db.Stats(); stats.Keys != len(want) || stats.Engine != "btree" {
+			t.Errorf("Stats() = engine %q with %d keys, want btree with %d", stats.Engine, stats.Keys, len(want))
+		}
+	}
+	verify(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	verify(reopen(t, tempDir))
+}
+
+func TestBTreeStorageEngine_FreePages(t *testing.T) {
+	db, _ := setupTestEngine(t, smallOptions()...)
+	write := func(round int) {
+		for i := range 300 {
+			key := fmt.Sprintf("key%04d", i)
+			if err := db.Set(key, fmt.Sprintf("value%d-%d", i, round)); err != nil {
+				t.Fatalf("Set(%q) failed: %v", key, err)
+			}
+		}
+	}
+	write(0)
+	size := db.Stats().Segments[0].Bytes
+
+	// Rewriting the same keys reuses the pages the previous versions were on
+	for round := 1; round <= 5; round++ {
+		write(round)
+	}
+	if got := db.Stats().Segments[0].Bytes; got > 2*size {
+		t.Errorf("file grew from %d to %d bytes rewriting the same keys", size, got)
+	}
+
+	for i := range 300 {
+		if err := db.Delete(fmt.Sprintf("key%04d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	check(t, db)
+	stats := db.Stats()
+	if stats.Keys != 0 || stats.Segments[0].DeadBytes == 0 {
+		t.Errorf("Stats() after deleting every key = %d keys and %d dead bytes, want 0 and some", stats.Keys, stats.Segments[0].DeadBytes)
+	}
+}
+
+func TestBTreeStorageEngine_Persistence(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewBTreeStorageEngine(tempDir, WithPageSize(1024))
+	if err != nil {
+		t.Fatalf("NewBTreeStorageEngine failed: %v", err)
+	}
+	for i := range 100 {
+		if err := db.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := db.Delete("key007"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, lastVersion, _ := db.GetVersioned("key099")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The page size of the file wins over the option
+	db = reopen(t, tempDir)
+	if db.pageSize != 1024 {
+		t.Errorf("page size after reopen = %d, want 1024", db.pageSize)
+	}
+	if got, err := db.Get("key042"); got != "value42" || err != nil {
+		t.Errorf("Get(%q) after reopen = %q, %v, want %q, nil", "key042", got, err, "value42")
+	}
+	if _, err := db.Get("key007"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) of deleted key after reopen = %v, want %v", "key007", err, storage.ErrNotFound)
+	}
+	if version, err := db.SetIf("new", "v", nil); err != nil || version <= lastVersion {
+		t.Errorf("SetIf() after reopen = %d, %v, want a version above %d", version, err, lastVersion)
+	}
+}
+
+func TestBTreeStorageEngine_Recovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(t *testing.T, path string, db *BTreeStorageEngine)
+		want    string // Value of "b" after reopen, "" if missing
+		wantErr bool
+	}{
+		{
+			name: "torn meta page",
+			damage: func(t *testing.T, path string, db *BTreeStorageEngine) {
+				corrupt(t, path, int64(db.meta.txid%2)*int64(db.pageSize)+40)
+			},
+			want: "1",
+		},
+		{
+			name: "other meta page damaged",
+			damage: func(t *testing.T, path string, db *BTreeStorageEngine) {
+				corrupt(t, path, int64((db.meta.txid+1)%2)*int64(db.pageSize)+40)
+			},
+			want: "2",
+		},
+		{
+			name: "both meta pages damaged",
+			damage: func(t *testing.T, path string, db *BTreeStorageEngine) {
+				corrupt(t, path, 40)
+				corrupt(t, path, int64(db.pageSize)+40)
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated file",
+			damage: func(t *testing.T, path string, db *BTreeStorageEngine) {
+				if err := os.Truncate(path, int64(db.meta.pageCount-1)*int64(db.pageSize)); err != nil {
+					t.Fatalf("Truncate failed: %v", err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			db, err := NewBTreeStorageEngine(tempDir, smallOptions()...)
+			if err != nil {
+				t.Fatalf("NewBTreeStorageEngine failed: %v", err)
+			}
+			if err := db.MSet([]storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "1"}}); err != nil {
+				t.Fatalf("MSet failed: %v", err)
+			}
+			if err := db.Set("b", "2"); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			tt.damage(t, filepath.Join(tempDir, dbFileName), db)
+
+			db, err = NewBTreeStorageEngine(tempDir)
+			if tt.wantErr {
+				if err == nil {
+					db.Close()
+					t.Fatalf("NewBTreeStorageEngine() on a damaged file = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewBTreeStorageEngine() = %v, want nil", err)
+			}
+			defer db.Close()
+			if got, err := db.Get("b"); got != tt.want || err != nil {
+				t.Errorf("Get(%q) = %q, %v, want %q, nil", "b", got, err, tt.want)
+			}
+			if got, err := db.Get("a"); got != "1" || err != nil {
+				t.Errorf("Get(%q) = %q, %v, want %q, nil", "a", got, err, "1")
+			}
+			check(t, db)
+
+			// The next commit overwrites the damaged page
+			if err := db.Set("c", "3"); err != nil {
+				t.Errorf("Set() after recovery = %v, want nil", err)
+			}
+		})
+	}
+}
+
+// corrupt flips a byte of the file at off.
+func corrupt(t *testing.T, path string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+}
+
+func TestBTreeStorageEngine_FileLocking(t *testing.T) {
+	_, tempDir := setupTestEngine(t)
+	if _, err := NewBTreeStorageEngine(tempDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("second NewBTreeStorageEngine(%q) = %v, want %v", tempDir, err, ErrLocked)
+	}
+}
+
+func TestBTreeStorageEngine_KeysAndRange(t *testing.T) {
+	db, _ := setupTestEngine(t, smallOptions()...)
+	for _, key := range []string{"user:3", "user:1", "order:1", "user:2", "users", "user:4"} {
+		if err := db.Set(key, strings.Repeat("x", 100)); err != nil {
+			t.Fatalf("Set(%q) failed: %v", key, err)
+		}
+	}
+	if err := db.Delete("user:4"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"user:", []string{"user:1", "user:2", "user:3"}},
+		{"order", []string{"order:1"}},
+		{"zzz", []string{}},
+		{"", []string{"order:1", "user:1", "user:2", "user:3", "users"}},
+	}
+	for _, tt := range tests {
+		if got, err := db.Keys(tt.prefix); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Keys(%q) = %v, %v, want %v", tt.prefix, got, err, tt.want)
+		}
+	}
+
+	rangeTests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"user:1", "user:3", []string{"user:1", "user:2"}},
+		{"user:15", "", []string{"user:2", "user:3", "users"}},
+		{"a", "b", nil},
+	}
+	for _, tt := range rangeTests {
+		var got []string
+		err := db.Range(tt.start, tt.end, func(key, value string) error {
+			got = append(got, key)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Range(%q, %q) = %v, %v, want %v", tt.start, tt.end, got, err, tt.want)
+		}
+	}
+	stop := errors.New("stop")
+	if err := db.Range("", "", func(key, value string) error { return stop }); err != stop {
+		t.Errorf("Range() with a failing callback = %v, want %v", err, stop)
+	}
+}
+
+func TestBTreeStorageEngine_Batch(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	pairs := []storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}
+	if err := db.MSet(pairs); err != nil {
+		t.Fatalf("MSet failed: %v", err)
+	}
+	if err := db.MSet([]storage.KeyValue{{Key: "c", Value: "3"}, {Key: "", Value: "4"}}); err == nil {
+		t.Errorf("MSet() with an empty key = nil, want error")
+	}
+	results, err := db.MGet([]string{"a", "c", "b"})
+	want := []storage.Result{{Value: "1", Found: true}, {}, {Value: "2", Found: true}}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("MGet() = %v, %v, want %v, nil", results, err, want)
+	}
+}
+
+func TestBTreeStorageEngine_Apply(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	changes := []storage.Change{
+		{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 100},
+		{Type: storage.ChangeSet, Key: "a", Value: "stale", Version: 50},
+		{Type: storage.ChangeDelete, Key: "missing", Version: 101},
+		{Type: storage.ChangeSet, Key: "b", Value: "2", Version: 102},
+		{Type: storage.ChangeDelete, Key: "b", Version: 103},
+	}
+	applied, err := db.Apply(changes)
+	if err != nil || fmt.Sprint(applied) != "[true false false true true]" {
+		t.Errorf("Apply() = %v, %v, want [true false false true true], nil", applied, err)
+	}
+	if value, version, err := db.GetVersioned("a"); value != "1" || version != 100 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, 100, nil", "a", value, version, err, "1")
+	}
+	if _, err := db.Get("b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after applied delete = %v, want %v", "b", err, storage.ErrNotFound)
+	}
+	if version, _ := db.SetIf("c", "3", nil); version <= 103 {
+		t.Errorf("SetIf() after Apply() = version %d, want more than 103", version)
+	}
+
+	// A local delete does not hide older versions from a snapshot applied after it
+	if err := db.Delete("c"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if applied, err := db.Apply([]storage.Change{{Type: storage.ChangeSet, Key: "c", Value: "leader", Version: 10}}); err != nil || !applied[0] {
+		t.Errorf("Apply() over a local delete = %v, %v, want [true], nil", applied, err)
+	}
+}
+
+func TestBTreeStorageEngine_Context(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	db.writeMu.Lock()
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetContext(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := db.SetIfContext(ctx, "foo", "baz", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetIfContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := db.MSetContext(ctx, []storage.KeyValue{{Key: "foo", Value: "baz"}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MSetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	db.mu.Unlock()
+	db.writeMu.Unlock()
+
+	if got, err := db.GetContext(context.Background(), "foo"); err != nil || got != "bar" {
+		t.Errorf("GetContext(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+	}
+}
+
+func TestBTreeStorageEngine_Concurrency(t *testing.T) {
+	db, _ := setupTestEngine(t, smallOptions()...)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("conc_key_%d_%d", g, i)
+				if err := db.Set(key, fmt.Sprintf("conc_val_%d_%d", g, i)); err != nil {
+					t.Errorf("Set(%q) failed: %v", key, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("conc_key_%d_%d", g, i)
+				if _, err := db.Get(key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+					t.Errorf("Get(%q) failed: %v", key, err)
+				}
+				if i%50 == 0 {
+					if _, err := db.Keys("conc_key_"); err != nil {
+						t.Errorf("Keys() failed: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check(t, db)
+	for g := range 8 {
+		for i := range 200 {
+			key, want := fmt.Sprintf("conc_key_%d_%d", g, i), fmt.Sprintf("conc_val_%d_%d", g, i)
+			if got, err := db.Get(key); got != want || err != nil {
+				t.Fatalf("Get(%q) = %q, %v, want %q, nil", key, got, err, want)
+			}
+		}
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  Option
+		wantErr bool
+	}{
+		{"defaults", func(*Options) {}, false},
+		{"smallest page", WithPageSize(512), false},
+		{"page not a power of two", WithPageSize(1000), true},
+		{"page too small", WithPageSize(256), true},
+		{"page too big", WithPageSize(128 << 10), true},
+		{"no cache", WithCacheSize(0), true},
+		{"no logger", WithLogger(nil), true},
+	}
+	for _, tt := range tests {
+		opts := defaultOptions()
+		tt.option(&opts)
+		if err := opts.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() with %s = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package btree
+
+// cursor walks the leaves of the tree in key order. It keeps the path from the root,
+// as pages have no sibling links: copy-on-write would have to copy a leaf's neighbours
+// along with it. Used holding the read lock.
+type cursor struct {
+	e     *BTreeStorageEngine
+	stack []frame
+}
+
+// frame is a node on the cursor's path and the position in it.
+type frame struct {
+	n *node
+	i int
+}
+
+// seek returns a cursor on the first key not below key.
+func (e *BTreeStorageEngine) seek(key string) (*cursor, error) {
+	c := &cursor{e: e}
+	n, err := e.readNode(e.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	for !n.leaf {
+		i := n.childIndex(key)
+		c.stack = append(c.stack, frame{n: n, i: i})
+		if n, err = e.readNode(n.children[i]); err != nil {
+			return nil, err
+		}
+	}
+	i, _ := n.search(key)
+	c.stack = append(c.stack, frame{n: n, i: i})
+	return c, c.settle()
+}
+
+func (c *cursor) valid() bool {
+	return len(c.stack) > 0
+}
+
+func (c *cursor) key() string {
+	f := c.stack[len(c.stack)-1]
+	return f.n.keys[f.i]
+}
+
+func (c *cursor) value() leafValue {
+	f := c.stack[len(c.stack)-1]
+	return f.n.values[f.i]
+}
+
+func (c *cursor) next() error {
+	c.stack[len(c.stack)-1].i++
+	return c.settle()
+}
+
+// settle moves the cursor from past the end of a node to the next key, if there is one.
+func (c *cursor) settle() error {
+	for len(c.stack) > 0 {
+		f := &c.stack[len(c.stack)-1]
+		if f.n.leaf && f.i < len(f.n.keys) {
+			return nil
+		}
+		if !f.n.leaf && f.i < len(f.n.children) {
+			child, err := c.e.readNode(f.n.children[f.i])
+			if err != nil {
+				return err
+			}
+			c.stack = append(c.stack, frame{n: child})
+			continue
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+		if len(c.stack) > 0 {
+			c.stack[len(c.stack)-1].i++
+		}
+	}
+	return nil
+}
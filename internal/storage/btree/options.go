@@ -0,0 +1,73 @@
+package btree
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Defaults of the tunables.
+const (
+	DefaultPageSize  = 4 << 10 // 4 KiB
+	DefaultCacheSize = 2048    // Pages, 8 MiB with the default page size
+	minPageSize      = 512
+	maxPageSize      = 64 << 10
+)
+
+// Options holds the tunables of a BTreeStorageEngine.
+type Options struct {
+	// PageSize is the size in bytes of the pages of a new database file, a power of two
+	// between 512 and 65536. An existing file keeps the page size it was created with.
+	PageSize int
+	// CacheSize is the number of decoded pages the buffer pool keeps in memory.
+	CacheSize int
+	// NoSync skips the fsyncs of every commit. Commits then survive the process crashing
+	// but not the machine: the file is only synced by Sync and Close.
+	NoSync bool
+	// Logger receives warnings found while opening the file.
+	Logger *slog.Logger
+}
+
+// Option configures a BTreeStorageEngine.
+type Option func(*Options)
+
+func defaultOptions() Options {
+	return Options{
+		PageSize:  DefaultPageSize,
+		CacheSize: DefaultCacheSize,
+		Logger:    slog.Default(),
+	}
+}
+
+// WithPageSize sets the page size of a new database file.
+func WithPageSize(size int) Option {
+	return func(o *Options) { o.PageSize = size }
+}
+
+// WithCacheSize sets the number of pages the buffer pool holds.
+func WithCacheSize(pages int) Option {
+	return func(o *Options) { o.CacheSize = pages }
+}
+
+// WithNoSync skips the fsyncs of every commit, trading durability on power loss for
+// write throughput.
+func WithNoSync() Option {
+	return func(o *Options) { o.NoSync = true }
+}
+
+// WithLogger sets the logger used for warnings.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func (o Options) validate() error {
+	if o.Logger == nil {
+		return fmt.Errorf("logger must not be nil")
+	}
+	if o.PageSize < minPageSize || o.PageSize > maxPageSize || o.PageSize&(o.PageSize-1) != 0 {
+		return fmt.Errorf("page size must be a power of two between %d and %d (got %d)", minPageSize, maxPageSize, o.PageSize)
+	}
+	if o.CacheSize < 1 {
+		return fmt.Errorf("cache size must be at least one page (got %d)", o.CacheSize)
+	}
+	return nil
+}
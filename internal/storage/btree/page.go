@@ -0,0 +1,367 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sort"
+)
+
+// The database file is an array of pages. Every page starts with a header
+//
+//	crc32(4) | type(1) | flags(1) | count(2) | next(8)
+//
+// where the CRC covers the rest of the page, count is the number of entries of branch,
+// leaf and freelist pages, and next links the pages of a freelist or an overflow value.
+// Pages 0 and 1 hold the two copies of the meta page.
+
+// pgid is the number of a page in the file.
+type pgid uint64
+
+const pageHeaderSize = 16
+
+// Page types
+const (
+	pageMeta     byte = 1
+	pageBranch   byte = 2
+	pageLeaf     byte = 3
+	pageFreelist byte = 4
+	pageOverflow byte = 5
+)
+
+// Flags of leaf entries
+const (
+	valueInline   byte = 0
+	valueOverflow byte = 1
+)
+
+var (
+	// ErrCorrupt is returned when a page fails its checksum or cannot be decoded.
+	ErrCorrupt = errors.New("corrupt database file")
+	// ErrKeyTooLong is returned for keys that do not fit in a quarter of a page.
+	ErrKeyTooLong = errors.New("key too long")
+)
+
+// pageType, pageCount and pageNext read the header of page.
+func pageType(page []byte) byte { return page[4] }
+func pageCount(page []byte) int { return int(binary.BigEndian.Uint16(page[6:])) }
+func pageNext(page []byte) pgid { return pgid(binary.BigEndian.Uint64(page[8:])) }
+func setHeader(page []byte, typ byte, count int, next pgid) {
+	page[4] = typ
+	binary.BigEndian.PutUint16(page[6:], uint16(count))
+	binary.BigEndian.PutUint64(page[8:], uint64(next))
+}
+
+// sealPage sets the CRC of page; checkPage verifies it.
+func sealPage(page []byte) {
+	binary.BigEndian.PutUint32(page, crc32.ChecksumIEEE(page[4:]))
+}
+
+// checkPage also checks that the page has one of types.
+func checkPage(page []byte, id pgid, types ...byte) error {
+	if crc32.ChecksumIEEE(page[4:]) != binary.BigEndian.Uint32(page) {
+		return fmt.Errorf("%w: checksum mismatch in page %d", ErrCorrupt, id)
+	}
+	if !slices.Contains(types, pageType(page)) {
+		return fmt.Errorf("%w: page %d has type %d, want one of %v", ErrCorrupt, id, pageType(page), types)
+	}
+	return nil
+}
+
+// maxEntrySize is the most a leaf or branch entry may take, so that a node split in
+// two always fits in two pages. Larger values go to overflow pages.
+func maxEntrySize(pageSize int) int {
+	return (pageSize - pageHeaderSize) / 4
+}
+
+// maxKeySize leaves room in an entry for the version and an overflow reference.
+func maxKeySize(pageSize int) int {
+	return maxEntrySize(pageSize) - 32
+}
+
+// leafValue is the value of a leaf entry: inline, or the first page of an overflow
+// chain holding size bytes.
+type leafValue struct {
+	value    string
+	version  uint64
+	overflow pgid
+	size     int
+}
+
+// node is a decoded branch or leaf page. A branch has a key per child: the smallest
+// key that may be found under it, larger than every key under the child before.
+// Nodes read from the file are shared and never changed; writers change clones.
+type node struct {
+	leaf     bool
+	keys     []string
+	values   []leafValue // Leaves only
+	children []pgid      // Branches only
+}
+
+func uvarintLen(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
+
+func leafEntrySize(key string, v leafValue) int {
+	size := uvarintLen(len(key)) + len(key) + 8 + 1
+	if v.overflow != 0 {
+		return size + 8 + uvarintLen(v.size)
+	}
+	return size + uvarintLen(len(v.value)) + len(v.value)
+}
+
+func (n *node) entrySize(i int) int {
+	if n.leaf {
+		return leafEntrySize(n.keys[i], n.values[i])
+	}
+	return uvarintLen(len(n.keys[i])) + len(n.keys[i]) + 8
+}
+
+// size returns the bytes the node takes encoded.
+func (n *node) size() int {
+	size := pageHeaderSize
+	for i := range n.keys {
+		size += n.entrySize(i)
+	}
+	return size
+}
+
+// search returns the position of the first key not below key, and whether it is key.
+func (n *node) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+// childIndex returns the child of a branch that key belongs under.
+func (n *node) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+	return max(i-1, 0)
+}
+
+func (n *node) clone() *node {
+	return &node{leaf: n.leaf, keys: slices.Clone(n.keys), values: slices.Clone(n.values), children: slices.Clone(n.children)}
+}
+
+func (n *node) insertValue(i int, key string, v leafValue) {
+	n.keys = slices.Insert(n.keys, i, key)
+	n.values = slices.Insert(n.values, i, v)
+}
+
+func (n *node) insertChild(i int, key string, child pgid) {
+	n.keys = slices.Insert(n.keys, i, key)
+	n.children = slices.Insert(n.children, i, child)
+}
+
+func (n *node) removeAt(i int) {
+	n.keys = slices.Delete(n.keys, i, i+1)
+	if n.leaf {
+		n.values = slices.Delete(n.values, i, i+1)
+	} else {
+		n.children = slices.Delete(n.children, i, i+1)
+	}
+}
+
+// absorb appends the entries of right, the node that follows n.
+func (n *node) absorb(right *node) {
+	n.keys = append(n.keys, right.keys...)
+	n.values = append(n.values, right.values...)
+	n.children = append(n.children, right.children...)
+}
+
+// split divides a node too big for a page into nodes of about the same size that each
+// fit. n keeps the first part.
+func (n *node) split(pageSize int) []*node {
+	capacity := pageSize - pageHeaderSize
+	total := n.size() - pageHeaderSize
+	target := total / ((total + capacity - 1) / capacity)
+
+	var parts []*node
+	var part *node
+	partSize := 0
+	for i := range n.keys {
+		entry := n.entrySize(i)
+		if part == nil || partSize+entry > capacity || partSize >= target {
+			part = &node{leaf: n.leaf}
+			parts = append(parts, part)
+			partSize = 0
+		}
+		part.keys = append(part.keys, n.keys[i])
+		if n.leaf {
+			part.values = append(part.values, n.values[i])
+		} else {
+			part.children = append(part.children, n.children[i])
+		}
+		partSize += entry
+	}
+	*n = *parts[0]
+	parts[0] = n
+	return parts
+}
+
+// encode writes the node to page, which must be zeroed and big enough.
+func (n *node) encode(page []byte) {
+	typ := pageBranch
+	if n.leaf {
+		typ = pageLeaf
+	}
+	setHeader(page, typ, len(n.keys), 0)
+	buf := page[pageHeaderSize:pageHeaderSize]
+	for i, key := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		if !n.leaf {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(n.children[i]))
+			continue
+		}
+		v := n.values[i]
+		buf = binary.BigEndian.AppendUint64(buf, v.version)
+		if v.overflow != 0 {
+			buf = append(buf, valueOverflow)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(v.overflow))
+			buf = binary.AppendUvarint(buf, uint64(v.size))
+		} else {
+			buf = append(buf, valueInline)
+			buf = binary.AppendUvarint(buf, uint64(len(v.value)))
+			buf = append(buf, v.value...)
+		}
+	}
+}
+
+// decodeNode decodes a branch or leaf page that passed checkPage.
+func decodeNode(page []byte, id pgid) (*node, error) {
+	n := &node{leaf: pageType(page) == pageLeaf}
+	count := pageCount(page)
+	buf := page[pageHeaderSize:]
+	bad := func() (*node, error) { return nil, fmt.Errorf("%w: bad entry in page %d", ErrCorrupt, id) }
+
+	readBytes := func() (string, bool) {
+		size, m := binary.Uvarint(buf)
+		if m <= 0 || uint64(len(buf)-m) < size {
+			return "", false
+		}
+		s := string(buf[m : m+int(size)])
+		buf = buf[m+int(size):]
+		return s, true
+	}
+	for range count {
+		key, ok := readBytes()
+		if !ok || len(buf) < 8 {
+			return bad()
+		}
+		n.keys = append(n.keys, key)
+		if !n.leaf {
+			n.children = append(n.children, pgid(binary.BigEndian.Uint64(buf)))
+			buf = buf[8:]
+			continue
+		}
+
+		v := leafValue{version: binary.BigEndian.Uint64(buf)}
+		buf = buf[8:]
+		if len(buf) < 1 {
+			return bad()
+		}
+		flag := buf[0]
+		buf = buf[1:]
+		switch flag {
+		case valueInline:
+			if v.value, ok = readBytes(); !ok {
+				return bad()
+			}
+		case valueOverflow:
+			if len(buf) < 8 {
+				return bad()
+			}
+			v.overflow = pgid(binary.BigEndian.Uint64(buf))
+			size, m := binary.Uvarint(buf[8:])
+			if m <= 0 {
+				return bad()
+			}
+			v.size = int(size)
+			buf = buf[8+m:]
+		default:
+			return bad()
+		}
+		n.values = append(n.values, v)
+	}
+	return n, nil
+}
+
+// meta describes a committed state of the database. The two meta pages are written
+// in turns, so that one always holds a complete commit; the valid one with the
+// highest txid is current.
+type meta struct {
+	pageSize    int
+	root        pgid
+	freelist    pgid   // First page of the freelist
+	pageCount   pgid   // Pages in use or free; pages past it are unused
+	txid        uint64 // Number of the commit
+	lastVersion uint64 // Version of the latest write
+	keys        uint64
+}
+
+const (
+	metaMagic   uint64 = 0x7a617062747265 // "zapbtre"
+	metaVersion uint32 = 1
+)
+
+func (m meta) encode(page []byte) {
+	setHeader(page, pageMeta, 0, 0)
+	buf := page[pageHeaderSize:pageHeaderSize]
+	buf = binary.BigEndian.AppendUint64(buf, metaMagic)
+	buf = binary.BigEndian.AppendUint32(buf, metaVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(m.pageSize))
+	for _, v := range []uint64{uint64(m.root), uint64(m.freelist), uint64(m.pageCount), m.txid, m.lastVersion, m.keys} {
+		buf = binary.BigEndian.AppendUint64(buf, v)
+	}
+	sealPage(page)
+}
+
+// metaSize is the number of bytes of a meta page the fields and CRC take.
+const metaSize = pageHeaderSize + 16 + 6*8
+
+// decodeMeta decodes a meta page. It checks the CRC over the whole page, whose size
+// it takes from the page itself.
+func decodeMeta(page []byte, id pgid) (meta, error) {
+	if len(page) < metaSize {
+		return meta{}, fmt.Errorf("%w: meta page %d cut short", ErrCorrupt, id)
+	}
+	buf := page[pageHeaderSize:]
+	if binary.BigEndian.Uint64(buf) != metaMagic {
+		return meta{}, fmt.Errorf("%w: page %d is not a meta page", ErrCorrupt, id)
+	}
+	if v := binary.BigEndian.Uint32(buf[8:]); v != metaVersion {
+		return meta{}, fmt.Errorf("%w: unsupported format version %d", ErrCorrupt, v)
+	}
+	m := meta{pageSize: int(binary.BigEndian.Uint32(buf[12:]))}
+	if m.pageSize < minPageSize || m.pageSize > maxPageSize || len(page) < m.pageSize {
+		return meta{}, fmt.Errorf("%w: meta page %d has page size %d", ErrCorrupt, id, m.pageSize)
+	}
+	if err := checkPage(page[:m.pageSize], id, pageMeta); err != nil {
+		return meta{}, err
+	}
+	field := func(i int) uint64 { return binary.BigEndian.Uint64(buf[16+8*i:]) }
+	m.root, m.freelist, m.pageCount = pgid(field(0)), pgid(field(1)), pgid(field(2))
+	m.txid, m.lastVersion, m.keys = field(3), field(4), field(5)
+	return m, nil
+}
+
+// freelistPerPage is the number of page ids a freelist page holds.
+func freelistPerPage(pageSize int) int {
+	return (pageSize - pageHeaderSize) / 8
+}
+
+func putPgid(buf []byte, id pgid) {
+	binary.BigEndian.PutUint64(buf, uint64(id))
+}
+
+// decodeFreelist returns the page ids of a freelist page that passed checkPage.
+func decodeFreelist(page []byte) []pgid {
+	ids := make([]pgid, pageCount(page))
+	for i := range ids {
+		ids[i] = pgid(binary.BigEndian.Uint64(page[pageHeaderSize+8*i:]))
+	}
+	return ids
+}
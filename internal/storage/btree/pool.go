@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bufferPool keeps the most recently used decoded pages in memory. Pages are never
+// changed in place, so a cached node stays valid until its page is freed, when the
+// writer evicts it. It is safe for concurrent use.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // Of *poolEntry, most recently used first
+	items    map[pgid]*list.Element
+}
+
+type poolEntry struct {
+	id pgid
+	n  *node
+}
+
+func newBufferPool(capacity int) *bufferPool {
+	return &bufferPool{capacity: capacity, lru: list.New(), items: make(map[pgid]*list.Element)}
+}
+
+func (p *bufferPool) get(id pgid) (*node, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.items[id]
+	if !ok {
+		return nil, false
+	}
+	p.lru.MoveToFront(elem)
+	return elem.Value.(*poolEntry).n, true
+}
+
+// put caches n as the node of page id, evicting the least recently used page if the
+// pool is full.
+func (p *bufferPool) put(id pgid, n *node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.items[id]; ok {
+		elem.Value.(*poolEntry).n = n
+		p.lru.MoveToFront(elem)
+		return
+	}
+	p.items[id] = p.lru.PushFront(&poolEntry{id: id, n: n})
+	if p.lru.Len() > p.capacity {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.items, oldest.Value.(*poolEntry).id)
+	}
+}
+
+func (p *bufferPool) evict(id pgid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.items[id]; ok {
+		p.lru.Remove(elem)
+		delete(p.items, id)
+	}
+}
+
+// len returns the number of cached pages.
+func (p *bufferPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
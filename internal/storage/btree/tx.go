@@ -0,0 +1,364 @@
+package btree
+
+import (
+	"fmt"
+	"slices"
+)
+
+// tx is a write transaction. It never changes a page of the committed tree: every node
+// it changes is copied to a free page first (copy-on-write), up to a new root. Commit
+// writes those pages, then a meta page pointing at the new root, so a crash at any
+// point leaves the previous commit intact. Pages the transaction stops using become
+// free once it has committed, as readers of the previous tree may still need them.
+type tx struct {
+	e        *BTreeStorageEngine
+	meta     meta
+	dirty    map[pgid]*node  // Nodes changed by the transaction, by their new page
+	overflow map[pgid][]byte // Overflow pages written by the transaction
+	free     []pgid          // Pages free before the transaction, highest first
+	pending  []pgid          // Pages of the committed tree the transaction no longer uses
+	fresh    map[pgid]bool   // Pages allocated by the transaction
+}
+
+// begin starts a write transaction. Called when holding writeMu.
+func (e *BTreeStorageEngine) begin() *tx {
+	return &tx{
+		e:        e,
+		meta:     e.meta,
+		dirty:    make(map[pgid]*node),
+		overflow: make(map[pgid][]byte),
+		free:     slices.Clone(e.free),
+		fresh:    make(map[pgid]bool),
+	}
+}
+
+// alloc returns a page for the transaction to write: the lowest free page, else a new
+// one at the end of the file.
+func (tx *tx) alloc() pgid {
+	var id pgid
+	if n := len(tx.free); n > 0 {
+		id, tx.free = tx.free[n-1], tx.free[:n-1]
+	} else {
+		id = tx.meta.pageCount
+		tx.meta.pageCount++
+	}
+	tx.fresh[id] = true
+	return id
+}
+
+// release frees page id. A page allocated by the transaction can be reused right away.
+func (tx *tx) release(id pgid) {
+	if !tx.fresh[id] {
+		tx.pending = append(tx.pending, id)
+		return
+	}
+	delete(tx.fresh, id)
+	delete(tx.dirty, id)
+	delete(tx.overflow, id)
+	tx.free = append(tx.free, id)
+}
+
+// node returns the node of page id as the transaction sees it. It must not be changed.
+func (tx *tx) node(id pgid) (*node, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return n, nil
+	}
+	return tx.e.readNode(id)
+}
+
+// writable returns a node of page id that the transaction may change, and the page it
+// now lives in, which the caller must store in place of id.
+func (tx *tx) writable(id pgid) (*node, pgid, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return n, id, nil
+	}
+	n, err := tx.e.readNode(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	c := n.clone()
+	tx.release(id)
+	newID := tx.alloc()
+	tx.dirty[newID] = c
+	return c, newID, nil
+}
+
+// get returns the value of key as the transaction sees it.
+func (tx *tx) get(key string) (leafValue, bool, error) {
+	return lookup(tx.meta.root, tx.node, key)
+}
+
+// step is a node on the path from the root to a leaf, with its index in its parent.
+type step struct {
+	n     *node
+	index int
+}
+
+// path makes the nodes from the root to the leaf that holds, or would hold, key
+// writable and returns them.
+func (tx *tx) path(key string) ([]step, error) {
+	n, id, err := tx.writable(tx.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	tx.meta.root = id
+	path := []step{{n: n}}
+	for !n.leaf {
+		// The first key of a branch is a lower bound of its keys, kept so that every
+		// branch stays sorted when its leftmost child splits
+		if key < n.keys[0] {
+			n.keys[0] = key
+		}
+		i := n.childIndex(key)
+		child, childID, err := tx.writable(n.children[i])
+		if err != nil {
+			return nil, err
+		}
+		n.children[i] = childID
+		path = append(path, step{n: child, index: i})
+		n = child
+	}
+	return path, nil
+}
+
+// put stores value under key with the given version.
+func (tx *tx) put(key, value string, version uint64) error {
+	path, err := tx.path(key)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1].n
+	v := tx.newValue(key, value, version)
+	i, found := leaf.search(key)
+	if found {
+		if err := tx.releaseValue(leaf.values[i]); err != nil {
+			return err
+		}
+		leaf.values[i] = v
+	} else {
+		leaf.insertValue(i, key, v)
+		tx.meta.keys++
+	}
+	tx.meta.lastVersion = max(tx.meta.lastVersion, version)
+	return tx.rebalance(path)
+}
+
+// delete removes key, which must exist.
+func (tx *tx) delete(key string, version uint64) error {
+	path, err := tx.path(key)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1].n
+	i, found := leaf.search(key)
+	if !found {
+		return fmt.Errorf("%w: key '%s' is missing from its leaf", ErrCorrupt, key)
+	}
+	if err := tx.releaseValue(leaf.values[i]); err != nil {
+		return err
+	}
+	leaf.removeAt(i)
+	tx.meta.keys--
+	tx.meta.lastVersion = max(tx.meta.lastVersion, version)
+	return tx.rebalance(path)
+}
+
+// rebalance restores the shape of the tree after the leaf of path changed, from the
+// leaf up: a node under a quarter full is merged with a sibling, a node too big for a
+// page is split, and the root grows or shrinks by a level as needed.
+func (tx *tx) rebalance(path []step) error {
+	pageSize := tx.meta.pageSize
+	for d := len(path) - 1; d > 0; d-- {
+		n, i := path[d].n, path[d].index
+		parent := path[d-1].n
+
+		if n.size() < pageSize/4 && len(parent.children) > 1 {
+			left, right := i, i+1
+			if right == len(parent.children) {
+				left, right = i-1, i
+			}
+			ln, leftID, err := tx.writable(parent.children[left])
+			if err != nil {
+				return err
+			}
+			parent.children[left] = leftID
+			rn, err := tx.node(parent.children[right])
+			if err != nil {
+				return err
+			}
+			ln.absorb(rn)
+			tx.release(parent.children[right])
+			parent.removeAt(right)
+			n, i = ln, left
+		}
+
+		if n.size() > pageSize {
+			for k, part := range n.split(pageSize)[1:] {
+				id := tx.alloc()
+				tx.dirty[id] = part
+				parent.insertChild(i+1+k, part.keys[0], id)
+			}
+		}
+	}
+
+	root := path[0].n
+	for root.size() > pageSize {
+		parts := root.split(pageSize)
+		newRoot := &node{}
+		for k, part := range parts {
+			id := tx.meta.root
+			if k > 0 {
+				id = tx.alloc()
+				tx.dirty[id] = part
+			}
+			newRoot.insertChild(k, part.keys[0], id)
+		}
+		tx.meta.root = tx.alloc()
+		tx.dirty[tx.meta.root] = newRoot
+		root = newRoot
+	}
+	for !root.leaf && len(root.children) == 1 {
+		child := root.children[0]
+		tx.release(tx.meta.root)
+		tx.meta.root = child
+		var err error
+		if root, err = tx.node(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newValue returns the leaf value for value, moving it to a chain of overflow pages if
+// the entry would take more than its share of a page.
+func (tx *tx) newValue(key, value string, version uint64) leafValue {
+	v := leafValue{value: value, version: version}
+	pageSize := tx.meta.pageSize
+	if leafEntrySize(key, v) <= maxEntrySize(pageSize) {
+		return v
+	}
+
+	chunk := pageSize - pageHeaderSize
+	ids := make([]pgid, (len(value)+chunk-1)/chunk)
+	for i := range ids {
+		ids[i] = tx.alloc()
+	}
+	for i, id := range ids {
+		var next pgid
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+		page := make([]byte, pageSize)
+		setHeader(page, pageOverflow, 0, next)
+		copy(page[pageHeaderSize:], value[i*chunk:])
+		tx.overflow[id] = page
+	}
+	return leafValue{version: version, overflow: ids[0], size: len(value)}
+}
+
+// releaseValue frees the overflow pages of v, if it has any.
+func (tx *tx) releaseValue(v leafValue) error {
+	for id := v.overflow; id != 0; {
+		page, ok := tx.overflow[id]
+		if !ok {
+			var err error
+			if page, err = tx.e.readPage(id, pageOverflow); err != nil {
+				return err
+			}
+		}
+		next := pageNext(page)
+		tx.release(id)
+		id = next
+	}
+	return nil
+}
+
+// changed reports whether the transaction has anything to commit.
+func (tx *tx) changed() bool {
+	return len(tx.fresh) > 0 || len(tx.pending) > 0
+}
+
+// commit writes the pages of the transaction, syncs them, then writes and syncs the
+// meta page that makes them current. The engine only sees the new tree once the meta
+// page is written, under its lock. Called when holding writeMu.
+func (tx *tx) commit() error {
+	e := tx.e
+	if !tx.changed() {
+		return nil
+	}
+	pageSize := tx.meta.pageSize
+
+	// The freelist is rewritten as a whole on new pages, which must not come from the
+	// pages freed by this transaction.
+	for _, id := range e.freelistPages {
+		tx.release(id)
+	}
+	var listPages []pgid
+	for {
+		count := len(tx.free) + len(tx.pending)
+		if need := max((count+freelistPerPage(pageSize)-1)/freelistPerPage(pageSize), 1); len(listPages) >= need {
+			break
+		}
+		listPages = append(listPages, tx.alloc())
+	}
+	free := append(slices.Clone(tx.free), tx.pending...)
+	slices.Sort(free)
+	for i, id := range listPages {
+		var next pgid
+		if i+1 < len(listPages) {
+			next = listPages[i+1]
+		}
+		start := min(i*freelistPerPage(pageSize), len(free))
+		ids := free[start:min(start+freelistPerPage(pageSize), len(free))]
+		page := make([]byte, pageSize)
+		setHeader(page, pageFreelist, len(ids), next)
+		for j, freeID := range ids {
+			putPgid(page[pageHeaderSize+8*j:], freeID)
+		}
+		tx.overflow[id] = page
+	}
+	tx.meta.freelist = listPages[0]
+
+	page := make([]byte, pageSize)
+	for id, n := range tx.dirty {
+		clear(page)
+		n.encode(page)
+		if err := e.writePage(id, page); err != nil {
+			return err
+		}
+	}
+	for id, data := range tx.overflow {
+		if err := e.writePage(id, data); err != nil {
+			return err
+		}
+	}
+	if err := e.syncFile(); err != nil {
+		return err
+	}
+
+	tx.meta.txid++
+	clear(page)
+	tx.meta.encode(page)
+	if err := e.writePage(pgid(tx.meta.txid%2), page); err != nil {
+		return err
+	}
+	if err := e.syncFile(); err != nil {
+		return err
+	}
+
+	// Readers of the previous tree finish before the lock is granted, so pages it no
+	// longer shares with the new one can be reused by the next transaction.
+	slices.Reverse(free)
+	e.mu.Lock()
+	e.meta = tx.meta
+	e.free = free
+	e.freelistPages = listPages
+	e.mu.Unlock()
+	for _, id := range tx.pending {
+		e.pool.evict(id)
+	}
+	for id, n := range tx.dirty {
+		e.pool.put(id, n)
+	}
+	return nil
+}
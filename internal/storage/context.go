@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// ContextEngine is implemented by engines whose operations can be given up: they
+// return ctx.Err() if ctx ends while they wait for a lock or for I/O. A write that has
+// started writing is completed anyway, so that it is never left half done.
+type ContextEngine interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	SetContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// ContextVersioned is Versioned for engines that take a context, see ContextEngine.
+type ContextVersioned interface {
+	GetVersionedContext(ctx context.Context, key string) (value string, version uint64, err error)
+	SetIfContext(ctx context.Context, key, value string, pre Precondition) (version uint64, err error)
+	DeleteIfContext(ctx context.Context, key string, pre Precondition) error
+}
+
+// ContextBatcher is Batcher for engines that take a context, see ContextEngine.
+type ContextBatcher interface {
+	MGetContext(ctx context.Context, keys []string) ([]Result, error)
+	MSetContext(ctx context.Context, pairs []KeyValue) error
+}
+
+// TryLocker is a lock that can also be taken without waiting, like sync.Mutex.
+type TryLocker interface {
+	sync.Locker
+	TryLock() bool
+}
+
+// Lock takes l, or returns ctx.Err() if ctx ends first. A waiter that gives up keeps
+// its place in the queue of l, in a goroutine that releases l as soon as it gets it,
+// so giving up never lets waiters behind it jump ahead of a writer.
+func Lock(ctx context.Context, l TryLocker) error {
+	done := ctx.Done()
+	if done == nil {
+		l.Lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.TryLock() {
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		l.Lock()
+		select {
+		case acquired <- struct{}{}:
+		case <-abandoned:
+			l.Unlock()
+		}
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-done:
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+// RLock takes a read lock of mu, or returns ctx.Err() if ctx ends first, see Lock.
+func RLock(ctx context.Context, mu *sync.RWMutex) error {
+	return Lock(ctx, readLocker{mu})
+}
+
+// readLocker is the read side of a sync.RWMutex as a TryLocker.
+type readLocker struct {
+	mu *sync.RWMutex
+}
+
+func (r readLocker) Lock()         { r.mu.RLock() }
+func (r readLocker) Unlock()       { r.mu.RUnlock() }
+func (r readLocker) TryLock() bool { return r.mu.TryRLock() }
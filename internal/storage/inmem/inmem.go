@@ -1,43 +1,237 @@
 package inmem
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"zap-store/internal/storage"
 )
 
+// entry is a stored value and the version it was written at.
+type entry struct {
+	value   string
+	version uint64
+}
+
 type InMemStorageEngine struct {
-	hashMap map[string]string
-	lock    sync.Mutex
+	hashMap     map[string]entry
+	lock        sync.Mutex
+	lastVersion uint64 // Version of the latest write, guarded by lock
 }
 
 func (kvs *InMemStorageEngine) Set(key string, value string) error {
+	return kvs.SetContext(context.Background(), key, value)
+}
+
+func (kvs *InMemStorageEngine) Get(key string) (string, error) {
+	return kvs.GetContext(context.Background(), key)
+}
+
+func (kvs *InMemStorageEngine) Delete(key string) error {
+	return kvs.DeleteContext(context.Background(), key)
+}
+
+// SetContext is Set, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) SetContext(ctx context.Context, key string, value string) error {
+	_, err := kvs.SetIfContext(ctx, key, value, nil)
+	return err
+}
+
+// GetContext is Get, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := kvs.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// DeleteContext is Delete, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) DeleteContext(ctx context.Context, key string) error {
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return err
+	}
+	defer kvs.lock.Unlock()
+
+	delete(kvs.hashMap, key)
+	return nil
+}
+
+// GetVersioned returns the value of key together with its version.
+func (kvs *InMemStorageEngine) GetVersioned(key string) (string, uint64, error) {
+	return kvs.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext is GetVersioned, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return "", 0, err
+	}
+	defer kvs.lock.Unlock()
+
+	e, ok := kvs.hashMap[key]
+	if !ok {
+		return "", 0, storage.ErrNotFound
+	}
+	return e.value, e.version, nil
+}
+
+// SetIf stores value under key if pre holds and returns the new version.
+func (kvs *InMemStorageEngine) SetIf(key string, value string, pre storage.Precondition) (uint64, error) {
+	return kvs.SetIfContext(context.Background(), key, value, pre)
+}
+
+// SetIfContext is SetIf, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) SetIfContext(ctx context.Context, key string, value string, pre storage.Precondition) (uint64, error) {
 	if key == "" {
-		return fmt.Errorf("key cannot be empty")
+		return 0, storage.ErrEmptyKey
 	}
 
-	kvs.lock.Lock()
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return 0, err
+	}
+	defer kvs.lock.Unlock()
+
+	if pre != nil {
+		old, exists := kvs.hashMap[key]
+		if err := pre(old.version, exists); err != nil {
+			return 0, err
+		}
+	}
+
+	kvs.lastVersion++
+	kvs.hashMap[key] = entry{value: value, version: kvs.lastVersion}
+	return kvs.lastVersion, nil
+}
+
+// DeleteIf removes key if pre holds.
+func (kvs *InMemStorageEngine) DeleteIf(key string, pre storage.Precondition) error {
+	return kvs.DeleteIfContext(context.Background(), key, pre)
+}
+
+// DeleteIfContext is DeleteIf, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) DeleteIfContext(ctx context.Context, key string, pre storage.Precondition) error {
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return err
+	}
 	defer kvs.lock.Unlock()
 
-	kvs.hashMap[key] = value
+	old, exists := kvs.hashMap[key]
+	if pre != nil {
+		if err := pre(old.version, exists); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+	delete(kvs.hashMap, key)
 	return nil
 }
 
-func (kvs *InMemStorageEngine) Get(key string) (string, error) {
+// MGet looks up every key while holding the lock once.
+func (kvs *InMemStorageEngine) MGet(keys []string) ([]storage.Result, error) {
+	return kvs.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) MGetContext(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return nil, err
+	}
+	defer kvs.lock.Unlock()
+
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		if e, ok := kvs.hashMap[key]; ok {
+			results[i] = storage.Result{Value: e.value, Found: true}
+		}
+	}
+	return results, nil
+}
+
+// MSet stores every pair while holding the lock once. Nothing is written if a key is empty.
+func (kvs *InMemStorageEngine) MSet(pairs []storage.KeyValue) error {
+	return kvs.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, giving up if ctx ends while waiting for the lock.
+func (kvs *InMemStorageEngine) MSetContext(ctx context.Context, pairs []storage.KeyValue) error {
+	for _, pair := range pairs {
+		if pair.Key == "" {
+			return storage.ErrEmptyKey
+		}
+	}
+
+	if err := storage.Lock(ctx, &kvs.lock); err != nil {
+		return err
+	}
+	defer kvs.lock.Unlock()
+
+	for _, pair := range pairs {
+		kvs.lastVersion++
+		kvs.hashMap[pair.Key] = entry{value: pair.Value, version: kvs.lastVersion}
+	}
+	return nil
+}
+
+// Apply writes changes read from another engine's log while holding the lock once,
+// keeping their versions.
+func (kvs *InMemStorageEngine) Apply(changes []storage.Change) ([]bool, error) {
 	kvs.lock.Lock()
 	defer kvs.lock.Unlock()
 
-	if _, ok := kvs.hashMap[key]; !ok {
-		return "", fmt.Errorf("key not found")
+	applied := make([]bool, len(changes))
+	for i, change := range changes {
+		old, exists := kvs.hashMap[change.Key]
+		if exists && old.version >= change.Version {
+			continue
+		}
+		switch change.Type {
+		case storage.ChangeSet:
+			kvs.hashMap[change.Key] = entry{value: change.Value, version: change.Version}
+		case storage.ChangeDelete:
+			if !exists {
+				continue
+			}
+			delete(kvs.hashMap, change.Key)
+		default:
+			return applied, fmt.Errorf("unknown change type %q for key '%s'", change.Type, change.Key)
+		}
+		kvs.lastVersion = max(kvs.lastVersion, change.Version)
+		applied[i] = true
 	}
-	return kvs.hashMap[key], nil
+	return applied, nil
 }
 
-func (kvs *InMemStorageEngine) Delete(key string) error {
+// Keys returns the keys starting with prefix, sorted.
+func (kvs *InMemStorageEngine) Keys(prefix string) ([]string, error) {
 	kvs.lock.Lock()
 	defer kvs.lock.Unlock()
 
-	delete(kvs.hashMap, key)
-	return nil
+	keys := make([]string, 0, len(kvs.hashMap))
+	for key := range kvs.hashMap {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stats reports the number of keys and the bytes held by keys and values.
+func (kvs *InMemStorageEngine) Stats() storage.Stats {
+	kvs.lock.Lock()
+	defer kvs.lock.Unlock()
+
+	var size int64
+	for key, e := range kvs.hashMap {
+		size += int64(len(key) + len(e.value))
+	}
+	return storage.Stats{
+		Engine:      "inmem",
+		Keys:        len(kvs.hashMap),
+		KeyDirBytes: size,
+	}
 }
 
 func (kvs *InMemStorageEngine) Close() error {
@@ -46,6 +240,6 @@ func (kvs *InMemStorageEngine) Close() error {
 
 func NewInMemStorageEngine() *InMemStorageEngine {
 	return &InMemStorageEngine{
-		hashMap: make(map[string]string),
+		hashMap: make(map[string]entry),
 	}
 }
@@ -1,6 +1,14 @@
 package inmem
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/storagetest"
+)
 
 func TestInMemStorageEngineSet(t *testing.T) {
 	tests := []struct {
@@ -115,3 +123,65 @@ func TestInMemStorageEngineDel(t *testing.T) {
 		}
 	}
 }
+
+func TestInMemStorageEngineApply(t *testing.T) {
+	engine := NewInMemStorageEngine()
+	changes := []storage.Change{
+		{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 100},
+		{Type: storage.ChangeSet, Key: "a", Value: "stale", Version: 50},
+		{Type: storage.ChangeDelete, Key: "missing", Version: 101},
+		{Type: storage.ChangeSet, Key: "b", Value: "2", Version: 102},
+		{Type: storage.ChangeDelete, Key: "b", Version: 103},
+	}
+	applied, err := engine.Apply(changes)
+	if err != nil || fmt.Sprint(applied) != "[true false false true true]" {
+		t.Errorf("Apply() = %v, %v, want [true false false true true], nil", applied, err)
+	}
+	if value, version, err := engine.GetVersioned("a"); value != "1" || version != 100 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, 100, nil", "a", value, version, err, "1")
+	}
+	if _, err := engine.Get("b"); err == nil {
+		t.Errorf("Get(%q) after applied delete succeeded, want error", "b")
+	}
+
+	// Local writes carry on after the applied versions
+	if version, _ := engine.SetIf("c", "3", nil); version <= 103 {
+		t.Errorf("SetIf() after Apply() = version %d, want more than 103", version)
+	}
+}
+
+func TestInMemStorageEngineContext(t *testing.T) {
+	engine := NewInMemStorageEngine()
+	engine.Set("foo", "bar")
+
+	// Hold the lock as a long write would
+	engine.lock.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := engine.GetContext(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := engine.SetContext(ctx, "foo", "baz"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := engine.MGetContext(ctx, []string{"foo"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MGetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	engine.lock.Unlock()
+
+	// The waiters that gave up must not keep the lock or have written anything
+	if got, err := engine.GetContext(context.Background(), "foo"); err != nil || got != "bar" {
+		t.Errorf("GetContext(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := engine.DeleteContext(cancelled, "foo"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteContext with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestInMemStorageEngineConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Engine{
+		Open: func(t *testing.T, dir string) storage.StorageEngine { return NewInMemStorageEngine() },
+	})
+}
@@ -0,0 +1,57 @@
+package lsm
+
+import "hash/fnv"
+
+// bloomFilter tells whether a table may hold a key, so that reads of keys it does not
+// hold skip it without reading a block. It is encoded as its bits followed by one byte
+// with the number of probes.
+type bloomFilter []byte
+
+// bloomHash returns the hash of key the probes are derived from.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// probeHashes splits a key hash into the two hashes probe i combines as h1 + i*h2.
+func probeHashes(hash uint64) (uint32, uint32) {
+	return uint32(hash), uint32(hash>>32) | 1
+}
+
+// newBloomFilter builds the filter of the keys with the given hashes, with bitsPerKey
+// bits for each. The number of probes is bitsPerKey * ln 2, which gives about 1% false
+// positives at 10 bits.
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	probes := min(max(bitsPerKey*69/100, 1), 30)
+	bits := max(len(hashes)*bitsPerKey, 64)
+	filter := make(bloomFilter, (bits+7)/8+1)
+	bits = (len(filter) - 1) * 8
+	for _, hash := range hashes {
+		h1, h2 := probeHashes(hash)
+		for i := range probes {
+			bit := (h1 + uint32(i)*h2) % uint32(bits)
+			filter[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	filter[len(filter)-1] = byte(probes)
+	return filter
+}
+
+// mayContain reports whether key may have been added to the filter. An empty filter,
+// as written with bloom filters disabled, may contain anything.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	probes := int(f[len(f)-1])
+	bits := uint32(len(f)-1) * 8
+	h1, h2 := probeHashes(bloomHash(key))
+	for i := range probes {
+		bit := (h1 + uint32(i)*h2) % bits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
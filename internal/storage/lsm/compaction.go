@@ -0,0 +1,383 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// retryInterval is how often the background worker looks for work besides being
+// woken, which retries flushes and compactions that failed.
+const retryInterval = time.Second
+
+// run is the background worker: it flushes frozen memtables and compacts the levels
+// until there is nothing left to do, then waits to be woken.
+func (e *LSMStorageEngine) run() {
+	defer close(e.done)
+	retry := time.NewTicker(retryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.work:
+		case <-retry.C:
+		}
+		if err := e.background(); err != nil {
+			if e.bgErr.Swap(&err) == nil {
+				e.opts.Logger.Error("lsm background work failed, retrying", "error", err)
+			}
+			// Wake writers waiting for a flush, so that they give up instead
+			e.mu.Lock()
+			e.broadcastLocked()
+			e.mu.Unlock()
+		} else if e.bgErr.Swap(nil) != nil {
+			e.opts.Logger.Info("lsm background work recovered")
+		}
+	}
+}
+
+// stopping reports whether Close asked the worker to stop.
+func (e *LSMStorageEngine) stopping() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// background flushes frozen memtables, which writers may be waiting for, before
+// compacting, and goes on until neither is needed.
+func (e *LSMStorageEngine) background() error {
+	for !e.stopping() {
+		flushed, err := e.flush()
+		if err != nil {
+			return err
+		}
+		if flushed {
+			continue
+		}
+
+		e.mu.RLock()
+		c := e.pickCompaction()
+		e.mu.RUnlock()
+		if c == nil {
+			return nil
+		}
+		if err := e.compact(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastLocked wakes writers waiting for a flush. Called when holding the write lock.
+func (e *LSMStorageEngine) broadcastLocked() {
+	close(e.flushed)
+	e.flushed = make(chan struct{})
+}
+
+// allocNum returns the number of a new table.
+func (e *LSMStorageEngine) allocNum() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	num := e.nextNum
+	e.nextNum++
+	return num
+}
+
+// flush writes the oldest frozen memtable to a table of level 0 and removes its log.
+// It reports whether there was one.
+func (e *LSMStorageEngine) flush() (bool, error) {
+	e.mu.RLock()
+	if len(e.imm) == 0 {
+		e.mu.RUnlock()
+		return false, nil
+	}
+	m := e.imm[0] // Frozen, so it can be read without the lock
+	e.mu.RUnlock()
+
+	metas, err := e.writeTables(m.iter(""), false, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to flush memtable: %w", err)
+	}
+
+	e.mu.Lock()
+	err = e.installLocked(nil, 0, metas)
+	if err == nil {
+		e.imm = e.imm[1:]
+		e.broadcastLocked()
+	}
+	e.mu.Unlock()
+	if err != nil {
+		removeTables(e.dataDir, metas)
+		return false, fmt.Errorf("failed to flush memtable: %w", err)
+	}
+
+	if err := os.Remove(walPath(e.dataDir, m.walNum)); err != nil {
+		e.opts.Logger.Warn("failed to remove flushed write-ahead log", "error", err)
+	}
+	return true, nil
+}
+
+// writeTables writes the records of it to new tables, starting a new one every
+// TableSize bytes if split is set, and skipping tombstones if dropTombstones is set.
+// The tables are synced but not yet listed in the manifest.
+func (e *LSMStorageEngine) writeTables(it iterator, split, dropTombstones bool) ([]tableMeta, error) {
+	var metas []tableMeta
+	var w *tableWriter
+	fail := func(err error) ([]tableMeta, error) {
+		if w != nil {
+			w.abort()
+		}
+		removeTables(e.dataDir, metas)
+		return nil, err
+	}
+
+	var err error
+	for ; it.valid(); err = it.next() {
+		record := it.entry()
+		if record.deleted && dropTombstones {
+			continue
+		}
+		if w == nil {
+			if w, err = newTableWriter(e.dataDir, e.allocNum(), e.opts.BlockSize, e.opts.BloomBitsPerKey); err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(record); err != nil {
+			return fail(err)
+		}
+		if split && w.size() >= e.opts.TableSize {
+			meta, err := w.finish()
+			if err != nil {
+				return fail(err)
+			}
+			metas, w = append(metas, meta), nil
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if w != nil {
+		meta, err := w.finish()
+		if err != nil {
+			return fail(err)
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// removeTables removes table files that never made it into the manifest.
+func removeTables(dataDir string, metas []tableMeta) {
+	for _, meta := range metas {
+		os.Remove(tablePath(dataDir, meta.Num))
+	}
+}
+
+// installLocked replaces the tables removed with the new tables of metas on level and
+// writes the manifest. The levels are left as they were if that fails. Called when
+// holding the write lock.
+func (e *LSMStorageEngine) installLocked(removed []*table, level int, metas []tableMeta) error {
+	var added []*table
+	for _, meta := range metas {
+		t, err := openTable(e.dataDir, meta)
+		if err != nil {
+			for _, t := range added {
+				t.close()
+			}
+			return err
+		}
+		added = append(added, t)
+	}
+
+	gone := make(map[*table]bool, len(removed))
+	for _, t := range removed {
+		gone[t] = true
+	}
+	old := e.levels
+	e.levels = make([][]*table, maxLevels)
+	m := manifest{Levels: make([][]tableMeta, maxLevels)}
+	for l, tables := range old {
+		for _, t := range tables {
+			if !gone[t] {
+				e.levels[l] = append(e.levels[l], t)
+			}
+		}
+	}
+	e.levels[level] = append(e.levels[level], added...)
+	for l := range e.levels {
+		e.sortLevel(l)
+		for _, t := range e.levels[l] {
+			m.Levels[l] = append(m.Levels[l], t.meta)
+		}
+	}
+	m.NextNum = e.nextNum
+
+	if err := writeManifest(e.dataDir, m); err != nil {
+		e.levels = old
+		for _, t := range added {
+			t.close()
+		}
+		return err
+	}
+	return nil
+}
+
+// sortLevel orders the tables of a level: by key where they do not overlap, so that a
+// read can search for the one table that may hold a key, else newest first.
+func (e *LSMStorageEngine) sortLevel(level int) {
+	tables := e.levels[level]
+	if e.overlapping(level) {
+		sort.Slice(tables, func(i, j int) bool { return tables[i].meta.Num > tables[j].meta.Num })
+	} else {
+		sort.Slice(tables, func(i, j int) bool { return string(tables[i].meta.Smallest) < string(tables[j].meta.Smallest) })
+	}
+}
+
+// compaction is a merge of input tables into new tables on the output level.
+type compaction struct {
+	inputs []*table
+	output int
+	// split starts a new output table every TableSize bytes
+	split bool
+	// dropTombstones is set when no table outside the inputs, on the output level or
+	// below, may hold a key of the inputs, so a tombstone has nothing left to hide.
+	dropTombstones bool
+}
+
+// pickCompaction returns the compaction the levels need most, or nil if none does.
+// Called by the worker when holding the lock.
+func (e *LSMStorageEngine) pickCompaction() *compaction {
+	if e.opts.Compaction == Tiered {
+		// Once a level has TierTrigger tables, merge them all into one on the level below;
+		// the last level merges into itself.
+		for level, tables := range e.levels {
+			if len(tables) >= e.opts.TierTrigger {
+				return e.newCompaction(append([]*table(nil), tables...), min(level+1, maxLevels-1), false)
+			}
+		}
+		return nil
+	}
+
+	// Level 0 tables overlap, so they all move to level 1 at once, merged with the
+	// level 1 tables they overlap.
+	if len(e.levels[0]) >= e.opts.L0Trigger {
+		inputs := append([]*table(nil), e.levels[0]...)
+		smallest, largest := keyRange(inputs)
+		inputs = append(inputs, overlappingTables(e.levels[1], smallest, largest)...)
+		return e.newCompaction(inputs, 1, true)
+	}
+
+	// A level over its size moves one table down, taking turns through its key range,
+	// merged with the tables it overlaps on the next level.
+	maxSize := e.opts.BaseLevelSize
+	for level := 1; level < maxLevels-1; level++ {
+		tables := e.levels[level]
+		if levelSize(tables) > maxSize {
+			t := tables[0]
+			for _, candidate := range tables {
+				if string(candidate.meta.Smallest) > e.compactPointer[level] {
+					t = candidate
+					break
+				}
+			}
+			e.compactPointer[level] = string(t.meta.Largest)
+			inputs := append([]*table{t}, overlappingTables(e.levels[level+1], string(t.meta.Smallest), string(t.meta.Largest))...)
+			return e.newCompaction(inputs, level+1, true)
+		}
+		maxSize *= int64(e.opts.LevelMultiplier)
+	}
+	return nil
+}
+
+func (e *LSMStorageEngine) newCompaction(inputs []*table, output int, split bool) *compaction {
+	c := &compaction{inputs: inputs, output: output, split: split, dropTombstones: true}
+	isInput := make(map[*table]bool, len(inputs))
+	for _, t := range inputs {
+		isInput[t] = true
+	}
+	smallest, largest := keyRange(inputs)
+	for level := output; level < maxLevels; level++ {
+		for _, t := range overlappingTables(e.levels[level], smallest, largest) {
+			if !isInput[t] {
+				c.dropTombstones = false
+			}
+		}
+	}
+	return c
+}
+
+// compact runs c: it merges the inputs without holding the lock, then swaps the new
+// tables in for them and removes them.
+func (e *LSMStorageEngine) compact(c *compaction) error {
+	sources := make([]iterator, 0, len(c.inputs))
+	for _, t := range c.inputs {
+		it, err := t.iter("")
+		if err != nil {
+			return fmt.Errorf("failed to compact: %w", err)
+		}
+		sources = append(sources, it)
+	}
+	it, err := newMergingIterator(sources)
+	if err != nil {
+		return fmt.Errorf("failed to compact: %w", err)
+	}
+	metas, err := e.writeTables(it, c.split, c.dropTombstones)
+	if err != nil {
+		return fmt.Errorf("failed to compact: %w", err)
+	}
+
+	e.mu.Lock()
+	err = e.installLocked(c.inputs, c.output, metas)
+	e.mu.Unlock()
+	if err != nil {
+		removeTables(e.dataDir, metas)
+		return fmt.Errorf("failed to compact: %w", err)
+	}
+
+	// Readers hold the lock while they use tables, so none can still use the inputs
+	for _, t := range c.inputs {
+		if err := t.close(); err != nil {
+			e.opts.Logger.Warn("failed to close compacted table", "file", t.file.Name(), "error", err)
+		}
+		if err := os.Remove(t.file.Name()); err != nil {
+			e.opts.Logger.Warn("failed to remove compacted table", "file", t.file.Name(), "error", err)
+		}
+	}
+	return nil
+}
+
+// keyRange returns the smallest and largest keys of tables.
+func keyRange(tables []*table) (string, string) {
+	smallest, largest := string(tables[0].meta.Smallest), string(tables[0].meta.Largest)
+	for _, t := range tables[1:] {
+		smallest = min(smallest, string(t.meta.Smallest))
+		largest = max(largest, string(t.meta.Largest))
+	}
+	return smallest, largest
+}
+
+// overlappingTables returns the tables that may hold keys between smallest and largest.
+func overlappingTables(tables []*table, smallest, largest string) []*table {
+	var overlapping []*table
+	for _, t := range tables {
+		if t.meta.overlaps(smallest, largest) {
+			overlapping = append(overlapping, t)
+		}
+	}
+	return overlapping
+}
+
+// levelSize returns the bytes taken by tables.
+func levelSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.meta.Size
+	}
+	return size
+}
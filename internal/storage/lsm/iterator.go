@@ -0,0 +1,75 @@
+package lsm
+
+import "container/heap"
+
+// iterator walks records in key order, one per key.
+type iterator interface {
+	valid() bool
+	entry() entry
+	next() error
+}
+
+// mergingIterator merges iterators into one that returns, for every key, the record
+// with the highest version among them. Tombstones are returned too; it is up to the
+// caller to skip them or keep them.
+type mergingIterator struct {
+	sources iteratorHeap
+	cur     entry
+	ok      bool
+}
+
+func newMergingIterator(sources []iterator) (*mergingIterator, error) {
+	m := &mergingIterator{}
+	for _, it := range sources {
+		if it.valid() {
+			m.sources = append(m.sources, it)
+		}
+	}
+	heap.Init(&m.sources)
+	return m, m.next()
+}
+
+func (m *mergingIterator) valid() bool  { return m.ok }
+func (m *mergingIterator) entry() entry { return m.cur }
+
+func (m *mergingIterator) next() error {
+	if len(m.sources) == 0 {
+		m.ok = false
+		return nil
+	}
+	// The heap orders equal keys newest first, so the top is the record to return and
+	// the other sources only need to move past the key.
+	m.cur, m.ok = m.sources[0].entry(), true
+	for len(m.sources) > 0 && m.sources[0].entry().key == m.cur.key {
+		it := m.sources[0]
+		if err := it.next(); err != nil {
+			return err
+		}
+		if it.valid() {
+			heap.Fix(&m.sources, 0)
+		} else {
+			heap.Pop(&m.sources)
+		}
+	}
+	return nil
+}
+
+// iteratorHeap orders iterators by the key of their record, then newest first.
+type iteratorHeap []iterator
+
+func (h iteratorHeap) Len() int { return len(h) }
+func (h iteratorHeap) Less(i, j int) bool {
+	a, b := h[i].entry(), h[j].entry()
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.version > b.version
+}
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *iteratorHeap) Push(x any)   { *h = append(*h, x.(iterator)) }
+func (h *iteratorHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,705 @@
+// Package lsm implements a storage engine based on a log-structured merge tree.
+//
+// Writes go to a write-ahead log and to a memtable, a skiplist sorted by key. Once the
+// memtable reaches MemtableSize it is frozen and a background worker flushes it to an
+// immutable table (SSTable) on level 0, then merges tables down the levels, keeping
+// only the newest record of every key, as the compaction style decides. A manifest
+// records which tables make up every level. Reads look at the memtables first, then
+// at the levels from the top; every table has a block index and a bloom filter, so a
+// read takes at most one block per table that may hold the key.
+//
+// Unlike bitcask, keys do not have to fit in memory, and they are kept in order.
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"zap-store/internal/storage"
+
+	"github.com/gofrs/flock"
+)
+
+// Lock file name
+const lockFileName = "lsm.lock"
+
+var (
+	// ErrLocked is returned when opening a data directory another process has open.
+	ErrLocked = errors.New("data directory is locked by another process")
+	// ErrEngineClosed is returned by operations on an engine that has been closed.
+	ErrEngineClosed = errors.New("lsm engine is closed")
+)
+
+type LSMStorageEngine struct {
+	dataDir string
+	opts    Options
+	fLock   *flock.Flock
+
+	mu          sync.RWMutex
+	mem         *memtable     // Takes the writes, guarded by mu
+	imm         []*memtable   // Frozen memtables waiting to be flushed, oldest first, guarded by mu
+	wal         *wal          // Log of mem, guarded by mu
+	levels      [][]*table    // Tables of every level, guarded by mu; see sortLevel
+	nextNum     int64         // Number of the next table or log file, guarded by mu
+	lastVersion uint64        // Version of the latest write, guarded by mu
+	flushed     chan struct{} // Closed and replaced after every flush, guarded by mu
+	closed      bool          // Guarded by mu
+
+	work    chan struct{}         // Wakes the background worker
+	stop    chan struct{}         // Closed by Close to stop the worker
+	done    chan struct{}         // Closed when the worker has stopped
+	bgErr   atomic.Pointer[error] // Why the last flush or compaction failed, nil once one succeeds
+	failure atomic.Pointer[error] // Set once a failed write stopped the engine taking writes
+
+	compactPointer [maxLevels]string // Largest key of the table leveled compaction moved last, per level; worker only
+}
+
+// NewLSMStorageEngine opens, or creates, an engine in dataDir. The records of the
+// write-ahead logs left by the last run are flushed to a table before it returns.
+func NewLSMStorageEngine(dataDir string, options ...Option) (*LSMStorageEngine, error) {
+	opts := defaultOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid lsm options: %w", err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %s: %w", dataDir, err)
+	}
+	lockPath := filepath.Join(dataDir, lockFileName)
+	fLock := flock.New(lockPath)
+	locked, err := fLock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check or acquire file lock %s: %w", lockPath, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: %s (lock file: %s)", ErrLocked, dataDir, lockPath)
+	}
+
+	engine := &LSMStorageEngine{
+		dataDir: dataDir,
+		opts:    opts,
+		fLock:   fLock,
+		levels:  make([][]*table, maxLevels),
+		flushed: make(chan struct{}),
+		work:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := engine.recover(); err != nil {
+		engine.closeTables()
+		fLock.Unlock()
+		return nil, err
+	}
+
+	go engine.run()
+	engine.wake() // The levels may be due for a compaction
+	return engine, nil
+}
+
+// recover opens the tables of the manifest, flushes the records of the write-ahead
+// logs to a new table and starts a fresh log. Files that the manifest does not list
+// are left overs of an interrupted flush or compaction and are removed.
+func (e *LSMStorageEngine) recover() error {
+	m, err := readManifest(e.dataDir)
+	if err != nil {
+		return err
+	}
+	e.nextNum = max(m.NextNum, 1)
+	listed := make(map[int64]bool)
+	for level, metas := range m.Levels {
+		if level >= maxLevels {
+			return fmt.Errorf("manifest of %s has %d levels, at most %d are supported", e.dataDir, len(m.Levels), maxLevels)
+		}
+		for _, meta := range metas {
+			t, err := openTable(e.dataDir, meta)
+			if err != nil {
+				return err
+			}
+			e.levels[level] = append(e.levels[level], t)
+			e.lastVersion = max(e.lastVersion, meta.MaxVersion)
+			listed[meta.Num] = true
+		}
+		e.sortLevel(level)
+	}
+
+	tables, wals, err := listFiles(e.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, num := range tables {
+		e.nextNum = max(e.nextNum, num+1)
+		if !listed[num] {
+			e.opts.Logger.Warn("removing table left over by an interrupted flush or compaction", "file", tablePath(e.dataDir, num))
+			if err := os.Remove(tablePath(e.dataDir, num)); err != nil {
+				return fmt.Errorf("failed to remove left over table: %w", err)
+			}
+		}
+	}
+
+	// Replay the logs, oldest first, into a single memtable and flush it
+	mem := newMemtable(0)
+	for _, num := range wals {
+		e.nextNum = max(e.nextNum, num+1)
+		err := replayWAL(walPath(e.dataDir, num), func(record entry) {
+			mem.put(record)
+			e.lastVersion = max(e.lastVersion, record.version)
+		})
+		if err != nil {
+			e.opts.Logger.Warn("error reading write-ahead log, skipping the rest of it", "file", walPath(e.dataDir, num), "error", err)
+		}
+	}
+	if mem.count > 0 {
+		metas, err := e.writeTables(mem.iter(""), false, false)
+		if err != nil {
+			return fmt.Errorf("failed to flush write-ahead logs: %w", err)
+		}
+		if err := e.installLocked(nil, 0, metas); err != nil {
+			removeTables(e.dataDir, metas)
+			return fmt.Errorf("failed to flush write-ahead logs: %w", err)
+		}
+	}
+	for _, num := range wals {
+		if err := os.Remove(walPath(e.dataDir, num)); err != nil {
+			return fmt.Errorf("failed to remove flushed write-ahead log: %w", err)
+		}
+	}
+
+	w, err := createWAL(e.dataDir, e.nextNum)
+	if err != nil {
+		return err
+	}
+	e.nextNum++
+	e.wal = w
+	e.mem = newMemtable(w.num)
+	return nil
+}
+
+// wake tells the background worker there may be work, without waiting.
+func (e *LSMStorageEngine) wake() {
+	select {
+	case e.work <- struct{}{}:
+	default:
+	}
+}
+
+// Health reports the reason the engine stopped accepting writes, if it did.
+func (e *LSMStorageEngine) Health() error {
+	if err := e.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// setFailure switches the engine to read-only after a write to the log failed; the
+// log may end in a partial record now, so nothing can be appended after it.
+func (e *LSMStorageEngine) setFailure(cause error) {
+	err := fmt.Errorf("%w: %v", storage.ErrReadOnly, cause)
+	e.failure.CompareAndSwap(nil, &err)
+}
+
+// getLocked returns the newest record of key: from the memtables, newest first, else
+// from the first level that has one. Called when holding the lock.
+func (e *LSMStorageEngine) getLocked(key string) (entry, bool, error) {
+	if record, ok := e.mem.get(key); ok {
+		return record, true, nil
+	}
+	for i := len(e.imm) - 1; i >= 0; i-- {
+		if record, ok := e.imm[i].get(key); ok {
+			return record, true, nil
+		}
+	}
+
+	for level, tables := range e.levels {
+		if !e.overlapping(level) {
+			// Sorted and disjoint: only the first table ending at or after key may hold it
+			i := sort.Search(len(tables), func(i int) bool { return string(tables[i].meta.Largest) >= key })
+			if i == len(tables) {
+				continue
+			}
+			record, ok, err := tables[i].get(key)
+			if err != nil || ok {
+				return record, ok, err
+			}
+			continue
+		}
+
+		var found entry
+		var ok bool
+		for _, t := range tables {
+			record, hit, err := t.get(key)
+			if err != nil {
+				return entry{}, false, err
+			}
+			if hit && (!ok || record.version > found.version) {
+				found, ok = record, true
+			}
+		}
+		if ok {
+			return found, true, nil
+		}
+	}
+	return entry{}, false, nil
+}
+
+// overlapping reports whether the tables of level may hold the same keys: on level 0,
+// which takes the flushed memtables, and on every level with tiered compaction.
+func (e *LSMStorageEngine) overlapping(level int) bool {
+	return level == 0 || e.opts.Compaction == Tiered
+}
+
+func (e *LSMStorageEngine) Get(key string) (string, error) {
+	return e.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := e.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersioned returns the value of key together with its version.
+func (e *LSMStorageEngine) GetVersioned(key string) (string, uint64, error) {
+	return e.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext is GetVersioned, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
+	if err := storage.RLock(ctx, &e.mu); err != nil {
+		return "", 0, err
+	}
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return "", 0, ErrEngineClosed
+	}
+	record, ok, err := e.getLocked(key)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+	}
+	if !ok || record.deleted {
+		return "", 0, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
+	return record.value, record.version, nil
+}
+
+// lockForWrite takes the write lock, first waiting while as many memtables as the
+// engine keeps in memory wait for their flush.
+func (e *LSMStorageEngine) lockForWrite(ctx context.Context) error {
+	for {
+		if err := storage.Lock(ctx, &e.mu); err != nil {
+			return err
+		}
+		if e.closed {
+			e.mu.Unlock()
+			return ErrEngineClosed
+		}
+		if err := e.failure.Load(); err != nil {
+			e.mu.Unlock()
+			return *err
+		}
+		if len(e.imm) < maxImmutableMemtables {
+			return nil
+		}
+		if err := e.bgErr.Load(); err != nil {
+			e.mu.Unlock()
+			return fmt.Errorf("%w: memtables cannot be flushed: %v", storage.ErrReadOnly, *err)
+		}
+
+		flushed := e.flushed
+		e.mu.Unlock()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeLocked logs records and adds them to the memtable, freezing it once it is full.
+// Called when holding the write lock.
+func (e *LSMStorageEngine) writeLocked(records ...entry) error {
+	if err := e.wal.append(records...); err != nil {
+		e.setFailure(err)
+		return err
+	}
+	if e.opts.SyncWrites {
+		if err := e.wal.sync(); err != nil {
+			e.setFailure(err)
+			return err
+		}
+	}
+	for _, record := range records {
+		e.mem.put(record)
+	}
+
+	if e.mem.size >= e.opts.MemtableSize {
+		if err := e.rotateLocked(); err != nil {
+			// The records are logged; the memtable just goes on growing until a rotation works
+			e.opts.Logger.Error("failed to freeze full memtable", "error", err)
+		}
+	}
+	return nil
+}
+
+// rotateLocked freezes the memtable, for the background worker to flush, and starts a
+// new one with its own log. Called when holding the write lock.
+func (e *LSMStorageEngine) rotateLocked() error {
+	w, err := createWAL(e.dataDir, e.nextNum)
+	if err != nil {
+		return err
+	}
+	e.nextNum++
+	if err := e.wal.close(); err != nil {
+		e.opts.Logger.Warn("failed to close write-ahead log", "file", e.wal.file.Name(), "error", err)
+	}
+	e.imm = append(e.imm, e.mem)
+	e.mem = newMemtable(w.num)
+	e.wal = w
+	e.wake()
+	return nil
+}
+
+func (e *LSMStorageEngine) Set(key string, value string) error {
+	return e.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) SetContext(ctx context.Context, key string, value string) error {
+	_, err := e.SetIfContext(ctx, key, value, nil)
+	return err
+}
+
+// SetIf stores value under key if pre holds and returns the new version.
+func (e *LSMStorageEngine) SetIf(key string, value string, pre storage.Precondition) (uint64, error) {
+	return e.SetIfContext(context.Background(), key, value, pre)
+}
+
+// SetIfContext is SetIf, giving up if ctx ends while waiting for the lock, e.g. while
+// writes wait for memtables to be flushed. Once the record is being written, it is
+// written regardless.
+func (e *LSMStorageEngine) SetIfContext(ctx context.Context, key string, value string, pre storage.Precondition) (uint64, error) {
+	if key == "" {
+		return 0, storage.ErrEmptyKey
+	}
+	if err := e.lockForWrite(ctx); err != nil {
+		return 0, err
+	}
+	defer e.mu.Unlock()
+
+	if pre != nil {
+		old, exists, err := e.getLocked(key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key '%s': %w", key, err)
+		}
+		exists = exists && !old.deleted
+		if !exists {
+			old.version = 0
+		}
+		if err := pre(old.version, exists); err != nil {
+			return 0, err
+		}
+	}
+
+	record := entry{key: key, value: value, version: e.lastVersion + 1}
+	if err := e.writeLocked(record); err != nil {
+		return 0, fmt.Errorf("failed to write key '%s': %w", key, err)
+	}
+	e.lastVersion++
+	return record.version, nil
+}
+
+func (e *LSMStorageEngine) Delete(key string) error {
+	return e.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) DeleteContext(ctx context.Context, key string) error {
+	err := e.DeleteIfContext(ctx, key, nil)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Deleting a non-existent key is treated as success (idempotent)
+	}
+	return err
+}
+
+// DeleteIf removes key if pre holds. Unlike Delete it reports a missing key.
+func (e *LSMStorageEngine) DeleteIf(key string, pre storage.Precondition) error {
+	return e.DeleteIfContext(context.Background(), key, pre)
+}
+
+// DeleteIfContext is DeleteIf, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) DeleteIfContext(ctx context.Context, key string, pre storage.Precondition) error {
+	if err := e.lockForWrite(ctx); err != nil {
+		return err
+	}
+	defer e.mu.Unlock()
+
+	old, exists, err := e.getLocked(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key '%s': %w", key, err)
+	}
+	exists = exists && !old.deleted
+	if !exists {
+		old.version = 0
+	}
+	if pre != nil {
+		if err := pre(old.version, exists); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+
+	record := entry{key: key, version: e.lastVersion + 1, deleted: true}
+	if err := e.writeLocked(record); err != nil {
+		return fmt.Errorf("failed to write tombstone for key '%s': %w", key, err)
+	}
+	e.lastVersion++
+	return nil
+}
+
+// MGet looks up every key while taking the read lock once.
+func (e *LSMStorageEngine) MGet(keys []string) ([]storage.Result, error) {
+	return e.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, giving up if ctx ends while waiting for the lock or between keys.
+func (e *LSMStorageEngine) MGetContext(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if err := storage.RLock(ctx, &e.mu); err != nil {
+		return nil, err
+	}
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		record, ok, err := e.getLocked(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve value for key '%s': %w", key, err)
+		}
+		if ok && !record.deleted {
+			results[i] = storage.Result{Value: record.value, Found: true}
+		}
+	}
+	return results, nil
+}
+
+// MSet writes every pair with a single write to the log and, with SyncWrites, a single
+// fsync. Nothing is written if a key is empty.
+func (e *LSMStorageEngine) MSet(pairs []storage.KeyValue) error {
+	return e.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, giving up if ctx ends while waiting for the lock.
+func (e *LSMStorageEngine) MSetContext(ctx context.Context, pairs []storage.KeyValue) error {
+	for _, pair := range pairs {
+		if pair.Key == "" {
+			return storage.ErrEmptyKey
+		}
+	}
+	if err := e.lockForWrite(ctx); err != nil {
+		return err
+	}
+	defer e.mu.Unlock()
+
+	records := make([]entry, len(pairs))
+	for i, pair := range pairs {
+		records[i] = entry{key: pair.Key, value: pair.Value, version: e.lastVersion + uint64(i) + 1}
+	}
+	if err := e.writeLocked(records...); err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+	e.lastVersion += uint64(len(pairs))
+	return nil
+}
+
+// Apply writes changes read from another engine's log with a single write to the log,
+// keeping their versions.
+func (e *LSMStorageEngine) Apply(changes []storage.Change) ([]bool, error) {
+	applied := make([]bool, len(changes))
+	if err := e.lockForWrite(context.Background()); err != nil {
+		return applied, err
+	}
+	defer e.mu.Unlock()
+
+	var records []entry
+	pending := make(map[string]entry) // Latest record of every key written by this batch
+	for i, change := range changes {
+		old, exists := pending[change.Key]
+		if !exists {
+			var err error
+			if old, exists, err = e.getLocked(change.Key); err != nil {
+				return applied, fmt.Errorf("failed to read key '%s': %w", change.Key, err)
+			}
+		}
+		// Like the other engines, a deleted key does not remember its version
+		exists = exists && !old.deleted
+		if exists && old.version >= change.Version {
+			continue // Already holds this version or a newer one
+		}
+
+		record := entry{key: change.Key, value: change.Value, version: change.Version}
+		switch change.Type {
+		case storage.ChangeSet:
+		case storage.ChangeDelete:
+			if !exists {
+				continue
+			}
+			record.value, record.deleted = "", true
+		default:
+			return applied, fmt.Errorf("unknown change type %q for key '%s'", change.Type, change.Key)
+		}
+		records = append(records, record)
+		pending[change.Key] = record
+		applied[i] = true
+	}
+
+	if len(records) > 0 {
+		if err := e.writeLocked(records...); err != nil {
+			return make([]bool, len(changes)), fmt.Errorf("failed to write applied changes: %w", err)
+		}
+	}
+	for _, record := range records {
+		e.lastVersion = max(e.lastVersion, record.version)
+	}
+	return applied, nil
+}
+
+// Keys returns the live keys starting with prefix, sorted. It merges the memtables
+// and the tables in key order, starting at prefix, so it reads only the blocks that
+// can hold such keys.
+func (e *LSMStorageEngine) Keys(prefix string) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	sources := []iterator{e.mem.iter(prefix)}
+	for _, m := range e.imm {
+		sources = append(sources, m.iter(prefix))
+	}
+	for _, tables := range e.levels {
+		for _, t := range tables {
+			if string(t.meta.Largest) < prefix {
+				continue
+			}
+			it, err := t.iter(prefix)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, it)
+		}
+	}
+
+	it, err := newMergingIterator(sources)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for ; it.valid() && strings.HasPrefix(it.entry().key, prefix); err = it.next() {
+		if !it.entry().deleted {
+			keys = append(keys, it.entry().key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Stats reports the tables as segments. Keys counts the records of the memtables and
+// tables, so it also counts overwritten and deleted keys until compaction drops them;
+// KeyDirBytes is the memory taken by the memtables, block indexes and bloom filters.
+func (e *LSMStorageEngine) Stats() storage.Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	stats := storage.Stats{
+		Engine:    "lsm",
+		DataDir:   e.dataDir,
+		OpenFiles: 1, // The write-ahead log
+	}
+	for _, m := range append([]*memtable{e.mem}, e.imm...) {
+		stats.Keys += m.count
+		stats.KeyDirBytes += m.size
+	}
+	for _, tables := range e.levels {
+		for _, t := range tables {
+			stats.Keys += int(t.meta.Entries)
+			stats.KeyDirBytes += int64(len(t.bloom))
+			for _, h := range t.index {
+				stats.KeyDirBytes += int64(len(h.lastKey)) + 16
+			}
+			stats.Segments = append(stats.Segments, storage.SegmentStats{FileID: t.meta.Num, Bytes: t.meta.Size})
+			stats.OpenFiles++
+		}
+	}
+	sort.Slice(stats.Segments, func(i, j int) bool { return stats.Segments[i].FileID < stats.Segments[j].FileID })
+	return stats
+}
+
+// Sync flushes the write-ahead log to disk, making every write so far durable.
+func (e *LSMStorageEngine) Sync() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrEngineClosed
+	}
+	return e.wal.sync()
+}
+
+// Close stops the background worker, once it is done with what it is doing, and
+// closes the files. The memtable is not flushed: its log is replayed on the next open.
+func (e *LSMStorageEngine) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.broadcastLocked() // Writers waiting for a flush give up
+	e.mu.Unlock()
+
+	close(e.stop)
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var errs []error
+	if err := e.wal.sync(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, e.wal.close())
+	errs = append(errs, e.closeTables())
+	if err := e.fLock.Unlock(); err != nil {
+		errs = append(errs, fmt.Errorf("failed releasing file lock %s: %w", e.fLock.Path(), err))
+	}
+	return errors.Join(errs...)
+}
+
+// closeTables closes every open table.
+func (e *LSMStorageEngine) closeTables() error {
+	var errs []error
+	for _, tables := range e.levels {
+		for _, t := range tables {
+			errs = append(errs, t.close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,511 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/storagetest"
+)
+
+// setupTestEngine opens an engine in a temporary directory and closes it when the
+// test finishes.
+func setupTestEngine(t *testing.T, options ...Option) (*LSMStorageEngine, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	db, err := NewLSMStorageEngine(tempDir, options...)
+	if err != nil {
+		t.Fatalf("Failed to initialize test engine in %s: %v", tempDir, err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing test engine in %s: %v", tempDir, err)
+		}
+	})
+	return db, tempDir
+}
+
+// smallOptions make memtables flush and levels compact after a few kilobytes.
+func smallOptions(style CompactionStyle) []Option {
+	return []Option{
+		WithMemtableSize(1 << 10),
+		WithBlockSize(256),
+		WithTableSize(2 << 10),
+		WithCompaction(style),
+		WithLevels(2, 8<<10, 2),
+		WithTierTrigger(3),
+	}
+}
+
+// waitForBackground waits until every memtable is flushed and no compaction is due.
+func waitForBackground(t *testing.T, db *LSMStorageEngine) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		db.wake()
+		db.mu.Lock()
+		idle := len(db.imm) == 0 && db.pickCompaction() == nil
+		db.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("background work did not finish")
+}
+
+func TestLSMStorageEngine_SetGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		set     bool
+		wantErr error
+	}{
+		{name: "simple set/get", key: "key1", value: "value1", set: true},
+		{name: "set/get empty value", key: "key2", value: "", set: true},
+		{name: "set/get unicode", key: "你好", value: "世界", set: true},
+		{name: "set/get tombstone marker", key: "key3", value: "<DELETED>", set: true},
+		{name: "get non-existent", key: "non_existent_key", wantErr: storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestEngine(t)
+			if tt.set {
+				if err := db.Set(tt.key, tt.value); err != nil {
+					t.Fatalf("Set(%q, %q) = %v, want nil", tt.key, tt.value, err)
+				}
+			}
+			got, err := db.Get(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get(%q) error = %v, want %v", tt.key, err, tt.wantErr)
+			}
+			if got != tt.value {
+				t.Errorf("Get(%q) = %q, want %q", tt.key, got, tt.value)
+			}
+		})
+	}
+
+	db, _ := setupTestEngine(t)
+	if err := db.Set("", "value"); err == nil {
+		t.Errorf("Set(%q) = nil, want error", "")
+	}
+}
+
+func TestLSMStorageEngine_Conformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Engine{
+		Open: func(t *testing.T, dir string) storage.StorageEngine {
+			db, err := NewLSMStorageEngine(dir, smallOptions(Leveled)...)
+			if err != nil {
+				t.Fatalf("NewLSMStorageEngine(%q) failed: %v", dir, err)
+			}
+			return db
+		},
+		Durable: true,
+	})
+}
+
+func TestLSMStorageEngine_Delete(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := db.Delete("foo"); err != nil {
+		t.Fatalf("Delete(%q) = %v, want nil", "foo", err)
+	}
+	if _, err := db.Get("foo"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after delete = %v, want %v", "foo", err, storage.ErrNotFound)
+	}
+	if err := db.Delete("foo"); err != nil {
+		t.Errorf("Delete(%q) of deleted key = %v, want nil", "foo", err)
+	}
+	if err := db.DeleteIf("foo", nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteIf(%q) of deleted key = %v, want %v", "foo", err, storage.ErrNotFound)
+	}
+}
+
+func TestLSMStorageEngine_Versions(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	ifVersion := func(want uint64) storage.Precondition {
+		return func(version uint64, exists bool) error {
+			if version != want {
+				return storage.ErrPreconditionFailed
+			}
+			return nil
+		}
+	}
+
+	v1, err := db.SetIf("k", "1", ifVersion(0))
+	if err != nil || v1 == 0 {
+		t.Fatalf("SetIf(%q) on a new key = %d, %v, want a version, nil", "k", v1, err)
+	}
+	if _, err := db.SetIf("k", "2", ifVersion(0)); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("SetIf(%q) with a stale version = %v, want %v", "k", err, storage.ErrPreconditionFailed)
+	}
+	v2, err := db.SetIf("k", "2", ifVersion(v1))
+	if err != nil || v2 <= v1 {
+		t.Errorf("SetIf(%q) = %d, %v, want a version above %d, nil", "k", v2, err, v1)
+	}
+	if value, version, err := db.GetVersioned("k"); value != "2" || version != v2 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", "k", value, version, err, "2", v2)
+	}
+	if err := db.DeleteIf("k", ifVersion(v1)); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("DeleteIf(%q) with a stale version = %v, want %v", "k", err, storage.ErrPreconditionFailed)
+	}
+	if err := db.DeleteIf("k", ifVersion(v2)); err != nil {
+		t.Errorf("DeleteIf(%q) = %v, want nil", "k", err)
+	}
+}
+
+func TestLSMStorageEngine_Persistence(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewLSMStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("NewLSMStorageEngine failed: %v", err)
+	}
+	for i := range 100 {
+		if err := db.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := db.Delete("key007"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, lastVersion, _ := db.GetVersioned("key099")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The first reopen flushes the log to a table, the second reads the table
+	for range 2 {
+		db, err = NewLSMStorageEngine(tempDir)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		if got, err := db.Get("key042"); got != "value42" || err != nil {
+			t.Errorf("Get(%q) after reopen = %q, %v, want %q, nil", "key042", got, err, "value42")
+		}
+		if _, err := db.Get("key007"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Get(%q) of deleted key after reopen = %v, want %v", "key007", err, storage.ErrNotFound)
+		}
+		if version, err := db.SetIf("new", "v", nil); err != nil || version <= lastVersion {
+			t.Errorf("SetIf() after reopen = %d, %v, want a version above %d", version, err, lastVersion)
+		} else {
+			lastVersion = version
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestLSMStorageEngine_TornLog(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := NewLSMStorageEngine(tempDir)
+	if err != nil {
+		t.Fatalf("NewLSMStorageEngine failed: %v", err)
+	}
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	walFile := db.wal.file.Name()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A write cut short by a crash
+	f, err := os.OpenFile(walFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 0, 0, 0, 50, 1})
+	f.Close()
+
+	db = reopen(t, tempDir)
+	if got, err := db.Get("a"); got != "1" || err != nil {
+		t.Errorf("Get(%q) after torn write = %q, %v, want %q, nil", "a", got, err, "1")
+	}
+}
+
+// reopen opens the engine in dir, closing it when the test finishes.
+func reopen(t *testing.T, dir string, options ...Option) *LSMStorageEngine {
+	t.Helper()
+	db, err := NewLSMStorageEngine(dir, options...)
+	if err != nil {
+		t.Fatalf("Reopen of %s failed: %v", dir, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLSMStorageEngine_FileLocking(t *testing.T) {
+	_, tempDir := setupTestEngine(t)
+	if _, err := NewLSMStorageEngine(tempDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("second NewLSMStorageEngine(%q) = %v, want %v", tempDir, err, ErrLocked)
+	}
+}
+
+func TestLSMStorageEngine_Compaction(t *testing.T) {
+	for _, style := range []CompactionStyle{Leveled, Tiered} {
+		t.Run(style.String(), func(t *testing.T) {
+			db, tempDir := setupTestEngine(t, smallOptions(style)...)
+
+			// Write every key three times and delete every fifth
+			want := make(map[string]string)
+			for round := range 3 {
+				for i := range 500 {
+					key := fmt.Sprintf("key%04d", i)
+					value := fmt.Sprintf("value%d-%d", i, round)
+					if err := db.Set(key, value); err != nil {
+						t.Fatalf("Set(%q) failed: %v", key, err)
+					}
+					want[key] = value
+				}
+			}
+			for i := 0; i < 500; i += 5 {
+				key := fmt.Sprintf("key%04d", i)
+				if err := db.Delete(key); err != nil {
+					t.Fatalf("Delete(%q) failed: %v", key, err)
+				}
+				delete(want, key)
+			}
+			waitForBackground(t, db)
+
+			check := func(db *LSMStorageEngine) {
+				t.Helper()
+				for i := range 500 {
+					key := fmt.Sprintf("key%04d", i)
+					got, err := db.Get(key)
+					if value, ok := want[key]; ok && (got != value || err != nil) {
+						t.Fatalf("Get(%q) = %q, %v, want %q, nil", key, got, err, value)
+					} else if !ok && !errors.Is(err, storage.ErrNotFound) {
+						t.Fatalf("Get(%q) of deleted key = %q, %v, want %v", key, got, err, storage.ErrNotFound)
+					}
+				}
+				var wantKeys []string
+				for key := range want {
+					wantKeys = append(wantKeys, key)
+				}
+				sort.Strings(wantKeys)
+				if keys, err := db.Keys(""); err != nil || !reflect.DeepEqual(keys, wantKeys) {
+					t.Fatalf("Keys(%q) = %d keys, %v, want %d keys", "", len(keys), err, len(wantKeys))
+				}
+			}
+			check(db)
+
+			stats := db.Stats()
+			if stats.Engine != "lsm" || len(stats.Segments) == 0 {
+				t.Errorf("Stats() = engine %q with %d segments, want lsm with some", stats.Engine, len(stats.Segments))
+			}
+			db.mu.RLock()
+			below := 0
+			for _, tables := range db.levels[1:] {
+				below += len(tables)
+			}
+			db.mu.RUnlock()
+			if below == 0 {
+				t.Errorf("no tables below level 0 after compaction")
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			db = reopen(t, tempDir, smallOptions(style)...)
+			check(db)
+
+			// Only the tables of the manifest and the log are left
+			files, _ := filepath.Glob(filepath.Join(tempDir, "*"+tableExt))
+			if len(files) != len(db.Stats().Segments) {
+				t.Errorf("%d table files after reopen, want %d", len(files), len(db.Stats().Segments))
+			}
+		})
+	}
+}
+
+func TestLSMStorageEngine_Keys(t *testing.T) {
+	db, _ := setupTestEngine(t, smallOptions(Leveled)...)
+	for _, key := range []string{"user:3", "user:1", "order:1", "user:2", "users", "user:4"} {
+		if err := db.Set(key, strings.Repeat("x", 100)); err != nil {
+			t.Fatalf("Set(%q) failed: %v", key, err)
+		}
+	}
+	waitForBackground(t, db)
+	if err := db.Delete("user:4"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"user:", []string{"user:1", "user:2", "user:3"}},
+		{"order", []string{"order:1"}},
+		{"zzz", []string{}},
+		{"", []string{"order:1", "user:1", "user:2", "user:3", "users"}},
+	}
+	for _, tt := range tests {
+		if got, err := db.Keys(tt.prefix); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Keys(%q) = %v, %v, want %v", tt.prefix, got, err, tt.want)
+		}
+	}
+}
+
+func TestLSMStorageEngine_Batch(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	pairs := []storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}
+	if err := db.MSet(pairs); err != nil {
+		t.Fatalf("MSet failed: %v", err)
+	}
+	if err := db.MSet([]storage.KeyValue{{Key: "c", Value: "3"}, {Key: "", Value: "4"}}); err == nil {
+		t.Errorf("MSet() with an empty key = nil, want error")
+	}
+	results, err := db.MGet([]string{"a", "c", "b"})
+	want := []storage.Result{{Value: "1", Found: true}, {}, {Value: "2", Found: true}}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("MGet() = %v, %v, want %v, nil", results, err, want)
+	}
+}
+
+func TestLSMStorageEngine_Apply(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	changes := []storage.Change{
+		{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 100},
+		{Type: storage.ChangeSet, Key: "a", Value: "stale", Version: 50},
+		{Type: storage.ChangeDelete, Key: "missing", Version: 101},
+		{Type: storage.ChangeSet, Key: "b", Value: "2", Version: 102},
+		{Type: storage.ChangeDelete, Key: "b", Version: 103},
+	}
+	applied, err := db.Apply(changes)
+	if err != nil || fmt.Sprint(applied) != "[true false false true true]" {
+		t.Errorf("Apply() = %v, %v, want [true false false true true], nil", applied, err)
+	}
+	if value, version, err := db.GetVersioned("a"); value != "1" || version != 100 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, 100, nil", "a", value, version, err, "1")
+	}
+	if _, err := db.Get("b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(%q) after applied delete = %v, want %v", "b", err, storage.ErrNotFound)
+	}
+	if version, _ := db.SetIf("c", "3", nil); version <= 103 {
+		t.Errorf("SetIf() after Apply() = version %d, want more than 103", version)
+	}
+
+	// A local delete does not hide older versions from a snapshot applied after it
+	if err := db.Delete("c"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if applied, err := db.Apply([]storage.Change{{Type: storage.ChangeSet, Key: "c", Value: "leader", Version: 10}}); err != nil || !applied[0] {
+		t.Errorf("Apply() over a local delete = %v, %v, want [true], nil", applied, err)
+	}
+}
+
+func TestLSMStorageEngine_Context(t *testing.T) {
+	db, _ := setupTestEngine(t)
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetContext(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := db.SetIfContext(ctx, "foo", "baz", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetIfContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := db.MSetContext(ctx, []storage.KeyValue{{Key: "foo", Value: "baz"}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MSetContext while locked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	db.mu.Unlock()
+
+	if got, err := db.GetContext(context.Background(), "foo"); err != nil || got != "bar" {
+		t.Errorf("GetContext(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+	}
+}
+
+func TestLSMStorageEngine_Concurrency(t *testing.T) {
+	db, _ := setupTestEngine(t, smallOptions(Leveled)...)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("conc_key_%d_%d", g, i)
+				if err := db.Set(key, fmt.Sprintf("conc_val_%d_%d", g, i)); err != nil {
+					t.Errorf("Set(%q) failed: %v", key, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("conc_key_%d_%d", g, i)
+				if _, err := db.Get(key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+					t.Errorf("Get(%q) failed: %v", key, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for g := range 8 {
+		for i := range 200 {
+			key, want := fmt.Sprintf("conc_key_%d_%d", g, i), fmt.Sprintf("conc_val_%d_%d", g, i)
+			if got, err := db.Get(key); got != want || err != nil {
+				t.Fatalf("Get(%q) = %q, %v, want %q, nil", key, got, err, want)
+			}
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var hashes []uint64
+	for i := range 1000 {
+		hashes = append(hashes, bloomHash(fmt.Sprintf("key%d", i)))
+	}
+	filter := newBloomFilter(hashes, 10)
+	for i := range 1000 {
+		if key := fmt.Sprintf("key%d", i); !filter.mayContain(key) {
+			t.Fatalf("mayContain(%q) = false for an added key", key)
+		}
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if filter.mayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives in 10000, want about 1%%", falsePositives)
+	}
+}
+
+func TestParseCompactionStyle(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    CompactionStyle
+		wantErr bool
+	}{
+		{"leveled", Leveled, false},
+		{"", Leveled, false},
+		{"tiered", Tiered, false},
+		{"universal", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCompactionStyle(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("ParseCompactionStyle(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
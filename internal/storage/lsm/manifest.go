@@ -0,0 +1,120 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File names in the data directory
+const (
+	manifestName = "MANIFEST"
+	tableExt     = ".sst"
+	walExt       = ".wal"
+)
+
+// manifest lists the tables of every level. It is rewritten whole, through a
+// temporary file and a rename, whenever a flush or compaction changes the levels.
+type manifest struct {
+	NextNum int64         `json:"nextNum"`
+	Levels  [][]tableMeta `json:"levels"`
+}
+
+func tablePath(dataDir string, num int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%06d%s", num, tableExt))
+}
+
+func walPath(dataDir string, num int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%06d%s", num, walExt))
+}
+
+// readManifest reads the manifest of dataDir; a directory without one has no tables.
+func readManifest(dataDir string) (manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{}, nil
+	}
+	if err != nil {
+		return manifest{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, fmt.Errorf("failed to decode manifest %s: %w", filepath.Join(dataDir, manifestName), err)
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest of dataDir with m, syncing the file and the
+// directory so that the new manifest, and the tables it lists, survive a crash.
+func writeManifest(dataDir string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, manifestName)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return syncDir(dataDir)
+}
+
+// syncDir syncs the entries of a directory, making renames and removals in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// listFiles returns the numbers of the tables and write-ahead logs in dataDir, sorted.
+func listFiles(dataDir string) (tables, wals []int64, err error) {
+	dirEntries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		ext := filepath.Ext(name)
+		if ext != tableExt && ext != walExt {
+			continue
+		}
+		num, err := strconv.ParseInt(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		if ext == tableExt {
+			tables = append(tables, num)
+		} else {
+			wals = append(wals, num)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+	return tables, wals, nil
+}
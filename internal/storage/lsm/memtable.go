@@ -0,0 +1,116 @@
+package lsm
+
+import "math/rand/v2"
+
+// entry is one record of the engine: a value, or a tombstone when deleted is set,
+// written at version. Versions are sequence numbers, so the newest record of a key is
+// the one with the highest version.
+type entry struct {
+	key     string
+	value   string
+	version uint64
+	deleted bool
+}
+
+// entryOverhead approximates the memory a memtable entry takes besides its key and value.
+const entryOverhead = 64
+
+const skiplistMaxHeight = 12
+
+type skipNode struct {
+	entry
+	next []*skipNode
+}
+
+// memtable is a skiplist of the latest record of every key written since the last
+// flush, sorted by key. It is not safe for concurrent use: the engine writes the active
+// memtable under its write lock and only reads frozen ones.
+type memtable struct {
+	head   *skipNode
+	height int
+	size   int64 // Approximate bytes taken by the entries
+	count  int
+	walNum int64 // Write-ahead log holding the same records
+}
+
+func newMemtable(walNum int64) *memtable {
+	return &memtable{
+		head:   &skipNode{next: make([]*skipNode, skiplistMaxHeight)},
+		height: 1,
+		walNum: walNum,
+	}
+}
+
+// randomHeight picks the height of a new node: every level up is a quarter as likely.
+func randomHeight() int {
+	height := 1
+	for height < skiplistMaxHeight && rand.IntN(4) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node whose key is at least key, or nil, and
+// fills prev, if given, with the last node before it on every level.
+func (m *memtable) findGreaterOrEqual(key string, prev []*skipNode) *skipNode {
+	node := m.head
+	for level := m.height - 1; level >= 0; level-- {
+		for next := node.next[level]; next != nil && next.key < key; next = node.next[level] {
+			node = next
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// put stores e, replacing the record held for its key.
+func (m *memtable) put(e entry) {
+	prev := make([]*skipNode, skiplistMaxHeight)
+	node := m.findGreaterOrEqual(e.key, prev)
+	if node != nil && node.key == e.key {
+		m.size += int64(len(e.value) - len(node.value))
+		node.entry = e
+		return
+	}
+
+	height := randomHeight()
+	for level := m.height; level < height; level++ {
+		prev[level] = m.head
+	}
+	m.height = max(m.height, height)
+	node = &skipNode{entry: e, next: make([]*skipNode, height)}
+	for level := range height {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	m.size += int64(len(e.key)+len(e.value)) + entryOverhead
+	m.count++
+}
+
+// get returns the record held for key.
+func (m *memtable) get(key string) (entry, bool) {
+	node := m.findGreaterOrEqual(key, nil)
+	if node == nil || node.key != key {
+		return entry{}, false
+	}
+	return node.entry, true
+}
+
+// iter returns an iterator over the records with keys from start on.
+func (m *memtable) iter(start string) *memtableIterator {
+	return &memtableIterator{node: m.findGreaterOrEqual(start, nil)}
+}
+
+// memtableIterator walks a memtable in key order.
+type memtableIterator struct {
+	node *skipNode
+}
+
+func (it *memtableIterator) valid() bool  { return it.node != nil }
+func (it *memtableIterator) entry() entry { return it.node.entry }
+func (it *memtableIterator) next() error {
+	it.node = it.node.next[0]
+	return nil
+}
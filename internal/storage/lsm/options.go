@@ -0,0 +1,189 @@
+package lsm
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Defaults of the tunables.
+const (
+	DefaultMemtableSize    int64 = 4 << 20  // 4 MiB
+	DefaultBlockSize             = 4 << 10  // 4 KiB
+	DefaultTableSize       int64 = 2 << 20  // 2 MiB
+	DefaultBaseLevelSize   int64 = 10 << 20 // 10 MiB
+	DefaultLevelMultiplier       = 10
+	DefaultL0Trigger             = 4
+	DefaultBloomBitsPerKey       = 10
+	DefaultTierTrigger           = 4
+	maxLevels                    = 7
+	maxImmutableMemtables        = 4
+)
+
+// CompactionStyle decides how tables move down the levels.
+type CompactionStyle int
+
+const (
+	// Leveled keeps the tables of every level below 0 sorted and disjoint, and moves
+	// one table at a time into the next level once a level outgrows its size. Reads
+	// touch at most one table per level; data is rewritten about LevelMultiplier times
+	// per level.
+	Leveled CompactionStyle = iota
+	// Tiered lets the tables of a level overlap and merges all of them into a single
+	// table of the next level once there are TierTrigger. Data is rewritten once per
+	// level, at the cost of reads checking every table of a level.
+	Tiered
+)
+
+func (s CompactionStyle) String() string {
+	switch s {
+	case Leveled:
+		return "leveled"
+	case Tiered:
+		return "tiered"
+	default:
+		return fmt.Sprintf("CompactionStyle(%d)", int(s))
+	}
+}
+
+// ParseCompactionStyle converts "leveled" or "tiered" into a CompactionStyle.
+func ParseCompactionStyle(s string) (CompactionStyle, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "leveled", "":
+		return Leveled, nil
+	case "tiered":
+		return Tiered, nil
+	default:
+		return Leveled, fmt.Errorf("unknown compaction style %q (want leveled or tiered)", s)
+	}
+}
+
+// Options holds the tunables of an LSMStorageEngine.
+type Options struct {
+	// MemtableSize is the approximate size in bytes at which the memtable is frozen and
+	// flushed to a table of level 0.
+	MemtableSize int64
+	// BlockSize is the size in bytes of the data blocks of a table, the unit it is read in.
+	BlockSize int
+	// TableSize is the size in bytes at which leveled compaction starts a new table.
+	TableSize int64
+	// BloomBitsPerKey sizes the bloom filter of every table. Zero disables the filters.
+	BloomBitsPerKey int
+	// Compaction picks leveled or tiered compaction.
+	Compaction CompactionStyle
+	// L0Trigger is the number of level 0 tables that starts a leveled compaction of them.
+	L0Trigger int
+	// BaseLevelSize is the size in bytes of level 1 above which leveled compaction moves
+	// tables down. Every level below may grow LevelMultiplier times bigger than the one above.
+	BaseLevelSize   int64
+	LevelMultiplier int
+	// TierTrigger is the number of tables of a level that starts a tiered compaction.
+	TierTrigger int
+	// SyncWrites fsyncs the write-ahead log after every write.
+	SyncWrites bool
+	// Logger receives warnings and failures of background work.
+	Logger *slog.Logger
+}
+
+// Option configures an LSMStorageEngine.
+type Option func(*Options)
+
+func defaultOptions() Options {
+	return Options{
+		MemtableSize:    DefaultMemtableSize,
+		BlockSize:       DefaultBlockSize,
+		TableSize:       DefaultTableSize,
+		BloomBitsPerKey: DefaultBloomBitsPerKey,
+		Compaction:      Leveled,
+		L0Trigger:       DefaultL0Trigger,
+		BaseLevelSize:   DefaultBaseLevelSize,
+		LevelMultiplier: DefaultLevelMultiplier,
+		TierTrigger:     DefaultTierTrigger,
+		Logger:          slog.Default(),
+	}
+}
+
+// WithMemtableSize sets the size at which the memtable is flushed.
+func WithMemtableSize(size int64) Option {
+	return func(o *Options) { o.MemtableSize = size }
+}
+
+// WithBlockSize sets the size of the data blocks of new tables.
+func WithBlockSize(size int) Option {
+	return func(o *Options) { o.BlockSize = size }
+}
+
+// WithTableSize sets the size at which leveled compaction starts a new table.
+func WithTableSize(size int64) Option {
+	return func(o *Options) { o.TableSize = size }
+}
+
+// WithBloomBitsPerKey sizes the bloom filters of new tables; zero disables them.
+func WithBloomBitsPerKey(bits int) Option {
+	return func(o *Options) { o.BloomBitsPerKey = bits }
+}
+
+// WithCompaction sets the compaction style.
+func WithCompaction(style CompactionStyle) Option {
+	return func(o *Options) { o.Compaction = style }
+}
+
+// WithLevels sets when leveled compaction runs: once level 0 has l0Trigger tables, and
+// once level 1 holds more than baseSize bytes or a deeper level multiplier times more
+// than the one above.
+func WithLevels(l0Trigger int, baseSize int64, multiplier int) Option {
+	return func(o *Options) {
+		o.L0Trigger = l0Trigger
+		o.BaseLevelSize = baseSize
+		o.LevelMultiplier = multiplier
+	}
+}
+
+// WithTierTrigger sets the number of tables of a level that starts a tiered compaction.
+func WithTierTrigger(tables int) Option {
+	return func(o *Options) { o.TierTrigger = tables }
+}
+
+// WithSyncWrites fsyncs the write-ahead log after every write.
+func WithSyncWrites() Option {
+	return func(o *Options) { o.SyncWrites = true }
+}
+
+// WithLogger sets the logger used for warnings and background failures.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func (o Options) validate() error {
+	if o.Logger == nil {
+		return fmt.Errorf("logger must not be nil")
+	}
+	if o.MemtableSize <= 0 {
+		return fmt.Errorf("memtable size must be positive (got %d)", o.MemtableSize)
+	}
+	if o.BlockSize <= 0 {
+		return fmt.Errorf("block size must be positive (got %d)", o.BlockSize)
+	}
+	if o.TableSize <= 0 {
+		return fmt.Errorf("table size must be positive (got %d)", o.TableSize)
+	}
+	if o.BloomBitsPerKey < 0 {
+		return fmt.Errorf("bloom bits per key cannot be negative (got %d)", o.BloomBitsPerKey)
+	}
+	if o.Compaction != Leveled && o.Compaction != Tiered {
+		return fmt.Errorf("unknown compaction style %d", int(o.Compaction))
+	}
+	if o.L0Trigger < 1 {
+		return fmt.Errorf("level 0 trigger must be at least 1 (got %d)", o.L0Trigger)
+	}
+	if o.BaseLevelSize <= 0 {
+		return fmt.Errorf("base level size must be positive (got %d)", o.BaseLevelSize)
+	}
+	if o.LevelMultiplier < 2 {
+		return fmt.Errorf("level multiplier must be at least 2 (got %d)", o.LevelMultiplier)
+	}
+	if o.TierTrigger < 2 {
+		return fmt.Errorf("tier trigger must be at least 2 (got %d)", o.TierTrigger)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// A table (SSTable) is an immutable file of records sorted by key, one per key:
+//
+//	data block | crc32 | data block | crc32 | ... | index | crc32 | bloom filter | crc32 | footer
+//
+// Data blocks hold records encoded by appendEntry, back to back, and are about
+// BlockSize bytes each. The index has one handle per data block: the block's last key
+// (length as uvarint, then the key), its offset and its size (uvarints). The footer
+// gives the offsets and sizes of the index and the filter, the number of records and
+// a magic number. Every CRC covers the block before it.
+
+const (
+	tableMagic      uint64 = 0x7a61707374736c6d // "zapstslm"
+	tableFooterSize        = 48
+)
+
+// ErrCorrupt is returned when a table fails its checksums or cannot be decoded.
+var ErrCorrupt = errors.New("corrupt table")
+
+// tableMeta describes a table in the manifest. Keys are bytes, as they need not be
+// valid UTF-8.
+type tableMeta struct {
+	Num        int64  `json:"num"`
+	Size       int64  `json:"size"`
+	Entries    int64  `json:"entries"`
+	Smallest   []byte `json:"smallest"`
+	Largest    []byte `json:"largest"`
+	MaxVersion uint64 `json:"maxVersion"`
+}
+
+// overlaps reports whether the table may hold keys between smallest and largest.
+func (m tableMeta) overlaps(smallest, largest string) bool {
+	return string(m.Smallest) <= largest && smallest <= string(m.Largest)
+}
+
+// blockHandle locates a data block of a table.
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	size    int64
+}
+
+// tableWriter writes a table from records added in key order.
+type tableWriter struct {
+	file       *os.File
+	w          *bufio.Writer
+	offset     int64 // Bytes written so far
+	blockSize  int
+	block      []byte
+	index      []blockHandle
+	hashes     []uint64 // Bloom hashes of the keys, nil with bloom filters disabled
+	bloomBits  int
+	lastKey    string
+	meta       tableMeta
+	crc        [4]byte
+	hasEntries bool
+}
+
+func newTableWriter(dataDir string, num int64, blockSize, bloomBits int) (*tableWriter, error) {
+	file, err := os.OpenFile(tablePath(dataDir, num), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create table: %w", err)
+	}
+	return &tableWriter{
+		file:      file,
+		w:         bufio.NewWriterSize(file, 64<<10),
+		blockSize: blockSize,
+		bloomBits: bloomBits,
+		meta:      tableMeta{Num: num},
+	}, nil
+}
+
+// add appends e, whose key must sort after the key added before.
+func (w *tableWriter) add(e entry) error {
+	if !w.hasEntries {
+		w.meta.Smallest = []byte(e.key)
+		w.hasEntries = true
+	}
+	w.block = appendEntry(w.block, e)
+	w.lastKey = e.key
+	w.meta.Largest = []byte(e.key)
+	w.meta.Entries++
+	w.meta.MaxVersion = max(w.meta.MaxVersion, e.version)
+	if w.bloomBits > 0 {
+		w.hashes = append(w.hashes, bloomHash(e.key))
+	}
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size returns the bytes the table takes so far.
+func (w *tableWriter) size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+// writeBlock writes data followed by its CRC and returns where it starts.
+func (w *tableWriter) writeBlock(data []byte) (int64, error) {
+	offset := w.offset
+	binary.BigEndian.PutUint32(w.crc[:], crc32.ChecksumIEEE(data))
+	if _, err := w.w.Write(data); err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(w.crc[:]); err != nil {
+		return 0, err
+	}
+	w.offset += int64(len(data)) + 4
+	return offset, nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	offset, err := w.writeBlock(w.block)
+	if err != nil {
+		return fmt.Errorf("failed to write table block: %w", err)
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: offset, size: int64(len(w.block))})
+	w.block = w.block[:0]
+	return nil
+}
+
+// finish writes the index, the filter and the footer, syncs the file and closes it.
+// The writer must have been given at least one record.
+func (w *tableWriter) finish() (tableMeta, error) {
+	if err := w.flushBlock(); err != nil {
+		return tableMeta{}, err
+	}
+
+	var index []byte
+	for _, h := range w.index {
+		index = binary.AppendUvarint(index, uint64(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.AppendUvarint(index, uint64(h.offset))
+		index = binary.AppendUvarint(index, uint64(h.size))
+	}
+	indexOffset, err := w.writeBlock(index)
+	if err != nil {
+		return tableMeta{}, fmt.Errorf("failed to write table index: %w", err)
+	}
+	var bloom bloomFilter
+	if w.bloomBits > 0 {
+		bloom = newBloomFilter(w.hashes, w.bloomBits)
+	}
+	bloomOffset, err := w.writeBlock(bloom)
+	if err != nil {
+		return tableMeta{}, fmt.Errorf("failed to write table filter: %w", err)
+	}
+
+	footer := make([]byte, 0, tableFooterSize)
+	for _, v := range []uint64{uint64(indexOffset), uint64(len(index)), uint64(bloomOffset), uint64(len(bloom)), uint64(w.meta.Entries), tableMagic} {
+		footer = binary.BigEndian.AppendUint64(footer, v)
+	}
+	if _, err := w.w.Write(footer); err != nil {
+		return tableMeta{}, fmt.Errorf("failed to write table footer: %w", err)
+	}
+	w.offset += tableFooterSize
+
+	if err := w.w.Flush(); err != nil {
+		return tableMeta{}, fmt.Errorf("failed to write table: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return tableMeta{}, fmt.Errorf("failed to sync table: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return tableMeta{}, fmt.Errorf("failed to close table: %w", err)
+	}
+	w.meta.Size = w.offset
+	return w.meta, nil
+}
+
+// abort closes and removes a table that will not be finished.
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// table is an open table. It is safe for concurrent use.
+type table struct {
+	meta  tableMeta
+	file  *os.File
+	index []blockHandle
+	bloom bloomFilter
+}
+
+func openTable(dataDir string, meta tableMeta) (*table, error) {
+	file, err := os.Open(tablePath(dataDir, meta.Num))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open table: %w", err)
+	}
+	t := &table{meta: meta, file: file}
+	if err := t.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w %s: %v", ErrCorrupt, file.Name(), err)
+	}
+	return t, nil
+}
+
+// load reads the footer, the index and the filter.
+func (t *table) load() error {
+	if t.meta.Size < tableFooterSize {
+		return fmt.Errorf("%d bytes is too small for a table", t.meta.Size)
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := t.file.ReadAt(footer, t.meta.Size-tableFooterSize); err != nil {
+		return fmt.Errorf("failed to read footer: %w", err)
+	}
+	field := func(i int) int64 { return int64(binary.BigEndian.Uint64(footer[i*8:])) }
+	if uint64(field(5)) != tableMagic {
+		return fmt.Errorf("bad magic number %x", uint64(field(5)))
+	}
+
+	index, err := t.readBlock(field(0), field(1))
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	for len(index) > 0 {
+		var h blockHandle
+		keyLen, n := binary.Uvarint(index)
+		if n <= 0 || uint64(len(index)-n) < keyLen {
+			return fmt.Errorf("bad index entry")
+		}
+		h.lastKey = string(index[n : n+int(keyLen)])
+		index = index[n+int(keyLen):]
+		offset, n := binary.Uvarint(index)
+		if n <= 0 {
+			return fmt.Errorf("bad index entry")
+		}
+		index = index[n:]
+		size, n := binary.Uvarint(index)
+		if n <= 0 {
+			return fmt.Errorf("bad index entry")
+		}
+		index = index[n:]
+		h.offset, h.size = int64(offset), int64(size)
+		t.index = append(t.index, h)
+	}
+
+	bloom, err := t.readBlock(field(2), field(3))
+	if err != nil {
+		return fmt.Errorf("failed to read filter: %w", err)
+	}
+	t.bloom = bloom
+	return nil
+}
+
+// readBlock reads the block of size bytes at offset and checks its CRC.
+func (t *table) readBlock(offset, size int64) ([]byte, error) {
+	if offset < 0 || size < 0 || offset+size+4 > t.meta.Size {
+		return nil, fmt.Errorf("%w %s: block at %d of %d bytes is out of bounds", ErrCorrupt, t.file.Name(), offset, size)
+	}
+	buf := make([]byte, size+4)
+	if _, err := t.file.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("failed reading table %s at offset %d: %w", t.file.Name(), offset, err)
+	}
+	data := buf[:size]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[size:]) {
+		return nil, fmt.Errorf("%w %s: checksum mismatch in block at %d", ErrCorrupt, t.file.Name(), offset)
+	}
+	return data, nil
+}
+
+// findBlock returns the first block that can hold key, or len(t.index) if none can.
+func (t *table) findBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+}
+
+// get returns the record of key, if the table holds one.
+func (t *table) get(key string) (entry, bool, error) {
+	if key < string(t.meta.Smallest) || key > string(t.meta.Largest) || !t.bloom.mayContain(key) {
+		return entry{}, false, nil
+	}
+	i := t.findBlock(key)
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+	block, err := t.readBlock(t.index[i].offset, t.index[i].size)
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(block) > 0 {
+		e, n, err := decodeEntry(block)
+		if err != nil {
+			return entry{}, false, fmt.Errorf("%w %s: %v", ErrCorrupt, t.file.Name(), err)
+		}
+		if e.key >= key {
+			return e, e.key == key, nil
+		}
+		block = block[n:]
+	}
+	return entry{}, false, nil
+}
+
+// iter returns an iterator over the records with keys from start on.
+func (t *table) iter(start string) (*tableIterator, error) {
+	it := &tableIterator{t: t, block: t.findBlock(start)}
+	if err := it.loadBlock(); err != nil {
+		return nil, err
+	}
+	for it.valid() && it.cur.key < start {
+		if err := it.next(); err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// tableIterator walks a table in key order.
+type tableIterator struct {
+	t     *table
+	block int    // Index of the block being read
+	data  []byte // Rest of that block after cur
+	cur   entry
+	ok    bool
+}
+
+// loadBlock reads block it.block and positions the iterator on its first record.
+func (it *tableIterator) loadBlock() error {
+	it.ok = false
+	if it.block >= len(it.t.index) {
+		return nil
+	}
+	h := it.t.index[it.block]
+	data, err := it.t.readBlock(h.offset, h.size)
+	if err != nil {
+		return err
+	}
+	it.data = data
+	return it.decode()
+}
+
+func (it *tableIterator) decode() error {
+	e, n, err := decodeEntry(it.data)
+	if err != nil {
+		it.ok = false
+		return fmt.Errorf("%w %s: %v", ErrCorrupt, it.t.file.Name(), err)
+	}
+	it.cur, it.data, it.ok = e, it.data[n:], true
+	return nil
+}
+
+func (it *tableIterator) valid() bool  { return it.ok }
+func (it *tableIterator) entry() entry { return it.cur }
+
+func (it *tableIterator) next() error {
+	if len(it.data) > 0 {
+		return it.decode()
+	}
+	it.block++
+	return it.loadBlock()
+}
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// A write-ahead log holds the records of one memtable, so that they survive a crash
+// until the memtable is flushed to a table. Every record is framed as
+//
+//	crc32(4) | payload length(4) | payload
+//
+// with the CRC covering the payload, which is encodeEntry's encoding of the entry.
+
+const walHeaderSize = 8
+
+const (
+	kindDelete byte = 0
+	kindSet    byte = 1
+)
+
+// appendEntry appends the encoding of e to buf: kind(1) | version(8) | key length
+// (uvarint) | key | value length (uvarint) | value.
+func appendEntry(buf []byte, e entry) []byte {
+	kind := kindSet
+	if e.deleted {
+		kind = kindDelete
+	}
+	buf = append(buf, kind)
+	buf = binary.BigEndian.AppendUint64(buf, e.version)
+	buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+	buf = append(buf, e.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+	return append(buf, e.value...)
+}
+
+// errShortEntry is returned by decodeEntry for a record cut short.
+var errShortEntry = errors.New("entry cut short")
+
+// decodeEntry decodes the entry at the start of buf and returns it with its length.
+func decodeEntry(buf []byte) (entry, int, error) {
+	if len(buf) < 9 {
+		return entry{}, 0, errShortEntry
+	}
+	var e entry
+	switch buf[0] {
+	case kindSet:
+	case kindDelete:
+		e.deleted = true
+	default:
+		return entry{}, 0, fmt.Errorf("unknown entry kind %d", buf[0])
+	}
+	e.version = binary.BigEndian.Uint64(buf[1:9])
+	n := 9
+
+	keyLen, m := binary.Uvarint(buf[n:])
+	if m <= 0 || uint64(len(buf)-n-m) < keyLen {
+		return entry{}, 0, errShortEntry
+	}
+	n += m
+	e.key = string(buf[n : n+int(keyLen)])
+	n += int(keyLen)
+
+	valueLen, m := binary.Uvarint(buf[n:])
+	if m <= 0 || uint64(len(buf)-n-m) < valueLen {
+		return entry{}, 0, errShortEntry
+	}
+	n += m
+	e.value = string(buf[n : n+int(valueLen)])
+	n += int(valueLen)
+	return e, n, nil
+}
+
+// wal is a write-ahead log open for appending.
+type wal struct {
+	file *os.File
+	num  int64
+	buf  []byte
+}
+
+func createWAL(dataDir string, num int64) (*wal, error) {
+	file, err := os.OpenFile(walPath(dataDir, num), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create write-ahead log: %w", err)
+	}
+	return &wal{file: file, num: num}, nil
+}
+
+// append writes the records of entries with a single write.
+func (w *wal) append(entries ...entry) error {
+	w.buf = w.buf[:0]
+	for _, e := range entries {
+		start := len(w.buf)
+		w.buf = append(w.buf, make([]byte, walHeaderSize)...)
+		w.buf = appendEntry(w.buf, e)
+		payload := w.buf[start+walHeaderSize:]
+		binary.BigEndian.PutUint32(w.buf[start:], crc32.ChecksumIEEE(payload))
+		binary.BigEndian.PutUint32(w.buf[start+4:], uint32(len(payload)))
+	}
+	if _, err := w.file.Write(w.buf); err != nil {
+		return fmt.Errorf("failed to write to write-ahead log %s: %w", w.file.Name(), err)
+	}
+	return nil
+}
+
+func (w *wal) sync() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log %s: %w", w.file.Name(), err)
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// replayWAL calls fn with every record of the write-ahead log at path, in order. A
+// record that is cut short or fails its CRC ends the log, as it is the write a crash
+// interrupted; the error then says where, for the caller to warn about.
+func replayWAL(path string, fn func(entry)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < walHeaderSize {
+			return fmt.Errorf("%w at offset %d", errShortEntry, offset)
+		}
+		crc := binary.BigEndian.Uint32(data[offset:])
+		size := int(binary.BigEndian.Uint32(data[offset+4:]))
+		payload := data[offset+walHeaderSize:]
+		if len(payload) < size {
+			return fmt.Errorf("%w at offset %d", errShortEntry, offset)
+		}
+		payload = payload[:size]
+		if crc32.ChecksumIEEE(payload) != crc {
+			return fmt.Errorf("checksum mismatch at offset %d", offset)
+		}
+		e, _, err := decodeEntry(payload)
+		if err != nil {
+			return fmt.Errorf("%w at offset %d", err, offset)
+		}
+		fn(e)
+		offset += walHeaderSize + size
+	}
+	return nil
+}
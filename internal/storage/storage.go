@@ -1,8 +1,225 @@
 package storage
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrEmptyKey is returned by writes of the empty key, which no engine stores.
+	ErrEmptyKey = errors.New("key cannot be empty")
+	// ErrPreconditionFailed is returned by conditional writes whose precondition did not hold.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrNotReady is reported while an engine is still loading its data.
+	ErrNotReady = errors.New("storage engine is not ready")
+	// ErrReadOnly is returned by writes to an engine that no longer accepts them.
+	ErrReadOnly = errors.New("storage engine is read-only")
+	// ErrLogPositionLost is returned when tailing from a change log position whose
+	// records are gone, e.g. removed by a merge. The consumer has to start over.
+	ErrLogPositionLost = errors.New("change log position no longer available")
+)
+
 type StorageEngine interface {
 	Get(string) (string, error)
 	Set(string, string) error
 	Delete(string) error
 	Close() error
 }
+
+// Precondition is checked against a key's current version while the engine holds its
+// write lock, so nothing can change the key in between. exists is false (and version
+// zero) when the key is absent. A non-nil error aborts the write and is returned as is.
+type Precondition func(version uint64, exists bool) error
+
+// Versioned is implemented by engines that track a version for every record. Versions
+// of a key only ever increase; a nil Precondition always holds.
+type Versioned interface {
+	GetVersioned(key string) (value string, version uint64, err error)
+	// SetIf stores value if pre holds and returns the new version.
+	SetIf(key, value string, pre Precondition) (version uint64, err error)
+	// DeleteIf removes key if pre holds. It returns ErrNotFound if the key is absent.
+	DeleteIf(key string, pre Precondition) error
+}
+
+// KeyValue is one pair of a batch write.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Result is the outcome of looking up one key of a batch read.
+type Result struct {
+	Value string
+	Found bool
+}
+
+// Batcher is implemented by engines that can read or write many keys while taking
+// their lock once. MGet returns one Result per key, in order. MSet writes the pairs in
+// order; it is not atomic, so if it fails part way the earlier pairs stay written.
+type Batcher interface {
+	MGet(keys []string) ([]Result, error)
+	MSet(pairs []KeyValue) error
+}
+
+// KeyLister is implemented by engines that can list their live keys.
+type KeyLister interface {
+	// Keys returns the live keys starting with prefix, in sorted order.
+	Keys(prefix string) ([]string, error)
+}
+
+// SegmentStats describes one on-disk file of a storage engine.
+type SegmentStats struct {
+	FileID    int64 `json:"fileId"`
+	Bytes     int64 `json:"bytes"`     // Size of the file
+	DeadBytes int64 `json:"deadBytes"` // Bytes taken by overwritten values and tombstones
+}
+
+// Stats is a point in time summary of a storage engine.
+type Stats struct {
+	Engine      string         `json:"engine"`
+	Keys        int            `json:"keys"`
+	KeyDirBytes int64          `json:"keyDirBytes"` // Approximate memory used by the in-memory index
+	DataDir     string         `json:"dataDir,omitempty"`
+	Segments    []SegmentStats `json:"segments,omitempty"`
+	OpenFiles   int            `json:"openFiles"`
+}
+
+// DataBytes returns the total size of all segments.
+func (s Stats) DataBytes() int64 {
+	var total int64
+	for _, seg := range s.Segments {
+		total += seg.Bytes
+	}
+	return total
+}
+
+// DeadBytes returns the total reclaimable bytes across all segments.
+func (s Stats) DeadBytes() int64 {
+	var total int64
+	for _, seg := range s.Segments {
+		total += seg.DeadBytes
+	}
+	return total
+}
+
+// StatsReporter is implemented by engines that can describe their internal state.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// HealthChecker is implemented by engines that can be unable to serve requests, e.g. while
+// loading their data or after a write failure. Health returns nil when the engine is ready.
+type HealthChecker interface {
+	Health() error
+}
+
+// LogPosition is a place in an engine's change log: a log file and a byte offset in it.
+type LogPosition struct {
+	FileID int64 `json:"fileId"`
+	Offset int64 `json:"offset"`
+}
+
+// ChangeType says what a change did to its key.
+type ChangeType string
+
+const (
+	ChangeSet    ChangeType = "set"
+	ChangeDelete ChangeType = "delete"
+)
+
+// Change is one record read back from an engine's change log. As JSON, a key or value
+// that is not valid UTF-8 is written base64 encoded as "keyBase64" or "valueBase64"
+// instead of "key" or "value", since a JSON string would turn its bytes into U+FFFD.
+type Change struct {
+	Type    ChangeType
+	Key     string
+	Value   string // The value written by set changes
+	Version uint64
+	At      LogPosition // Where the record starts
+	Next    LogPosition // Where the following record starts, to resume from
+}
+
+// changeJSON is the JSON form of a Change.
+type changeJSON struct {
+	Type        ChangeType  `json:"type"`
+	Key         string      `json:"key,omitempty"`
+	KeyBase64   []byte      `json:"keyBase64,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	ValueBase64 []byte      `json:"valueBase64,omitempty"`
+	Version     uint64      `json:"version"`
+	At          LogPosition `json:"at"`
+	Next        LogPosition `json:"next"`
+}
+
+func (c Change) MarshalJSON() ([]byte, error) {
+	j := changeJSON{Type: c.Type, Key: c.Key, Value: c.Value, Version: c.Version, At: c.At, Next: c.Next}
+	if !utf8.ValidString(c.Key) {
+		j.Key, j.KeyBase64 = "", []byte(c.Key)
+	}
+	if !utf8.ValidString(c.Value) {
+		j.Value, j.ValueBase64 = "", []byte(c.Value)
+	}
+	return json.Marshal(j)
+}
+
+func (c *Change) UnmarshalJSON(data []byte) error {
+	var j changeJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*c = Change{Type: j.Type, Key: j.Key, Value: j.Value, Version: j.Version, At: j.At, Next: j.Next}
+	if j.KeyBase64 != nil {
+		c.Key = string(j.KeyBase64)
+	}
+	if j.ValueBase64 != nil {
+		c.Value = string(j.ValueBase64)
+	}
+	return nil
+}
+
+// ChangeReader returns the records of a change log one at a time.
+type ChangeReader interface {
+	// Next waits for the next change, until ctx is done. A change that is already
+	// available is returned even if ctx is done, so a cancelled context polls.
+	Next(ctx context.Context) (Change, error)
+	Close() error
+}
+
+// ChangeFeed is implemented by engines whose log of writes can be followed as it grows.
+type ChangeFeed interface {
+	// Tail returns a reader of the changes starting at from. The zero LogPosition
+	// starts at the oldest record still on disk.
+	Tail(from LogPosition) (ChangeReader, error)
+	// LogEnd returns the position the next write will be logged at.
+	LogEnd() (LogPosition, error)
+}
+
+// Replica is implemented by engines that can copy another engine's data by applying
+// the changes read from its change log, keeping their versions.
+type Replica interface {
+	// Apply writes changes in order and reports which of them it applied. A change is
+	// skipped if the key already holds its version or a newer one, and a delete also
+	// if the key is absent, so replaying changes that were applied before ends in the
+	// same state.
+	Apply(changes []Change) ([]bool, error)
+}
+
+// Snapshot is a consistent copy of an engine's data, taken at a point of its change
+// log. WriteTo streams it in an engine specific format.
+type Snapshot interface {
+	io.WriterTo
+	// End returns the change log position the snapshot covers up to; tailing from
+	// there picks up every later write.
+	End() LogPosition
+	Close() error
+}
+
+// Snapshotter is implemented by engines that can take snapshots.
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
@@ -0,0 +1,648 @@
+// Package storagetest is a conformance suite for storage engines. Every engine runs it
+// from its own tests, so that they all behave the same way where callers rely on it:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, storagetest.Engine{
+//			Open: func(t *testing.T, dir string) storage.StorageEngine { ... },
+//			Durable: true,
+//		})
+//	}
+//
+// The optional interfaces of package storage, such as Versioned, Batcher, KeyLister and
+// ContextEngine, are tested for engines that implement them. Besides tests of single
+// operations, a randomized test checks long sequences of them against a map, reopening
+// durable engines along the way; -storagetest.seed replays a failing sequence.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zap-store/internal/storage"
+)
+
+var seedFlag = flag.Int64("storagetest.seed", 0, "Seed of the randomized storage engine test, 0 for a new one")
+
+// Engine describes the engine under test.
+type Engine struct {
+	// Open opens the engine with its data in dir, failing t if it cannot. Every test
+	// gets a new directory; engines that keep nothing on disk ignore it.
+	Open func(t *testing.T, dir string) storage.StorageEngine
+	// Durable is set for engines that keep their data across Close and a new Open of
+	// the same directory.
+	Durable bool
+}
+
+// Run runs the conformance suite against e, each test as a subtest of t.
+func Run(t *testing.T, e Engine) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, h *harness)
+	}{
+		{"SetGet", testSetGet},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"EmptyKey", testEmptyKey},
+		{"Versioned", testVersioned},
+		{"Batch", testBatch},
+		{"Keys", testKeys},
+		{"Context", testContext},
+		{"Concurrency", testConcurrency},
+		{"Persistence", testPersistence},
+		{"Model", testModel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, e.open(t))
+		})
+	}
+}
+
+// harness holds the engine a test works on, which it closes when the test finishes.
+type harness struct {
+	t   *testing.T
+	e   Engine
+	dir string
+	db  storage.StorageEngine
+}
+
+func (e Engine) open(t *testing.T) *harness {
+	h := &harness{t: t, e: e, dir: t.TempDir()}
+	h.db = e.Open(t, h.dir)
+	t.Cleanup(func() {
+		if h.db != nil {
+			if err := h.db.Close(); err != nil {
+				t.Errorf("Close() = %v, want nil", err)
+			}
+		}
+	})
+	return h
+}
+
+// reopen closes the engine and opens it again on the same directory.
+func (h *harness) reopen() {
+	h.t.Helper()
+	db := h.db
+	h.db = nil
+	if err := db.Close(); err != nil {
+		h.t.Fatalf("Close() = %v, want nil", err)
+	}
+	h.db = h.e.Open(h.t, h.dir)
+}
+
+// skipUnless skips the test if the engine does not implement the interface of T, and
+// returns it as a T otherwise.
+func skipUnless[T any](h *harness) T {
+	h.t.Helper()
+	v, ok := h.db.(T)
+	if !ok {
+		h.t.Skipf("engine %T does not implement %T", h.db, (*T)(nil))
+	}
+	return v
+}
+
+func set(t *testing.T, db storage.StorageEngine, key, value string) {
+	t.Helper()
+	if err := db.Set(key, value); err != nil {
+		t.Fatalf("Set(%q) = %v, want nil", short(key), err)
+	}
+}
+
+func wantValue(t *testing.T, db storage.StorageEngine, key, want string) {
+	t.Helper()
+	if got, err := db.Get(key); got != want || err != nil {
+		t.Fatalf("Get(%q) = %q, %v, want %q, nil", short(key), short(got), err, short(want))
+	}
+}
+
+func wantMissing(t *testing.T, db storage.StorageEngine, key string) {
+	t.Helper()
+	if got, err := db.Get(key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get(%q) of a missing key = %q, %v, want %v", short(key), short(got), err, storage.ErrNotFound)
+	}
+}
+
+// short cuts s down to a readable length for error messages.
+func short(s string) string {
+	if len(s) <= 40 {
+		return s
+	}
+	return fmt.Sprintf("%s... (%d bytes)", s[:40], len(s))
+}
+
+func testSetGet(t *testing.T, h *harness) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{name: "simple", key: "key1", value: "value1"},
+		{name: "empty value", key: "key2", value: ""},
+		{name: "unicode", key: "你好", value: "世界"},
+		{name: "binary", key: "\x00\xff\n\t", value: "\x00\x01\xfe\xff"},
+		{name: "long key", key: strings.Repeat("k", 256), value: "long"},
+		{name: "large value", key: "large", value: strings.Repeat("0123456789abcdef", 1<<16)},
+		{name: "key prefix of another", key: "key", value: "prefix"},
+	}
+	for _, tt := range tests {
+		set(t, h.db, tt.key, tt.value)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantValue(t, h.db, tt.key, tt.value)
+		})
+	}
+	wantMissing(t, h.db, "never written")
+}
+
+func testOverwrite(t *testing.T, h *harness) {
+	for i := range 100 {
+		set(t, h.db, "key", fmt.Sprintf("value%d", i))
+	}
+	wantValue(t, h.db, "key", "value99")
+
+	// A shorter value replaces a longer one completely
+	set(t, h.db, "key", "v")
+	wantValue(t, h.db, "key", "v")
+}
+
+func testDelete(t *testing.T, h *harness) {
+	set(t, h.db, "foo", "bar")
+	set(t, h.db, "other", "kept")
+	if err := h.db.Delete("foo"); err != nil {
+		t.Fatalf("Delete(%q) = %v, want nil", "foo", err)
+	}
+	wantMissing(t, h.db, "foo")
+	wantValue(t, h.db, "other", "kept")
+
+	// Deleting is idempotent
+	if err := h.db.Delete("foo"); err != nil {
+		t.Errorf("Delete(%q) of a deleted key = %v, want nil", "foo", err)
+	}
+	if err := h.db.Delete("never written"); err != nil {
+		t.Errorf("Delete(%q) of a missing key = %v, want nil", "never written", err)
+	}
+
+	set(t, h.db, "foo", "again")
+	wantValue(t, h.db, "foo", "again")
+}
+
+func testEmptyKey(t *testing.T, h *harness) {
+	if err := h.db.Set("", "value"); !errors.Is(err, storage.ErrEmptyKey) {
+		t.Errorf("Set(%q) = %v, want %v", "", err, storage.ErrEmptyKey)
+	}
+	wantMissing(t, h.db, "")
+	if v, ok := h.db.(storage.Versioned); ok {
+		if _, err := v.SetIf("", "value", nil); !errors.Is(err, storage.ErrEmptyKey) {
+			t.Errorf("SetIf(%q) = %v, want %v", "", err, storage.ErrEmptyKey)
+		}
+	}
+	if b, ok := h.db.(storage.Batcher); ok {
+		err := b.MSet([]storage.KeyValue{{Key: "a", Value: "1"}, {Key: "", Value: "2"}})
+		if !errors.Is(err, storage.ErrEmptyKey) {
+			t.Errorf("MSet() with an empty key = %v, want %v", err, storage.ErrEmptyKey)
+		}
+		// The batch is checked before anything is written
+		wantMissing(t, h.db, "a")
+	}
+}
+
+func testVersioned(t *testing.T, h *harness) {
+	v := skipUnless[storage.Versioned](h)
+
+	// The precondition sees the key's current version, or that it is missing
+	expect := func(wantVersion uint64, wantExists bool) storage.Precondition {
+		return func(version uint64, exists bool) error {
+			if version != wantVersion || exists != wantExists {
+				t.Errorf("precondition got version %d, exists %v, want %d, %v", version, exists, wantVersion, wantExists)
+			}
+			return nil
+		}
+	}
+	v1, err := v.SetIf("k", "1", expect(0, false))
+	if err != nil || v1 == 0 {
+		t.Fatalf("SetIf(%q) of a new key = %d, %v, want a version, nil", "k", v1, err)
+	}
+	if value, version, err := v.GetVersioned("k"); value != "1" || version != v1 || err != nil {
+		t.Errorf("GetVersioned(%q) = %q, %d, %v, want %q, %d, nil", "k", value, version, err, "1", v1)
+	}
+	v2, err := v.SetIf("k", "2", expect(v1, true))
+	if err != nil || v2 <= v1 {
+		t.Errorf("SetIf(%q) = %d, %v, want a version above %d, nil", "k", v2, err, v1)
+	}
+	if _, _, err := v.GetVersioned("missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetVersioned(%q) = %v, want %v", "missing", err, storage.ErrNotFound)
+	}
+
+	// An error of the precondition aborts the write and is returned as is
+	errStale := errors.New("stale")
+	fail := func(uint64, bool) error { return errStale }
+	if _, err := v.SetIf("k", "3", fail); !errors.Is(err, errStale) {
+		t.Errorf("SetIf(%q) with a failing precondition = %v, want %v", "k", err, errStale)
+	}
+	if err := v.DeleteIf("k", fail); !errors.Is(err, errStale) {
+		t.Errorf("DeleteIf(%q) with a failing precondition = %v, want %v", "k", err, errStale)
+	}
+	if value, version, err := v.GetVersioned("k"); value != "2" || version != v2 || err != nil {
+		t.Errorf("GetVersioned(%q) after failed writes = %q, %d, %v, want %q, %d, nil", "k", value, version, err, "2", v2)
+	}
+
+	if err := v.DeleteIf("k", expect(v2, true)); err != nil {
+		t.Errorf("DeleteIf(%q) = %v, want nil", "k", err)
+	}
+	wantMissing(t, h.db, "k")
+	if err := v.DeleteIf("k", nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteIf(%q) of a deleted key = %v, want %v", "k", err, storage.ErrNotFound)
+	}
+
+	// Versions of a key keep increasing across a delete
+	if v3, err := v.SetIf("k", "3", expect(0, false)); err != nil || v3 <= v2 {
+		t.Errorf("SetIf(%q) after a delete = %d, %v, want a version above %d, nil", "k", v3, err, v2)
+	}
+}
+
+func testBatch(t *testing.T, h *harness) {
+	b := skipUnless[storage.Batcher](h)
+
+	// Pairs are written in order, so the last of a key wins
+	pairs := []storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}}
+	if err := b.MSet(pairs); err != nil {
+		t.Fatalf("MSet() = %v, want nil", err)
+	}
+	results, err := b.MGet([]string{"a", "missing", "b", "a"})
+	want := []storage.Result{{Value: "3", Found: true}, {}, {Value: "2", Found: true}, {Value: "3", Found: true}}
+	if err != nil || !slices.Equal(results, want) {
+		t.Errorf("MGet() = %v, %v, want %v, nil", results, err, want)
+	}
+	wantValue(t, h.db, "b", "2")
+
+	if err := b.MSet(nil); err != nil {
+		t.Errorf("MSet(nil) = %v, want nil", err)
+	}
+	if results, err := b.MGet(nil); len(results) != 0 || err != nil {
+		t.Errorf("MGet(nil) = %v, %v, want no results, nil", results, err)
+	}
+}
+
+func testKeys(t *testing.T, h *harness) {
+	l := skipUnless[storage.KeyLister](h)
+	for _, key := range []string{"user:3", "user:1", "order:1", "user:2", "users", "user:4"} {
+		set(t, h.db, key, "x")
+	}
+	if err := h.db.Delete("user:4"); err != nil {
+		t.Fatalf("Delete() = %v, want nil", err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"user:", []string{"user:1", "user:2", "user:3"}},
+		{"order", []string{"order:1"}},
+		{"user:4", nil},
+		{"zzz", nil},
+		{"", []string{"order:1", "user:1", "user:2", "user:3", "users"}},
+	}
+	for _, tt := range tests {
+		if got, err := l.Keys(tt.prefix); err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("Keys(%q) = %q, %v, want %q, nil", tt.prefix, got, err, tt.want)
+		}
+	}
+}
+
+func testContext(t *testing.T, h *harness) {
+	c := skipUnless[storage.ContextEngine](h)
+	set(t, h.db, "foo", "bar")
+
+	// A context that has already ended fails every operation, without writing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetContext(ctx, "foo"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+	if err := c.SetContext(ctx, "foo", "baz"); !errors.Is(err, context.Canceled) {
+		t.Errorf("SetContext() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+	if err := c.DeleteContext(ctx, "foo"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteContext() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+	wantValue(t, h.db, "foo", "bar")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := c.SetContext(ctx, "foo", "baz"); err != nil {
+		t.Errorf("SetContext() = %v, want nil", err)
+	}
+	if got, err := c.GetContext(ctx, "foo"); got != "baz" || err != nil {
+		t.Errorf("GetContext(%q) = %q, %v, want %q, nil", "foo", got, err, "baz")
+	}
+}
+
+func testConcurrency(t *testing.T, h *harness) {
+	const goroutines, keys = 8, 100
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				key := fmt.Sprintf("conc_%d_%d", g, i)
+				if err := h.db.Set(key, key+"_value"); err != nil {
+					t.Errorf("Set(%q) = %v, want nil", key, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				key := fmt.Sprintf("conc_%d_%d", g, i)
+				if got, err := h.db.Get(key); err != nil && !errors.Is(err, storage.ErrNotFound) || err == nil && got != key+"_value" {
+					t.Errorf("Get(%q) = %q, %v, want %q or %v", key, got, err, key+"_value", storage.ErrNotFound)
+				}
+			}
+		}()
+		// Every goroutine also writes and deletes the same keys as the others
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				key := fmt.Sprintf("shared_%d", i%10)
+				if err := h.db.Set(key, fmt.Sprint(g)); err != nil {
+					t.Errorf("Set(%q) = %v, want nil", key, err)
+				}
+				if i%3 == 0 {
+					if err := h.db.Delete(key); err != nil {
+						t.Errorf("Delete(%q) = %v, want nil", key, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for g := range goroutines {
+		for i := range keys {
+			key := fmt.Sprintf("conc_%d_%d", g, i)
+			wantValue(t, h.db, key, key+"_value")
+		}
+	}
+	for i := range 10 {
+		key := fmt.Sprintf("shared_%d", i)
+		if got, err := h.db.Get(key); err != nil && !errors.Is(err, storage.ErrNotFound) || err == nil && len(got) != 1 {
+			t.Errorf("Get(%q) = %q, %v, want one goroutine's value or %v", key, got, err, storage.ErrNotFound)
+		}
+	}
+}
+
+func testPersistence(t *testing.T, h *harness) {
+	if !h.e.Durable {
+		t.Skip("engine is not durable")
+	}
+	want := make(map[string]string)
+	for i := range 200 {
+		key := fmt.Sprintf("key%03d", i)
+		want[key] = fmt.Sprintf("value%d", i)
+		set(t, h.db, key, want[key])
+	}
+	for i := 0; i < 200; i += 3 {
+		key := fmt.Sprintf("key%03d", i)
+		want[key] = "overwritten"
+		set(t, h.db, key, want[key])
+	}
+	for i := 0; i < 200; i += 5 {
+		key := fmt.Sprintf("key%03d", i)
+		delete(want, key)
+		if err := h.db.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) = %v, want nil", key, err)
+		}
+	}
+	var versions map[string]uint64
+	if v, ok := h.db.(storage.Versioned); ok {
+		versions = make(map[string]uint64)
+		for key := range want {
+			_, versions[key], _ = v.GetVersioned(key)
+		}
+	}
+
+	// Engines may move data on their first open, e.g. out of a log, so open twice
+	for range 2 {
+		h.reopen()
+		for i := range 200 {
+			key := fmt.Sprintf("key%03d", i)
+			if value, ok := want[key]; ok {
+				wantValue(t, h.db, key, value)
+			} else {
+				wantMissing(t, h.db, key)
+			}
+		}
+		if v, ok := h.db.(storage.Versioned); ok {
+			for key, want := range versions {
+				if _, got, err := v.GetVersioned(key); got != want || err != nil {
+					t.Fatalf("GetVersioned(%q) after reopen = version %d, %v, want %d, nil", key, got, err, want)
+				}
+			}
+			version, err := v.SetIf("key001", "new", nil)
+			if err != nil || version <= versions["key001"] {
+				t.Errorf("SetIf(%q) after reopen = %d, %v, want a version above %d", "key001", version, err, versions["key001"])
+			}
+			versions["key001"], want["key001"] = version, "new"
+		}
+	}
+}
+
+// record is what the model of testModel knows of a key.
+type record struct {
+	value   string
+	version uint64 // Of the last write, when the engine is Versioned
+	exists  bool
+}
+
+// testModel runs random operations on the engine and on a map, and checks that they
+// agree after each one. Durable engines are reopened along the way.
+func testModel(t *testing.T, h *harness) {
+	seed := *seedFlag
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	model := make(map[string]record)
+	const ops, keySpace = 3000, 150
+
+	randomKey := func() string {
+		return fmt.Sprintf("k%d/%03d", rng.Intn(3), rng.Intn(keySpace))
+	}
+	randomValue := func() string {
+		if rng.Intn(50) == 0 {
+			return strings.Repeat(fmt.Sprint(rng.Int63()), 500)
+		}
+		return fmt.Sprintf("%019d", rng.Int63())[:rng.Intn(10)]
+	}
+	// failf reports the seed that replays the failing sequence
+	failf := func(op int, format string, args ...any) {
+		t.Helper()
+		t.Fatalf("op %d (seed %d): %s", op, seed, fmt.Sprintf(format, args...))
+	}
+	written := func(op int, key, value string, version uint64) {
+		t.Helper()
+		if _, ok := h.db.(storage.Versioned); ok && version <= model[key].version {
+			failf(op, "write of %q got version %d, not above %d", key, version, model[key].version)
+		}
+		model[key] = record{value: value, version: version, exists: true}
+	}
+
+	for op := range ops {
+		if h.e.Durable && op > 0 && op%1000 == 0 {
+			h.reopen()
+		}
+		key := randomKey()
+		versioned, _ := h.db.(storage.Versioned)
+		switch r := rng.Intn(100); {
+		case r < 30:
+			value := randomValue()
+			if versioned == nil {
+				if err := h.db.Set(key, value); err != nil {
+					failf(op, "Set(%q) = %v", key, err)
+				}
+				written(op, key, value, 0)
+				break
+			}
+			version, err := versioned.SetIf(key, value, nil)
+			if err != nil {
+				failf(op, "SetIf(%q) = %v", key, err)
+			}
+			written(op, key, value, version)
+
+		case r < 45:
+			if err := h.db.Delete(key); err != nil {
+				failf(op, "Delete(%q) = %v", key, err)
+			}
+			m := model[key]
+			m.exists = false
+			model[key] = m
+
+		case r < 70:
+			got, err := h.db.Get(key)
+			if m := model[key]; m.exists && (got != m.value || err != nil) {
+				failf(op, "Get(%q) = %q, %v, want %q, nil", key, short(got), err, short(m.value))
+			} else if !m.exists && !errors.Is(err, storage.ErrNotFound) {
+				failf(op, "Get(%q) of a missing key = %q, %v, want %v", key, short(got), err, storage.ErrNotFound)
+			}
+
+		case r < 85 && versioned != nil:
+			// A conditional write whose precondition checks what the model expects
+			m := model[key]
+			var mismatch error
+			pre := func(version uint64, exists bool) error {
+				if exists != m.exists || exists && version != m.version {
+					mismatch = fmt.Errorf("precondition of %q got version %d, exists %v, want %d, %v", key, version, exists, m.version, m.exists)
+				}
+				if rng.Intn(4) == 0 {
+					return storage.ErrPreconditionFailed
+				}
+				return nil
+			}
+			if rng.Intn(3) == 0 {
+				err := versioned.DeleteIf(key, pre)
+				switch {
+				case mismatch != nil:
+					failf(op, "%v", mismatch)
+				case errors.Is(err, storage.ErrPreconditionFailed):
+				case !m.exists && errors.Is(err, storage.ErrNotFound):
+				case m.exists && err == nil:
+					m.exists = false
+					model[key] = m
+				default:
+					failf(op, "DeleteIf(%q) = %v", key, err)
+				}
+				break
+			}
+			value := randomValue()
+			version, err := versioned.SetIf(key, value, pre)
+			if mismatch != nil {
+				failf(op, "%v", mismatch)
+			}
+			if errors.Is(err, storage.ErrPreconditionFailed) {
+				break
+			}
+			if err != nil {
+				failf(op, "SetIf(%q) = %v", key, err)
+			}
+			written(op, key, value, version)
+
+		case r < 92:
+			b, ok := h.db.(storage.Batcher)
+			if !ok {
+				break
+			}
+			if rng.Intn(2) == 0 {
+				pairs := make([]storage.KeyValue, 1+rng.Intn(5))
+				for i := range pairs {
+					pairs[i] = storage.KeyValue{Key: randomKey(), Value: randomValue()}
+				}
+				if err := b.MSet(pairs); err != nil {
+					failf(op, "MSet() = %v", err)
+				}
+				last := make(map[string]string)
+				for _, pair := range pairs {
+					last[pair.Key] = pair.Value
+				}
+				for key, value := range last {
+					var version uint64
+					if versioned != nil {
+						_, version, _ = versioned.GetVersioned(key)
+					}
+					written(op, key, value, version)
+				}
+				break
+			}
+			keys := []string{key, randomKey(), randomKey()}
+			results, err := b.MGet(keys)
+			if err != nil || len(results) != len(keys) {
+				failf(op, "MGet(%q) = %d results, %v, want %d, nil", keys, len(results), err, len(keys))
+			}
+			for i, key := range keys {
+				m := model[key]
+				if want := (storage.Result{Value: m.value, Found: m.exists}); results[i] != want && (m.exists || results[i].Found) {
+					failf(op, "MGet() result for %q = %q, found %v, want %q, found %v", key, short(results[i].Value), results[i].Found, short(m.value), m.exists)
+				}
+			}
+
+		default:
+			l, ok := h.db.(storage.KeyLister)
+			if !ok {
+				break
+			}
+			prefix := key[:rng.Intn(len(key)+1)]
+			got, err := l.Keys(prefix)
+			var want []string
+			for key, m := range model {
+				if m.exists && strings.HasPrefix(key, prefix) {
+					want = append(want, key)
+				}
+			}
+			slices.Sort(want)
+			if err != nil || !slices.Equal(got, want) {
+				failf(op, "Keys(%q) = %d keys, %v, want %d keys", prefix, len(got), err, len(want))
+			}
+		}
+	}
+
+	if h.e.Durable {
+		h.reopen()
+	}
+	for _, key := range slices.Sorted(maps.Keys(model)) {
+		got, err := h.db.Get(key)
+		if m := model[key]; m.exists && (got != m.value || err != nil) {
+			failf(ops, "Get(%q) = %q, %v, want %q, nil", key, short(got), err, short(m.value))
+		} else if !m.exists && !errors.Is(err, storage.ErrNotFound) {
+			failf(ops, "Get(%q) of a missing key = %q, %v, want %v", key, short(got), err, storage.ErrNotFound)
+		}
+	}
+}
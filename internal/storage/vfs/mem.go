@@ -0,0 +1,552 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrCrashed is returned by the files opened before MemFS.Crash, which belong to the
+// process that crashed.
+var ErrCrashed = errors.New("file was open when the file system crashed")
+
+// OpKind is the kind of an operation a FaultFunc is asked about.
+type OpKind int
+
+const (
+	OpOpen OpKind = iota
+	OpRead
+	OpWrite
+	OpSync
+	OpReadDir
+	OpRemove
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpOpen:
+		return "open"
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpReadDir:
+		return "readdir"
+	case OpRemove:
+		return "remove"
+	default:
+		return fmt.Sprintf("OpKind(%d)", int(k))
+	}
+}
+
+// Op is an operation MemFS is about to carry out.
+type Op struct {
+	Kind   OpKind
+	Name   string // Cleaned path of the file or directory
+	Offset int64  // Where a read or write starts
+	Len    int    // Bytes a read or write asks for
+}
+
+// Fault makes an operation fail.
+type Fault struct {
+	Err error // Returned by the operation, inside an *fs.PathError
+	N   int   // Bytes a read or write still transfers before failing
+}
+
+// FaultFunc decides whether op fails, returning nil to let it go ahead. It is called
+// with the MemFS locked, so it must not use the MemFS itself.
+type FaultFunc func(op Op) *Fault
+
+// MemFS is an FS kept in memory that can inject faults and simulate crashes. It
+// remembers which writes of each file were synced: Crash loses the rest, as a power
+// cut loses what the page cache had not written back yet. Creating, truncating and
+// removing files take effect durably at once, as on a file system journaling its
+// metadata. A file removed while open stays readable through the handles on it.
+type MemFS struct {
+	mu       sync.Mutex
+	files    map[string]*inode
+	dirs     map[string]bool
+	locks    map[string]*memLock
+	fault    FaultFunc
+	capacity int64 // Bytes the files may take in total; zero means unlimited
+	epoch    int   // Bumped by every crash, invalidating the files open before it
+}
+
+// inode is the contents of a file.
+type inode struct {
+	data    []byte         // What reads see
+	synced  []byte         // What survives a crash
+	pending []pendingWrite // Writes since the last sync, oldest first
+	modTime time.Time
+}
+
+type pendingWrite struct {
+	offset int64
+	p      []byte
+}
+
+type memLock struct{}
+
+// NewMemFS returns an empty MemFS holding just the root and working directories.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*inode),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]*memLock),
+	}
+}
+
+// SetFault installs f to decide which operations fail from now on; nil stops injecting
+// faults.
+func (m *MemFS) SetFault(f FaultFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fault = f
+}
+
+// SetCapacity limits the bytes all files may take together. A write that does not
+// fit writes what does and fails with ENOSPC. Zero removes the limit.
+func (m *MemFS) SetCapacity(bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.capacity = bytes
+}
+
+// Used returns the bytes the files take, as counted against the capacity.
+func (m *MemFS) Used() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usedLocked()
+}
+
+// Crash simulates a power cut: every file loses the writes made since it was last
+// synced, the files open until then fail with ErrCrashed and the locks are released.
+func (m *MemFS) Crash() {
+	m.crash(func(*inode) []byte { return nil })
+}
+
+// CrashTearing is Crash, except that each file keeps some of its unsynced writes, as
+// if the page cache had written them back before the power went: a random number of
+// them in the order they were made, followed by a random prefix of the next one.
+func (m *MemFS) CrashTearing(r *rand.Rand) {
+	m.crash(func(n *inode) []byte {
+		data := slices.Clone(n.synced)
+		keep := r.Intn(len(n.pending) + 1)
+		for _, w := range n.pending[:keep] {
+			data = writeAt(data, w.offset, w.p)
+		}
+		if keep < len(n.pending) {
+			w := n.pending[keep]
+			data = writeAt(data, w.offset, w.p[:r.Intn(len(w.p)+1)])
+		}
+		return data
+	})
+}
+
+// crash resets every file to its synced contents, or to what survived returns if it
+// returns non-nil.
+func (m *MemFS) crash(survived func(*inode) []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.files {
+		if len(n.pending) > 0 {
+			if data := survived(n); data != nil {
+				n.synced = data
+			}
+		}
+		n.data = slices.Clone(n.synced)
+		n.pending = nil
+	}
+	m.locks = make(map[string]*memLock)
+	m.epoch++
+}
+
+// injectLocked asks the FaultFunc about op. Called when holding m.mu.
+func (m *MemFS) injectLocked(op Op) *Fault {
+	if m.fault == nil {
+		return nil
+	}
+	return m.fault(op)
+}
+
+// usedLocked returns the bytes the files take. Called when holding m.mu.
+func (m *MemFS) usedLocked() int64 {
+	var used int64
+	for _, n := range m.files {
+		used += int64(len(n.data))
+	}
+	return used
+}
+
+func clean(name string) string {
+	return filepath.Clean(name)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := clean(name)
+	if f := m.injectLocked(Op{Kind: OpOpen, Name: path}); f != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: f.Err}
+	}
+	if m.dirs[path] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	n, ok := m.files[path]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok && !m.dirs[filepath.Dir(path)]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		n = &inode{modTime: time.Now()}
+		m.files[path] = n
+	}
+
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if flag&os.O_TRUNC != 0 && access != os.O_RDONLY {
+		n.data, n.synced, n.pending = nil, nil, nil
+	}
+	return &memFile{
+		fs:       m,
+		name:     name,
+		node:     n,
+		epoch:    m.epoch,
+		readable: access != os.O_WRONLY,
+		writable: access != os.O_RDONLY,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := clean(name)
+	if f := m.injectLocked(Op{Kind: OpReadDir, Name: path}); f != nil {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: f.Err}
+	}
+	if !m.dirs[path] {
+		if _, ok := m.files[path]; ok {
+			return nil, &fs.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for dir := range m.dirs {
+		if dir != path && filepath.Dir(dir) == path {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(dir)))
+		}
+	}
+	for file, n := range m.files {
+		if filepath.Dir(file) == path {
+			entries = append(entries, fs.FileInfoToDirEntry(n.info(file)))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := clean(name)
+	if m.dirs[path] {
+		return dirInfo(path), nil
+	}
+	if n, ok := m.files[path]; ok {
+		return n.info(path), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := clean(name)
+	if f := m.injectLocked(Op{Kind: OpRemove, Name: path}); f != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: f.Err}
+	}
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if !m.dirs[path] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for dir := range m.dirs {
+		if dir != path && filepath.Dir(dir) == path {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	for file := range m.files {
+		if filepath.Dir(file) == path {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(m.dirs, path)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path := clean(name); !m.dirs[path]; path = filepath.Dir(path) {
+		if _, ok := m.files[path]; ok {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		m.dirs[path] = true
+	}
+	return nil
+}
+
+// Lock creates the file name if needed and locks it until the returned io.Closer is
+// closed or the file system crashes.
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := clean(name)
+	if m.locks[path] != nil {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, name)
+	}
+	if _, ok := m.files[path]; !ok {
+		if !m.dirs[filepath.Dir(path)] {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		m.files[path] = &inode{modTime: time.Now()}
+	}
+
+	l := &memLock{}
+	m.locks[path] = l
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.locks[path] == l { // Not released by a crash meanwhile
+			delete(m.locks, path)
+		}
+		return nil
+	}), nil
+}
+
+// writeAt writes p to data at offset, growing it as needed, and returns it.
+func writeAt(data []byte, offset int64, p []byte) []byte {
+	if end := offset + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[offset:], p)
+	return data
+}
+
+func (n *inode) info(path string) fs.FileInfo {
+	return fileInfo{name: filepath.Base(path), size: int64(len(n.data)), mode: 0644, modTime: n.modTime}
+}
+
+func dirInfo(path string) fs.FileInfo {
+	return fileInfo{name: filepath.Base(path), mode: fs.ModeDir | 0755}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any           { return nil }
+
+// memFile is a File of a MemFS. Its state is guarded by the MemFS lock.
+type memFile struct {
+	fs       *MemFS
+	name     string
+	node     *inode
+	epoch    int
+	offset   int64
+	closed   bool
+	readable bool
+	writable bool
+	append   bool
+}
+
+// checkLocked returns why f cannot be used, if it cannot. Called when holding the
+// MemFS lock.
+func (f *memFile) checkLocked(op string) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.epoch != f.fs.epoch {
+		return &fs.PathError{Op: op, Path: f.name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAtLocked("read", p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	n, err := f.readAtLocked("read", p, offset)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAtLocked reads into p from offset, returning io.EOF only if offset is at or past
+// the end. Called when holding the MemFS lock.
+func (f *memFile) readAtLocked(op string, p []byte, offset int64) (int, error) {
+	if err := f.checkLocked(op); err != nil {
+		return 0, err
+	}
+	if !f.readable {
+		return 0, &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[offset:])
+	if fault := f.fs.injectLocked(Op{Kind: OpRead, Name: clean(f.name), Offset: offset, Len: len(p)}); fault != nil {
+		n = min(n, max(fault.N, 0))
+		return n, &fs.PathError{Op: op, Path: f.name, Err: fault.Err}
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkLocked("write"); err != nil {
+		return 0, err
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	offset := f.offset
+	if f.append {
+		offset = int64(len(f.node.data))
+	}
+
+	n, err := len(p), error(nil)
+	if fault := f.fs.injectLocked(Op{Kind: OpWrite, Name: clean(f.name), Offset: offset, Len: len(p)}); fault != nil {
+		n, err = min(n, max(fault.N, 0)), fault.Err
+	}
+	if f.fs.capacity > 0 {
+		free := max(f.fs.capacity-f.fs.usedLocked(), 0)
+		if grow := offset + int64(n) - int64(len(f.node.data)); grow > free {
+			n, err = n-int(grow-free), syscall.ENOSPC
+		}
+	}
+
+	if n > 0 {
+		f.node.data = writeAt(f.node.data, offset, p[:n])
+		f.node.pending = append(f.node.pending, pendingWrite{offset: offset, p: slices.Clone(p[:n])})
+		f.node.modTime = time.Now()
+	}
+	f.offset = offset + int64(n)
+	if err != nil {
+		return n, &fs.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkLocked("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkLocked("stat"); err != nil {
+		return nil, err
+	}
+	return f.node.info(f.name), nil
+}
+
+// Sync makes the writes made to the file so far, through any handle, survive a crash.
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkLocked("sync"); err != nil {
+		return err
+	}
+	if fault := f.fs.injectLocked(Op{Kind: OpSync, Name: clean(f.name)}); fault != nil {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fault.Err}
+	}
+	f.node.synced = slices.Clone(f.node.data)
+	f.node.pending = nil
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
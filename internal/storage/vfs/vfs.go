@@ -0,0 +1,96 @@
+// Package vfs is the file system the storage engines do their I/O through. OS is the
+// real one; MemFS keeps files in memory and can inject faults and simulate crashes, so
+// tests can check how an engine copes with a full disk, failing reads or a power cut.
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/gofrs/flock"
+)
+
+// ErrLocked is returned by Lock for a file another process or engine holds locked.
+var ErrLocked = errors.New("file is locked")
+
+// File is an open file. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+}
+
+// FS is a file system. Its methods behave like the functions of package os of the
+// same name.
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	MkdirAll(name string, perm fs.FileMode) error
+	// Lock takes an exclusive lock on the file name, creating it if needed, without
+	// waiting for it. It fails with ErrLocked if the lock is held. Closing the returned
+	// io.Closer releases it.
+	Lock(name string) (io.Closer, error)
+}
+
+// Open opens name in fsys for reading.
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OS is the file system of the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // Not a nil *os.File in a non-nil File
+	}
+	return f, nil
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+// Lock uses flock(2), so the lock also keeps out other processes.
+func (osFS) Lock(name string) (io.Closer, error) {
+	fLock := flock.New(name)
+	locked, err := fLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, name)
+	}
+	return closerFunc(fLock.Unlock), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,256 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeFile(t *testing.T, fsys FS, name string, flag int, data string) File {
+	t.Helper()
+	f, err := fsys.OpenFile(name, flag, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%q) error = %v", name, err)
+	}
+	if n, err := f.Write([]byte(data)); n != len(data) || err != nil {
+		t.Fatalf("Write(%q) = %d, %v, want %d, nil", data, n, err, len(data))
+	}
+	return f
+}
+
+func readFile(t *testing.T, fsys FS, name string) string {
+	t.Helper()
+	f, err := Open(fsys, name)
+	if err != nil {
+		t.Fatalf("Open(%q) error = %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll(%q) error = %v", name, err)
+	}
+	return string(data)
+}
+
+// TestFS checks that MemFS behaves like the OS where the engines rely on it.
+func TestFS(t *testing.T) {
+	for name, fsys := range map[string]FS{"os": OS, "mem": NewMemFS()} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "data", "sub")
+			if err := fsys.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("MkdirAll() error = %v", err)
+			}
+			if _, err := Open(fsys, filepath.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Open(missing) error = %v, want fs.ErrNotExist", err)
+			}
+			if _, err := fsys.OpenFile(filepath.Join(dir, "nodir", "a"), os.O_CREATE|os.O_RDWR, 0644); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("OpenFile(in missing dir) error = %v, want fs.ErrNotExist", err)
+			}
+
+			a := filepath.Join(dir, "a")
+			f := writeFile(t, fsys, a, os.O_CREATE|os.O_APPEND|os.O_RDWR, "hello")
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek() error = %v", err)
+			}
+			if _, err := f.Write([]byte(" world")); err != nil { // Appends despite the seek
+				t.Fatalf("Write() error = %v", err)
+			}
+			buf := make([]byte, 5)
+			if n, err := f.ReadAt(buf, 6); n != 5 || err != nil || string(buf) != "world" {
+				t.Errorf("ReadAt(6) = %d, %q, %v, want 5, %q, nil", n, buf, err, "world")
+			}
+			if n, err := f.ReadAt(buf, 8); n != 3 || err != io.EOF {
+				t.Errorf("ReadAt(8) = %d, %v, want 3, io.EOF", n, err)
+			}
+			if info, err := f.Stat(); err != nil || info.Size() != 11 {
+				t.Errorf("Stat() = %v, %v, want size 11", info, err)
+			}
+			if err := f.Sync(); err != nil {
+				t.Errorf("Sync() error = %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+			if got := readFile(t, fsys, a); got != "hello world" {
+				t.Errorf("contents = %q, want %q", got, "hello world")
+			}
+
+			ro, err := Open(fsys, a)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			if _, err := ro.Write([]byte("x")); err == nil {
+				t.Errorf("Write() to a file opened read-only succeeded")
+			}
+			// A removed file stays readable through the handles on it
+			if err := fsys.Remove(a); err != nil {
+				t.Fatalf("Remove() error = %v", err)
+			}
+			if n, err := ro.ReadAt(buf, 0); n != 5 || err != nil || string(buf) != "hello" {
+				t.Errorf("ReadAt() after Remove = %d, %q, %v, want 5, %q, nil", n, buf, err, "hello")
+			}
+			ro.Close()
+			if _, err := fsys.Stat(a); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat(removed) error = %v, want fs.ErrNotExist", err)
+			}
+
+			writeFile(t, fsys, filepath.Join(dir, "c"), os.O_CREATE|os.O_WRONLY, "c").Close()
+			writeFile(t, fsys, filepath.Join(dir, "b"), os.O_CREATE|os.O_WRONLY, "b").Close()
+			if err := fsys.MkdirAll(filepath.Join(dir, "d"), 0755); err != nil {
+				t.Fatalf("MkdirAll() error = %v", err)
+			}
+			entries, err := fsys.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("ReadDir() error = %v", err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			if len(names) != 3 || names[0] != "b" || names[1] != "c" || names[2] != "d" || !entries[2].IsDir() {
+				t.Errorf("ReadDir() = %v, want [b c d/]", names)
+			}
+			if err := fsys.Remove(dir); err == nil {
+				t.Errorf("Remove() of a non-empty directory succeeded")
+			}
+
+			lockPath := filepath.Join(dir, "lock")
+			lock, err := fsys.Lock(lockPath)
+			if err != nil {
+				t.Fatalf("Lock() error = %v", err)
+			}
+			if _, err := fsys.Lock(lockPath); !errors.Is(err, ErrLocked) {
+				t.Errorf("second Lock() error = %v, want ErrLocked", err)
+			}
+			if err := lock.Close(); err != nil {
+				t.Fatalf("unlock error = %v", err)
+			}
+			lock, err = fsys.Lock(lockPath)
+			if err != nil {
+				t.Fatalf("Lock() after unlock error = %v", err)
+			}
+			lock.Close()
+		})
+	}
+}
+
+func TestMemFS_Crash(t *testing.T) {
+	m := NewMemFS()
+	f := writeFile(t, m, "a", os.O_CREATE|os.O_RDWR, "synced")
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if _, err := f.Write([]byte(" lost")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	writeFile(t, m, "b", os.O_CREATE|os.O_RDWR, "never synced").Close()
+	if _, err := m.Lock("lock"); err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+
+	m.Crash()
+
+	if got := readFile(t, m, "a"); got != "synced" {
+		t.Errorf("a = %q after crash, want %q", got, "synced")
+	}
+	if got := readFile(t, m, "b"); got != "" {
+		t.Errorf("b = %q after crash, want it empty", got)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Write() through a handle opened before the crash error = %v, want ErrCrashed", err)
+	}
+	if _, err := m.Lock("lock"); err != nil {
+		t.Errorf("Lock() after crash error = %v, want the lock released", err)
+	}
+}
+
+func TestMemFS_CrashTearing(t *testing.T) {
+	full := "synced|one|two|three"
+	for seed := int64(0); seed < 50; seed++ {
+		m := NewMemFS()
+		f := writeFile(t, m, "a", os.O_CREATE|os.O_APPEND|os.O_RDWR, "synced")
+		f.Sync()
+		for _, s := range []string{"|one", "|two", "|three"} {
+			f.Write([]byte(s))
+		}
+
+		m.CrashTearing(rand.New(rand.NewSource(seed)))
+
+		got := readFile(t, m, "a")
+		if len(got) < len("synced") || full[:len(got)] != got {
+			t.Errorf("seed %d: a = %q after crash, want a prefix of %q keeping %q", seed, got, full, "synced")
+		}
+	}
+}
+
+func TestMemFS_Faults(t *testing.T) {
+	eio := func(kind OpKind, n int) FaultFunc {
+		return func(op Op) *Fault {
+			if op.Kind == kind {
+				return &Fault{Err: syscall.EIO, N: n}
+			}
+			return nil
+		}
+	}
+
+	m := NewMemFS()
+	f := writeFile(t, m, "a", os.O_CREATE|os.O_RDWR, "0123456789")
+
+	m.SetFault(eio(OpRead, 4))
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, 0); n != 4 || !errors.Is(err, syscall.EIO) {
+		t.Errorf("ReadAt() = %d, %v, want 4, EIO", n, err)
+	}
+
+	m.SetFault(eio(OpWrite, 3))
+	if n, err := f.Write([]byte("abcdef")); n != 3 || !errors.Is(err, syscall.EIO) {
+		t.Errorf("Write() = %d, %v, want 3, EIO", n, err)
+	}
+
+	m.SetFault(eio(OpSync, 0))
+	if err := f.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Sync() error = %v, want EIO", err)
+	}
+
+	m.SetFault(eio(OpOpen, 0))
+	if _, err := Open(m, "a"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Open() error = %v, want EIO", err)
+	}
+
+	m.SetFault(nil)
+	if got := readFile(t, m, "a"); got != "0123456789abc" {
+		t.Errorf("contents = %q, want the short write kept", got)
+	}
+	m.Crash() // The failed sync made nothing durable
+	if got := readFile(t, m, "a"); got != "" {
+		t.Errorf("contents after crash = %q, want it empty", got)
+	}
+}
+
+func TestMemFS_Capacity(t *testing.T) {
+	m := NewMemFS()
+	m.SetCapacity(8)
+	writeFile(t, m, "a", os.O_CREATE|os.O_RDWR, "12345").Close()
+
+	f, err := m.OpenFile("b", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if n, err := f.Write([]byte("abcdef")); n != 3 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Write() = %d, %v, want 3, ENOSPC", n, err)
+	}
+	if err := m.Remove("a"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if n, err := f.Write([]byte("def")); n != 3 || err != nil {
+		t.Errorf("Write() after freeing space = %d, %v, want 3, nil", n, err)
+	}
+	if got := readFile(t, m, "b"); got != "abcdef" {
+		t.Errorf("b = %q, want %q", got, "abcdef")
+	}
+}
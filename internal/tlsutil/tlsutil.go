@@ -0,0 +1,246 @@
+// Package tlsutil builds the TLS configurations used by the ZapStore server and CLI,
+// including certificate reloading and optional client-certificate (mTLS) verification.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseClientAuth converts "none", "request" or "require" into a tls.ClientAuthType.
+// "request" verifies a client certificate only when one is presented.
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q (want none, request or require)", s)
+	}
+}
+
+// LoadCertPool reads PEM encoded certificates from file into a new pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", file)
+	}
+	return pool, nil
+}
+
+// ServerOptions describes the files the server's TLS configuration is built from.
+type ServerOptions struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string             // CA bundle used to verify client certificates
+	ClientAuth   tls.ClientAuthType // How client certificates are requested and verified
+}
+
+// reloadCheckInterval bounds how often handshakes stat the certificate files.
+const reloadCheckInterval = time.Second
+
+// Reloader serves a server certificate and client CA pool that are reloaded whenever
+// the files on disk change, so certificates can be rotated without a restart.
+type Reloader struct {
+	opts ServerOptions
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time // Modification times of the files when last loaded
+	lastCheck time.Time
+}
+
+// NewReloader loads the certificate, key and client CA described by opts.
+func NewReloader(opts ServerOptions) (*Reloader, error) {
+	if opts.ClientAuth == tls.RequireAndVerifyClientCert && opts.ClientCAFile == "" {
+		return nil, fmt.Errorf("client certificates are required but no client CA file is configured")
+	}
+	r := &Reloader{opts: opts}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) currentModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, stat.ModTime())
+	}
+	return modTimes, nil
+}
+
+// Reload re-reads the certificate files. On error the previously loaded ones stay in use.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked()
+}
+
+// Prepare reads the certificate files and returns a function that starts serving them,
+// so a caller can check the files before changing anything else. Until it is called the
+// previously loaded ones stay in use.
+func (r *Reloader) Prepare() (func(), error) {
+	files, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.storeLocked(files)
+	}, nil
+}
+
+// loadedFiles is the result of reading the certificate files.
+type loadedFiles struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+func (r *Reloader) load() (loadedFiles, error) {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return loadedFiles{}, fmt.Errorf("failed to stat TLS files: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return loadedFiles{}, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.opts.ClientCAFile != "" {
+		clientCAs, err = LoadCertPool(r.opts.ClientCAFile)
+		if err != nil {
+			return loadedFiles{}, err
+		}
+	}
+	return loadedFiles{cert: &cert, clientCAs: clientCAs, modTimes: modTimes}, nil
+}
+
+func (r *Reloader) storeLocked(files loadedFiles) {
+	r.cert = files.cert
+	r.clientCAs = files.clientCAs
+	r.modTimes = files.modTimes
+	r.lastCheck = time.Now()
+}
+
+func (r *Reloader) reloadLocked() error {
+	files, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.storeLocked(files)
+	return nil
+}
+
+// maybeReload reloads the files if they changed since the last load. Stat calls are
+// rate limited so busy servers don't hit the filesystem on every handshake.
+func (r *Reloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < reloadCheckInterval {
+		return
+	}
+	r.lastCheck = time.Now()
+
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return // Keep serving the loaded certificate while files are being replaced
+	}
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			// A failed reload keeps the old certificate; the next check retries.
+			r.reloadLocked()
+			return
+		}
+	}
+}
+
+// nextProtos are the protocols offered over ALPN. net/http only adds "h2" to the
+// outer configuration, which the one returned by GetConfigForClient replaces, so
+// without them every connection would fall back to HTTP/1.1.
+var nextProtos = []string{"h2", "http/1.1"}
+
+// TLSConfig returns a server configuration that always presents the latest certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.maybeReload()
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.opts.ClientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig builds the client side TLS configuration. caFile adds a CA to trust on
+// top of the system roots; certFile and keyFile present a client certificate for mTLS.
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,313 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority used to issue test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM file holding the CA certificate
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zapstore test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+
+	file := filepath.Join(dir, "ca.crt")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate signed by the CA and its key to dir/name.crt and dir/name.key
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", file, err)
+	}
+}
+
+// startTLSServer serves a trivial handler with the reloader's TLS configuration
+func startTLSServer(t *testing.T, r *Reloader) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	ts.TLS = r.TLSConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// get performs a request with a fresh connection and returns the server certificate serial
+func get(t *testing.T, url string, cfg *tls.Config) (*big.Int, error) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber, nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+
+	r, err := NewReloader(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+	ts := startTLSServer(t, r)
+
+	clientCfg, err := ClientConfig(ca.file, "", "")
+	if err != nil {
+		t.Fatalf("ClientConfig failed: %v", err)
+	}
+	if _, err := get(t, ts.URL, clientCfg); err != nil {
+		t.Fatalf("GET with trusted CA failed: %v", err)
+	}
+
+	// Without the CA the server certificate must not be trusted
+	untrusted, _ := ClientConfig("", "", "")
+	if _, err := get(t, ts.URL, untrusted); err == nil {
+		t.Errorf("GET without trusting the CA succeeded, want certificate error")
+	}
+}
+
+// TestServerHTTP2 serves the configuration the way zapstore-server does, checking that
+// clients still negotiate HTTP/2 through GetConfigForClient.
+func TestServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	r, err := NewReloader(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		TLSConfig: r.TLSConfig(),
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	clientCfg, err := ClientConfig(ca.file, "", "")
+	if err != nil {
+		t.Fatalf("ClientConfig failed: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("GET negotiated %s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", 20, x509.ExtKeyUsageClientAuth)
+
+	r, err := NewReloader(ServerOptions{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: ca.file,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+	ts := startTLSServer(t, r)
+
+	withCert, err := ClientConfig(ca.file, clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("ClientConfig failed: %v", err)
+	}
+	if _, err := get(t, ts.URL, withCert); err != nil {
+		t.Fatalf("GET with client certificate failed: %v", err)
+	}
+
+	withoutCert, _ := ClientConfig(ca.file, "", "")
+	if _, err := get(t, ts.URL, withoutCert); err == nil {
+		t.Errorf("GET without client certificate succeeded, want handshake failure")
+	}
+
+	// A certificate from another CA is rejected too
+	otherCA := newTestCA(t, t.TempDir())
+	otherCert, otherKey := otherCA.issue(t, t.TempDir(), "intruder", 30, x509.ExtKeyUsageClientAuth)
+	withOtherCert, _ := ClientConfig(ca.file, otherCert, otherKey)
+	if _, err := get(t, ts.URL, withOtherCert); err == nil {
+		t.Errorf("GET with certificate from an unknown CA succeeded, want handshake failure")
+	}
+}
+
+func TestReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+
+	r, err := NewReloader(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+	ts := startTLSServer(t, r)
+	clientCfg, _ := ClientConfig(ca.file, "", "")
+
+	// Explicit reload, as triggered by SIGHUP
+	ca.issue(t, dir, "server", 11, x509.ExtKeyUsageServerAuth)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	serial, err := get(t, ts.URL, clientCfg)
+	if err != nil {
+		t.Fatalf("GET after reload failed: %v", err)
+	}
+	if serial.Int64() != 11 {
+		t.Errorf("Served certificate serial = %d after reload, want 11", serial)
+	}
+
+	// Prepared certificates are only served once applied
+	ca.issue(t, dir, "server", 20, x509.ExtKeyUsageServerAuth)
+	apply, err := r.Prepare()
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	r.mu.Lock()
+	served := r.cert
+	r.mu.Unlock()
+	apply()
+	if served.Leaf.SerialNumber.Int64() != 11 {
+		t.Errorf("Certificate serial = %d before applying, want 11", served.Leaf.SerialNumber)
+	}
+	if serial, err := get(t, ts.URL, clientCfg); err != nil || serial.Int64() != 20 {
+		t.Errorf("Served certificate serial = %v (%v) after applying, want 20", serial, err)
+	}
+
+	// Automatic reload when the files change on disk
+	ca.issue(t, dir, "server", 12, x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.mu.Lock()
+	r.lastCheck = time.Time{}
+	r.mu.Unlock()
+
+	serial, err = get(t, ts.URL, clientCfg)
+	if err != nil {
+		t.Fatalf("GET after certificate change failed: %v", err)
+	}
+	if serial.Int64() != 12 {
+		t.Errorf("Served certificate serial = %d after file change, want 12", serial)
+	}
+
+	// A broken certificate keeps the previous one in service
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload with a corrupt certificate succeeded, want error")
+	}
+	if _, err := get(t, ts.URL, clientCfg); err != nil {
+		t.Errorf("GET after failed reload failed: %v", err)
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    tls.ClientAuthType
+		wantErr bool
+	}{
+		{in: "", want: tls.NoClientCert},
+		{in: "none", want: tls.NoClientCert},
+		{in: "request", want: tls.VerifyClientCertIfGiven},
+		{in: "REQUIRE", want: tls.RequireAndVerifyClientCert},
+		{in: "maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseClientAuth(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseClientAuth(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseClientAuth(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
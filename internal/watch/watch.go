@@ -0,0 +1,235 @@
+// Package watch is an in-process event bus recording changes to keys. Recent events
+// are retained in memory so that consumers can resume from the last sequence number
+// they saw instead of missing the changes made while they were away or slow. Nothing
+// is retained while nobody watches.
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType says what happened to a key.
+type EventType string
+
+const (
+	Set    EventType = "set"
+	Delete EventType = "delete"
+)
+
+// Event is one change to a key. Seq increases by one with every published event.
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Type    EventType `json:"type"`
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"`   // The new value of set events
+	Version uint64    `json:"version,omitempty"` // The record version, if the engine tracks them
+}
+
+// size approximates the memory held by an event.
+func (e Event) size() int {
+	return len(e.Key) + len(e.Value) + 64
+}
+
+// ErrSequenceUnavailable is returned when resuming from a sequence whose following
+// events are no longer retained, or which this bus never issued. The consumer has
+// to resynchronise (e.g. re-read the keys) and start watching again from now.
+var ErrSequenceUnavailable = errors.New("sequence unavailable")
+
+// Retention bounds the events a Bus keeps for consumers to catch up and resume from.
+type Retention struct {
+	Events int // Most events kept, at least 1
+	Bytes  int // Most memory the kept events take, roughly; the latest is always kept
+	// Idle is how long events are still kept once no watcher is open, or after Seq
+	// handed out a sequence to resume from, e.g. between two long-polls. Past that, and
+	// before the first watcher, nothing is kept: resuming gets ErrSequenceUnavailable.
+	Idle time.Duration
+}
+
+// Bus distributes events to any number of consumers. Publishing never blocks on
+// consumers: each reads the retained events at its own pace, and one that falls
+// further behind than the retention limits gets ErrSequenceUnavailable.
+type Bus struct {
+	mu        sync.Mutex
+	events    []Event // Retained events, oldest first, with consecutive sequence numbers
+	bytes     int     // Approximate size of events
+	seq       uint64  // Sequence of the latest event
+	changed   chan struct{}
+	watchers  int       // Open watchers
+	keepUntil time.Time // When events stop being kept if no watcher is open
+
+	retention Retention
+}
+
+// NewBus creates a bus keeping events within the limits of retention.
+//
+// Sequence numbers start from the current time in microseconds rather than zero, so
+// they keep increasing across restarts of the process: a consumer resuming with a
+// sequence from before a restart gets ErrSequenceUnavailable rather than silently
+// waiting for a number that was already reused.
+func NewBus(retention Retention) *Bus {
+	retention.Events = max(retention.Events, 1)
+	return &Bus{
+		seq:       uint64(time.Now().UnixMicro()),
+		changed:   make(chan struct{}),
+		retention: retention,
+	}
+}
+
+// Publish assigns the next sequence number to e, records it and wakes up consumers.
+func (b *Bus) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	if b.watchers == 0 && !time.Now().Before(b.keepUntil) {
+		// Nobody watches or is about to resume: drop what was kept, and e too
+		clear(b.events)
+		b.events, b.bytes = nil, 0
+	} else {
+		b.events = append(b.events, e)
+		b.bytes += e.size()
+		for len(b.events) > b.retention.Events || (b.bytes > b.retention.Bytes && len(b.events) > 1) {
+			b.bytes -= b.events[0].size()
+			b.events[0] = Event{} // Release the value
+			b.events = b.events[1:]
+		}
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return e
+}
+
+// Seq returns the sequence number of the latest event. The events after it are kept
+// for at least the idle retention, for the caller to resume from it.
+func (b *Bus) Seq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keepUntil = later(b.keepUntil, time.Now().Add(b.retention.Idle))
+	return b.seq
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Since returns up to limit (all if limit <= 0) events after sequence after whose key
+// starts with prefix, and the sequence to resume from next time. When there are none
+// it also returns a channel that is closed once another event is published.
+func (b *Bus) Since(after uint64, prefix string, limit int) ([]Event, uint64, <-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkLocked(after); err != nil {
+		return nil, after, nil, err
+	}
+
+	oldest := b.seq + 1 - uint64(len(b.events))
+	var events []Event
+	for _, e := range b.events[after+1-oldest:] {
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+		events = append(events, e)
+		if len(events) == limit {
+			return events, e.Seq, nil, nil
+		}
+	}
+	if len(events) > 0 {
+		return events, b.seq, nil, nil
+	}
+	return nil, b.seq, b.changed, nil
+}
+
+// checkLocked verifies that every event after sequence after is still retained.
+func (b *Bus) checkLocked(after uint64) error {
+	if after > b.seq {
+		return fmt.Errorf("%w: %d is ahead of the latest event %d", ErrSequenceUnavailable, after, b.seq)
+	}
+	if oldest := b.seq + 1 - uint64(len(b.events)); after+1 < oldest {
+		return fmt.Errorf("%w: events after %d are no longer retained, the oldest is %d", ErrSequenceUnavailable, after, oldest)
+	}
+	return nil
+}
+
+// WatchLatest returns a Watcher for the keys starting with prefix that only sees
+// events published from now on.
+func (b *Bus) WatchLatest(prefix string) *Watcher {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watchers++
+	return &Watcher{bus: b, prefix: prefix, after: b.seq}
+}
+
+// Watch returns a Watcher for the keys starting with prefix, beginning with the
+// events after sequence after.
+func (b *Bus) Watch(prefix string, after uint64) (*Watcher, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkLocked(after); err != nil {
+		return nil, err
+	}
+	b.watchers++
+	return &Watcher{bus: b, prefix: prefix, after: after}, nil
+}
+
+// Watcher follows the events of a prefix. It is not safe for concurrent use. Events
+// are kept for it until it is closed.
+type Watcher struct {
+	bus    *Bus
+	prefix string
+	after  uint64
+	closed bool
+}
+
+// Close stops the watcher. Events stay kept for the idle retention, to resume from
+// its Seq.
+func (w *Watcher) Close() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	b := w.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watchers--
+	if b.watchers == 0 {
+		b.keepUntil = later(b.keepUntil, time.Now().Add(b.retention.Idle))
+	}
+}
+
+// Seq returns the sequence the watcher has consumed up to, to resume from later.
+func (w *Watcher) Seq() uint64 {
+	return w.after
+}
+
+// Next waits until there is at least one new event for the prefix and returns up to
+// limit of them, in order. It returns ctx.Err() if ctx ends first, and
+// ErrSequenceUnavailable if the watcher fell behind the retained events.
+func (w *Watcher) Next(ctx context.Context, limit int) ([]Event, error) {
+	for {
+		events, next, changed, err := w.bus.Since(w.after, w.prefix, limit)
+		if err != nil {
+			return nil, err
+		}
+		w.after = next
+		if len(events) > 0 {
+			return events, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func publishKeys(b *Bus, keys ...string) {
+	for _, key := range keys {
+		b.Publish(Event{Type: Set, Key: key, Value: "v"})
+	}
+}
+
+func eventKeys(events []Event) []string {
+	keys := make([]string, len(events))
+	for i, e := range events {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func TestBusSince(t *testing.T) {
+	b := NewBus(Retention{Events: 100, Bytes: 1 << 20, Idle: time.Minute})
+	start := b.Seq()
+	publishKeys(b, "a/1", "b/1", "a/2", "a/3")
+
+	tests := []struct {
+		name     string
+		after    uint64
+		prefix   string
+		limit    int
+		wantKeys []string
+		wantNext uint64
+	}{
+		{name: "all", after: start, wantKeys: []string{"a/1", "b/1", "a/2", "a/3"}, wantNext: start + 4},
+		{name: "prefix", after: start, prefix: "a/", wantKeys: []string{"a/1", "a/2", "a/3"}, wantNext: start + 4},
+		{name: "limit", after: start, prefix: "a/", limit: 2, wantKeys: []string{"a/1", "a/2"}, wantNext: start + 3},
+		{name: "resume", after: start + 3, prefix: "a/", wantKeys: []string{"a/3"}, wantNext: start + 4},
+		{name: "nothing_matches", after: start, prefix: "c/", wantKeys: []string{}, wantNext: start + 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, next, changed, err := b.Since(tt.after, tt.prefix, tt.limit)
+			if err != nil {
+				t.Fatalf("Since(%d, %q, %d) failed: %v", tt.after, tt.prefix, tt.limit, err)
+			}
+			if got := eventKeys(events); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("Since(%d, %q, %d) keys = %v, want %v", tt.after, tt.prefix, tt.limit, got, tt.wantKeys)
+			}
+			if next != tt.wantNext {
+				t.Errorf("Since(%d, %q, %d) next = %d, want %d", tt.after, tt.prefix, tt.limit, next, tt.wantNext)
+			}
+			if (changed != nil) != (len(events) == 0) {
+				t.Errorf("Since(%d, %q, %d) returned a wait channel = %v with %d events", tt.after, tt.prefix, tt.limit, changed != nil, len(events))
+			}
+		})
+	}
+}
+
+func TestBusRetention(t *testing.T) {
+	b := NewBus(Retention{Events: 3, Bytes: 1 << 20, Idle: time.Minute})
+	start := b.Seq()
+	publishKeys(b, "a", "b", "c", "d", "e")
+
+	if _, _, _, err := b.Since(start+2, "", 0); err != nil {
+		t.Errorf("Since the oldest retained event failed: %v", err)
+	}
+	if _, _, _, err := b.Since(start+1, "", 0); !errors.Is(err, ErrSequenceUnavailable) {
+		t.Errorf("Since a dropped event = %v, want ErrSequenceUnavailable", err)
+	}
+	if _, err := b.Watch("", start+6); !errors.Is(err, ErrSequenceUnavailable) {
+		t.Errorf("Watch from a future sequence = %v, want ErrSequenceUnavailable", err)
+	}
+
+	// The byte limit drops events too, but always keeps the latest one
+	small := NewBus(Retention{Events: 100, Bytes: 1, Idle: time.Minute})
+	latest := small.Seq() + 1
+	publishKeys(small, "a", "b")
+	if events, _, _, err := small.Since(latest, "", 0); err != nil || len(events) != 1 {
+		t.Errorf("Since(latest-1) with a tiny byte limit = %d events, %v, want 1 event", len(events), err)
+	}
+
+	// A restarted bus never reissues the sequences of an earlier one
+	time.Sleep(time.Millisecond)
+	if restarted := NewBus(Retention{Events: 3, Bytes: 1 << 20, Idle: time.Minute}); restarted.Seq() <= b.Seq() {
+		t.Errorf("New bus starts at %d, want above %d", restarted.Seq(), b.Seq())
+	}
+}
+
+func TestBusRetainsForWatchers(t *testing.T) {
+	b := NewBus(Retention{Events: 100, Bytes: 1 << 20, Idle: 50 * time.Millisecond})
+	publishKeys(b, "unwatched")
+	if len(b.events) != 0 {
+		t.Errorf("Bus without watchers kept %d events, want none", len(b.events))
+	}
+
+	w := b.WatchLatest("")
+	start := w.Seq()
+	publishKeys(b, "a", "b")
+	w.Close()
+	w.Close() // Closing twice is harmless
+	publishKeys(b, "c")
+	if events, _, _, err := b.Since(start, "", 0); err != nil || len(events) != 3 {
+		t.Errorf("Since a closed watcher's start within the idle retention = %d events, %v, want 3 events", len(events), err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	publishKeys(b, "d")
+	if _, _, _, err := b.Since(start, "", 0); !errors.Is(err, ErrSequenceUnavailable) {
+		t.Errorf("Since after the idle retention = %v, want ErrSequenceUnavailable", err)
+	}
+	if len(b.events) != 0 {
+		t.Errorf("Bus kept %d events after the idle retention, want none", len(b.events))
+	}
+}
+
+func TestWatcherNext(t *testing.T) {
+	b := NewBus(Retention{Events: 100, Bytes: 1 << 20, Idle: time.Minute})
+	w := b.WatchLatest("a/")
+
+	got := make(chan []Event)
+	go func() {
+		events, err := w.Next(context.Background(), 10)
+		if err != nil {
+			t.Errorf("Next failed: %v", err)
+		}
+		got <- events
+	}()
+
+	publishKeys(b, "b/ignored", "a/wanted")
+	select {
+	case events := <-got:
+		if len(events) != 1 || events[0].Key != "a/wanted" {
+			t.Errorf("Next = %v, want only a/wanted", eventKeys(events))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next did not return after a matching event was published")
+	}
+	if w.Seq() != b.Seq() {
+		t.Errorf("Watcher Seq = %d, want %d", w.Seq(), b.Seq())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := w.Next(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Next without events = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,80 @@
+package zapstore
+
+import (
+	"context"
+	"zap-store/internal/storage"
+)
+
+// The helpers below call the context variant of an engine operation if the engine has
+// one. Otherwise they check ctx before calling the plain operation, which then runs to
+// the end.
+
+func engineGet(ctx context.Context, engine storage.StorageEngine, key string) (string, error) {
+	if e, ok := engine.(storage.ContextEngine); ok {
+		return e.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return engine.Get(key)
+}
+
+func engineSet(ctx context.Context, engine storage.StorageEngine, key, value string) error {
+	if e, ok := engine.(storage.ContextEngine); ok {
+		return e.SetContext(ctx, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return engine.Set(key, value)
+}
+
+func engineDelete(ctx context.Context, engine storage.StorageEngine, key string) error {
+	if e, ok := engine.(storage.ContextEngine); ok {
+		return e.DeleteContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return engine.Delete(key)
+}
+
+func engineMSet(ctx context.Context, engine storage.Batcher, pairs []storage.KeyValue) error {
+	if e, ok := engine.(storage.ContextBatcher); ok {
+		return e.MSetContext(ctx, pairs)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return engine.MSet(pairs)
+}
+
+func getVersioned(ctx context.Context, engine storage.Versioned, key string) (string, uint64, error) {
+	if e, ok := engine.(storage.ContextVersioned); ok {
+		return e.GetVersionedContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	return engine.GetVersioned(key)
+}
+
+func setIf(ctx context.Context, engine storage.Versioned, key, value string, pre storage.Precondition) (uint64, error) {
+	if e, ok := engine.(storage.ContextVersioned); ok {
+		return e.SetIfContext(ctx, key, value, pre)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return engine.SetIf(key, value, pre)
+}
+
+func deleteIf(ctx context.Context, engine storage.Versioned, key string, pre storage.Precondition) error {
+	if e, ok := engine.(storage.ContextVersioned); ok {
+		return e.DeleteIfContext(ctx, key, pre)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return engine.DeleteIf(key, pre)
+}
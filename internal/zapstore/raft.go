@@ -0,0 +1,426 @@
+package zapstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"zap-store/internal/raft"
+	"zap-store/internal/storage"
+	"zap-store/internal/storage/bitcask"
+)
+
+// raftTimeout bounds how long a write, or a linearizable read, waits for the Raft group.
+const raftTimeout = 10 * time.Second
+
+// raftRestoreBatch is how many records of a snapshot are applied at a time.
+const raftRestoreBatch = 1000
+
+// ReadConsistency says how up to date the reads of a Raft member have to be.
+type ReadConsistency int32
+
+const (
+	// ReadStale serves reads from the local engine, which may lag behind the leader.
+	ReadStale ReadConsistency = iota
+	// ReadLinearizable first makes sure the local engine has every write committed
+	// before the read started, asking the leader for its commit index (read-index).
+	ReadLinearizable
+)
+
+// raftOp is one write of a replicated command. Keys and values are bytes, which JSON
+// writes as base64: as JSON strings, bytes that are not valid UTF-8 would come back
+// as U+FFFD.
+type raftOp struct {
+	Type   storage.ChangeType `json:"type"`
+	Key    []byte             `json:"key"`
+	Value  []byte             `json:"value,omitempty"`
+	Expect *raftExpect        `json:"expect,omitempty"`
+}
+
+// raftExpect is the state a conditional write found when its precondition was checked.
+// The write only applies if the key is still in that state when the command commits.
+type raftExpect struct {
+	Exists  bool   `json:"exists"`
+	Version uint64 `json:"version"`
+}
+
+type raftResult struct {
+	version uint64
+	created bool // Whether a single set created its key
+	err     error
+}
+
+// StartRaft makes the store a member of a Raft group. From then on Set, Delete, their
+// conditional forms and MSet are proposed to the group's leader and reach the engine
+// when committed, on every member alike; on other members they fail with
+// raft.ErrNotLeader. Every write of a command gets the command's log index as its
+// version, so versions are the same on all members. Compacting the log syncs an engine
+// that can sync, which then keeps its data across restarts; other engines get a
+// snapshot from the leader when they restart. Snapshots are the engine's own when it
+// takes them, otherwise its keys with their values and versions.
+//
+// The engine has to track versions, list keys and apply changes. A node with fresh
+// raft storage needs an empty engine, since existing versions would not line up with
+// log indexes. StartRaft must be called before the store is used; stop the returned
+// node before closing the engine.
+func (kv *ZapStore) StartRaft(cfg raft.Config) (*raft.Node, error) {
+	if _, err := kv.versioned(); err != nil {
+		return nil, err
+	}
+	lister, ok := kv.StorageEngine.(storage.KeyLister)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage engine cannot list keys", errors.ErrUnsupported)
+	}
+	if _, ok := kv.StorageEngine.(storage.Replica); !ok {
+		return nil, fmt.Errorf("%w: storage engine cannot apply changes", errors.ErrUnsupported)
+	}
+	if cfg.Storage == nil {
+		return nil, errors.New("raft node needs storage")
+	}
+
+	state, snapshot, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft state: %w", err)
+	}
+	if state == (raft.HardState{}) && snapshot.Index == 0 && len(entries) == 0 {
+		keys, err := lister.Keys("")
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return nil, fmt.Errorf("a new raft member needs an empty storage engine, found %d keys", len(keys))
+		}
+	}
+
+	cfg.StateMachine = raftMachine{kv: kv}
+	node, err := raft.Start(cfg)
+	if err != nil {
+		return nil, err
+	}
+	kv.raft = node
+	return node, nil
+}
+
+// SetReadConsistency sets how up to date reads of a Raft member have to be. It has no
+// effect without Raft, where reads are always up to date.
+func (kv *ZapStore) SetReadConsistency(consistency ReadConsistency) {
+	kv.readConsistency.Store(int32(consistency))
+}
+
+// ReadIndex waits until the engine has every write committed by the Raft group before
+// the call, so that reads made afterwards are linearizable, whatever the read
+// consistency. Without Raft it returns at once.
+func (kv *ZapStore) ReadIndex(ctx context.Context) error {
+	if kv.raft == nil {
+		return nil
+	}
+	return kv.raft.ReadIndex(ctx)
+}
+
+// readBarrier makes a read linearizable if the read consistency asks for it.
+func (kv *ZapStore) readBarrier(ctx context.Context) error {
+	if kv.raft == nil || ReadConsistency(kv.readConsistency.Load()) != ReadLinearizable {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, raftTimeout)
+	defer cancel()
+	return kv.raft.ReadIndex(ctx)
+}
+
+// raftWrite checks the precondition of a conditional write against a linearizable
+// read, then proposes the write expecting the key to be unchanged when it commits.
+func (kv *ZapStore) raftWrite(ctx context.Context, op raftOp, pre storage.Precondition) (raftResult, error) {
+	if len(op.Key) == 0 {
+		return raftResult{}, storage.ErrEmptyKey
+	}
+	ctx, cancel := context.WithTimeout(ctx, raftTimeout)
+	defer cancel()
+
+	if pre != nil {
+		if err := kv.raft.ReadIndex(ctx); err != nil {
+			return raftResult{}, err
+		}
+		engine, _ := kv.versioned()
+		_, version, err := engine.GetVersioned(string(op.Key))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return raftResult{}, err
+		}
+		if err := pre(version, err == nil); err != nil {
+			return raftResult{}, err
+		}
+		op.Expect = &raftExpect{Exists: err == nil, Version: version}
+	}
+	return kv.propose(ctx, []raftOp{op})
+}
+
+// raftMSet proposes a batch as one command. Only the last value of a key repeated in
+// the batch is kept, as all writes of a command get the same version.
+func (kv *ZapStore) raftMSet(ctx context.Context, pairs []storage.KeyValue) error {
+	ops := make([]raftOp, 0, len(pairs))
+	index := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		if pair.Key == "" {
+			return storage.ErrEmptyKey
+		}
+		op := raftOp{Type: storage.ChangeSet, Key: []byte(pair.Key), Value: []byte(pair.Value)}
+		if i, ok := index[pair.Key]; ok {
+			ops[i] = op
+			continue
+		}
+		index[pair.Key] = len(ops)
+		ops = append(ops, op)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, raftTimeout)
+	defer cancel()
+	_, err := kv.propose(ctx, ops)
+	return err
+}
+
+func (kv *ZapStore) propose(ctx context.Context, ops []raftOp) (raftResult, error) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return raftResult{}, err
+	}
+	value, err := kv.raft.Propose(ctx, data)
+	if err != nil {
+		return raftResult{}, err
+	}
+	result := value.(raftResult)
+	return result, result.err
+}
+
+// raftMachine applies the commands committed by the Raft group to the store.
+type raftMachine struct {
+	kv *ZapStore
+}
+
+// Apply applies a command, unless an expectation of a conditional write no longer
+// holds: then nothing is written and the proposer gets storage.ErrPreconditionFailed.
+// A delete of a missing key reports storage.ErrNotFound.
+func (m raftMachine) Apply(index uint64, data []byte) any {
+	var ops []raftOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return raftResult{err: fmt.Errorf("invalid raft command at index %d: %w", index, err)}
+	}
+
+	engine, _ := m.kv.versioned()
+	// A single set reports whether it creates its key, for the proposer
+	created := false
+	if len(ops) == 1 && ops[0].Type == storage.ChangeSet {
+		_, _, err := engine.GetVersioned(string(ops[0].Key))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return raftResult{err: err}
+		}
+		created = err != nil
+	}
+	changes := make([]storage.Change, len(ops))
+	for i, op := range ops {
+		if op.Expect != nil {
+			_, version, err := engine.GetVersioned(string(op.Key))
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return raftResult{err: err}
+			}
+			if (err == nil) != op.Expect.Exists || version != op.Expect.Version {
+				return raftResult{err: fmt.Errorf("%w: key '%s' changed before the write committed", storage.ErrPreconditionFailed, op.Key)}
+			}
+		}
+		changes[i] = storage.Change{Type: op.Type, Key: string(op.Key), Value: string(op.Value), Version: index}
+	}
+
+	applied, err := m.kv.apply(changes)
+	if err != nil {
+		return raftResult{err: err}
+	}
+	if len(ops) == 1 && ops[0].Type == storage.ChangeDelete && !applied[0] {
+		return raftResult{err: fmt.Errorf("%w: key '%s'", storage.ErrNotFound, ops[0].Key)}
+	}
+	return raftResult{version: index, created: created}
+}
+
+// raftRecord is a key in a state machine snapshot, with bytes for the same reason as
+// in raftOp.
+type raftRecord struct {
+	Key     []byte `json:"key"`
+	Value   []byte `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+// Snapshot formats, the first byte of a snapshot.
+const (
+	raftSnapshotFiles   = 'f' // The engine's storage.Snapshot
+	raftSnapshotRecords = 'r' // One raftRecord per line, for engines without snapshots
+)
+
+// syncer is implemented by engines whose writes survive a restart once synced.
+type syncer interface {
+	Sync() error
+}
+
+func (m raftMachine) Persistent() bool {
+	_, ok := m.kv.StorageEngine.(syncer)
+	return ok
+}
+
+func (m raftMachine) Sync() error {
+	if engine, ok := m.kv.StorageEngine.(syncer); ok {
+		return engine.Sync()
+	}
+	return nil
+}
+
+// Snapshot takes the engine's own snapshot when it has one, which holds on to its
+// files as they are. Otherwise the keys are read as the snapshot is written, and may
+// include later writes, which Restore followed by the later commands allows.
+func (m raftMachine) Snapshot() (raft.SnapshotData, error) {
+	if _, ok := m.kv.StorageEngine.(storage.Snapshotter); ok {
+		snapshot, err := m.kv.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		return raftFileSnapshot{snapshot}, nil
+	}
+	return raftRecordSnapshot{kv: m.kv}, nil
+}
+
+type raftFileSnapshot struct {
+	storage.Snapshot
+}
+
+func (s raftFileSnapshot) WriteTo(w io.Writer) (int64, error) {
+	if _, err := w.Write([]byte{raftSnapshotFiles}); err != nil {
+		return 0, err
+	}
+	n, err := s.Snapshot.WriteTo(w)
+	return n + 1, err
+}
+
+type raftRecordSnapshot struct {
+	kv *ZapStore
+}
+
+func (s raftRecordSnapshot) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	if _, err := counter.Write([]byte{raftSnapshotRecords}); err != nil {
+		return counter.n, err
+	}
+	keys, err := s.kv.StorageEngine.(storage.KeyLister).Keys("")
+	if err != nil {
+		return counter.n, err
+	}
+	engine, _ := s.kv.versioned()
+	enc := json.NewEncoder(counter)
+	for _, key := range keys {
+		value, version, err := engine.GetVersioned(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue // Deleted since it was listed
+		}
+		if err != nil {
+			return counter.n, fmt.Errorf("failed to read key '%s' for snapshot: %w", key, err)
+		}
+		if err := enc.Encode(raftRecord{Key: []byte(key), Value: []byte(value), Version: version}); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+func (s raftRecordSnapshot) Close() error {
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Restore applies the records of a snapshot taken after the command at index, then
+// deletes the local keys it lacks. Records the engine already holds, at their version
+// or a newer one, are skipped, so a member that is only a little behind rewrites
+// little.
+func (m raftMachine) Restore(index uint64, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	format, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("invalid raft snapshot: %w", err)
+	}
+
+	// The state of every key in the snapshot, by its newest record
+	type keyState struct {
+		version uint64
+		exists  bool
+	}
+	keys := make(map[string]keyState)
+	batch := make([]storage.Change, 0, raftRestoreBatch)
+	add := func(change storage.Change) error {
+		if state, ok := keys[change.Key]; !ok || change.Version >= state.version {
+			keys[change.Key] = keyState{version: change.Version, exists: change.Type == storage.ChangeSet}
+		}
+		batch = append(batch, change)
+		if len(batch) < raftRestoreBatch {
+			return nil
+		}
+		err := m.kv.Apply(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	switch format {
+	case raftSnapshotFiles:
+		err = bitcask.ReadSnapshot(br, add)
+	case raftSnapshotRecords:
+		dec := json.NewDecoder(br)
+		for err == nil {
+			var record raftRecord
+			if err = dec.Decode(&record); err == io.EOF {
+				err = nil
+				break
+			}
+			if err != nil {
+				err = fmt.Errorf("invalid raft snapshot: %w", err)
+				break
+			}
+			err = add(storage.Change{Type: storage.ChangeSet, Key: string(record.Key), Value: string(record.Value), Version: record.Version})
+		}
+	default:
+		err = fmt.Errorf("invalid raft snapshot: unknown format %q", format)
+	}
+	if err == nil && len(batch) > 0 {
+		err = m.kv.Apply(batch)
+	}
+	if err != nil {
+		return err
+	}
+
+	local, err := m.kv.StorageEngine.(storage.KeyLister).Keys("")
+	if err != nil {
+		return err
+	}
+	batch = batch[:0]
+	for _, key := range local {
+		if keys[key].exists {
+			continue
+		}
+		batch = append(batch, storage.Change{Type: storage.ChangeDelete, Key: key, Version: index})
+		if len(batch) == raftRestoreBatch {
+			if err := m.kv.Apply(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		return m.kv.Apply(batch)
+	}
+	return nil
+}
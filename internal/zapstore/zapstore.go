@@ -1,34 +1,583 @@
 package zapstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zap-store/internal/raft"
 	"zap-store/internal/storage"
+	"zap-store/internal/watch"
 )
 
+// DefaultWatchRetention bounds the change events kept for watchers to resume from,
+// unless set with WithWatchRetention.
+var DefaultWatchRetention = watch.Retention{Events: 10000, Bytes: 64 << 20, Idle: time.Minute}
+
+// keyLockStripes is how many locks the keys written are spread over.
+const keyLockStripes = 256
+
 type ZapStore struct {
 	StorageEngine storage.StorageEngine
+
+	// keyLocks order the writes to each key so that its events are published in the
+	// order the engine applied them. A key's lock is held across the whole engine
+	// write, I/O and fsync included, but writes to keys of other stripes run
+	// concurrently, their events in either order.
+	keyLocks [keyLockStripes]sync.Mutex
+	events   *watch.Bus
+
+	readOnly atomic.Pointer[error] // Returned by writes while set, see SetReadOnly
+
+	raft            *raft.Node   // Orders the writes when set, see StartRaft
+	readConsistency atomic.Int32 // A ReadConsistency
+}
+
+// Option configures a ZapStore.
+type Option func(*ZapStore)
+
+// WithWatchRetention bounds the change events kept for watchers to resume from.
+func WithWatchRetention(retention watch.Retention) Option {
+	return func(kv *ZapStore) {
+		kv.events = watch.NewBus(retention)
+	}
 }
 
 // NewZapStore creates a new instance of ZapStore with the provided storage engine
-func NewZapStore(engine storage.StorageEngine) *ZapStore {
-	return &ZapStore{
+func NewZapStore(engine storage.StorageEngine, opts ...Option) *ZapStore {
+	kv := &ZapStore{
 		StorageEngine: engine,
+		events:        watch.NewBus(DefaultWatchRetention),
+	}
+	for _, opt := range opts {
+		opt(kv)
+	}
+	return kv
+}
+
+// lockKeys locks the stripes of keys in stripe order, so that writers of several keys
+// never deadlock, and returns the function unlocking them. It gives up with ctx.Err()
+// if ctx ends first.
+func (kv *ZapStore) lockKeys(ctx context.Context, keys ...string) (func(), error) {
+	stripes := make([]int, len(keys))
+	for i, key := range keys {
+		stripes[i] = keyStripe(key)
+	}
+	slices.Sort(stripes)
+	return kv.lockStripes(ctx, slices.Compact(stripes))
+}
+
+func keyStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % keyLockStripes)
+}
+
+// lockAll locks every stripe, for writes to keys not known in advance.
+func (kv *ZapStore) lockAll(ctx context.Context) (func(), error) {
+	stripes := make([]int, keyLockStripes)
+	for i := range stripes {
+		stripes[i] = i
+	}
+	return kv.lockStripes(ctx, stripes)
+}
+
+func (kv *ZapStore) lockStripes(ctx context.Context, stripes []int) (func(), error) {
+	unlock := func(locked []int) {
+		for _, stripe := range locked {
+			kv.keyLocks[stripe].Unlock()
+		}
+	}
+	for i, stripe := range stripes {
+		if err := storage.Lock(ctx, &kv.keyLocks[stripe]); err != nil {
+			unlock(stripes[:i])
+			return nil, err
+		}
+	}
+	return func() { unlock(stripes) }, nil
+}
+
+// SetReadOnly makes every write fail with an error wrapping storage.ErrReadOnly that
+// gives reason, e.g. while the store follows a replication leader. Apply and Reset
+// still work. An empty reason makes the store writable again.
+func (kv *ZapStore) SetReadOnly(reason string) {
+	if reason == "" {
+		kv.readOnly.Store(nil)
+		return
 	}
+	err := fmt.Errorf("%w: %s", storage.ErrReadOnly, reason)
+	kv.readOnly.Store(&err)
+}
+
+// writable returns the read-only error if writes are refused.
+func (kv *ZapStore) writable() error {
+	if err := kv.readOnly.Load(); err != nil {
+		return *err
+	}
+	return nil
 }
 
 // Get retrieves a value from the storage engine by key
 func (kv *ZapStore) Get(key string) (string, error) {
-	return kv.StorageEngine.Get(key)
+	return kv.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, giving up with ctx.Err() if ctx ends first.
+func (kv *ZapStore) GetContext(ctx context.Context, key string) (string, error) {
+	if err := kv.readBarrier(ctx); err != nil {
+		return "", err
+	}
+	return engineGet(ctx, kv.StorageEngine, key)
 }
 
 // Set stores a value in the storage engine with the given key
 func (kv *ZapStore) Set(key string, value string) error {
-	return kv.StorageEngine.Set(key, value)
+	return kv.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set, giving up with ctx.Err() if ctx ends before the write starts.
+func (kv *ZapStore) SetContext(ctx context.Context, key string, value string) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	if _, err := kv.versioned(); err == nil {
+		_, err := kv.SetIfContext(ctx, key, value, nil)
+		return err
+	}
+
+	unlock, err := kv.lockKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := engineSet(ctx, kv.StorageEngine, key, value); err != nil {
+		return err
+	}
+	kv.events.Publish(watch.Event{Type: watch.Set, Key: key, Value: value})
+	return nil
 }
 
-// Delete removes a value from the storage engine by key
+// Delete removes a value from the storage engine by key. Deleting a missing key is
+// not an error, and with engines that track versions it publishes no event.
 func (kv *ZapStore) Delete(key string) error {
-	return kv.StorageEngine.Delete(key)
+	return kv.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, giving up with ctx.Err() if ctx ends before the delete starts.
+func (kv *ZapStore) DeleteContext(ctx context.Context, key string) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	if _, err := kv.versioned(); err == nil {
+		if err := kv.DeleteIfContext(ctx, key, nil); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	unlock, err := kv.lockKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := engineDelete(ctx, kv.StorageEngine, key); err != nil {
+		return err
+	}
+	kv.events.Publish(watch.Event{Type: watch.Delete, Key: key})
+	return nil
+}
+
+// MGet retrieves many values at once, in the order of keys. Engines that support
+// batching look them all up under a single lock; others are queried key by key.
+func (kv *ZapStore) MGet(keys []string) ([]storage.Result, error) {
+	return kv.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, giving up with ctx.Err() if ctx ends first.
+func (kv *ZapStore) MGetContext(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if err := kv.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	return kv.mget(ctx, keys)
+}
+
+func (kv *ZapStore) mget(ctx context.Context, keys []string) ([]storage.Result, error) {
+	if engine, ok := kv.StorageEngine.(storage.ContextBatcher); ok {
+		return engine.MGetContext(ctx, keys)
+	}
+	if engine, ok := kv.StorageEngine.(storage.Batcher); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return engine.MGet(keys)
+	}
+
+	results := make([]storage.Result, len(keys))
+	for i, key := range keys {
+		value, err := engineGet(ctx, kv.StorageEngine, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i] = storage.Result{Value: value, Found: true}
+	}
+	return results, nil
+}
+
+// MSet stores many values at once, under a single lock when the engine supports batching
+func (kv *ZapStore) MSet(pairs []storage.KeyValue) error {
+	return kv.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, giving up with ctx.Err() if ctx ends before the writes start.
+func (kv *ZapStore) MSetContext(ctx context.Context, pairs []storage.KeyValue) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	if kv.raft != nil {
+		return kv.raftMSet(ctx, pairs)
+	}
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+	unlock, err := kv.lockKeys(ctx, keys...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if engine, ok := kv.StorageEngine.(storage.Batcher); ok {
+		if err := engineMSet(ctx, engine, pairs); err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			kv.events.Publish(watch.Event{Type: watch.Set, Key: pair.Key, Value: pair.Value})
+		}
+		return nil
+	}
+
+	for _, pair := range pairs {
+		if err := engineSet(ctx, kv.StorageEngine, pair.Key, pair.Value); err != nil {
+			return err
+		}
+		kv.events.Publish(watch.Event{Type: watch.Set, Key: pair.Key, Value: pair.Value})
+	}
+	return nil
+}
+
+// scanBatchSize is how many values Scan reads per engine lock.
+const scanBatchSize = 256
+
+// Scan calls fn with every key starting with prefix and its value, in key order,
+// stopping at the first error fn returns. The engine lock is only held for one batch
+// of keys at a time, so writers are not blocked for the whole scan; keys deleted while
+// it runs are skipped, and keys created after it started are not visited.
+func (kv *ZapStore) Scan(prefix string, fn func(key, value string) error) error {
+	return kv.ScanContext(context.Background(), prefix, fn)
+}
+
+// ScanContext is Scan, stopping with ctx.Err() once ctx ends.
+func (kv *ZapStore) ScanContext(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	lister, ok := kv.StorageEngine.(storage.KeyLister)
+	if !ok {
+		return fmt.Errorf("%w: storage engine cannot list keys", errors.ErrUnsupported)
+	}
+	if err := kv.readBarrier(ctx); err != nil {
+		return err
+	}
+	keys, err := lister.Keys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += scanBatchSize {
+		batch := keys[start:min(start+scanBatchSize, len(keys))]
+		results, err := kv.mget(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if !result.Found {
+				continue
+			}
+			if err := fn(batch[i], result.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importBatchBytes and importBatchPairs bound the batches Import hands to MSet.
+const (
+	importBatchBytes = 4 << 20
+	importBatchPairs = 1000
+)
+
+// Import stores every pair returned by next until it returns io.EOF, in batches
+// written with MSet. It returns how many pairs were stored, which on error is the
+// number stored before the failing batch.
+func (kv *ZapStore) Import(next func() (storage.KeyValue, error)) (int, error) {
+	return kv.ImportContext(context.Background(), next)
+}
+
+// ImportContext is Import, stopping with ctx.Err() once ctx ends.
+func (kv *ZapStore) ImportContext(ctx context.Context, next func() (storage.KeyValue, error)) (int, error) {
+	var imported, batchBytes int
+	batch := make([]storage.KeyValue, 0, importBatchPairs)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := kv.MSetContext(ctx, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+
+	for {
+		pair, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+		batch = append(batch, pair)
+		batchBytes += len(pair.Key) + len(pair.Value)
+		if len(batch) == importBatchPairs || batchBytes >= importBatchBytes {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+// versioned returns the engine's versioning support, or an error if it has none.
+func (kv *ZapStore) versioned() (storage.Versioned, error) {
+	engine, ok := kv.StorageEngine.(storage.Versioned)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage engine does not track versions", errors.ErrUnsupported)
+	}
+	return engine, nil
+}
+
+// GetVersioned retrieves a value and its version from the storage engine by key
+func (kv *ZapStore) GetVersioned(key string) (string, uint64, error) {
+	return kv.GetVersionedContext(context.Background(), key)
+}
+
+// GetVersionedContext is GetVersioned, giving up with ctx.Err() if ctx ends first.
+func (kv *ZapStore) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
+	engine, err := kv.versioned()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := kv.readBarrier(ctx); err != nil {
+		return "", 0, err
+	}
+	return getVersioned(ctx, engine, key)
+}
+
+// SetIf stores a value if pre holds for the key's current version and returns the new version
+func (kv *ZapStore) SetIf(key string, value string, pre storage.Precondition) (uint64, error) {
+	return kv.SetIfContext(context.Background(), key, value, pre)
+}
+
+// SetIfContext is SetIf, giving up with ctx.Err() if ctx ends before the write starts.
+func (kv *ZapStore) SetIfContext(ctx context.Context, key string, value string, pre storage.Precondition) (uint64, error) {
+	version, _, err := kv.PutContext(ctx, key, value, pre)
+	return version, err
+}
+
+// PutContext is SetIfContext, also reporting whether the write created the key rather
+// than replacing a value. pre may be nil; under Raft only a non-nil one costs a
+// linearizable read before the write.
+func (kv *ZapStore) PutContext(ctx context.Context, key string, value string, pre storage.Precondition) (version uint64, created bool, err error) {
+	if err := kv.writable(); err != nil {
+		return 0, false, err
+	}
+	engine, err := kv.versioned()
+	if err != nil {
+		return 0, false, err
+	}
+	if kv.raft != nil {
+		result, err := kv.raftWrite(ctx, raftOp{Type: storage.ChangeSet, Key: []byte(key), Value: []byte(value)}, pre)
+		return result.version, result.created, err
+	}
+
+	unlock, err := kv.lockKeys(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	defer unlock()
+	// The engine checks pre holding the key's lock, so existence seen there is what
+	// the write replaced
+	version, err = setIf(ctx, engine, key, value, func(version uint64, exists bool) error {
+		created = !exists
+		if pre == nil {
+			return nil
+		}
+		return pre(version, exists)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	kv.events.Publish(watch.Event{Type: watch.Set, Key: key, Value: value, Version: version})
+	return version, created, nil
+}
+
+// DeleteIf removes a value if pre holds for the key's current version
+func (kv *ZapStore) DeleteIf(key string, pre storage.Precondition) error {
+	return kv.DeleteIfContext(context.Background(), key, pre)
+}
+
+// DeleteIfContext is DeleteIf, giving up with ctx.Err() if ctx ends before the delete starts.
+func (kv *ZapStore) DeleteIfContext(ctx context.Context, key string, pre storage.Precondition) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	engine, err := kv.versioned()
+	if err != nil {
+		return err
+	}
+	if kv.raft != nil {
+		_, err := kv.raftWrite(ctx, raftOp{Type: storage.ChangeDelete, Key: []byte(key)}, pre)
+		return err
+	}
+
+	unlock, err := kv.lockKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := deleteIf(ctx, engine, key, pre); err != nil {
+		return err
+	}
+	kv.events.Publish(watch.Event{Type: watch.Delete, Key: key})
+	return nil
+}
+
+// Watch follows the changes to keys starting with prefix made from now on. Events are
+// retained while the watcher is open: close it once done.
+func (kv *ZapStore) Watch(prefix string) *watch.Watcher {
+	return kv.events.WatchLatest(prefix)
+}
+
+// WatchFrom follows the changes to keys starting with prefix made after the event
+// numbered after, returning watch.ErrSequenceUnavailable if they are no longer retained.
+func (kv *ZapStore) WatchFrom(prefix string, after uint64) (*watch.Watcher, error) {
+	return kv.events.Watch(prefix, after)
+}
+
+// WatchSeq returns the sequence number of the latest change, to watch from within the
+// idle retention.
+func (kv *ZapStore) WatchSeq() uint64 {
+	return kv.events.Seq()
+}
+
+// changeFeed returns the engine's change log, or an error if it has none.
+func (kv *ZapStore) changeFeed() (storage.ChangeFeed, error) {
+	engine, ok := kv.StorageEngine.(storage.ChangeFeed)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage engine has no change log", errors.ErrUnsupported)
+	}
+	return engine, nil
+}
+
+// Tail follows the engine's change log from position from
+func (kv *ZapStore) Tail(from storage.LogPosition) (storage.ChangeReader, error) {
+	engine, err := kv.changeFeed()
+	if err != nil {
+		return nil, err
+	}
+	return engine.Tail(from)
+}
+
+// LogEnd returns the position of the end of the engine's change log
+func (kv *ZapStore) LogEnd() (storage.LogPosition, error) {
+	engine, err := kv.changeFeed()
+	if err != nil {
+		return storage.LogPosition{}, err
+	}
+	return engine.LogEnd()
+}
+
+// Snapshot takes a snapshot of the engine's data
+func (kv *ZapStore) Snapshot() (storage.Snapshot, error) {
+	engine, ok := kv.StorageEngine.(storage.Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage engine cannot take snapshots", errors.ErrUnsupported)
+	}
+	return engine.Snapshot()
+}
+
+// Apply writes changes read from another store's change log, keeping their versions,
+// and publishes an event for each one the engine applied. It works in read-only mode.
+func (kv *ZapStore) Apply(changes []storage.Change) error {
+	_, err := kv.apply(changes)
+	return err
+}
+
+// apply is Apply, also reporting which changes the engine applied.
+func (kv *ZapStore) apply(changes []storage.Change) ([]bool, error) {
+	engine, ok := kv.StorageEngine.(storage.Replica)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage engine cannot apply changes", errors.ErrUnsupported)
+	}
+
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+	unlock, _ := kv.lockKeys(context.Background(), keys...)
+	defer unlock()
+	applied, err := engine.Apply(changes)
+	for i, change := range changes[:len(applied)] {
+		if !applied[i] {
+			continue
+		}
+		if change.Type == storage.ChangeDelete {
+			kv.events.Publish(watch.Event{Type: watch.Delete, Key: change.Key})
+		} else {
+			kv.events.Publish(watch.Event{Type: watch.Set, Key: change.Key, Value: change.Value, Version: change.Version})
+		}
+	}
+	return applied, err
+}
+
+// Reset deletes every key, for a replica about to copy another store's data. It works
+// in read-only mode.
+func (kv *ZapStore) Reset() error {
+	lister, ok := kv.StorageEngine.(storage.KeyLister)
+	if !ok {
+		return fmt.Errorf("%w: storage engine cannot list keys", errors.ErrUnsupported)
+	}
+
+	unlock, _ := kv.lockAll(context.Background())
+	defer unlock()
+	keys, err := lister.Keys("")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := kv.StorageEngine.Delete(key); err != nil {
+			return err
+		}
+		kv.events.Publish(watch.Event{Type: watch.Delete, Key: key})
+	}
+	return nil
 }
 
 var ErrInvalidStorageEngine = fmt.Errorf("invalid storage engine")
@@ -1,11 +1,20 @@
 package zapstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"math/rand"
 	"strings"
 	"testing"
+	"time"
+	"zap-store/internal/raft"
+	"zap-store/internal/storage"
 	"zap-store/internal/storage/bitcask"
+	"zap-store/internal/storage/btree"
 	"zap-store/internal/storage/inmem"
 )
 
@@ -446,3 +455,636 @@ func BenchmarkZapStoreBitCaskConcurrent(b *testing.B) {
 		}
 	})
 }
+
+// newBTreeBench opens a btree engine for a benchmark. Commits skip fsync, like the
+// bitcask benchmarks, so they compare the page writes rather than the disk.
+func newBTreeBench(b *testing.B) *ZapStore {
+	b.Helper()
+	storageEngine, err := btree.NewBTreeStorageEngine(b.TempDir(), btree.WithNoSync())
+	if err != nil {
+		b.Fatalf("Failed to initialize BTreeStorageEngine: %v", err)
+	}
+	b.Cleanup(func() {
+		if err := storageEngine.Close(); err != nil {
+			b.Fatalf("Failed to close BTreeStorageEngine: %v", err)
+		}
+	})
+	return NewZapStore(storageEngine)
+}
+
+func BenchmarkZapStoreBTreeSet(b *testing.B) {
+	kvs := newBTreeBench(b)
+	keys := preKeys(1000)
+
+	for i := 0; b.Loop(); i++ {
+		if err := kvs.Set(keys[i%1000], "value"); err != nil {
+			b.Fatalf("Set failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkZapStoreBTreeGet(b *testing.B) {
+	kvs := newBTreeBench(b)
+
+	// Pre-populate with 10,000 keys, so reads walk a few levels
+	keys := preKeys(10000)
+	for _, key := range keys {
+		if err := kvs.Set(key, "value"); err != nil {
+			b.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	for i := 0; b.Loop(); i++ {
+		if _, err := kvs.Get(keys[i%10000]); err != nil {
+			b.Fatalf("Get failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkZapStoreBTreeMixed(b *testing.B) {
+	kvs := newBTreeBench(b)
+	keys := preKeys(10000)
+	for _, key := range keys {
+		if err := kvs.Set(key, "value"); err != nil {
+			b.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// Mixed workload: 50% Get, 40% Set, 10% Delete
+	for i := 0; b.Loop(); i++ {
+		r := rand.Float64()
+		key := keys[i%10000]
+		switch {
+		case r < 0.5:
+			if _, err := kvs.Get(key); err != nil {
+				b.Fatalf("Get failed: %v", err)
+			}
+		case r < 0.9:
+			if err := kvs.Set(key, "value"); err != nil {
+				b.Fatalf("Set failed: %v", err)
+			}
+		default:
+			if err := kvs.Delete(key); err != nil {
+				b.Fatalf("Delete failed: %v", err)
+			}
+			if err := kvs.Set(key, "value"); err != nil {
+				b.Fatalf("Set failed: %v", err)
+			}
+		}
+	}
+}
+
+func TestZapStoreVersioned(t *testing.T) {
+	bitcaskEngine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create bitcask engine: %v", err)
+	}
+	defer bitcaskEngine.Close()
+
+	engines := map[string]storage.StorageEngine{
+		"inmem":   inmem.NewInMemStorageEngine(),
+		"bitcask": bitcaskEngine,
+	}
+	mustNotExist := func(version uint64, exists bool) error {
+		if exists {
+			return storage.ErrPreconditionFailed
+		}
+		return nil
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			kvs := NewZapStore(engine)
+
+			v1, err := kvs.SetIf("versioned", "one", mustNotExist)
+			if err != nil {
+				t.Fatalf("SetIf on a new key failed: %v", err)
+			}
+			if _, err := kvs.SetIf("versioned", "again", mustNotExist); !errors.Is(err, storage.ErrPreconditionFailed) {
+				t.Errorf("SetIf on an existing key error = %v, want %v", err, storage.ErrPreconditionFailed)
+			}
+
+			value, version, err := kvs.GetVersioned("versioned")
+			if err != nil || value != "one" || version != v1 {
+				t.Errorf("GetVersioned() = %q, %d, %v, want %q, %d, nil", value, version, err, "one", v1)
+			}
+
+			v2, err := kvs.SetIf("versioned", "two", nil)
+			if err != nil || v2 <= v1 {
+				t.Errorf("SetIf() = %d, %v, want a version above %d", v2, err, v1)
+			}
+
+			onlyV1 := func(version uint64, exists bool) error {
+				if version != v1 {
+					return storage.ErrPreconditionFailed
+				}
+				return nil
+			}
+			if err := kvs.DeleteIf("versioned", onlyV1); !errors.Is(err, storage.ErrPreconditionFailed) {
+				t.Errorf("DeleteIf with a stale version error = %v, want %v", err, storage.ErrPreconditionFailed)
+			}
+			if err := kvs.DeleteIf("versioned", nil); err != nil {
+				t.Errorf("DeleteIf() error = %v", err)
+			}
+			if err := kvs.DeleteIf("versioned", nil); !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("DeleteIf on a missing key error = %v, want %v", err, storage.ErrNotFound)
+			}
+			if _, _, err := kvs.GetVersioned("versioned"); !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("GetVersioned after delete error = %v, want %v", err, storage.ErrNotFound)
+			}
+
+			if _, created, err := kvs.PutContext(context.Background(), "versioned", "three", nil); err != nil || !created {
+				t.Errorf("PutContext() of a deleted key = created %v, %v, want created", created, err)
+			}
+			if _, created, err := kvs.PutContext(context.Background(), "versioned", "four", nil); err != nil || created {
+				t.Errorf("PutContext() of an existing key = created %v, %v, want replaced", created, err)
+			}
+		})
+	}
+}
+
+// plainEngine hides every optional interface of the engine it wraps
+type plainEngine struct {
+	storage.StorageEngine
+}
+
+func TestZapStoreMGetMSet(t *testing.T) {
+	bitcaskEngine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create bitcask engine: %v", err)
+	}
+	defer bitcaskEngine.Close()
+
+	engines := map[string]storage.StorageEngine{
+		"inmem":    inmem.NewInMemStorageEngine(),
+		"bitcask":  bitcaskEngine,
+		"fallback": plainEngine{inmem.NewInMemStorageEngine()},
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			kvs := NewZapStore(engine)
+			err := kvs.MSet([]storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}})
+			if err != nil {
+				t.Fatalf("MSet() error = %v", err)
+			}
+
+			got, err := kvs.MGet([]string{"a", "missing", "b"})
+			if err != nil {
+				t.Fatalf("MGet() error = %v", err)
+			}
+			want := []storage.Result{{Value: "3", Found: true}, {}, {Value: "2", Found: true}}
+			if len(got) != len(want) {
+				t.Fatalf("MGet() returned %d results, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("MGet() result %d = %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestZapStoreContext(t *testing.T) {
+	engines := map[string]storage.StorageEngine{
+		"inmem":    inmem.NewInMemStorageEngine(),
+		"fallback": plainEngine{inmem.NewInMemStorageEngine()},
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			kvs := NewZapStore(engine)
+			if err := kvs.SetContext(context.Background(), "foo", "bar"); err != nil {
+				t.Fatalf("SetContext() error = %v", err)
+			}
+
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := kvs.GetContext(cancelled, "foo"); !errors.Is(err, context.Canceled) {
+				t.Errorf("GetContext with a cancelled context = %v, want %v", err, context.Canceled)
+			}
+			if _, err := kvs.MGetContext(cancelled, []string{"foo"}); !errors.Is(err, context.Canceled) {
+				t.Errorf("MGetContext with a cancelled context = %v, want %v", err, context.Canceled)
+			}
+			if _, ok := engine.(storage.KeyLister); ok {
+				err := kvs.ScanContext(cancelled, "", func(key, value string) error { return nil })
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("ScanContext with a cancelled context = %v, want %v", err, context.Canceled)
+				}
+			}
+
+			// A write waiting behind another one gives up at its deadline
+			unlock, _ := kvs.lockKeys(context.Background(), "foo")
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if err := kvs.SetContext(ctx, "foo", "baz"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("SetContext while a write is running = %v, want %v", err, context.DeadlineExceeded)
+			}
+			// Writes to keys of other stripes do not wait for it
+			other := "other"
+			for keyStripe(other) == keyStripe("foo") {
+				other += "+"
+			}
+			otherCtx, cancelOther := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelOther()
+			if err := kvs.SetContext(otherCtx, other, "x"); err != nil {
+				t.Errorf("SetContext(%q) while %q is written = %v, want nil", other, "foo", err)
+			}
+			unlock()
+
+			if got, err := kvs.Get("foo"); err != nil || got != "bar" {
+				t.Errorf("Get(%q) = %q, %v, want %q, nil", "foo", got, err, "bar")
+			}
+		})
+	}
+}
+
+func TestZapStoreImportScan(t *testing.T) {
+	bitcaskEngine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create bitcask engine: %v", err)
+	}
+	defer bitcaskEngine.Close()
+
+	engines := map[string]storage.StorageEngine{
+		"inmem":   inmem.NewInMemStorageEngine(),
+		"bitcask": bitcaskEngine,
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			kvs := NewZapStore(engine)
+
+			// Enough pairs to span several import and scan batches
+			const total = 2500
+			i := 0
+			imported, err := kvs.Import(func() (storage.KeyValue, error) {
+				if i == total {
+					return storage.KeyValue{}, io.EOF
+				}
+				i++
+				return storage.KeyValue{Key: fmt.Sprintf("user/%05d", i), Value: fmt.Sprint(i)}, nil
+			})
+			if err != nil || imported != total {
+				t.Fatalf("Import() = %d, %v, want %d, nil", imported, err, total)
+			}
+			kvs.Set("other", "x")
+
+			var scanned int
+			last := ""
+			err = kvs.Scan("user/", func(key, value string) error {
+				if key <= last {
+					t.Fatalf("Scan visited %q after %q, want sorted order", key, last)
+				}
+				last = key
+				scanned++
+				return nil
+			})
+			if err != nil || scanned != total {
+				t.Errorf("Scan(%q) visited %d keys, err %v, want %d", "user/", scanned, err, total)
+			}
+
+			stop := errors.New("stop")
+			if err := kvs.Scan("", func(string, string) error { return stop }); err != stop {
+				t.Errorf("Scan() error = %v, want the callback's error", err)
+			}
+
+			failing := errors.New("broken stream")
+			imported, err = kvs.Import(func() (storage.KeyValue, error) { return storage.KeyValue{}, failing })
+			if imported != 0 || err != failing {
+				t.Errorf("Import() of a failing stream = %d, %v, want 0, %v", imported, err, failing)
+			}
+		})
+	}
+}
+
+func TestZapStoreWatch(t *testing.T) {
+	engines := map[string]storage.StorageEngine{
+		"inmem":    inmem.NewInMemStorageEngine(),
+		"fallback": plainEngine{inmem.NewInMemStorageEngine()},
+	}
+
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			kvs := NewZapStore(engine)
+			kvs.Set("app/before", "ignored")
+			w := kvs.Watch("app/")
+			start := kvs.WatchSeq()
+
+			kvs.Set("app/a", "1")
+			kvs.Set("other", "x")
+			kvs.MSet([]storage.KeyValue{{Key: "app/b", Value: "2"}})
+			kvs.Delete("app/a")
+			kvs.Delete("app/missing")
+			kvs.SetIf("app/b", "3", func(uint64, bool) error { return storage.ErrPreconditionFailed })
+
+			want := []string{"set app/a=1", "set app/b=2", "delete app/a="}
+			if name == "fallback" {
+				// Without versions a delete cannot tell whether the key existed
+				want = append(want, "delete app/missing=")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			events, err := w.Next(ctx, 0)
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			var got []string
+			for _, e := range events {
+				got = append(got, fmt.Sprintf("%s %s=%s", e.Type, e.Key, e.Value))
+			}
+			if strings.Join(got, ", ") != strings.Join(want, ", ") {
+				t.Errorf("Watch(%q) events = %v, want %v", "app/", got, want)
+			}
+
+			// Resuming from the start sees the same events again
+			resumed, err := kvs.WatchFrom("app/", start)
+			if err != nil {
+				t.Fatalf("WatchFrom(%d) error = %v", start, err)
+			}
+			if again, _ := resumed.Next(ctx, 0); len(again) != len(events) {
+				t.Errorf("WatchFrom(%d) returned %d events, want %d", start, len(again), len(events))
+			}
+		})
+	}
+}
+
+func TestZapStoreReadOnlyReplica(t *testing.T) {
+	kvs := NewZapStore(inmem.NewInMemStorageEngine())
+	kvs.Set("old", "x")
+	kvs.SetReadOnly("replica of http://leader")
+
+	writes := map[string]func() error{
+		"Set":    func() error { return kvs.Set("k", "v") },
+		"Delete": func() error { return kvs.Delete("old") },
+		"MSet":   func() error { return kvs.MSet([]storage.KeyValue{{Key: "k", Value: "v"}}) },
+		"SetIf": func() error {
+			_, err := kvs.SetIf("k", "v", nil)
+			return err
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, storage.ErrReadOnly) || !strings.Contains(err.Error(), "replica of") {
+			t.Errorf("%s() on a read-only store error = %v, want ErrReadOnly giving the reason", name, err)
+		}
+	}
+
+	// Replication still writes, and publishes events for what it applied
+	w := kvs.Watch("")
+	if err := kvs.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	err := kvs.Apply([]storage.Change{
+		{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 7},
+		{Type: storage.ChangeDelete, Key: "missing", Version: 8},
+	})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	events, _ := w.Next(ctx, 0)
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %s=%s@%d", e.Type, e.Key, e.Value, e.Version))
+	}
+	if want := "delete old=@0, set a=1@7"; strings.Join(got, ", ") != want {
+		t.Errorf("Events of Reset() and Apply() = %v, want %s", got, want)
+	}
+
+	kvs.SetReadOnly("")
+	if err := kvs.Set("k", "v"); err != nil {
+		t.Errorf("Set() after SetReadOnly(\"\") error = %v, want nil", err)
+	}
+}
+
+func TestZapStoreRaft(t *testing.T) {
+	network := raft.NewMemoryNetwork()
+	stores := make(map[string]*ZapStore)
+	nodes := make(map[string]*raft.Node)
+	start := func(id string, engine storage.StorageEngine, members []string) {
+		t.Helper()
+		kvs := NewZapStore(engine)
+		node, err := kvs.StartRaft(raft.Config{
+			ID:              id,
+			Members:         members,
+			Storage:         raft.NewMemoryStorage(),
+			Transport:       network.Transport(id),
+			TickInterval:    5 * time.Millisecond,
+			SnapshotEntries: 5,
+			Logger:          slog.New(slog.DiscardHandler),
+		})
+		if err != nil {
+			t.Fatalf("StartRaft(%s) error = %v", id, err)
+		}
+		network.Attach(node)
+		stores[id], nodes[id] = kvs, node
+		t.Cleanup(node.Stop)
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		start(id, inmem.NewInMemStorageEngine(), ids)
+	}
+	var leader, follower string
+	waitFor("a leader", func() bool {
+		for _, id := range ids {
+			if nodes[id].Status().Role == raft.Leader {
+				leader = id
+				return true
+			}
+		}
+		return false
+	})
+	for _, id := range ids {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+
+	// Writes go through the leader and apply everywhere with the same version
+	version, err := stores[leader].SetIf("k", "v1", nil)
+	if err != nil {
+		t.Fatalf("SetIf() on the leader error = %v", err)
+	}
+	if err := stores[follower].Set("k", "v2"); !errors.Is(err, raft.ErrNotLeader) {
+		t.Errorf("Set() on a follower error = %v, want %v", err, raft.ErrNotLeader)
+	}
+	stores[follower].SetReadConsistency(ReadLinearizable)
+	if value, got, err := stores[follower].GetVersioned("k"); err != nil || value != "v1" || got != version {
+		t.Errorf("linearizable GetVersioned() on a follower = %q, %d, %v, want %q, %d, nil", value, got, err, "v1", version)
+	}
+
+	// Puts report whether they created the key, without a precondition
+	ctx := context.Background()
+	if _, created, err := stores[leader].PutContext(ctx, "p", "1", nil); err != nil || !created {
+		t.Errorf("PutContext() of a new key = created %v, %v, want created", created, err)
+	}
+	if _, created, err := stores[leader].PutContext(ctx, "p", "2", nil); err != nil || created {
+		t.Errorf("PutContext() of an existing key = created %v, %v, want replaced", created, err)
+	}
+
+	mustNotExist := func(version uint64, exists bool) error {
+		if exists {
+			return storage.ErrPreconditionFailed
+		}
+		return nil
+	}
+	if _, err := stores[leader].SetIf("k", "again", mustNotExist); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Errorf("SetIf() on an existing key error = %v, want %v", err, storage.ErrPreconditionFailed)
+	}
+	if err := stores[leader].MSet([]storage.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}}); err != nil {
+		t.Fatalf("MSet() error = %v", err)
+	}
+	if err := stores[leader].Delete("b"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if err := stores[leader].DeleteIf("b", nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteIf() on a missing key error = %v, want %v", err, storage.ErrNotFound)
+	}
+	for i := range 10 {
+		if err := stores[leader].Set(fmt.Sprintf("n%d", i), "x"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	// Bytes that are not valid UTF-8 reach every member unchanged, in the log and in snapshots
+	const binaryKey, binaryValue = "bin\xff", "\xff\x00\xfe"
+	if err := stores[leader].Set(binaryKey, binaryValue); err != nil {
+		t.Fatalf("Set() of a binary value error = %v", err)
+	}
+	if err := stores[leader].MSet([]storage.KeyValue{{Key: "mbin", Value: "\xc3("}}); err != nil {
+		t.Fatalf("MSet() of a binary value error = %v", err)
+	}
+
+	// A new member on another engine gets the data as a snapshot of the engine
+	bitcaskEngine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create bitcask engine: %v", err)
+	}
+	defer bitcaskEngine.Close()
+	start("n4", bitcaskEngine, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodes[leader].AddMember(ctx, "n4"); err != nil {
+		t.Fatalf("AddMember(n4) error = %v", err)
+	}
+	if s := nodes[leader].Status(); s.SnapshotIndex == 0 {
+		t.Errorf("leader snapshot index = 0, want the log compacted")
+	}
+
+	want := map[string]string{"k": "v1", "p": "2", "a": "3", binaryKey: binaryValue, "mbin": "\xc3("}
+	for i := range 10 {
+		want[fmt.Sprintf("n%d", i)] = "x"
+	}
+	for _, id := range append(ids, "n4") {
+		waitFor(id+" to apply every write", func() bool {
+			got := make(map[string]string)
+			stores[id].Scan("", func(key, value string) error {
+				got[key] = value
+				return nil
+			})
+			return maps.Equal(got, want)
+		})
+		if _, got, _ := stores[id].GetVersioned("k"); got != version {
+			t.Errorf("%s version of k = %d, want %d", id, got, version)
+		}
+	}
+
+	// Existing data would not line up with the log
+	kvs := NewZapStore(inmem.NewInMemStorageEngine())
+	kvs.Set("old", "x")
+	if _, err := kvs.StartRaft(raft.Config{ID: "n5", Storage: raft.NewMemoryStorage(), Transport: network.Transport("n5")}); err == nil {
+		t.Errorf("StartRaft() on a non-empty engine error = nil, want an error")
+	}
+}
+
+func TestZapStoreRaftSnapshot(t *testing.T) {
+	newBitcask := func(t *testing.T) storage.StorageEngine {
+		engine, err := bitcask.NewBitCaskStorageEngine(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create bitcask engine: %v", err)
+		}
+		t.Cleanup(func() { engine.Close() })
+		return engine
+	}
+	newInMem := func(t *testing.T) storage.StorageEngine {
+		return inmem.NewInMemStorageEngine()
+	}
+
+	for _, tc := range []struct {
+		name   string
+		source func(t *testing.T) storage.StorageEngine
+	}{
+		{"engine snapshot", newBitcask},
+		{"records", newInMem},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source := NewZapStore(tc.source(t))
+			err := source.Apply([]storage.Change{
+				{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 1},
+				{Type: storage.ChangeSet, Key: "b", Value: "2", Version: 2},
+				{Type: storage.ChangeDelete, Key: "a", Version: 3},
+				{Type: storage.ChangeSet, Key: "c", Value: "4", Version: 4},
+				{Type: storage.ChangeSet, Key: "c", Value: "5", Version: 5},
+			})
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			snapshot, err := raftMachine{kv: source}.Snapshot()
+			if err != nil {
+				t.Fatalf("Snapshot() error = %v", err)
+			}
+			var buf strings.Builder
+			if _, err := snapshot.WriteTo(&buf); err != nil {
+				t.Fatalf("WriteTo() error = %v", err)
+			}
+			snapshot.Close()
+
+			// The member restoring it keeps what it has in common, and loses what the
+			// snapshot lacks
+			target := NewZapStore(newBitcask(t))
+			err = target.Apply([]storage.Change{
+				{Type: storage.ChangeSet, Key: "a", Value: "1", Version: 1},
+				{Type: storage.ChangeSet, Key: "b", Value: "2", Version: 2},
+				{Type: storage.ChangeSet, Key: "stale", Value: "x", Version: 2},
+			})
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			machine := raftMachine{kv: target}
+			if !machine.Persistent() {
+				t.Errorf("Persistent() on a bitcask engine = false, want true")
+			}
+			if err := machine.Restore(5, strings.NewReader(buf.String())); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			got := make(map[string]string)
+			target.Scan("", func(key, value string) error {
+				got[key] = value
+				return nil
+			})
+			if want := map[string]string{"b": "2", "c": "5"}; !maps.Equal(got, want) {
+				t.Errorf("after Restore() data = %v, want %v", got, want)
+			}
+			if _, version, _ := target.GetVersioned("c"); version != 5 {
+				t.Errorf("after Restore() version of c = %d, want 5", version)
+			}
+		})
+	}
+
+	if (raftMachine{kv: NewZapStore(inmem.NewInMemStorageEngine())}).Persistent() {
+		t.Errorf("Persistent() on an in-memory engine = true, want false")
+	}
+}
@@ -0,0 +1,33 @@
+// Package zapstore embeds ZapStore in a Go program: the same key-value store the
+// zapstore-server serves over HTTP, called directly instead.
+//
+//	engine, err := zapstore.NewBitcask("data", zapstore.WithSyncPolicy(zapstore.SyncAlways, 0))
+//	if err != nil {
+//		return err
+//	}
+//	kv := zapstore.New(engine)
+//	defer kv.Close()
+//
+// Any type implementing StorageEngine can back a store. The built-in engines also
+// track versions, read and write batches and list keys; the methods needing those
+// fail with ErrUnsupported on engines that cannot.
+//
+// # Compatibility
+//
+// This package is the supported Go API of ZapStore; everything under internal/ may
+// change in any release. Within a major version, this package follows the Go 1
+// compatibility promise:
+//
+//   - Exported identifiers are not removed or renamed, and the signatures of
+//     functions and methods do not change. New functions, methods, options, struct
+//     fields and error values may be added.
+//   - StorageEngine does not gain methods, so engines written against it keep
+//     compiling. New engine features are optional interfaces, used when the engine
+//     implements them.
+//   - Documented behaviour does not change. Error messages are not part of it: match
+//     errors with errors.Is against the Err values of this package.
+//   - The on-disk format of the bitcask engine stays readable by later releases.
+//
+// Breaking changes need a new major version. Deprecated identifiers are marked as
+// such and kept until then.
+package zapstore
@@ -0,0 +1,98 @@
+package zapstore
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+	"zap-store/internal/storage/bitcask"
+	"zap-store/internal/storage/inmem"
+)
+
+// StorageEngine is where a ZapStore keeps its data. Get and Delete of a missing key
+// return an error matching ErrNotFound. Implementations must be safe for concurrent use.
+// An engine that also has GetContext, SetContext and DeleteContext methods taking a
+// context.Context first is passed the contexts of the store's ...Context methods.
+type StorageEngine interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+	Close() error
+}
+
+// NewInMemory returns an engine keeping the data in memory only. It supports every
+// feature of the store.
+func NewInMemory() StorageEngine {
+	return inmem.NewInMemStorageEngine()
+}
+
+// SyncPolicy controls when bitcask writes are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs after every write.
+	SyncAlways
+	// SyncInterval fsyncs periodically in the background.
+	SyncInterval
+)
+
+// BitcaskOption configures the engine returned by NewBitcask.
+type BitcaskOption func(*[]bitcask.Option)
+
+// WithMaxFileSize sets the size in bytes at which the active data file is sealed and a
+// new one started, 64 MiB by default. Zero disables rotation.
+func WithMaxFileSize(size int64) BitcaskOption {
+	return func(opts *[]bitcask.Option) { *opts = append(*opts, bitcask.WithMaxFileSize(size)) }
+}
+
+// WithSyncPolicy sets when writes are fsynced, SyncNever by default. The interval is
+// only used by SyncInterval.
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) BitcaskOption {
+	return func(opts *[]bitcask.Option) {
+		*opts = append(*opts, bitcask.WithSyncPolicy(bitcask.SyncPolicy(policy), interval))
+	}
+}
+
+// WithMergeInterval compacts the data files in the background every interval.
+func WithMergeInterval(interval time.Duration) BitcaskOption {
+	return func(opts *[]bitcask.Option) { *opts = append(*opts, bitcask.WithMergeInterval(interval)) }
+}
+
+// WithBackgroundLoad makes NewBitcask return before the index of the existing data
+// is rebuilt. Operations wait for it, and report ErrNotReady while it runs.
+func WithBackgroundLoad() BitcaskOption {
+	return func(opts *[]bitcask.Option) { *opts = append(*opts, bitcask.WithBackgroundLoad()) }
+}
+
+// WithReadOnly opens the data directory for reading only, next to the program that
+// writes it, e.g. for an analytics job running beside the server. Nothing in the
+// directory is created, locked or changed, and writes fail with ErrReadOnly. With a
+// positive follow the engine picks up new writes every follow; with zero it serves the
+// data as it was when opened.
+func WithReadOnly(follow time.Duration) BitcaskOption {
+	return func(opts *[]bitcask.Option) {
+		*opts = append(*opts, bitcask.WithReadOnly(), bitcask.WithFollowInterval(follow))
+	}
+}
+
+// WithLogger sets the logger for warnings and background failures, slog.Default() by default.
+func WithLogger(logger *slog.Logger) BitcaskOption {
+	return func(opts *[]bitcask.Option) { *opts = append(*opts, bitcask.WithLogger(logger)) }
+}
+
+// NewBitcask opens, or creates, a bitcask engine in dataDir: an append-only log of
+// writes with an in-memory index of the keys, so every key has to fit in memory but
+// values do not. Only one engine can have dataDir open for writing at a time; see
+// WithReadOnly for the others.
+func NewBitcask(dataDir string, opts ...BitcaskOption) (StorageEngine, error) {
+	var options []bitcask.Option
+	for _, opt := range opts {
+		opt(&options)
+	}
+	engine, err := bitcask.NewBitCaskStorageEngine(dataDir, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bitcask engine: %w", err)
+	}
+	return engine, nil
+}
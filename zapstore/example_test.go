@@ -0,0 +1,160 @@
+package zapstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"zap-store/zapstore"
+)
+
+func Example() {
+	kv := zapstore.New(zapstore.NewInMemory())
+	defer kv.Close()
+
+	if err := kv.Set("greeting", "hello"); err != nil {
+		log.Fatal(err)
+	}
+	value, err := kv.Get("greeting")
+	fmt.Println(value, err)
+
+	_, err = kv.Get("missing")
+	fmt.Println(errors.Is(err, zapstore.ErrNotFound))
+	// Output:
+	// hello <nil>
+	// true
+}
+
+func ExampleNewBitcask() {
+	dir, err := os.MkdirTemp("", "zapstore")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, err := zapstore.NewBitcask(dir, zapstore.WithSyncPolicy(zapstore.SyncAlways, 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	kv := zapstore.New(engine)
+	kv.Set("persisted", "yes")
+	kv.Close()
+
+	// The data is still there once the directory is opened again
+	engine, err = zapstore.NewBitcask(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kv = zapstore.New(engine)
+	defer kv.Close()
+	fmt.Println(kv.Get("persisted"))
+	// Output: yes <nil>
+}
+
+func ExampleZapStore_SetIf() {
+	kv := zapstore.New(zapstore.NewInMemory())
+	defer kv.Close()
+
+	version, _ := kv.SetIf("counter", "1", zapstore.IfAbsent())
+
+	// Only one of two writers updating the same version wins
+	_, err := kv.SetIf("counter", "2", zapstore.IfVersion(version))
+	fmt.Println(err)
+	_, err = kv.SetIf("counter", "2", zapstore.IfVersion(version))
+	fmt.Println(errors.Is(err, zapstore.ErrPreconditionFailed))
+	// Output:
+	// <nil>
+	// true
+}
+
+func ExampleZapStore_Scan() {
+	kv := zapstore.New(zapstore.NewInMemory())
+	defer kv.Close()
+
+	kv.MSet([]zapstore.KeyValue{
+		{Key: "users/2", Value: "grace"},
+		{Key: "users/1", Value: "ada"},
+		{Key: "groups/1", Value: "admins"},
+	})
+	kv.Scan("users/", func(key, value string) error {
+		fmt.Println(key, value)
+		return nil
+	})
+	// Output:
+	// users/1 ada
+	// users/2 grace
+}
+
+func ExampleZapStore_Watch() {
+	kv := zapstore.New(zapstore.NewInMemory())
+	defer kv.Close()
+
+	w := kv.Watch("users/")
+	defer w.Close()
+	kv.Set("users/1", "ada")
+	kv.Set("groups/1", "admins")
+	kv.Delete("users/1")
+
+	events, _ := w.Next(context.Background(), 10)
+	for _, e := range events {
+		fmt.Println(e.Type, e.Key)
+	}
+	// Output:
+	// set users/1
+	// delete users/1
+}
+
+// mapEngine is a StorageEngine written outside of ZapStore, with no optional features.
+type mapEngine struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+func (e *mapEngine) Get(key string) (string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	value, ok := e.data[key]
+	if !ok {
+		return "", zapstore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (e *mapEngine) Set(key, value string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.data[key] = value
+	return nil
+}
+
+func (e *mapEngine) Delete(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.data[key]; !ok {
+		return zapstore.ErrNotFound
+	}
+	delete(e.data, key)
+	return nil
+}
+
+func (e *mapEngine) Close() error {
+	return nil
+}
+
+func ExampleStorageEngine() {
+	kv := zapstore.New(&mapEngine{data: make(map[string]string)})
+	defer kv.Close()
+
+	kv.Set("a", "1")
+	results, _ := kv.MGet([]string{"a", "b"})
+	fmt.Println(results)
+
+	// Features the engine lacks are reported as such
+	err := kv.Scan("", func(key, value string) error { return nil })
+	fmt.Println(errors.Is(err, zapstore.ErrUnsupported))
+	// Output:
+	// [{1 true} { false}]
+	// true
+}
@@ -0,0 +1,73 @@
+package zapstore
+
+import (
+	"context"
+	"zap-store/internal/watch"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventSet    EventType = "set"
+	EventDelete EventType = "delete"
+)
+
+// Event is one change to a watched key. Seq increases by one with every change.
+type Event struct {
+	Seq     uint64
+	Type    EventType
+	Key     string
+	Value   string // The new value of set events
+	Version uint64 // The record version, if the engine tracks them
+}
+
+// Watcher reports the changes to the keys under a prefix, in order. It is not safe
+// for concurrent use. Close it once done: the store keeps changes in memory while
+// watchers are open.
+type Watcher struct {
+	w *watch.Watcher
+}
+
+// Watch follows the changes to the keys starting with prefix made from now on.
+func (s *ZapStore) Watch(prefix string) *Watcher {
+	return &Watcher{w: s.kv.Watch(prefix)}
+}
+
+// WatchFrom follows the changes to the keys starting with prefix made after the change
+// numbered after. The store keeps the latest changes in memory while watchers are
+// open, and for a while after the last one is closed, see WithWatchRetention; older
+// ones give ErrEventsLost.
+func (s *ZapStore) WatchFrom(prefix string, after uint64) (*Watcher, error) {
+	w, err := s.kv.WatchFrom(prefix, after)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{w: w}, nil
+}
+
+// Close stops the watcher. Watching again from its Seq works within the idle retention.
+func (w *Watcher) Close() {
+	w.w.Close()
+}
+
+// Seq returns the sequence of the last change the watcher went past, to resume from
+// with WatchFrom.
+func (w *Watcher) Seq() uint64 {
+	return w.w.Seq()
+}
+
+// Next waits for changes and returns up to limit of them, or ctx.Err() if ctx ends
+// first. A watcher that falls behind the changes the store keeps gets ErrEventsLost:
+// re-read the keys under the prefix, then watch again.
+func (w *Watcher) Next(ctx context.Context, limit int) ([]Event, error) {
+	events, err := w.w.Next(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Event, len(events))
+	for i, e := range events {
+		out[i] = Event{Seq: e.Seq, Type: EventType(e.Type), Key: e.Key, Value: e.Value, Version: e.Version}
+	}
+	return out, nil
+}
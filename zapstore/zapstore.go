@@ -0,0 +1,213 @@
+package zapstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+	"zap-store/internal/server"
+	"zap-store/internal/storage"
+	"zap-store/internal/watch"
+	"zap-store/internal/zapstore"
+)
+
+// Errors returned by the store and its engines, to match with errors.Is.
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = storage.ErrNotFound
+	// ErrPreconditionFailed is returned by conditional writes whose precondition did not hold.
+	ErrPreconditionFailed = storage.ErrPreconditionFailed
+	// ErrReadOnly is returned by writes to an engine that no longer accepts them, e.g.
+	// after a failed write to disk.
+	ErrReadOnly = storage.ErrReadOnly
+	// ErrNotReady is returned while an engine is still loading its data.
+	ErrNotReady = storage.ErrNotReady
+	// ErrUnsupported is returned by operations the engine cannot perform.
+	ErrUnsupported = errors.ErrUnsupported
+	// ErrEventsLost is returned when watching from changes the store no longer keeps.
+	ErrEventsLost = watch.ErrSequenceUnavailable
+)
+
+// Precondition is checked against the current version of a key by SetIf and DeleteIf,
+// while nothing else can write the key. exists is false, and version zero, when the
+// key is absent. A non-nil error aborts the write and is returned as is.
+type Precondition func(version uint64, exists bool) error
+
+// IfVersion holds when the key exists at version.
+func IfVersion(version uint64) Precondition {
+	return func(current uint64, exists bool) error {
+		if !exists || current != version {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+}
+
+// IfAbsent holds when the key does not exist.
+func IfAbsent() Precondition {
+	return func(_ uint64, exists bool) error {
+		if exists {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+}
+
+// KeyValue is a key and its value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Result is the outcome of reading one key of a batch.
+type Result struct {
+	Value string
+	Found bool
+}
+
+// ZapStore is a key-value store on top of a StorageEngine. It is safe for concurrent use.
+type ZapStore struct {
+	kv *zapstore.ZapStore
+}
+
+// Option configures a ZapStore.
+type Option func(*[]zapstore.Option)
+
+// WithWatchRetention bounds the changes kept in memory for watchers to resume from:
+// at most events changes taking about bytes of keys and values. They are kept only
+// while a Watcher is open, and for idle after the last one is closed. The default
+// keeps 10,000 changes, 64 MiB and one minute.
+func WithWatchRetention(events, bytes int, idle time.Duration) Option {
+	return func(opts *[]zapstore.Option) {
+		*opts = append(*opts, zapstore.WithWatchRetention(watch.Retention{Events: events, Bytes: bytes, Idle: idle}))
+	}
+}
+
+// New returns a store keeping its data in engine. The store owns the engine from then
+// on: Close closes it.
+func New(engine StorageEngine, opts ...Option) *ZapStore {
+	var kvOpts []zapstore.Option
+	for _, opt := range opts {
+		opt(&kvOpts)
+	}
+	return &ZapStore{kv: zapstore.NewZapStore(engine, kvOpts...)}
+}
+
+// Get returns the value of key.
+func (s *ZapStore) Get(key string) (string, error) {
+	return s.kv.Get(key)
+}
+
+// GetContext is Get, returning ctx.Err() if ctx ends while it waits for a lock or I/O.
+func (s *ZapStore) GetContext(ctx context.Context, key string) (string, error) {
+	return s.kv.GetContext(ctx, key)
+}
+
+// GetVersioned returns the value of key and its version, which increases with every
+// write of the key.
+func (s *ZapStore) GetVersioned(key string) (string, uint64, error) {
+	return s.kv.GetVersioned(key)
+}
+
+// GetVersionedContext is GetVersioned, returning ctx.Err() if ctx ends first.
+func (s *ZapStore) GetVersionedContext(ctx context.Context, key string) (string, uint64, error) {
+	return s.kv.GetVersionedContext(ctx, key)
+}
+
+// Set stores value under key.
+func (s *ZapStore) Set(key, value string) error {
+	return s.kv.Set(key, value)
+}
+
+// SetContext is Set, returning ctx.Err() if ctx ends before the write starts. A write
+// that has started is completed.
+func (s *ZapStore) SetContext(ctx context.Context, key, value string) error {
+	return s.kv.SetContext(ctx, key, value)
+}
+
+// SetIf stores value under key if pre holds, and returns the new version.
+func (s *ZapStore) SetIf(key, value string, pre Precondition) (uint64, error) {
+	return s.kv.SetIf(key, value, storage.Precondition(pre))
+}
+
+// SetIfContext is SetIf, returning ctx.Err() if ctx ends before the write starts.
+func (s *ZapStore) SetIfContext(ctx context.Context, key, value string, pre Precondition) (uint64, error) {
+	return s.kv.SetIfContext(ctx, key, value, storage.Precondition(pre))
+}
+
+// Delete removes key. Deleting a missing key is not an error, except on engines
+// without versions, which may return ErrNotFound.
+func (s *ZapStore) Delete(key string) error {
+	return s.kv.Delete(key)
+}
+
+// DeleteContext is Delete, returning ctx.Err() if ctx ends before the delete starts.
+func (s *ZapStore) DeleteContext(ctx context.Context, key string) error {
+	return s.kv.DeleteContext(ctx, key)
+}
+
+// DeleteIf removes key if pre holds. It returns ErrNotFound if the key is absent.
+func (s *ZapStore) DeleteIf(key string, pre Precondition) error {
+	return s.kv.DeleteIf(key, storage.Precondition(pre))
+}
+
+// DeleteIfContext is DeleteIf, returning ctx.Err() if ctx ends before the delete starts.
+func (s *ZapStore) DeleteIfContext(ctx context.Context, key string, pre Precondition) error {
+	return s.kv.DeleteIfContext(ctx, key, storage.Precondition(pre))
+}
+
+// MGet reads many keys at once and returns their results in the order of keys.
+func (s *ZapStore) MGet(keys []string) ([]Result, error) {
+	return s.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is MGet, returning ctx.Err() if ctx ends first.
+func (s *ZapStore) MGetContext(ctx context.Context, keys []string) ([]Result, error) {
+	results, err := s.kv.MGetContext(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Result, len(results))
+	for i, r := range results {
+		out[i] = Result{Value: r.Value, Found: r.Found}
+	}
+	return out, nil
+}
+
+// MSet stores all pairs. Engines that write batches do so under one lock, so readers
+// see all of the pairs or none; if it fails part way, the pairs written so far stay.
+func (s *ZapStore) MSet(pairs []KeyValue) error {
+	return s.MSetContext(context.Background(), pairs)
+}
+
+// MSetContext is MSet, returning ctx.Err() if ctx ends before the writes start.
+func (s *ZapStore) MSetContext(ctx context.Context, pairs []KeyValue) error {
+	batch := make([]storage.KeyValue, len(pairs))
+	for i, pair := range pairs {
+		batch[i] = storage.KeyValue{Key: pair.Key, Value: pair.Value}
+	}
+	return s.kv.MSetContext(ctx, batch)
+}
+
+// Scan calls fn with every key starting with prefix and its value, in key order,
+// stopping at the first error fn returns. Writers are not blocked while it runs: keys
+// deleted meanwhile are skipped, and keys created after it started are not visited.
+func (s *ZapStore) Scan(prefix string, fn func(key, value string) error) error {
+	return s.kv.Scan(prefix, fn)
+}
+
+// ScanContext is Scan, stopping with ctx.Err() once ctx ends.
+func (s *ZapStore) ScanContext(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	return s.kv.ScanContext(ctx, prefix, fn)
+}
+
+// Handler returns an http.Handler serving the store's HTTP API, the same as
+// zapstore-server without authentication, to mount in a program's own server.
+func (s *ZapStore) Handler() http.Handler {
+	return server.New(s.kv)
+}
+
+// Close closes the engine. The store cannot be used afterwards.
+func (s *ZapStore) Close() error {
+	return s.kv.StorageEngine.Close()
+}